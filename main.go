@@ -1,86 +1,309 @@
 package main
 
 import (
+	"errors"
+	"fmt"
+	"io"
 	"log"
+	"net/url"
 	"os"
+	"regexp"
 	"strings"
+	"time"
 
 	"github.com/alecthomas/kong"
 	"github.com/e2guardian-angel/guardian-cli/utils"
 )
 
-var CLI struct {
+type cliGrammar struct {
+	ReadOnly       bool          `name:"read-only" help:"Refuse any command that changes policy, targets or deployments" default:"false"`
+	StepTimeout    time.Duration `name:"step-timeout" help:"Abort any long-running remote step (helm upgrade, playbook run) that takes longer than this"`
+	Record         string        `name:"record" help:"Record every remote operation and its result to this transcript file" type:"path"`
+	Replay         string        `name:"replay" help:"Answer remote operations from a recorded transcript file instead of the targets" type:"existingfile"`
+	OutputFile     string        `name:"output-file" help:"Write the data of show, list and report commands to this file instead of stdout" type:"path"`
+	Progress       string        `name:"progress" help:"Output as human-readable text, or as newline-delimited JSON progress events for GUIs and CI" enum:"text,json" default:"text"`
+	Yes            bool          `name:"yes" help:"Agree to confirmations such as accepting a new host key or 'target reset'" default:"false"`
+	NonInteractive bool          `name:"non-interactive" help:"Fail instead of prompting when input is needed, for CI pipelines" default:"false"`
+	StateBackend   string        `name:"state-backend" help:"Where config.json and host_data are kept: file, git:<remote url> or sqlite[:<path>]" env:"GUARDIAN_STATE" default:"file"`
+	DelegateToken  string        `name:"delegate-token" help:"Run the command through an admin's daemon with this delegate token" env:"GUARDIAN_DELEGATE_TOKEN" secret:""`
+	DaemonAddress  string        `name:"daemon-address" help:"host:port the daemon serves delegated commands on, instead of its socket on this machine" env:"GUARDIAN_DAEMON_ADDRESS"`
+	Audit          struct {
+		Log struct {
+			Limit int `name:"limit" help:"Show only this many of the most recent actions, 0 for all" default:"50"`
+		} `cmd:"" name:"log" help:"Show the administrative actions run from this machine"`
+		Remote struct {
+			Syslog string `name:"syslog" help:"Collector to send every action to, udp://, tcp:// or tls://host[:port]; empty to stop"`
+			Format string `name:"format" help:"Send events as RFC 5424 syslog with structured data, or as CEF" enum:"syslog,cef" default:"syslog"`
+			CaFile string `name:"ca-file" help:"CA certificate to verify a tls:// collector with instead of the system roots" type:"existingfile"`
+		} `cmd:"" name:"remote" help:"Also send every administrative action to a central syslog or CEF collector"`
+	} `cmd:"" name:"audit" help:"Audit trail of administrative actions"`
 	Config struct {
+		Categorizer struct {
+			Url string `name:"url" help:"URL of the external categorization service; empty to disable"`
+			Key string `name:"key" help:"API key sent as a bearer token to the categorization service" secret:""`
+		} `cmd:"" name:"categorizer" help:"Configure an external domain categorization service"`
+		DeployGate struct {
+			Url string `name:"url" help:"URL every deploy plan is POSTed to and that must answer {\"allow\": true}; empty to disable"`
+			Key string `name:"key" help:"API key sent as a bearer token to the deploy gate" secret:""`
+		} `cmd:"" name:"deploy-gate" help:"Require an external change-management webhook to allow every deploy"`
+		Approvers struct {
+			Users []string `arg:"" name:"users" help:"Operators who may approve proposed changes; none to deploy without approval" optional:""`
+		} `cmd:"" name:"approvers" help:"Require deploys to go through 'filter propose' and 'filter approve'"`
+		SshProxy struct {
+			Url string `arg:"" name:"url" help:"Proxy as socks5://, socks5h:// or http://[user:password@]host:port; none to connect directly" optional:""`
+		} `cmd:"" name:"ssh-proxy" help:"Reach every target over SSH through a SOCKS5 or HTTP proxy, unless it sets its own"`
+		SshKeyPassphrase struct {
+		} `cmd:"" name:"ssh-key-passphrase" help:"Protect the CLI's SSH key with a passphrase, or change or remove it; commands then ask for it or read GUARDIAN_KEY_PASSPHRASE"`
 		Export struct {
 			Output string `name:"output" help:"Output file path to export to" required:"true"`
 		} `cmd:"" name:"export" help:"Exports config to file"`
 		Import struct {
 			Input string `name:"input" help:"Input file path to import from" required:"true"`
 		} `cmd:"" name:"import" help:"Imports config from file"`
+		ReadOnly struct {
+			Mode string `arg:"" name:"mode" help:"on or off" enum:"on,off"`
+		} `cmd:"" name:"read-only" help:"Share this config read-only, refusing commands that change anything"`
+		LocalStore struct {
+			Store string `arg:"" name:"store" help:"json or sqlite" enum:"json,sqlite"`
+		} `cmd:"" name:"local-store" help:"Keep the category cache, deploy history and audit log in JSON files or in one SQLite database"`
+		State struct {
+			Push struct {
+			} `cmd:"" name:"push" help:"Upload the state in GUARDIAN_HOME to the --state-backend, to start using a new one"`
+		} `cmd:"" name:"state" help:"Storage of config.json and host_data"`
 	} `cmd:"" help:"Export/Import configuration to file"`
+	Daemon struct {
+		Targets []string `arg:"" name:"targets" help:"Targets to keep connections open to (default: all)" optional:""`
+		Listen  string   `name:"listen" help:"Also serve commands of delegate tokens on this loopback host:port, for helpers coming in through an SSH tunnel"`
+	} `cmd:"" name:"daemon" help:"Keep SSH connections to targets warm for faster commands, and update their threat feeds on schedule"`
+	Delegate struct {
+		Create struct {
+			Allow   string `name:"allow" help:"Comma-separated commands the token may run; a trailing * allows every command under it, i.e. 'filter report *'" required:"true"`
+			Expires string `name:"expires" help:"How long the token is valid, i.e. 12h or 30d" default:"30d"`
+			Name    string `name:"name" help:"Who the token is for, shown in the audit log"`
+		} `cmd:"" name:"create" help:"Create a token letting a helper run only some commands, through the daemon"`
+		List struct {
+		} `cmd:"" name:"list" help:"List delegate tokens"`
+		Revoke struct {
+			Id string `arg:"" name:"id" help:"Id of the delegate to revoke"`
+		} `cmd:"" name:"revoke" help:"Revoke a delegate token"`
+	} `cmd:"" name:"delegate" help:"Scoped tokens for helpers such as a babysitter or helpdesk"`
+	Devtest struct {
+		Down struct {
+			Provider string `name:"provider" help:"Tool the cluster was created with" enum:"kind,k3d" default:"kind"`
+			Cluster  string `name:"cluster" help:"Name of the local cluster" default:"guardian-devtest"`
+		} `cmd:"" name:"down" help:"Delete the local cluster and the devtest target"`
+		Run struct {
+		} `cmd:"" name:"run" help:"Exercise the deploy, acl and list workflows against the devtest target"`
+		Up struct {
+			Provider string `name:"provider" help:"Tool to create the local cluster with" enum:"kind,k3d" default:"kind"`
+			Cluster  string `name:"cluster" help:"Name of the local cluster" default:"guardian-devtest"`
+		} `cmd:"" name:"up" help:"Create a local cluster and add it as the 'devtest' target, reached without SSH"`
+	} `cmd:"" name:"devtest" help:"Test workflows end to end against a local kind or k3d cluster"`
+	Migrate struct {
+		To         string `name:"to" help:"New admin machine as user@host" required:"true"`
+		Port       uint16 `name:"port" help:"SSH port of the new machine" default:"22"`
+		RemoteHome string `name:"remote-home" help:"Guardian home on the new machine, relative to the user's home" default:".guardian"`
+	} `cmd:"" name:"migrate" help:"Move this machine's configuration, keys and targets to a new admin machine"`
 	Target struct {
 		Add struct {
-			Name       string `arg:"" name:"name" help:"Name to refer to target host" required:"true"`
-			Host       string `arg:"" name:"host" help:"Target host address for install" type:"ip/hostname" required:"true"`
-			Username   string `arg:"" name:"username" help:"Username for SSH login" required:"true"`
-			Port       uint16 `name:"port" help:"SSH port" default:"22"`
-			NoPassword bool   `name:"no-password" help:"Don't use password auth for SSH key exchange" default:"false"`
-			HomePath   string `name:"home-path" help:"Custom home path on remote target installation"`
+			Name         string `arg:"" name:"name" help:"Name to refer to target host" required:"true"`
+			Host         string `arg:"" name:"host" help:"Target host address for install" type:"ip/hostname" required:"true"`
+			Username     string `arg:"" name:"username" help:"Username for SSH login" required:"true"`
+			Port         uint16 `name:"port" help:"SSH port" default:"22"`
+			NoPassword   bool   `name:"no-password" help:"Don't use password auth for SSH key exchange" default:"false"`
+			HomePath     string `name:"home-path" help:"Custom home path on remote target installation"`
+			JumpHost     string `name:"jump-host" help:"Bastion to tunnel SSH through, as [user@]host[:port]"`
+			SkipProbe    bool   `name:"skip-probe" help:"Don't check that the host is reachable before adding it" default:"false"`
+			TimeZone     string `name:"timezone" help:"IANA time zone schedules run in, i.e. Europe/Berlin (default: detected from the host)"`
+			IdentityFile string `name:"identity-file" help:"Existing private key already authorized on the host, used instead of the CLI's key pair" type:"path"`
+			SshProxy     string `name:"ssh-proxy" help:"Proxy to reach the host through, as socks5://, socks5h:// or http://[user:password@]host:port; 'direct' to bypass the global one"`
+			Preflight    bool   `name:"preflight" help:"Check SSH, sudo, OS and architecture, free disk and the k3s ports before adding the host, and don't add it if a check fails" default:"false"`
 		} `cmd:"" name:"add" help:"Add a target host for installation" required:"true"`
+		Credentials struct {
+			Set struct {
+				Name string `arg:"" name:"name" help:"Name of target host"`
+				Kind string `arg:"" name:"kind" help:"Which password: sudo, or ssh for copying the key again on 'target update'" enum:"sudo,ssh"`
+			} `cmd:"" name:"set" help:"Check a password and keep it in the OS keyring, so commands stop asking for it"`
+			Clear struct {
+				Name string `arg:"" name:"name" help:"Name of target host"`
+				Kind string `arg:"" name:"kind" help:"Which password: sudo or ssh (default: both)" enum:"sudo,ssh," default:"" optional:""`
+			} `cmd:"" name:"clear" help:"Remove a target's passwords from the OS keyring"`
+		} `cmd:"" name:"credentials" help:"Sudo and SSH passwords of a target kept in the OS keyring (keychain, Credential Manager or Secret Service)"`
+		Dedupe struct {
+		} `cmd:"" name:"dedupe" help:"Merge targets that manage the same host"`
 		Delete struct {
 			Name string `arg:"" name:"name" help:"Name of target host to delete"`
 		} `cmd:"" name:"delete" help:"Deletes a target host"`
+		Teardown struct {
+			Name        string `arg:"" name:"name" help:"Name of target host to tear down"`
+			KeepData    bool   `name:"keep-data" help:"Keep the filter's volumes on the host" default:"false"`
+			ForceUnlock bool   `name:"force-unlock" help:"Remove another run's lock on the target before tearing down" default:"false"`
+		} `cmd:"" name:"teardown" help:"Uninstall the filter, k3s and everything setup put on the host, keeping it configured"`
+		Exec struct {
+			Name    string   `arg:"" name:"name" help:"Name of target host"`
+			Command []string `arg:"" name:"command" help:"Command to run, after --" passthrough:""`
+		} `cmd:"" name:"exec" help:"Run a command on a target with KUBECONFIG set, exiting with its exit code"`
+		Group struct {
+			Add struct {
+				Group   string   `arg:"" name:"group" help:"Name of the group"`
+				Targets []string `arg:"" name:"targets" help:"Targets to add"`
+			} `cmd:"" name:"add" help:"Add targets to a group"`
+			Create struct {
+				Group string `arg:"" name:"group" help:"Name of the group"`
+			} `cmd:"" name:"create" help:"Create an empty group"`
+			Delete struct {
+				Group string `arg:"" name:"group" help:"Name of the group"`
+			} `cmd:"" name:"delete" help:"Delete a group, leaving its targets"`
+			List struct {
+			} `cmd:"" name:"list" help:"List groups and their targets"`
+			Remove struct {
+				Group   string   `arg:"" name:"group" help:"Name of the group"`
+				Targets []string `arg:"" name:"targets" help:"Targets to remove"`
+			} `cmd:"" name:"remove" help:"Remove targets from a group"`
+		} `cmd:"" name:"group" help:"Named sets of targets for 'filter --target-group'"`
+		Hook struct {
+			Add struct {
+				Name    string `arg:"" name:"name" help:"Name of target host"`
+				Stage   string `arg:"" name:"stage" help:"When to run the hook (pre-deploy, post-deploy)"`
+				Command string `arg:"" name:"command" help:"Shell command to run"`
+				Remote  bool   `name:"remote" help:"Run the command on the target host instead of locally" default:"false"`
+			} `cmd:"" name:"add" help:"Add a deploy hook"`
+			List struct {
+				Name string `arg:"" name:"name" help:"Name of target host"`
+			} `cmd:"" name:"list" help:"List deploy hooks"`
+			Remove struct {
+				Name    string `arg:"" name:"name" help:"Name of target host"`
+				Stage   string `arg:"" name:"stage" help:"Stage of the hook (pre-deploy, post-deploy)"`
+				Command string `arg:"" name:"command" help:"Shell command of the hook to remove"`
+			} `cmd:"" name:"remove" help:"Remove a deploy hook"`
+		} `cmd:"" name:"hook" help:"Manage scripts run before and after deploys"`
 		List struct {
+			Status bool `name:"status" help:"Probe each host for SSH, k3s and release state" default:"false"`
 		} `cmd:"" name:"list" help:"List configured target hosts"`
+		Node struct {
+			Add struct {
+				Name     string `arg:"" name:"name" help:"Name of target host"`
+				Address  string `arg:"" name:"address" help:"Address of the machine to join" type:"ip/hostname"`
+				Username string `arg:"" name:"username" help:"Username for SSH login on the machine"`
+				Port     uint16 `name:"port" help:"SSH port" default:"22"`
+			} `cmd:"" name:"add" help:"Install k3s on a machine and join it to the target's cluster as a worker"`
+			List struct {
+				Name string `arg:"" name:"name" help:"Name of target host"`
+			} `cmd:"" name:"list" help:"List the nodes of the target's cluster"`
+			Remove struct {
+				Name string `arg:"" name:"name" help:"Name of target host"`
+				Node string `arg:"" name:"node" help:"Node name or address of a worker added with 'target node add'"`
+			} `cmd:"" name:"remove" help:"Drain a worker, remove it from the cluster and uninstall k3s from it"`
+		} `cmd:"" name:"node" help:"Worker nodes of a target's k3s cluster"`
+		Patch struct {
+			Name           string `arg:"" name:"name" help:"Name of target host to patch"`
+			RebootIfNeeded bool   `name:"reboot-if-needed" help:"Reboot the host if updates require it" default:"false"`
+		} `cmd:"" name:"patch" help:"Update OS packages and k3s on a target host"`
+		PortForward struct {
+			Name       string `arg:"" name:"name" help:"Name of target host"`
+			Service    string `arg:"" name:"service" help:"Service to reach (web, grafana, postgres or a service name in the filter namespace)"`
+			LocalPort  uint16 `arg:"" name:"localport" help:"Local port to listen on"`
+			RemotePort int    `name:"remote-port" help:"Service port, defaults to the service's first port"`
+		} `cmd:"" name:"port-forward" help:"Tunnel a filter service to this machine over SSH"`
 		Reset struct {
 		} `cmd:"" name:"reset" help:"Reset SSH and clear all hosts"`
 		Select struct {
-			Name string `arg:"" name:"name" help:"Name of target host to select"`
+			Name string `arg:"" optional:"" name:"name" help:"Name of target host to select, 'show' or 'none'; prompts when omitted"`
 		} `cmd:"" name:"select" help:"Select target for operations"`
+		Show struct {
+			Name string `arg:"" name:"name" help:"Name of target host"`
+		} `cmd:"" name:"show" help:"Show the settings of a target, including its time zone"`
 		Setup struct {
-			Name string `arg:"" name:"name" help:"Target to select for setup"`
+			Name              string `arg:"" name:"name" help:"Target to select for setup"`
+			SkipImagePrecheck bool   `name:"skip-image-precheck" help:"Don't check whether the target still has to download k3s, or measure the SSH link to it" default:"false"`
 		} `cmd:"" name:"setup" help:"Setup dependencies on host"`
+		Status struct {
+			Name      string `arg:"" name:"name" help:"Name of target host"`
+			Threshold int    `name:"threshold" help:"Warn when the volume filesystem is this percent full" default:"80"`
+		} `cmd:"" name:"status" help:"Check that a target's cluster, release, pods, disk and CA are healthy"`
 		Test struct {
 			Name string `arg:"" name:"name" help:"Name of target host to test"`
 		} `cmd:"" name:"test" help:"Run test ssh command"`
 		Update struct {
-			Name       string `arg:"" name:"name" help:"Name of target host to update" required:"true"`
-			Host       string `arg:"" name:"host" help:"Target host address for install" type:"ip/hostname" required:"true"`
-			Username   string `arg:"" name:"username" help:"Username for SSH login" required:"true"`
-			Port       uint16 `name:"port" help:"SSH port" default:"22"`
-			NoPassword bool   `name:"no-password" help:"Don't use password auth for SSH key exchange" default:"false"`
-			HomePath   string `name:"home-path" help:"Custom home path on remote target installation"`
+			Name         string `arg:"" name:"name" help:"Name of target host to update" required:"true"`
+			Host         string `arg:"" name:"host" help:"Target host address for install" type:"ip/hostname" required:"true"`
+			Username     string `arg:"" name:"username" help:"Username for SSH login" required:"true"`
+			Port         uint16 `name:"port" help:"SSH port" default:"22"`
+			NoPassword   bool   `name:"no-password" help:"Don't use password auth for SSH key exchange" default:"false"`
+			HomePath     string `name:"home-path" help:"Custom home path on remote target installation"`
+			JumpHost     string `name:"jump-host" help:"Bastion to tunnel SSH through, as [user@]host[:port]"`
+			TimeZone     string `name:"timezone" help:"IANA time zone schedules run in, or 'auto' to detect it again (default: keep an override, else detect)"`
+			IdentityFile string `name:"identity-file" help:"Existing private key already authorized on the host, used instead of the CLI's key pair (default: keep the current one)" type:"path"`
+			SshProxy     string `name:"ssh-proxy" help:"Proxy to reach the host through, as socks5://, socks5h:// or http://[user:password@]host:port; 'direct' to bypass the global one (default: keep the current one)"`
 		} `cmd:"" name:"update" help:"Updates a target host for installation"`
 	} `cmd:"" name:"target" help:"Operations on target hosts"`
 	Filter struct {
-		Target string `name:"target" help:"Name of target host for changes"`
-		Acl    struct {
+		Target       string `name:"target" help:"Name of target host for changes"`
+		TargetGroup  string `name:"target-group" help:"Run the command against every target of a group, one after another"`
+		RefreshFacts bool   `name:"refresh-facts" help:"Re-query cluster facts from the target instead of using the local cache" default:"false"`
+		Acl          struct {
 			AddRule struct {
 				Category string `arg:"" name:"category" help:"ACL rule category" required:"true"`
 				Action   string `arg:"" name:"action" help:"ACL rule action (allow, deny, decrypt, nodecrypt)" required:"true"`
 				Position int    `name:"position" help:"Position of rule in ordered acl list" default:"-1"`
+				Create   bool   `name:"create" help:"Allow a category that doesn't exist in the database yet" default:"false"`
+				// What --create was called before, kept for existing scripts
+				Force bool `name:"force" hidden:"" default:"false"`
 			} `cmd:"" name:"add" help:"Adds an ACL rule"`
 			DeleteRule struct {
 				Category string `arg:"" name:"category" help:"ACL rule category" required:"true"`
 				Action   string `arg:"" name:"action" help:"ACL rule action (allow, deny, decrypt, nodecrypt)" required:"true"`
 				Position int    `name:"position" help:"Position of rule in ordered acl list" default:"-1"`
 			} `cmd:"" name:"delete" help:"Deletes an ACL rule"`
+			AddGeo struct {
+				Country   string `arg:"" name:"country-code" help:"Two-letter ISO 3166 country code (i.e. DE)"`
+				Action    string `arg:"" name:"action" help:"Rule action (allow, deny)"`
+				Direction string `name:"direction" help:"Match traffic to the country, from it, or both" enum:"both,to,from" default:"both"`
+			} `cmd:"" name:"add-geo" help:"Allow or deny traffic to and from a country"`
+			DeleteGeo struct {
+				Country string `arg:"" name:"country-code" help:"Two-letter ISO 3166 country code (i.e. DE)"`
+			} `cmd:"" name:"delete-geo" help:"Delete the rule for a country"`
+			Geo struct {
+				Update struct {
+					Url string `name:"url" help:"URL of an mmdb country database, optionally gzipped; %s is replaced by the year and month (default: DB-IP lite)"`
+				} `cmd:"" name:"update" help:"Download the latest GeoIP country database onto the target"`
+			} `cmd:"" name:"geo" help:"Manage the GeoIP database used by geo rules"`
+			BlockNewDomains struct {
+				Age     string `name:"age" help:"Block domains registered within this long (i.e. 14d, 30d)" default:"30d"`
+				FeedUrl string `name:"feed-url" help:"URL of a daily newly registered domain list, with {date} for the day (default: WhoisDS)"`
+				Disable bool   `name:"disable" help:"Stop blocking new domains and drop their category" default:"false"`
+			} `cmd:"" name:"block-new-domains" help:"Block newly registered domains, refreshed with the threat feeds"`
+			HomographProtection struct {
+				Mode string `arg:"" name:"mode" help:"on or off" enum:"on,off"`
+			} `cmd:"" name:"homograph-protection" help:"Block mixed-script lookalikes of allow-listed sites"`
 			Show struct {
 			} `cmd:"" name:"show" help:"Show all acl rules"`
 			CategorizeDomain struct {
-				Category string `arg:"" name:"category" help:"Category that a host belongs to"`
-				Domain   string `arg:"" name:"domain" help:"Domain to be categorized (i.e. google.com)"`
-			} `cmd:"" name:"categorize-domain" help:"Associate a domain with a category"`
+				Category string   `arg:"" name:"category" help:"Category that a host belongs to"`
+				Domain   []string `arg:"" name:"domain" help:"Domains to be categorized (i.e. google.com)" optional:""`
+				FromFile string   `name:"from-file" help:"File with one domain per line to be categorized" type:"existingfile"`
+				Create   bool     `name:"create" help:"Create the category if it doesn't exist yet" default:"false"`
+			} `cmd:"" name:"categorize-domain" help:"Associate domains with a category"`
 			DecategorizeDomain struct {
-				Category string `arg:"" name:"category" help:"Category that a host belongs to"`
-				Domain   string `arg:"" name:"domain" help:"Domain to be decategorized (i.e. google.com)"`
-			} `cmd:"" name:"decategorize-domain" help:"Remove association of a domain with a category"`
+				Category string   `arg:"" name:"category" help:"Category that a host belongs to"`
+				Domain   []string `arg:"" name:"domain" help:"Domains to be decategorized (i.e. google.com)" optional:""`
+				FromFile string   `name:"from-file" help:"File with one domain per line to be decategorized" type:"existingfile"`
+			} `cmd:"" name:"decategorize-domain" help:"Remove association of domains with a category"`
+			Categories struct {
+				SyncBuiltin struct {
+				} `cmd:"" name:"sync-builtin" help:"Cache the categories known to the lookup service so 'acl add' can check category names"`
+			} `cmd:"" name:"categories" help:"Manage the cached category list"`
 			ListCategories struct {
 				Domain string `name:"domain" help:"Optional: show only categories that a domain belongs to" default:""`
 			} `cmd:"" name:"list-categories" help:"List all existing categories in the database"`
 			DeleteCategory struct {
 				Category string `arg:"" name:"category" help:"Domain category to be deleted"`
 			} `cmd:"" name:"delete-category" help:"Delete a domain category"`
+			Suggest struct {
+				Since string `name:"since" help:"How far back to look in the access logs (i.e. 12h, 7d)" default:"7d"`
+				Limit int    `name:"limit" help:"Maximum number of domains to suggest" default:"50"`
+				Json  bool   `name:"json" help:"Print suggestions as JSON instead of prompting" default:"false"`
+			} `cmd:"" name:"suggest" help:"Suggest frequently visited uncategorized domains to categorize"`
 			ClearDatabase struct {
 			} `cmd:"" name:"clear-database" help:"Clear the domain category database"`
 			Upload struct {
@@ -90,9 +313,51 @@ var CLI struct {
 				File string `name:"file" help:"Output of downloaded tar file"`
 			} `cmd:"" name:"download" help:"Generate and download a tarball containing squidguard-style lists of existing category db"`
 		} `cmd:"" name:"acl" help:"Configure acl lists for proxy"`
+		Adopt struct {
+			Force bool `name:"force" help:"Replace existing local overrides" default:"false"`
+		} `cmd:"" name:"adopt" help:"Manage an existing guardian-angel deployment by importing its values"`
+		Alerts struct {
+			Add struct {
+				Name       string   `arg:"" name:"name" help:"Name of the alert"`
+				On         string   `name:"on" help:"Event to alert on as <event>=<value>, events are blocked-category, blocked-domain, search-term, probe-failed (value: url or any)" required:"true"`
+				Notify     string   `name:"notify" help:"How to notify (webhook, email)" required:"true"`
+				WebhookUrl string   `name:"webhook-url" help:"URL the alert is posted to as JSON"`
+				Email      []string `name:"email" help:"Recipient email address (repeatable)"`
+			} `cmd:"" name:"add" help:"Notify in real time when a filter event occurs"`
+			List struct {
+			} `cmd:"" name:"list" help:"List alerts"`
+			Remove struct {
+				Name string `arg:"" name:"name" help:"Name of the alert to remove"`
+			} `cmd:"" name:"remove" help:"Remove an alert"`
+			Test struct {
+				Name string `arg:"" name:"name" help:"Name of the alert to fire"`
+			} `cmd:"" name:"test" help:"Send a sample notification for an alert"`
+		} `cmd:"" name:"alerts" help:"Real-time notifications on filter events"`
+		Apply struct {
+			File   string   `name:"file" short:"f" help:"Policy manifest: overrides.yaml keys, with {{ .name }} variables" type:"existingfile" required:"true"`
+			Vars   string   `name:"vars" help:"YAML file of variables, under 'defaults' and per target under 'targets'" type:"existingfile"`
+			Set    []string `name:"set" help:"Set a variable as name=value, overriding the variables file"`
+			DryRun bool     `name:"dry-run" help:"Print the manifest rendered for the target without applying it" default:"false"`
+		} `cmd:"" name:"apply" help:"Apply a shared policy manifest to the target, filling in its variables"`
 		Backup struct {
 			ToFile string `name:"to-file" help:"path to backup file" type:"filename" required:"true"`
 		} `cmd:"" name:"backup" help:"Backup target host's filter configuration"`
+		Blockpage struct {
+			Language struct {
+				Import struct {
+					Name string `arg:"" name:"name" help:"Name to refer to the translation by"`
+					File string `arg:"" name:"file" help:"e2guardian messages file with the translation" type:"existingfile"`
+				} `cmd:"" name:"import" help:"Import a custom translation"`
+				List struct {
+				} `cmd:"" name:"list" help:"List available languages"`
+				Remove struct {
+					Name string `arg:"" name:"name" help:"Name of the custom translation"`
+				} `cmd:"" name:"remove" help:"Remove a custom translation"`
+				Set struct {
+					Locale string `arg:"" name:"locale" help:"Locale (i.e. fr, pt-BR) or custom translation name"`
+				} `cmd:"" name:"set" help:"Set the language of the block pages"`
+			} `cmd:"" name:"language" help:"Language of the denied, warn and quota pages"`
+		} `cmd:"" name:"blockpage" help:"Configure the pages shown when a request is blocked"`
 		Certificate struct {
 			Configure struct {
 				CommonName   string `name:"common-name" help:"Common Name for the certificate subject line" default:"guardian.angel"`
@@ -104,7 +369,40 @@ var CLI struct {
 			GetRootCa struct {
 				Output string `name:"output" help:"Output file path to export certificate to" required:"true"`
 			} `cmd:"" name:"get-root-ca" help:"Fetch the root CA certificate and output to a file"`
+			ServeCa struct {
+				Port     uint16 `name:"port" help:"Port to serve on" default:"8081"`
+				Duration string `name:"duration" help:"How long to serve before stopping" default:"1h"`
+			} `cmd:"" name:"serve-ca" help:"Temporarily serve the root CA and install instructions to devices on the LAN"`
 		} `cmd:"" name:"certificate" help:"Manage decryption certificate"`
+		Clients struct {
+			Add struct {
+				Name    string `arg:"" name:"name" help:"Friendly name of the device"`
+				Address string `arg:"" name:"address" help:"IP or MAC address of the device"`
+			} `cmd:"" name:"add" help:"Add a client device"`
+			Assign struct {
+				Name  string `arg:"" name:"name" help:"Name of the device"`
+				Group string `name:"group" help:"Policy group for the device; leave empty for the default policy"`
+			} `cmd:"" name:"assign" help:"Apply a policy group to a client device"`
+			Discover struct {
+				DhcpLeases string `name:"dhcp-leases" help:"Where to read leases: a dnsmasq leases file path, kea, or windows" default:"/var/lib/misc/dnsmasq.leases"`
+				Router     string `name:"router" help:"Read the leases from a router as user@host instead of the target; it must accept the guardian SSH key"`
+				RouterPort uint16 `name:"router-port" help:"SSH port of the router" default:"22"`
+			} `cmd:"" name:"discover" help:"Add client devices with their hostnames and MACs from DHCP leases"`
+			Exempt struct {
+				Name     string `arg:"" name:"name" help:"Name of the device"`
+				Duration string `name:"duration" help:"How long the exemption lasts (i.e. 2h); leave empty for no expiry"`
+				Revoke   bool   `name:"revoke" help:"Remove an existing exemption" default:"false"`
+			} `cmd:"" name:"exempt" help:"Exempt a client device from filtering"`
+			List struct {
+			} `cmd:"" name:"list" help:"List client devices"`
+			Remove struct {
+				Name string `arg:"" name:"name" help:"Name of the device to remove"`
+			} `cmd:"" name:"remove" help:"Remove a client device"`
+		} `cmd:"" name:"clients" help:"Manage the inventory of client devices"`
+		Connections struct {
+			Client string `name:"client" help:"Only show connections of this client, by name or IP"`
+			Watch  bool   `name:"watch" help:"Refresh the view every two seconds until interrupted" default:"false"`
+		} `cmd:"" name:"connections" help:"Show the connections the proxy is handling right now"`
 		ContentList struct {
 			AddEntry struct {
 				Name  string `arg:"" name:"name" help:"Name of the content list to modify"`
@@ -130,15 +428,134 @@ var CLI struct {
 				Group string `name:"group" help:"name of content group"`
 			} `cmd:"" name:"remove-entry" help:"Remove an entry from an existing content list"`
 			Show struct {
-				Name  string `name:"name" help:"Name of the content list to show"`
-				Group string `name:"group" help:"name of content group"`
+				Name    string `name:"name" help:"Name of the content list to show"`
+				Group   string `name:"group" help:"name of content group"`
+				Limit   int    `name:"limit" help:"Maximum number of entries to show (0 for all)" default:"0"`
+				Offset  int    `name:"offset" help:"Number of matching entries to skip" default:"0"`
+				Pattern string `name:"pattern" help:"Only show entries matching this regular expression"`
 			} `cmd:"" name:"show" help:"Dump the contents of a content list"`
 			Whitelist struct {
 				Name string `arg:"" name:"name" help:"Name of the content list to be whitelisted" required:"true"`
 			} `cmd:"" name:"whitelist" help:"Whitelist this content list"`
 		} `cmd:"" name:"content-list" help:"Configure content lists for content scanning"`
+		Db struct {
+			Maintain struct {
+				Schedule string `name:"schedule" help:"Run maintenance on the target daily, weekly or monthly instead of now; 'none' removes the schedule"`
+			} `cmd:"" name:"maintain" help:"Vacuum the category DB and prune orphaned entries"`
+			Tune struct {
+				MaxConnections int    `name:"max-connections" help:"Maximum Postgres connections"`
+				PoolSize       int    `name:"pool-size" help:"Connections the lookup service keeps open"`
+				SharedBuffers  string `name:"shared-buffers" help:"Postgres shared buffers, i.e. 256Mi"`
+				MemoryLimit    string `name:"memory-limit" help:"Memory limit of the Postgres pod, i.e. 1Gi"`
+			} `cmd:"" name:"tune" help:"Tune the bundled Postgres"`
+		} `cmd:"" name:"db" help:"Category DB administration"`
+		Debug struct {
+			State       string `arg:"" name:"state" help:"on or off" enum:"on,off"`
+			Component   string `name:"component" help:"Component to switch" enum:"e2guardian,squid,lookup" default:"e2guardian"`
+			RevertAfter string `name:"revert-after" help:"Have the target turn debug logging off again after this long, i.e. 30m or 2h"`
+		} `cmd:"" name:"debug" help:"Turn verbose logging of a deployed component on or off; restarts it"`
+		Decrypt struct {
+			ExemptClient struct {
+				Client string `arg:"" name:"client" help:"Client name, IP or MAC address"`
+				Revoke bool   `name:"revoke" help:"Decrypt the client's traffic again" default:"false"`
+			} `cmd:"" name:"exempt-client" help:"Never intercept TLS for a device, i.e. IoT devices or guests without the CA"`
+			Exclusions struct {
+				Add struct {
+					Domain []string `arg:"" name:"domain" help:"Domains to never decrypt"`
+				} `cmd:"" name:"add" help:"Exclude custom domains from decryption"`
+				Enable struct {
+					Preset []string `name:"preset" help:"Curated list to exclude (mobile-apps, os-updates, payments), repeatable" required:"true"`
+				} `cmd:"" name:"enable" help:"Exclude apps that pin certificates from decryption"`
+				List struct {
+				} `cmd:"" name:"list" help:"List domains excluded from decryption"`
+				Remove struct {
+					Domain string `arg:"" name:"domain" help:"Custom domain to decrypt again"`
+				} `cmd:"" name:"remove" help:"Remove a custom exclusion"`
+				Update struct {
+				} `cmd:"" name:"update" help:"Load the current preset lists and custom domains into the category DB"`
+			} `cmd:"" name:"exclusions" help:"Domains never decrypted"`
+		} `cmd:"" name:"decrypt" help:"HTTPS inspection settings"`
 		Deploy struct {
+			Message           string `name:"message" help:"Note recorded in the deploy history explaining this deploy"`
+			ForceUnlock       bool   `name:"force-unlock" help:"Remove another run's lock on the target before deploying" default:"false"`
+			Force             bool   `name:"force" help:"Deploy even if the chart and this CLI's versions are incompatible" default:"false"`
+			TargetAll         bool   `name:"target-all" help:"Deploy to every configured target" default:"false"`
+			Resume            bool   `name:"resume" help:"Deploy only to the targets that failed in the last --target-all run" default:"false"`
+			SummaryFile       string `name:"summary-file" help:"Where to write the JSON summary of a --target-all run and read it for --resume"`
+			AutoRollback      bool   `name:"auto-rollback" help:"Check the release, pods and post-deploy hooks after deploying, and roll back the release and overrides if they fail" default:"false"`
+			SkipImagePrecheck bool   `name:"skip-image-precheck" help:"Don't look up which of the chart's images the target must pull before deploying" default:"false"`
 		} `cmd:"" name:"deploy" help:"Deploy filter stack to target host"`
+		Doctor struct {
+		} `cmd:"" name:"doctor" help:"Check for common problems and suggest fixes"`
+		Downloads struct {
+			Set struct {
+				MaxSize             string   `name:"max-size" help:"Largest download allowed, i.e. 500M"`
+				BlanketBlock        string   `name:"blanket-block" help:"Block every download except the exception extensions (on, off)" enum:",on,off" default:""`
+				BlockExtensions     []string `name:"block-extensions" help:"Comma separated extensions to block, i.e. exe,scr"`
+				ExceptionExtensions []string `name:"exception-extensions" help:"Comma separated extensions allowed despite a blanket block"`
+				ScanExtensions      []string `name:"scan-extensions" help:"Comma separated extensions sent to the content scanners, i.e. zip,docx"`
+			} `cmd:"" name:"set" help:"Set download size limits and blocked or scanned file types"`
+			Show struct {
+			} `cmd:"" name:"show" help:"Show download controls"`
+		} `cmd:"" name:"downloads" help:"Download management"`
+		Drift struct {
+		} `cmd:"" name:"drift" help:"Compare the local overrides with the values deployed on the target"`
+		ExportE2g struct {
+			Output string `name:"output" help:"Directory to write the e2guardian and squid configuration to" type:"path" required:"true"`
+		} `cmd:"" name:"export-e2g" help:"Render the filter policy as a standalone e2guardian and squid configuration"`
+		Guest struct {
+			Disable struct {
+			} `cmd:"" name:"disable" help:"Stop filtering the guest network separately"`
+			Enable struct {
+				Network   string `name:"network" help:"Guest network in CIDR notation, i.e. 192.168.50.0/24" required:"true"`
+				Policy    string `name:"policy" help:"Guest filtering policy (strict, moderate)" default:"strict"`
+				TermsPage string `name:"terms-page" help:"HTML page guests must accept before browsing" type:"existingfile"`
+			} `cmd:"" name:"enable" help:"Filter a guest network under its own policy with an acceptance page"`
+		} `cmd:"" name:"guest" help:"Guest network profile"`
+		ImportE2g struct {
+			Path   string `name:"path" help:"Directory of the e2guardian configuration" default:"/etc/e2guardian"`
+			Remote bool   `name:"remote" help:"Read the configuration from the target over SSH instead of this machine" default:"false"`
+		} `cmd:"" name:"import-e2g" help:"Convert the lists of a classic e2guardian installation into phrase and content lists"`
+		Ha struct {
+			Disable struct {
+			} `cmd:"" name:"disable" help:"Return to a single replica of each service"`
+			Enable struct {
+				Replicas int  `name:"replicas" help:"Replicas of the filter, DNS and nginx services" default:"2"`
+				Soft     bool `name:"soft" help:"Prefer but don't require replicas on separate nodes" default:"false"`
+			} `cmd:"" name:"enable" help:"Run services with several replicas spread across nodes"`
+		} `cmd:"" name:"ha" help:"High availability"`
+		History struct {
+			Limit int `name:"limit" help:"Only show this many of the latest deploys (0 for all)" default:"0"`
+		} `cmd:"" name:"history" help:"Show the deploy history of the target host"`
+		Lists struct {
+			FixIncludes struct {
+				DryRun bool `name:"dry-run" help:"Show the repairs without saving them" default:"false"`
+			} `cmd:"" name:"fix-includes" help:"Repair list includes that name a missing main list or one of another list type"`
+			Migrate struct {
+				DryRun bool `name:"dry-run" help:"Show the changes without saving them" default:"false"`
+			} `cmd:"" name:"migrate" help:"Update overrides from older versions: store each phrase list's kind and fix includes that don't match it"`
+		} `cmd:"" name:"lists" help:"Checks and repairs across content and phrase lists"`
+		Lint struct {
+		} `cmd:"" name:"lint" help:"Check the whole target profile (acl, lists, schema, secrets, includes) and report problems by severity"`
+		Network struct {
+			Ipv6 struct {
+				Disable struct {
+				} `cmd:"" name:"disable" help:"Stop serving IPv6 clients"`
+				Enable struct {
+					LanCidr string `name:"lan-cidr" help:"IPv6 LAN prefix in CIDR notation, i.e. fd00:1::/64" required:"true"`
+					Aaaa    string `name:"aaaa" help:"DNS AAAA handling: filter them like A records, strip them to force IPv4, or pass them" enum:"filter,strip,pass" default:"filter"`
+				} `cmd:"" name:"enable" help:"Filter IPv6 clients with dual-stack services, AAAA handling and IPv6 redirect rules"`
+			} `cmd:"" name:"ipv6" help:"IPv6 filtering"`
+		} `cmd:"" name:"network" help:"Network settings of the filter stack"`
+		Pac struct {
+			Generate struct {
+				DirectDomains []string `name:"direct-domains" help:"Comma separated domains clients reach without the proxy"`
+				Output        string   `name:"output" help:"File to write the PAC file to (default: stdout)"`
+				Serve         bool     `name:"serve" help:"Serve the PAC file from nginx at /wpad.dat" default:"false"`
+			} `cmd:"" name:"generate" help:"Generate a proxy auto-config file for explicit-proxy clients"`
+			Remove struct {
+			} `cmd:"" name:"remove" help:"Stop serving the PAC file"`
+		} `cmd:"" name:"pac" help:"Proxy auto-config for explicit-proxy deployments"`
 		PhraseList struct {
 			AddList struct {
 				Name     string `arg:"" name:"name" help:"Name of the phrase list to create"`
@@ -165,47 +582,630 @@ var CLI struct {
 				Name string `arg:"" name:"name" help:"Name of the phrase list to delete"`
 			} `cmd:"" name:"remove-list" help:"Delete an existing phrase list"`
 			Show struct {
-				Name  string `name:"name" help:"Name of the phrase list to show"`
-				Group string `name:"group" help:"name of phrase group"`
+				Name    string `name:"name" help:"Name of the phrase list to show"`
+				Group   string `name:"group" help:"name of phrase group"`
+				Limit   int    `name:"limit" help:"Maximum number of entries to show (0 for all)" default:"0"`
+				Offset  int    `name:"offset" help:"Number of matching entries to skip" default:"0"`
+				Pattern string `name:"pattern" help:"Only show entries matching this regular expression"`
 			} `cmd:"" name:"show" help:"Dump the contents of a phrase list"`
 			Whitelist struct {
 				Name string `arg:"" name:"name" help:"Name of the phrase list to be whitelisted" required:"true"`
 			} `cmd:"" name:"whitelist" help:"whitelist this phrase list"`
 		} `cmd:"" name:"phrase-list" help:"Configure phrase lists for content scanning"`
+		Report struct {
+			Compliance struct {
+				Output string `name:"output" help:"Report file, written as PDF or HTML by its extension" type:"path" required:"true"`
+			} `cmd:"" name:"compliance" help:"Document the active policy (ACL order, lists, safe search, decryption scope, certificate, last deploy) for auditors"`
+			List struct {
+			} `cmd:"" name:"list" help:"List scheduled reports"`
+			Schedule struct {
+				Name     string   `arg:"" name:"name" help:"Name of the report schedule"`
+				Daily    bool     `name:"daily" help:"Send the report every day" xor:"frequency"`
+				Weekly   bool     `name:"weekly" help:"Send the report every week (default)" xor:"frequency"`
+				Monthly  bool     `name:"monthly" help:"Send the report every month" xor:"frequency"`
+				Email    []string `name:"email" help:"Recipient email address (repeatable)" required:"true"`
+				Template string   `name:"template" help:"Report template (summary, detailed, blocked)" default:"summary"`
+			} `cmd:"" name:"schedule" help:"Schedule a periodic email digest"`
+			Smtp struct {
+				Server   string `name:"server" help:"SMTP server as host:port" required:"true"`
+				From     string `name:"from" help:"Sender address for reports" required:"true"`
+				Username string `name:"username" help:"Username for SMTP authentication, password is prompted or read from SMTP_PASSWORD"`
+			} `cmd:"" name:"smtp" help:"Configure the mail server reports are sent through"`
+			SearchTerms struct {
+				Client string `name:"client" help:"Only report searches from this client name or address"`
+				Since  string `name:"since" help:"How far back to look, i.e. 24h or 7d" default:"7d"`
+				Json   bool   `name:"json" help:"Print the report as JSON" default:"false"`
+			} `cmd:"" name:"search-terms" help:"Report search engine queries seen by the filter"`
+			Unschedule struct {
+				Name string `arg:"" name:"name" help:"Name of the report schedule to remove"`
+			} `cmd:"" name:"unschedule" help:"Remove a scheduled report"`
+		} `cmd:"" name:"report" help:"Schedule usage reports"`
+		Redis struct {
+			Tune struct {
+				MaxMemory      string `name:"max-memory" help:"Memory Redis may use for data, i.e. 256Mi"`
+				EvictionPolicy string `name:"eviction-policy" help:"What Redis evicts when full, i.e. allkeys-lru"`
+				Persistence    string `name:"persistence" help:"Persistence mode (none, rdb, aof)"`
+				MemoryLimit    string `name:"memory-limit" help:"Memory limit of the Redis pod, i.e. 512Mi"`
+			} `cmd:"" name:"tune" help:"Tune the bundled Redis"`
+		} `cmd:"" name:"redis" help:"Redis cache administration"`
 		ReleaseTag struct {
 			Tag string `arg:"" name:"tag" help:"Name of tag to apply to images"`
 		} `cmd:"" name:"release-tag" help:"Release tag for CI/CD images"`
+		Replicate struct {
+			From     string   `name:"from" help:"Primary target whose policy is copied" required:"true"`
+			To       []string `name:"to" help:"Replica targets to copy the policy to and deploy (i.e. site-b,site-c)" required:"true"`
+			Exclude  []string `name:"exclude" help:"Policy overrides each replica keeps its own value of; host settings and secrets always stay"`
+			Schedule string   `name:"schedule" help:"Keep replicating at this interval (i.e. 1h, 1d) until interrupted"`
+		} `cmd:"" name:"replicate" help:"Copy a primary target's overrides to replica targets and deploy them"`
 		Restore struct {
 			FromFile string `name:"from-file" help:"Restore configuration from a backup file" type:"filename" required:"true"`
 		} `cmd:"" name:"restore" help:"Restore target host's filter configuration from a backup file"`
+		Storage struct {
+			Status struct {
+				Threshold int `name:"threshold" help:"Warn when a volume or the filesystem is this percent full" default:"80"`
+			} `cmd:"" name:"status" help:"Report volume and disk usage on the target"`
+		} `cmd:"" name:"storage" help:"Disk and volume usage"`
+		ThreatFeed struct {
+			Disable struct {
+			} `cmd:"" name:"disable" help:"Stop updating threat feeds"`
+			Enable struct {
+				Feeds   []string `name:"feeds" help:"Comma separated feeds to subscribe to (openphish, urlhaus)" required:"true"`
+				Refresh string   `name:"refresh" help:"How often 'daemon' updates the feeds" default:"6h"`
+			} `cmd:"" name:"enable" help:"Subscribe to threat feeds and deny their categories"`
+			Update struct {
+			} `cmd:"" name:"update" help:"Fetch enabled threat feeds now"`
+		} `cmd:"" name:"threat-feed" help:"Block phishing and malware domains from security feeds"`
+		TestUrl struct {
+			Url string `arg:"" name:"url" help:"URL or domain to test"`
+		} `cmd:"" name:"test-url" help:"Show the categories of a URL and the acl rule that applies"`
+		Scanner struct {
+			Add struct {
+				Type string `arg:"" name:"type" help:"Scanner type (clamav, icap)"`
+				Url  string `name:"url" help:"Scanner address, i.e. tcp://host:3310 for clamav or icap://host:1344/avscan" required:"true"`
+				Name string `name:"name" help:"Name to refer to the scanner by, defaults to its type"`
+			} `cmd:"" name:"add" help:"Scan downloads with an external antivirus or ICAP service"`
+			Disable struct {
+				Name  string `arg:"" name:"name" help:"Name of the scanner"`
+				Group string `name:"group" help:"Filter group (default, guest)" default:"default"`
+			} `cmd:"" name:"disable" help:"Stop scanning downloads of a filter group"`
+			Enable struct {
+				Name  string `arg:"" name:"name" help:"Name of the scanner"`
+				Group string `name:"group" help:"Filter group (default, guest)" default:"default"`
+			} `cmd:"" name:"enable" help:"Scan downloads of a filter group"`
+			List struct {
+			} `cmd:"" name:"list" help:"List scanners and check they answer"`
+			Remove struct {
+				Name string `arg:"" name:"name" help:"Name of the scanner"`
+			} `cmd:"" name:"remove" help:"Remove a scanner"`
+		} `cmd:"" name:"scanner" help:"External content scanners"`
+		Squid struct {
+			Remove struct {
+			} `cmd:"" name:"remove" help:"Remove the squid config snippet"`
+			SetSnippet struct {
+				File string `name:"file" help:"squid.conf fragment to add" type:"existingfile" required:"true"`
+			} `cmd:"" name:"set-snippet" help:"Add a validated raw squid.conf fragment, i.e. cache_peer or ACLs"`
+			Show struct {
+			} `cmd:"" name:"show" help:"Show the squid config snippet"`
+		} `cmd:"" name:"squid" help:"Raw squid configuration for advanced cases"`
+		SearchTerms struct {
+			Disable struct {
+			} `cmd:"" name:"disable" help:"Stop logging search terms"`
+			Enable struct {
+				WatchWord  []string `name:"watch-word" help:"Alert when a search contains this word (repeatable)"`
+				AlertEmail []string `name:"alert-email" help:"Send watch-word alerts to this address (repeatable)"`
+			} `cmd:"" name:"enable" help:"Log search engine queries from SafeSearch and decrypted traffic"`
+		} `cmd:"" name:"search-terms" help:"Search term logging and watch-word alerts"`
 		SafeSearch struct {
 			Command string `arg:"" name:"command" help:"Safesearch is enforced (on/off/show)"`
 		} `cmd:"" name:"safe-search" help:"Safe search option"`
+		Probes struct {
+			Clear struct {
+			} `cmd:"" name:"clear" help:"Stop probing"`
+			Set struct {
+				Allowed []string `name:"allowed" help:"URL that must load through the filter (repeatable)"`
+				Blocked []string `name:"blocked" help:"URL the filter must deny (repeatable)"`
+				Every   string   `name:"every" help:"How often to probe, i.e. 15m or 1h (default: 5m)"`
+			} `cmd:"" name:"set" help:"Probe URLs from inside the cluster to verify filtering still works"`
+			Status struct {
+			} `cmd:"" name:"status" help:"Show how each probed URL did in the latest run"`
+		} `cmd:"" name:"probes" help:"Canary URL probes run by the stack"`
+		Profile struct {
+			Apply struct {
+				Profile string `arg:"" name:"profile" help:"low-memory for 1-2GB single-board computers such as a Raspberry Pi, high-throughput for 8GB+ servers" enum:"low-memory,high-throughput"`
+				DryRun  bool   `name:"dry-run" help:"Show the settings the profile changes without saving them" default:"false"`
+			} `cmd:"" name:"apply" help:"Set replicas, resource limits and cache sizes for the target's hardware"`
+		} `cmd:"" name:"profile" help:"Deployment sizing profiles"`
+		Propose struct {
+			Message string `name:"message" short:"m" help:"Why the change is needed, shown to the approver"`
+		} `cmd:"" name:"propose" help:"Record the local overrides as a pending change for review instead of deploying them"`
+		Approve struct {
+			Id int `name:"id" help:"Proposal to apply and deploy" required:"true"`
+		} `cmd:"" name:"approve" help:"Apply a proposed change and deploy it, as one of the approvers"`
+		Proposals struct {
+			Id int `name:"id" help:"Show the changes of this proposal instead of listing them all"`
+		} `cmd:"" name:"proposals" help:"List proposed changes and who approved them"`
+		Stats struct {
+			E2g struct {
+				Enable   bool `name:"enable" help:"Turn e2guardian's statistics on instead of showing them; deploy to apply" default:"false"`
+				Interval int  `name:"interval" help:"Seconds between samples when enabling" default:"60"`
+			} `cmd:"" name:"e2g" help:"Show e2guardian's current connections, request rates and filter group activity"`
+		} `cmd:"" name:"stats" help:"Runtime statistics of the deployed filter"`
+		Snapshot struct {
+			Create struct {
+				Name  string `arg:"" name:"name" help:"Name of the snapshot (i.e. weekend-lockdown)"`
+				Force bool   `name:"force" help:"Replace an existing snapshot with the same name" default:"false"`
+			} `cmd:"" name:"create" help:"Save a named copy of the target's current overrides"`
+			List struct {
+			} `cmd:"" name:"list" help:"List snapshots, marking the one matching the current overrides"`
+			Restore struct {
+				Name string `arg:"" name:"name" help:"Name of the snapshot to restore"`
+			} `cmd:"" name:"restore" help:"Replace the target's overrides with a snapshot; the replaced ones are saved as 'previous'"`
+			Delete struct {
+				Name string `arg:"" name:"name" help:"Name of the snapshot to delete"`
+			} `cmd:"" name:"delete" help:"Delete a snapshot"`
+		} `cmd:"" name:"snapshot" help:"Named point-in-time copies of the target's policy"`
+		Start struct {
+		} `cmd:"" name:"start" help:"Resume filtering after 'filter stop'"`
+		Stop struct {
+			DnsPassthrough bool `name:"dns-passthrough" help:"Also stop enforcing safe search so DNS answers pass through unmodified" default:"false"`
+		} `cmd:"" name:"stop" help:"Switch filtering to pass-through for maintenance; the proxy stays up and allows all traffic"`
 		Uninstall struct {
+			ForceUnlock bool `name:"force-unlock" help:"Remove another run's lock on the target before uninstalling" default:"false"`
 		} `cmd:"" name:"uninstall" help:"Uninstall filter stack on target host"`
+		Upstream struct {
+			Remove struct {
+			} `cmd:"" name:"remove" help:"Connect directly instead of through an upstream proxy"`
+			Set struct {
+				Proxy string `name:"proxy" help:"Upstream proxy URL, i.e. http://corp-proxy:3128" required:"true"`
+				Auth  string `name:"auth" help:"Credentials for the upstream proxy as user:pass" secret:""`
+			} `cmd:"" name:"set" help:"Forward all traffic through an upstream or corporate proxy"`
+			Show struct {
+			} `cmd:"" name:"show" help:"Show the upstream proxy"`
+		} `cmd:"" name:"upstream" help:"Upstream proxy chaining"`
+		Vpn struct {
+			Disable struct {
+			} `cmd:"" name:"disable" help:"Stop the VPN gateway, keeping its keys and peers"`
+			Enable struct {
+				Wireguard bool   `name:"wireguard" help:"Run a WireGuard gateway" default:"false"`
+				Port      uint16 `name:"port" help:"UDP port devices connect to" default:"51820"`
+				Network   string `name:"network" help:"Tunnel network devices get addresses from" default:"10.13.13.0/24"`
+				Endpoint  string `name:"endpoint" help:"Public hostname or address devices connect to (default: the target's address)"`
+			} `cmd:"" name:"enable" help:"Keep roaming devices filtered through a VPN gateway on the target"`
+			Peer struct {
+				Add struct {
+					Device string `arg:"" name:"device" help:"Name of the device"`
+					Output string `name:"output" help:"Where to write the device's WireGuard config (default: the target's host data directory)"`
+				} `cmd:"" name:"add" help:"Add a device and generate its WireGuard config"`
+				List struct {
+				} `cmd:"" name:"list" help:"List VPN devices"`
+				Remove struct {
+					Device string `arg:"" name:"device" help:"Name of the device"`
+				} `cmd:"" name:"remove" help:"Remove a device from the VPN"`
+			} `cmd:"" name:"peer" help:"Devices allowed to connect to the VPN"`
+		} `cmd:"" name:"vpn" help:"VPN gateway for roaming devices"`
+		Web struct {
+			Disable struct {
+			} `cmd:"" name:"disable" help:"Stop serving the web UI"`
+			Enable struct {
+				Hostname string `name:"hostname" help:"Hostname the web UI is served under, i.e. filter.lan"`
+				Port     uint16 `name:"port" help:"HTTPS port of the web UI, defaults to the current one"`
+			} `cmd:"" name:"enable" help:"Serve the web UI and print its URL and credentials"`
+			Status struct {
+			} `cmd:"" name:"status" help:"Show the web UI settings and whether it answers"`
+			Users struct {
+				Add struct {
+					Name string `arg:"" name:"name" help:"Login name of the user"`
+					Role string `name:"role" help:"Role of the user (admin, viewer)" default:"viewer"`
+				} `cmd:"" name:"add" help:"Add a web UI account, reading the password from WEB_PASSWORD or a prompt"`
+				List struct {
+				} `cmd:"" name:"list" help:"List web UI accounts"`
+				Remove struct {
+					Name string `arg:"" name:"name" help:"Login name of the user"`
+				} `cmd:"" name:"remove" help:"Remove a web UI account"`
+			} `cmd:"" name:"users" help:"Web UI and report page accounts"`
+		} `cmd:"" name:"web" help:"Web UI and report pages"`
 	} `cmd:"" help:"Deployment and configuration of the web filter"`
 }
 
+var CLI cliGrammar
+
 var listTypes = []string{"sitelist", "regexpurllist", "mimetypelist", "extensionslist"}
 
+// Commands that only read state, allowed in read-only mode
+var readOnlyCommands = map[string]bool{
+	"audit log":                          true,
+	"config export":                      true,
+	"daemon":                             true,
+	"daemon <targets>":                   true,
+	"delegate list":                      true,
+	"target group list":                  true,
+	"target hook list <name>":            true,
+	"target list":                        true,
+	"target node list <name>":            true,
+	"target show <name>":                 true,
+	"target status <name>":               true,
+	"target test <name>":                 true,
+	"filter acl categories sync-builtin": true,
+	"filter acl download":                true,
+	"filter acl list-categories":         true,
+	"filter acl show":                    true,
+	"filter alerts list":                 true,
+	"filter blockpage language list":     true,
+	"filter certificate get-root-ca":     true,
+	"filter certificate serve-ca":        true,
+	"filter clients list":                true,
+	"filter connections":                 true,
+	"filter content-list show":           true,
+	"filter decrypt exclusions list":     true,
+	"filter doctor":                      true,
+	"filter downloads show":              true,
+	"filter drift":                       true,
+	"filter export-e2g":                  true,
+	"filter history":                     true,
+	"filter lint":                        true,
+	"filter phrase-list show":            true,
+	"filter probes status":               true,
+	"filter report compliance":           true,
+	"filter report list":                 true,
+	"filter report search-terms":         true,
+	"filter scanner list":                true,
+	"filter proposals":                   true,
+	"filter snapshot list":               true,
+	"filter squid show":                  true,
+	"filter storage status":              true,
+	"filter test-url <url>":              true,
+	"filter upstream show":               true,
+	"filter vpn peer list":               true,
+	"filter web status":                  true,
+	"filter web users list":              true,
+}
+
+// Commands whose data can be sent to --output-file
+var outputCommands = map[string]bool{
+	"audit log":                      true,
+	"delegate list":                  true,
+	"target group list":              true,
+	"target hook list <name>":        true,
+	"target list":                    true,
+	"target node list <name>":        true,
+	"target show <name>":             true,
+	"target status <name>":           true,
+	"filter acl list-categories":     true,
+	"filter acl show":                true,
+	"filter acl suggest":             true,
+	"filter alerts list":             true,
+	"filter clients list":            true,
+	"filter connections":             true,
+	"filter content-list show":       true,
+	"filter decrypt exclusions list": true,
+	"filter downloads show":          true,
+	"filter drift":                   true,
+	"filter history":                 true,
+	"filter lint":                    true,
+	"filter lists fix-includes":      true,
+	"filter lists migrate":           true,
+	"filter phrase-list show":        true,
+	"filter probes status":           true,
+	"filter report list":             true,
+	"filter report search-terms":     true,
+	"filter scanner list":            true,
+	"filter proposals":               true,
+	"filter snapshot list":           true,
+	"filter squid show":              true,
+	"filter stats e2g":               true,
+	"filter storage status":          true,
+	"filter test-url <url>":          true,
+	"filter upstream show":           true,
+	"filter vpn peer list":           true,
+	"filter web status":              true,
+	"filter web users list":          true,
+}
+
+func readOnlyAllowed(command string) bool {
+	switch command {
+	case "filter safe-search <command>":
+		return CLI.Filter.SafeSearch.Command == "show"
+	case "target select <name>":
+		return CLI.Target.Select.Name == "show"
+	case "filter stats e2g":
+		return !CLI.Filter.Stats.E2g.Enable
+	case "config read-only <mode>":
+		// Turning it off again is a change like any other
+		return CLI.Config.ReadOnly.Mode == "on"
+	}
+	return readOnlyCommands[command]
+}
+
+// Every command of the CLI, for checking what a delegate token allows
+var commandPaths []string
+
+// Flag and argument types naming files on the daemon's machine
+var fileValueTypes = map[string]bool{"path": true, "existingfile": true, "existingdir": true, "filename": true}
+
+// Names of flags and arguments naming files, i.e. --output, --from-file or --home-path
+var fileValueName = regexp.MustCompile(`(^|-)(output|file|dir|path)$`)
+
+/*
+ * The command a delegate's arguments run. Flags and arguments naming files would
+ * have the daemon read or write them as the admin, and switching the state backend
+ * reaches beyond the command, so they are refused.
+ */
+func delegatedCommand(args []string) (string, error) {
+	var grammar cliGrammar
+	parser, err := kong.New(&grammar, kong.Exit(func(int) {}), kong.Writers(io.Discard, io.Discard))
+	if err != nil {
+		return "", err
+	}
+	ctx, err := parser.Parse(args)
+	if err != nil {
+		return "", err
+	}
+	if grammar.StateBackend != CLI.StateBackend {
+		return "", errors.New("--state-backend can't be used with a delegate token")
+	}
+	for _, element := range ctx.Path {
+		if element.Flag != nil && (fileValueTypes[element.Flag.Tag.Type] || fileValueName.MatchString(element.Flag.Name)) {
+			return "", fmt.Errorf("--%s names a file, which can't be used with a delegate token", element.Flag.Name)
+		}
+		if element.Positional != nil && (fileValueTypes[element.Positional.Tag.Type] || fileValueName.MatchString(element.Positional.Name)) {
+			return "", fmt.Errorf("<%s> names a file, which can't be used with a delegate token", element.Positional.Name)
+		}
+	}
+	return ctx.Command(), nil
+}
+
+/*
+ * Arguments to forward to the daemon, without the ones saying where and how
+ */
+func delegatedArgs(args []string) []string {
+	var forwarded []string
+	for i := 0; i < len(args); i++ {
+		switch {
+		case args[i] == "--delegate-token" || args[i] == "--daemon-address":
+			i++
+		case strings.HasPrefix(args[i], "--delegate-token=") || strings.HasPrefix(args[i], "--daemon-address="):
+		default:
+			forwarded = append(forwarded, args[i])
+		}
+	}
+	return forwarded
+}
+
+/*
+ * The command line as the audit log records it: the arguments given, with the
+ * values of flags tagged secret and the passwords of URLs masked
+ */
+func auditedCommand(ctx *kong.Context) string {
+	flags := map[string]*kong.Flag{}
+	for _, flag := range ctx.Flags() {
+		flags[flag.Name] = flag
+	}
+	var words []string
+	args := os.Args[1:]
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		name, value, hasValue := strings.Cut(strings.TrimPrefix(arg, "--"), "=")
+		if flag := flags[name]; strings.HasPrefix(arg, "--") && flag != nil && flag.Tag.Has("secret") {
+			if hasValue {
+				arg = fmt.Sprintf("--%s=********", name)
+			} else if !flag.IsBool() && i+1 < len(args) {
+				words = append(words, arg, "********")
+				i++
+				continue
+			}
+		} else if u, err := url.Parse(arg); err == nil && u.User != nil {
+			arg = u.Redacted()
+		} else if u, err := url.Parse(value); strings.HasPrefix(arg, "--") && hasValue && err == nil && u.User != nil {
+			arg = fmt.Sprintf("--%s=%s", name, u.Redacted())
+		}
+		words = append(words, arg)
+	}
+	return strings.Join(words, " ")
+}
+
 func main() {
 	var code int = 0
 	ctx := kong.Parse(&CLI)
+	utils.AssumeYes = CLI.Yes
+	utils.NonInteractive = CLI.NonInteractive
+
+	// Helpers with a delegate token have no config of their own, the daemon runs the command
+	if CLI.DelegateToken != "" && !strings.HasPrefix(ctx.Command(), "delegate") && !strings.HasPrefix(ctx.Command(), "daemon") {
+		os.Exit(utils.RunDelegated(CLI.DelegateToken, CLI.DaemonAddress, delegatedArgs(os.Args[1:])))
+	}
+	for _, leaf := range ctx.Model.Leaves(true) {
+		commandPaths = append(commandPaths, leaf.Path())
+	}
+	utils.ParseDelegatedCommand = delegatedCommand
+
+	// Fill the working copy in GUARDIAN_HOME before anything reads it
+	state, err := utils.OpenStateBackend(CLI.StateBackend)
+	if err != nil {
+		log.Fatalf("Invalid --state-backend: %s\n", err)
+		os.Exit(-1)
+	}
+	// Pushing starts a new backend from the local state, loading would replace it
+	if ctx.Command() != "config state push" {
+		if err := state.Load(); err != nil {
+			log.Fatalf("Failed to load state: %s\n", err)
+			os.Exit(-1)
+		}
+	}
+
+	if (CLI.ReadOnly || utils.ReadOnly()) && !readOnlyAllowed(ctx.Command()) {
+		log.Fatalf("Refusing '%s' in read-only mode\n", ctx.Command())
+		os.Exit(-1)
+	}
 
 	// Get the target if it is a filter command
 	target := CLI.Filter.Target
-	if strings.Contains(ctx.Command(), "filter") && target == "" {
+	deployAll := CLI.Filter.Deploy.TargetAll || CLI.Filter.Deploy.Resume
+	// Replication names its targets with --from and --to
+	multiTarget := deployAll || ctx.Command() == "filter replicate"
+	var groupTargets []string
+	if CLI.Filter.TargetGroup != "" {
+		if target != "" || multiTarget {
+			log.Fatalln("--target-group cannot be combined with --target, --target-all, --resume or replicate")
+			os.Exit(-1)
+		}
+		var err error
+		groupTargets, err = utils.GroupMembers(CLI.Filter.TargetGroup)
+		if err != nil {
+			log.Fatalf("Cannot run filter command: %s\n", err)
+			os.Exit(-1)
+		}
+	} else if strings.Contains(ctx.Command(), "filter") && target == "" && !multiTarget {
 		var err error
 		target, err = utils.GetTargetSelection()
 		if err != nil {
-			log.Fatalf("For filter commands, you must either use the '--target' flag, or select a target using 'guardian-cli target select'\n")
+			log.Fatalf("Cannot run filter command: %s\n", err)
+			os.Exit(-1)
+		}
+	}
+	if target != "" {
+		// Make it obvious which target every line of output is about
+		log.SetPrefix(fmt.Sprintf("[%s] ", target))
+	}
+
+	utils.RefreshFacts = CLI.Filter.RefreshFacts
+	utils.AutoRollback = CLI.Filter.Deploy.AutoRollback
+	utils.SkipImagePrecheck = CLI.Filter.Deploy.SkipImagePrecheck || CLI.Target.Setup.SkipImagePrecheck
+	if CLI.Record != "" && CLI.Replay != "" {
+		log.Fatalln("Cannot use --record and --replay together")
+		os.Exit(-1)
+	}
+	utils.RecordFile = CLI.Record
+	utils.StepTimeout = CLI.StepTimeout
+	// The daemon shuts down on its own signal handling
+	if !strings.HasPrefix(ctx.Command(), "daemon") {
+		utils.HandleInterrupts()
+	}
+	utils.ReplayFile = CLI.Replay
+
+	closeOutput := func() error { return nil }
+	if CLI.OutputFile != "" {
+		if !outputCommands[ctx.Command()] {
+			log.Fatalf("'%s' has no output to write to --output-file\n", ctx.Command())
+			os.Exit(-1)
+		}
+		var err error
+		closeOutput, err = utils.OpenOutputFile(CLI.OutputFile)
+		if err != nil {
+			log.Fatal("Failed to open output file: ", err)
 			os.Exit(-1)
 		}
 	}
 
-	switch ctx.Command() {
+	stopProgress := func() {}
+	if CLI.Progress == "json" {
+		stopProgress = utils.StartJsonProgress()
+		// Flushes the output captured so far when a command fails through log.Fatal
+		utils.OnFatal(stopProgress)
+	}
+
+	// Recorded before running too, a failing command usually exits on its own.
+	// Turning read-only mode on or off changes the config like any other command.
+	audited := !readOnlyAllowed(ctx.Command()) || ctx.Command() == "config read-only <mode>"
+	auditCommand := auditedCommand(ctx)
+	auditTarget := target
+	if CLI.Filter.TargetGroup != "" {
+		auditTarget = "group " + CLI.Filter.TargetGroup
+	} else if deployAll {
+		auditTarget = "all targets"
+	}
+	if audited {
+		utils.AuditAction(auditCommand, auditTarget, "started")
+	}
+
+	// What a command changed is saved even when it fails, i.e. the record of a failed deploy
+	saveState := audited && ctx.Command() != "config state push"
+	stateMessage := ctx.Command()
+	if target != "" {
+		stateMessage = fmt.Sprintf("%s (%s)", stateMessage, target)
+	}
+	if saveState {
+		utils.OnFatal(func() {
+			// The logger is held by the log.Fatal
+			if err := state.Save(stateMessage + " (failed)"); err != nil {
+				fmt.Fprintf(os.Stderr, "Failed to save state: %s\n", err)
+			}
+		})
+	}
+	utils.CatchFatal()
+
+	if groupTargets == nil {
+		code = runCommand(ctx.Command(), target, deployAll)
+	}
+	for _, member := range groupTargets {
+		stopOutput := utils.PrefixTargetOutput(member)
+		code = runCommand(ctx.Command(), member, deployAll)
+		stopOutput()
+		if code != 0 {
+			log.Printf("Stopping, group '%s' was only partly changed\n", CLI.Filter.TargetGroup)
+			break
+		}
+	}
+
+	if saveState {
+		message := stateMessage
+		if code != 0 {
+			message += " (failed)"
+		}
+		if err := state.Save(message); err != nil {
+			log.Printf("Failed to save state: %s\n", err)
+			code = -1
+		}
+	}
+
+	if audited {
+		outcome := "success"
+		if code != 0 {
+			outcome = "failure"
+		}
+		utils.AuditAction(auditCommand, auditTarget, outcome)
+	}
+
+	utils.CloseHostConnections()
+	stopProgress()
+	if err := closeOutput(); err != nil {
+		log.Printf("Failed to write output file: %s\n", err)
+		code = -1
+	}
+	os.Exit(code)
+}
+
+/*
+ * Run a command against one target
+ */
+func runCommand(command string, target string, deployAll bool) int {
+	var code int = 0
+	switch command {
+	case "audit log":
+		code = utils.ShowAuditLog(CLI.Audit.Log.Limit)
+	case "audit remote":
+		code = utils.SetRemoteAudit(CLI.Audit.Remote.Syslog, CLI.Audit.Remote.Format, CLI.Audit.Remote.CaFile)
+	case "devtest down":
+		code = utils.DevtestDown(CLI.Devtest.Down.Provider, CLI.Devtest.Down.Cluster)
+	case "devtest run":
+		code = utils.DevtestRun()
+	case "devtest up":
+		code = utils.DevtestUp(CLI.Devtest.Up.Provider, CLI.Devtest.Up.Cluster)
+	case "migrate":
+		code = utils.Migrate(CLI.Migrate.To, CLI.Migrate.Port, CLI.Migrate.RemoteHome)
 	case "target add <name> <host> <username>":
-		code = utils.AddHost(CLI.Target.Add.Name, CLI.Target.Add.Host, CLI.Target.Add.Port, CLI.Target.Add.Username, CLI.Target.Add.NoPassword, CLI.Target.Add.HomePath)
+		code = utils.AddHost(CLI.Target.Add.Name, CLI.Target.Add.Host, CLI.Target.Add.Port, CLI.Target.Add.Username, CLI.Target.Add.NoPassword, CLI.Target.Add.HomePath, CLI.Target.Add.JumpHost, CLI.Target.Add.SkipProbe, CLI.Target.Add.TimeZone, CLI.Target.Add.IdentityFile, CLI.Target.Add.SshProxy, CLI.Target.Add.Preflight)
+	case "target exec <name> <command>":
+		code = utils.ExecOnHost(CLI.Target.Exec.Name, CLI.Target.Exec.Command)
+	case "target port-forward <name> <service> <localport>":
+		code = utils.PortForward(CLI.Target.PortForward.Name, CLI.Target.PortForward.Service, CLI.Target.PortForward.LocalPort, CLI.Target.PortForward.RemotePort)
+	case "target patch <name>":
+		code = utils.PatchHost(CLI.Target.Patch.Name, CLI.Target.Patch.RebootIfNeeded)
+	case "target credentials set <name> <kind>":
+		code = utils.SetCredential(CLI.Target.Credentials.Set.Name, CLI.Target.Credentials.Set.Kind)
+	case "target credentials clear <name>", "target credentials clear <name> <kind>":
+		code = utils.ClearCredentials(CLI.Target.Credentials.Clear.Name, CLI.Target.Credentials.Clear.Kind)
+	case "target dedupe":
+		code = utils.DedupeHosts()
 	case "target update <name> <host> <username>":
 		host := utils.Host{
 			Name:     CLI.Target.Update.Name,
@@ -213,21 +1213,236 @@ func main() {
 			Username: CLI.Target.Update.Username,
 			Port:     CLI.Target.Update.Port,
 			HomePath: CLI.Target.Update.HomePath}
-		code = utils.UpdateHost(CLI.Target.Update.Name, host, CLI.Target.Update.NoPassword)
+		code = utils.UpdateHost(CLI.Target.Update.Name, host, CLI.Target.Update.NoPassword, CLI.Target.Update.JumpHost, CLI.Target.Update.TimeZone, CLI.Target.Update.IdentityFile, CLI.Target.Update.SshProxy)
 	case "target setup <name>":
 		code = utils.Setup(CLI.Target.Setup.Name)
 	case "target delete <name>":
 		code = utils.DeleteHost(CLI.Target.Delete.Name)
+	case "target teardown <name>":
+		code = utils.TeardownHost(CLI.Target.Teardown.Name, CLI.Target.Teardown.KeepData, CLI.Target.Teardown.ForceUnlock)
+	case "target group add <group> <targets>":
+		code = utils.AddToGroup(CLI.Target.Group.Add.Group, CLI.Target.Group.Add.Targets)
+	case "target group create <group>":
+		code = utils.CreateGroup(CLI.Target.Group.Create.Group)
+	case "target group delete <group>":
+		code = utils.DeleteGroup(CLI.Target.Group.Delete.Group)
+	case "target group list":
+		code = utils.ListGroups()
+	case "target group remove <group> <targets>":
+		code = utils.RemoveFromGroup(CLI.Target.Group.Remove.Group, CLI.Target.Group.Remove.Targets)
+	case "target hook add <name> <stage> <command>":
+		code = utils.AddHook(CLI.Target.Hook.Add.Name, CLI.Target.Hook.Add.Stage, CLI.Target.Hook.Add.Command, CLI.Target.Hook.Add.Remote)
+	case "target hook list <name>":
+		code = utils.ListHooks(CLI.Target.Hook.List.Name)
+	case "target hook remove <name> <stage> <command>":
+		code = utils.RemoveHook(CLI.Target.Hook.Remove.Name, CLI.Target.Hook.Remove.Stage, CLI.Target.Hook.Remove.Command)
 	case "target list":
-		code = utils.ListHosts()
+		code = utils.ListHosts(CLI.Target.List.Status)
+	case "target node add <name> <address> <username>":
+		code = utils.AddNode(CLI.Target.Node.Add.Name, CLI.Target.Node.Add.Address, CLI.Target.Node.Add.Username, CLI.Target.Node.Add.Port)
+	case "target node list <name>":
+		code = utils.ListNodes(CLI.Target.Node.List.Name)
+	case "target node remove <name> <node>":
+		code = utils.RemoveNode(CLI.Target.Node.Remove.Name, CLI.Target.Node.Remove.Node)
+	case "target show <name>":
+		code = utils.ShowHost(CLI.Target.Show.Name)
+	case "target status <name>":
+		code = utils.TargetStatus(CLI.Target.Status.Name, CLI.Target.Status.Threshold)
 	case "target reset":
 		code = utils.ResetSsh()
 	case "target test <name>":
 		code = utils.TestSshCommand(CLI.Target.Test.Name)
-	case "target select <name>":
+	case "target select", "target select <name>":
 		code = utils.SelectTargetHost(CLI.Target.Select.Name)
 	case "filter deploy":
-		code = utils.Deploy(target)
+		if deployAll {
+			code = utils.DeployAll(CLI.Filter.Deploy.Message, CLI.Filter.Deploy.ForceUnlock, CLI.Filter.Deploy.Force, CLI.Filter.Deploy.Resume, CLI.Filter.Deploy.SummaryFile)
+		} else {
+			code = utils.Deploy(target, CLI.Filter.Deploy.Message, CLI.Filter.Deploy.ForceUnlock, CLI.Filter.Deploy.Force)
+		}
+	case "filter propose":
+		code = utils.ProposeChanges(target, CLI.Filter.Propose.Message)
+	case "filter approve":
+		code = utils.ApproveProposal(target, CLI.Filter.Approve.Id)
+	case "filter proposals":
+		code = utils.ShowProposals(target, CLI.Filter.Proposals.Id)
+	case "filter stats e2g":
+		code = utils.ShowE2gStats(target, CLI.Filter.Stats.E2g.Enable, CLI.Filter.Stats.E2g.Interval)
+	case "filter connections":
+		code = utils.ShowConnections(target, CLI.Filter.Connections.Client, CLI.Filter.Connections.Watch)
+	case "filter snapshot create <name>":
+		code = utils.CreateSnapshot(target, CLI.Filter.Snapshot.Create.Name, CLI.Filter.Snapshot.Create.Force)
+	case "filter snapshot list":
+		code = utils.ListSnapshots(target)
+	case "filter snapshot restore <name>":
+		code = utils.RestoreSnapshot(target, CLI.Filter.Snapshot.Restore.Name)
+	case "filter snapshot delete <name>":
+		code = utils.DeleteSnapshot(target, CLI.Filter.Snapshot.Delete.Name)
+	case "filter apply":
+		code = utils.ApplyManifest(target, CLI.Filter.Apply.File, CLI.Filter.Apply.Vars, CLI.Filter.Apply.Set, CLI.Filter.Apply.DryRun)
+	case "filter replicate":
+		code = utils.Replicate(CLI.Filter.Replicate.From, CLI.Filter.Replicate.To, CLI.Filter.Replicate.Exclude, CLI.Filter.Replicate.Schedule)
+	case "filter clients add <name> <address>":
+		code = utils.AddClient(target, CLI.Filter.Clients.Add.Name, CLI.Filter.Clients.Add.Address)
+	case "filter clients assign <name>":
+		code = utils.AssignClient(target, CLI.Filter.Clients.Assign.Name, CLI.Filter.Clients.Assign.Group)
+	case "filter clients discover":
+		code = utils.DiscoverClients(target, CLI.Filter.Clients.Discover.DhcpLeases, CLI.Filter.Clients.Discover.Router, CLI.Filter.Clients.Discover.RouterPort)
+	case "filter clients exempt <name>":
+		code = utils.ExemptClient(target, CLI.Filter.Clients.Exempt.Name, CLI.Filter.Clients.Exempt.Duration, CLI.Filter.Clients.Exempt.Revoke)
+	case "filter clients list":
+		code = utils.ListClients(target)
+	case "filter clients remove <name>":
+		code = utils.RemoveClient(target, CLI.Filter.Clients.Remove.Name)
+	case "filter adopt":
+		code = utils.Adopt(target, CLI.Filter.Adopt.Force)
+	case "filter alerts add <name>":
+		code = utils.AddAlert(target, CLI.Filter.Alerts.Add.Name, CLI.Filter.Alerts.Add.On, CLI.Filter.Alerts.Add.Notify, CLI.Filter.Alerts.Add.WebhookUrl, CLI.Filter.Alerts.Add.Email)
+	case "filter alerts list":
+		code = utils.ListAlerts(target)
+	case "filter alerts remove <name>":
+		code = utils.RemoveAlert(target, CLI.Filter.Alerts.Remove.Name)
+	case "filter alerts test <name>":
+		code = utils.TestAlert(target, CLI.Filter.Alerts.Test.Name)
+	case "filter guest disable":
+		code = utils.DisableGuestNetwork(target)
+	case "filter guest enable":
+		code = utils.EnableGuestNetwork(target, CLI.Filter.Guest.Enable.Network, CLI.Filter.Guest.Enable.Policy, CLI.Filter.Guest.Enable.TermsPage)
+	case "filter upstream remove":
+		code = utils.RemoveUpstreamProxy(target)
+	case "filter upstream set":
+		code = utils.SetUpstreamProxy(target, CLI.Filter.Upstream.Set.Proxy, CLI.Filter.Upstream.Set.Auth)
+	case "filter upstream show":
+		code = utils.ShowUpstreamProxy(target)
+	case "filter vpn disable":
+		code = utils.DisableVpn(target)
+	case "filter vpn enable":
+		code = utils.EnableVpn(target, CLI.Filter.Vpn.Enable.Wireguard, CLI.Filter.Vpn.Enable.Port, CLI.Filter.Vpn.Enable.Network, CLI.Filter.Vpn.Enable.Endpoint)
+	case "filter vpn peer add <device>":
+		code = utils.AddVpnPeer(target, CLI.Filter.Vpn.Peer.Add.Device, CLI.Filter.Vpn.Peer.Add.Output)
+	case "filter vpn peer list":
+		code = utils.ListVpnPeers(target)
+	case "filter vpn peer remove <device>":
+		code = utils.RemoveVpnPeer(target, CLI.Filter.Vpn.Peer.Remove.Device)
+	case "filter web disable":
+		code = utils.DisableWeb(target)
+	case "filter web enable":
+		code = utils.EnableWeb(target, CLI.Filter.Web.Enable.Hostname, CLI.Filter.Web.Enable.Port)
+	case "filter web status":
+		code = utils.ShowWebStatus(target)
+	case "filter web users add <name>":
+		code = utils.AddWebUser(target, CLI.Filter.Web.Users.Add.Name, CLI.Filter.Web.Users.Add.Role)
+	case "filter web users list":
+		code = utils.ListWebUsers(target)
+	case "filter web users remove <name>":
+		code = utils.RemoveWebUser(target, CLI.Filter.Web.Users.Remove.Name)
+	case "filter export-e2g":
+		code = utils.ExportE2guardian(target, CLI.Filter.ExportE2g.Output)
+	case "filter import-e2g":
+		code = utils.ImportE2guardian(target, CLI.Filter.ImportE2g.Path, CLI.Filter.ImportE2g.Remote)
+	case "filter decrypt exempt-client <client>":
+		code = utils.ExemptClientFromDecryption(target, CLI.Filter.Decrypt.ExemptClient.Client, CLI.Filter.Decrypt.ExemptClient.Revoke)
+	case "filter decrypt exclusions add <domain>":
+		code = utils.AddDecryptExclusions(target, CLI.Filter.Decrypt.Exclusions.Add.Domain)
+	case "filter decrypt exclusions enable":
+		code = utils.EnableDecryptExclusions(target, CLI.Filter.Decrypt.Exclusions.Enable.Preset)
+	case "filter decrypt exclusions list":
+		code = utils.ListDecryptExclusions(target)
+	case "filter decrypt exclusions remove <domain>":
+		code = utils.RemoveDecryptExclusion(target, CLI.Filter.Decrypt.Exclusions.Remove.Domain)
+	case "filter decrypt exclusions update":
+		code = utils.UpdateDecryptExclusions(target)
+	case "filter downloads set":
+		set := CLI.Filter.Downloads.Set
+		code = utils.SetDownloads(target, set.MaxSize, set.BlanketBlock, set.BlockExtensions, set.ExceptionExtensions, set.ScanExtensions)
+	case "filter lists fix-includes":
+		code = utils.FixIncludes(target, CLI.Filter.Lists.FixIncludes.DryRun)
+	case "filter lists migrate":
+		code = utils.MigratePhraseLists(target, CLI.Filter.Lists.Migrate.DryRun)
+	case "filter lint":
+		code = utils.Lint(target)
+	case "filter doctor":
+		code = utils.Doctor(target)
+	case "filter downloads show":
+		code = utils.ShowDownloads(target)
+	case "filter scanner add <type>":
+		code = utils.AddScanner(target, CLI.Filter.Scanner.Add.Type, CLI.Filter.Scanner.Add.Name, CLI.Filter.Scanner.Add.Url)
+	case "filter scanner disable <name>":
+		code = utils.ToggleScanner(target, CLI.Filter.Scanner.Disable.Name, CLI.Filter.Scanner.Disable.Group, false)
+	case "filter scanner enable <name>":
+		code = utils.ToggleScanner(target, CLI.Filter.Scanner.Enable.Name, CLI.Filter.Scanner.Enable.Group, true)
+	case "filter scanner list":
+		code = utils.ListScanners(target)
+	case "filter scanner remove <name>":
+		code = utils.RemoveScanner(target, CLI.Filter.Scanner.Remove.Name)
+	case "filter squid remove":
+		code = utils.RemoveSquidSnippet(target)
+	case "filter squid set-snippet":
+		code = utils.SetSquidSnippet(target, CLI.Filter.Squid.SetSnippet.File)
+	case "filter squid show":
+		code = utils.ShowSquidSnippet(target)
+	case "filter report compliance":
+		code = utils.ComplianceReport(target, CLI.Filter.Report.Compliance.Output)
+	case "filter report list":
+		code = utils.ListReportSchedules(target)
+	case "filter report schedule <name>":
+		frequency := "weekly"
+		if CLI.Filter.Report.Schedule.Daily {
+			frequency = "daily"
+		} else if CLI.Filter.Report.Schedule.Monthly {
+			frequency = "monthly"
+		}
+		code = utils.ScheduleReport(target, CLI.Filter.Report.Schedule.Name, frequency, CLI.Filter.Report.Schedule.Email, CLI.Filter.Report.Schedule.Template)
+	case "filter report smtp":
+		code = utils.ConfigureSmtp(target, CLI.Filter.Report.Smtp.Server, CLI.Filter.Report.Smtp.From, CLI.Filter.Report.Smtp.Username)
+	case "filter report search-terms":
+		code = utils.ReportSearchTerms(target, CLI.Filter.Report.SearchTerms.Client, CLI.Filter.Report.SearchTerms.Since, CLI.Filter.Report.SearchTerms.Json)
+	case "filter search-terms disable":
+		code = utils.DisableSearchTerms(target)
+	case "filter search-terms enable":
+		code = utils.EnableSearchTerms(target, CLI.Filter.SearchTerms.Enable.WatchWord, CLI.Filter.SearchTerms.Enable.AlertEmail)
+	case "filter report unschedule <name>":
+		code = utils.UnscheduleReport(target, CLI.Filter.Report.Unschedule.Name)
+	case "filter stop":
+		code = utils.StopFilter(target, CLI.Filter.Stop.DnsPassthrough)
+	case "filter debug <state>":
+		code = utils.SetDebug(target, CLI.Filter.Debug.State, CLI.Filter.Debug.Component, CLI.Filter.Debug.RevertAfter)
+	case "filter probes clear":
+		code = utils.ClearProbes(target)
+	case "filter probes set":
+		code = utils.SetProbes(target, CLI.Filter.Probes.Set.Allowed, CLI.Filter.Probes.Set.Blocked, CLI.Filter.Probes.Set.Every)
+	case "filter probes status":
+		code = utils.ShowProbes(target)
+	case "filter profile apply <profile>":
+		code = utils.ApplyProfile(target, CLI.Filter.Profile.Apply.Profile, CLI.Filter.Profile.Apply.DryRun)
+	case "filter start":
+		code = utils.StartFilter(target)
+	case "filter uninstall":
+		code = utils.Uninstall(target, CLI.Filter.Uninstall.ForceUnlock)
+	case "filter drift":
+		code = utils.ShowDrift(target)
+	case "filter storage status":
+		code = utils.ShowStorageStatus(target, CLI.Filter.Storage.Status.Threshold)
+	case "filter db maintain":
+		code = utils.MaintainDb(target, CLI.Filter.Db.Maintain.Schedule)
+	case "filter db tune":
+		code = utils.TuneDb(target, CLI.Filter.Db.Tune.MaxConnections, CLI.Filter.Db.Tune.PoolSize, CLI.Filter.Db.Tune.SharedBuffers, CLI.Filter.Db.Tune.MemoryLimit)
+	case "filter redis tune":
+		code = utils.TuneRedis(target, CLI.Filter.Redis.Tune.MaxMemory, CLI.Filter.Redis.Tune.EvictionPolicy, CLI.Filter.Redis.Tune.Persistence, CLI.Filter.Redis.Tune.MemoryLimit)
+	case "filter ha disable":
+		code = utils.DisableHighAvailability(target)
+	case "filter ha enable":
+		code = utils.EnableHighAvailability(target, CLI.Filter.Ha.Enable.Replicas, CLI.Filter.Ha.Enable.Soft)
+	case "filter network ipv6 disable":
+		code = utils.DisableIpv6(target)
+	case "filter network ipv6 enable":
+		code = utils.EnableIpv6(target, CLI.Filter.Network.Ipv6.Enable.LanCidr, CLI.Filter.Network.Ipv6.Enable.Aaaa)
+	case "filter history":
+		code = utils.ShowDeployHistory(target, CLI.Filter.History.Limit)
+	case "filter pac generate":
+		code = utils.GeneratePac(target, CLI.Filter.Pac.Generate.DirectDomains, CLI.Filter.Pac.Generate.Output, CLI.Filter.Pac.Generate.Serve)
+	case "filter pac remove":
+		code = utils.RemovePac(target)
 	case "filter phrase-list add-list <name>":
 		code = utils.AddPhraseList(CLI.Filter.PhraseList.AddList.Name, CLI.Filter.PhraseList.AddList.Weighted, target)
 	case "filter phrase-list remove-list <name>":
@@ -253,7 +1468,12 @@ func main() {
 	case "filter phrase-list clear <name>":
 		code = utils.DeletePhraseIncludes(CLI.Filter.PhraseList.Clear.Name, target)
 	case "filter phrase-list show":
-		code = utils.ShowPhraseList(CLI.Filter.PhraseList.Show.Name, target, CLI.Filter.PhraseList.Show.Group)
+		opts := utils.ShowOptions{
+			Limit:   CLI.Filter.PhraseList.Show.Limit,
+			Offset:  CLI.Filter.PhraseList.Show.Offset,
+			Pattern: CLI.Filter.PhraseList.Show.Pattern,
+		}
+		code = utils.ShowPhraseList(CLI.Filter.PhraseList.Show.Name, target, CLI.Filter.PhraseList.Show.Group, opts)
 	case "filter content-list add-list <type> <name>":
 		valid := false
 		for _, t := range utils.ListTypes {
@@ -282,21 +1502,46 @@ func main() {
 	case "filter safe-search <command>":
 		code = utils.SafeSearch(CLI.Filter.SafeSearch.Command, target)
 	case "filter content-list show":
-		code = utils.ShowContentList(CLI.Filter.ContentList.Show.Name, target, CLI.Filter.ContentList.Show.Group)
+		opts := utils.ShowOptions{
+			Limit:   CLI.Filter.ContentList.Show.Limit,
+			Offset:  CLI.Filter.ContentList.Show.Offset,
+			Pattern: CLI.Filter.ContentList.Show.Pattern,
+		}
+		code = utils.ShowContentList(CLI.Filter.ContentList.Show.Name, target, CLI.Filter.ContentList.Show.Group, opts)
 	case "filter acl add <category> <action>":
-		code = utils.AddAclRule(CLI.Filter.Acl.AddRule.Category, CLI.Filter.Acl.AddRule.Action, target, CLI.Filter.Acl.AddRule.Position)
+		code = utils.AddAclRule(CLI.Filter.Acl.AddRule.Category, CLI.Filter.Acl.AddRule.Action, target, CLI.Filter.Acl.AddRule.Position, CLI.Filter.Acl.AddRule.Create || CLI.Filter.Acl.AddRule.Force)
 	case "filter acl delete <category> <action>":
 		code = utils.DeleteAclRule(CLI.Filter.Acl.DeleteRule.Category, CLI.Filter.Acl.DeleteRule.Action, target)
 	case "filter acl show":
 		code = utils.ShowAclRules(target)
-	case "filter acl categorize-domain <category> <domain>":
-		code = utils.Categorize(target, CLI.Filter.Acl.CategorizeDomain.Domain, CLI.Filter.Acl.CategorizeDomain.Category)
-	case "filter acl decategorize-domain <category> <domain>":
-		code = utils.DeCategorize(target, CLI.Filter.Acl.DecategorizeDomain.Domain, CLI.Filter.Acl.DecategorizeDomain.Category)
+	case "filter acl add-geo <country-code> <action>":
+		code = utils.AddGeoRule(target, CLI.Filter.Acl.AddGeo.Country, CLI.Filter.Acl.AddGeo.Action, CLI.Filter.Acl.AddGeo.Direction)
+	case "filter acl delete-geo <country-code>":
+		code = utils.DeleteGeoRule(target, CLI.Filter.Acl.DeleteGeo.Country)
+	case "filter acl block-new-domains":
+		if CLI.Filter.Acl.BlockNewDomains.Disable {
+			code = utils.UnblockNewDomains(target)
+		} else {
+			code = utils.BlockNewDomains(target, CLI.Filter.Acl.BlockNewDomains.Age, CLI.Filter.Acl.BlockNewDomains.FeedUrl)
+		}
+	case "filter acl homograph-protection <mode>":
+		code = utils.HomographProtection(target, CLI.Filter.Acl.HomographProtection.Mode == "on")
+	case "filter acl geo update":
+		code = utils.UpdateGeoDatabase(target, CLI.Filter.Acl.Geo.Update.Url)
+	case "filter acl categorize-domain <category> <domain>", "filter acl categorize-domain <category>":
+		domains := utils.ReadDomains(CLI.Filter.Acl.CategorizeDomain.Domain, CLI.Filter.Acl.CategorizeDomain.FromFile)
+		code = utils.CategorizeDomains(target, domains, CLI.Filter.Acl.CategorizeDomain.Category, CLI.Filter.Acl.CategorizeDomain.Create)
+	case "filter acl decategorize-domain <category> <domain>", "filter acl decategorize-domain <category>":
+		domains := utils.ReadDomains(CLI.Filter.Acl.DecategorizeDomain.Domain, CLI.Filter.Acl.DecategorizeDomain.FromFile)
+		code = utils.DeCategorize(target, domains, CLI.Filter.Acl.DecategorizeDomain.Category)
 	case "filter acl delete-category <category>":
 		code = utils.DeleteCategory(target, CLI.Filter.Acl.DeleteCategory.Category)
 	case "filter acl clear-database <category>":
 		code = utils.ClearAll(target)
+	case "filter acl suggest":
+		code = utils.SuggestCategories(target, CLI.Filter.Acl.Suggest.Since, CLI.Filter.Acl.Suggest.Limit, CLI.Filter.Acl.Suggest.Json)
+	case "filter acl categories sync-builtin":
+		code = utils.SyncBuiltinCategories(target)
 	case "filter acl list-categories":
 		code = utils.ListCategory(target, CLI.Filter.Acl.ListCategories.Domain)
 	case "filter acl upload":
@@ -309,8 +1554,50 @@ func main() {
 		code = utils.SetupCertificate(target, CLI.Filter.Certificate.Configure.CommonName, CLI.Filter.Certificate.Configure.Organization, CLI.Filter.Certificate.Configure.Country, CLI.Filter.Certificate.Configure.State, CLI.Filter.Certificate.Configure.Locality)
 	case "filter certificate get-root-ca":
 		code = utils.CopyRootCa(target, CLI.Filter.Certificate.GetRootCa.Output)
+	case "filter certificate serve-ca":
+		code = utils.ServeRootCa(target, CLI.Filter.Certificate.ServeCa.Port, CLI.Filter.Certificate.ServeCa.Duration)
+	case "daemon", "daemon <targets>":
+		code = utils.RunDaemon(CLI.Daemon.Targets, CLI.Daemon.Listen)
+	case "delegate create":
+		code = utils.CreateDelegate(CLI.Delegate.Create.Allow, CLI.Delegate.Create.Expires, CLI.Delegate.Create.Name, commandPaths)
+	case "delegate list":
+		code = utils.ListDelegates()
+	case "delegate revoke <id>":
+		code = utils.RevokeDelegate(CLI.Delegate.Revoke.Id)
+	case "filter threat-feed enable":
+		code = utils.EnableThreatFeeds(target, CLI.Filter.ThreatFeed.Enable.Feeds, CLI.Filter.ThreatFeed.Enable.Refresh)
+	case "filter threat-feed disable":
+		code = utils.DisableThreatFeeds(target)
+	case "filter threat-feed update":
+		code = utils.UpdateThreatFeeds(target)
+	case "filter blockpage language set <locale>":
+		code = utils.SetBlockPageLanguage(target, CLI.Filter.Blockpage.Language.Set.Locale)
+	case "filter blockpage language import <name> <file>":
+		code = utils.ImportBlockPageTranslation(target, CLI.Filter.Blockpage.Language.Import.Name, CLI.Filter.Blockpage.Language.Import.File)
+	case "filter blockpage language list":
+		code = utils.ListBlockPageLanguages(target)
+	case "filter blockpage language remove <name>":
+		code = utils.RemoveBlockPageTranslation(target, CLI.Filter.Blockpage.Language.Remove.Name)
+	case "filter test-url <url>":
+		code = utils.TestUrl(target, CLI.Filter.TestUrl.Url)
+	case "config approvers", "config approvers <users>":
+		code = utils.SetApprovers(CLI.Config.Approvers.Users)
+	case "config ssh-proxy", "config ssh-proxy <url>":
+		code = utils.SetSshProxy(CLI.Config.SshProxy.Url)
+	case "config ssh-key-passphrase":
+		code = utils.SetKeyPassphrase()
+	case "config deploy-gate":
+		code = utils.SetDeployGate(CLI.Config.DeployGate.Url, CLI.Config.DeployGate.Key)
+	case "config categorizer":
+		code = utils.SetCategorizer(CLI.Config.Categorizer.Url, CLI.Config.Categorizer.Key)
 	case "config import":
 		code = utils.ImportConfigs(CLI.Config.Import.Input)
+	case "config read-only <mode>":
+		code = utils.SetReadOnly(CLI.Config.ReadOnly.Mode == "on")
+	case "config local-store <store>":
+		code = utils.SetLocalStore(CLI.Config.LocalStore.Store)
+	case "config state push":
+		code = utils.PushState(CLI.StateBackend)
 	case "config export":
 		code = utils.ExportConfigs(CLI.Config.Export.Output)
 	default:
@@ -318,5 +1605,5 @@ func main() {
 		code = -1
 	}
 
-	os.Exit(code)
+	return code
 }
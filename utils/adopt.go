@@ -0,0 +1,92 @@
+package utils
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+
+	"gopkg.in/yaml.v2"
+)
+
+/*
+ * Rebuild the local overrides of a target from its live guardian-angel release,
+ * so a stack deployed by hand or from another workstation can be managed here
+ */
+func Adopt(targetName string, force bool) int {
+
+	config, err := loadConfig()
+	if err != nil {
+		log.Fatal("Failed to load config: ", err)
+		return -1
+	}
+
+	_, host := FindHost(config, targetName)
+	if host.Name != targetName {
+		log.Fatalf("Host %s doesn't exist, create it first", targetName)
+		return -1
+	}
+
+	if _, err := os.Stat(getHostFilterConfigPath(targetName)); err == nil && !force {
+		log.Fatalf("Target '%s' already has local overrides; use --force to replace them\n", targetName)
+		return -1
+	}
+
+	deployedValues, err := runHostCommands(host, []string{
+		"export KUBECONFIG=/etc/rancher/k3s/k3s.yaml",
+		"helm get values -n filter guardian-angel -o yaml",
+	}, false)
+	if err != nil {
+		log.Fatal("Failed to read the guardian-angel release, is it deployed? ", err)
+		return -1
+	}
+
+	err = checkoutHelm(false)
+	if err != nil {
+		log.Fatal("Failed to check out helm chart: ", err)
+		return -1
+	}
+
+	// Deployed values are overrides of the chart defaults
+	filterConfig, err := loadDefaultFilterConfig()
+	if err != nil {
+		log.Fatal("Failed to load chart defaults: ", err)
+		return -1
+	}
+	err = yaml.Unmarshal([]byte(deployedValues), &filterConfig)
+	if err != nil {
+		log.Fatal("Failed to parse deployed values: ", err)
+		return -1
+	}
+
+	if filterConfig.MasterNode == "" {
+		facts, err := getClusterFacts(host)
+		if err != nil {
+			log.Fatal("Failed to get cluster facts: ", err)
+			return -1
+		}
+		filterConfig.MasterNode = facts.MasterNode
+	}
+	if filterConfig.VolumePath == "" {
+		filterConfig.VolumePath = getHostVolumePath(host)
+	}
+	if filterConfig.JwtPassword == "" || filterConfig.DbPassword == "" || filterConfig.RedisPassword == "" {
+		log.Println("Warning: the release doesn't carry all service passwords; set them in the overrides before deploying")
+	}
+
+	os.MkdirAll(getHostDataDir(targetName), privateDirMode)
+	err = writeHostFilterConfig(targetName, filterConfig)
+	if err != nil {
+		log.Fatal("Failed to write host config: ", err)
+		return -1
+	}
+
+	caCertData, err := GetRootCa(targetName)
+	if err != nil {
+		log.Printf("Failed to fetch the root CA: %s\n", err)
+	} else if err = ioutil.WriteFile(getCaPathDir(targetName), []byte(caCertData), 0o644); err != nil {
+		log.Printf("Failed to write ca certificate to disk: %s\n", err)
+	}
+
+	log.Printf("Adopted the guardian-angel deployment on '%s'; check 'filter drift' before the next deploy\n", targetName)
+	return 0
+}
@@ -0,0 +1,249 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/mail"
+	"net/smtp"
+	"net/url"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// blocked-category: a request was denied by a category rule
+// blocked-domain: a request to a specific domain was denied
+// search-term: a search contained the given word
+// probe-failed: a canary probe of the given url, or of any url, failed
+var AlertEvents = []string{"blocked-category", "blocked-domain", "search-term", "probe-failed"}
+
+var AlertNotifiers = []string{"webhook", "email"}
+
+type AlertRule struct {
+	Name  string `yaml:"name"`
+	Event string `yaml:"event"`
+	Value string `yaml:"value"`
+	// webhook or email
+	Notify     string   `yaml:"notify"`
+	WebhookUrl string   `yaml:"webhookUrl,omitempty"`
+	Recipients []string `yaml:"recipients,omitempty"`
+}
+
+type alertPayload struct {
+	Alert  string `json:"alert"`
+	Target string `json:"target"`
+	Event  string `json:"event"`
+	Value  string `json:"value"`
+	Client string `json:"client"`
+	Url    string `json:"url"`
+	Time   string `json:"time"`
+	Test   bool   `json:"test,omitempty"`
+}
+
+func (config *FilterConfig) findAlert(name string) *AlertRule {
+	for i := range config.Alerts {
+		alert := &config.Alerts[i]
+		if alert.Name == name {
+			return alert
+		}
+	}
+	return nil
+}
+
+/*
+ * Parse an event condition, i.e. blocked-category=self-harm
+ */
+func parseAlertCondition(condition string) (string, string, error) {
+	parts := strings.SplitN(condition, "=", 2)
+	if len(parts) != 2 || parts[1] == "" {
+		return "", "", fmt.Errorf("invalid condition '%s', expected <event>=<value>", condition)
+	}
+	if !contains(AlertEvents, parts[0]) {
+		return "", "", fmt.Errorf("invalid event '%s', valid options are %s", parts[0], strings.Join(AlertEvents, ", "))
+	}
+	return parts[0], parts[1], nil
+}
+
+func AddAlert(targetName string, name string, condition string, notify string, webhookUrl string, recipients []string) int {
+
+	event, value, err := parseAlertCondition(condition)
+	if err != nil {
+		log.Fatal(err)
+		return -1
+	}
+
+	alert := AlertRule{Name: name, Event: event, Value: value, Notify: notify}
+	switch notify {
+	case "webhook":
+		if u, err := url.Parse(webhookUrl); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			log.Fatalf("Webhook alerts need a valid --webhook-url\n")
+			return -1
+		}
+		alert.WebhookUrl = webhookUrl
+	case "email":
+		if len(recipients) == 0 {
+			log.Fatalln("Email alerts need at least one --email recipient")
+			return -1
+		}
+		for _, recipient := range recipients {
+			if _, err := mail.ParseAddress(recipient); err != nil {
+				log.Fatalf("Invalid email address '%s'\n", recipient)
+				return -1
+			}
+		}
+		alert.Recipients = recipients
+	default:
+		log.Fatalf("Invalid notifier '%s', valid options are %s\n", notify, strings.Join(AlertNotifiers, ", "))
+		return -1
+	}
+
+	config, err := getHostFilterConfig(targetName)
+	if err != nil {
+		log.Fatal("Failed to get host config: ", err)
+		return -1
+	}
+
+	if config.findAlert(name) != nil {
+		log.Fatalf("Alert '%s' already exists\n", name)
+		return -1
+	}
+	if notify == "email" && config.Smtp.Server == "" {
+		log.Println("Warning: no SMTP server configured; use 'filter report smtp' before deploying")
+	}
+
+	config.Alerts = append(config.Alerts, alert)
+
+	err = writeHostFilterConfig(targetName, config)
+	if err != nil {
+		log.Fatal("Failed to write host config: ", err)
+		return -1
+	}
+
+	log.Printf("Added alert '%s' on %s=%s\n", name, event, value)
+	return 0
+}
+
+func RemoveAlert(targetName string, name string) int {
+
+	config, err := getHostFilterConfig(targetName)
+	if err != nil {
+		log.Fatal("Failed to get host config: ", err)
+		return -1
+	}
+
+	for i := range config.Alerts {
+		if config.Alerts[i].Name == name {
+			config.Alerts = append(config.Alerts[:i], config.Alerts[i+1:]...)
+			err = writeHostFilterConfig(targetName, config)
+			if err != nil {
+				log.Fatal("Failed to write host config: ", err)
+				return -1
+			}
+			log.Printf("Removed alert '%s'\n", name)
+			return 0
+		}
+	}
+
+	log.Fatalf("Alert '%s' does not exist\n", name)
+	return -1
+}
+
+func ListAlerts(targetName string) int {
+
+	config, err := getHostFilterConfig(targetName)
+	if err != nil {
+		log.Fatal("Failed to get host config: ", err)
+		return -1
+	}
+
+	w := tabwriter.NewWriter(showOutput(), 1, 1, 3, ' ', 0)
+	fmt.Fprintln(w, "Name\tOn\tNotify\tDestination")
+	for _, alert := range config.Alerts {
+		destination := alert.WebhookUrl
+		if alert.Notify == "email" {
+			destination = strings.Join(alert.Recipients, ", ")
+		}
+		fmt.Fprintf(w, "%s\t%s=%s\t%s\t%s\n", alert.Name, alert.Event, alert.Value, alert.Notify, destination)
+	}
+	w.Flush()
+
+	return 0
+}
+
+func sendWebhookAlert(alert AlertRule, payload alertPayload) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Post(alert.WebhookUrl, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer closeResponse(resp)
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("received code %d from webhook", resp.StatusCode)
+	}
+	return nil
+}
+
+func sendEmailAlert(smtpConfig SmtpConfig, alert AlertRule, payload alertPayload) error {
+	if smtpConfig.Server == "" {
+		return fmt.Errorf("no SMTP server configured")
+	}
+	var auth smtp.Auth
+	if smtpConfig.Username != "" {
+		host, _, _ := net.SplitHostPort(smtpConfig.Server)
+		auth = smtp.PlainAuth("", smtpConfig.Username, smtpConfig.Password, host)
+	}
+	message := fmt.Sprintf("From: %s\r\nTo: %s\r\nSubject: [guardian] %s alert on %s\r\n\r\n%s=%s\r\nClient: %s\r\nURL: %s\r\nTime: %s\r\n",
+		smtpConfig.From, strings.Join(alert.Recipients, ", "), alert.Name, payload.Target,
+		payload.Event, payload.Value, payload.Client, payload.Url, payload.Time)
+	return smtp.SendMail(smtpConfig.Server, auth, smtpConfig.From, alert.Recipients, []byte(message))
+}
+
+/*
+ * Send a sample notification through an alert's notifier
+ */
+func TestAlert(targetName string, name string) int {
+
+	config, err := getHostFilterConfig(targetName)
+	if err != nil {
+		log.Fatal("Failed to get host config: ", err)
+		return -1
+	}
+
+	alert := config.findAlert(name)
+	if alert == nil {
+		log.Fatalf("Alert '%s' does not exist\n", name)
+		return -1
+	}
+
+	payload := alertPayload{
+		Alert:  alert.Name,
+		Target: targetName,
+		Event:  alert.Event,
+		Value:  alert.Value,
+		Client: "192.0.2.1",
+		Url:    "http://example.com/",
+		Time:   time.Now().Format(time.RFC3339),
+		Test:   true,
+	}
+
+	if alert.Notify == "webhook" {
+		err = sendWebhookAlert(*alert, payload)
+	} else {
+		err = sendEmailAlert(config.Smtp, *alert, payload)
+	}
+	if err != nil {
+		log.Fatal("Failed to send test alert: ", err)
+		return -1
+	}
+
+	log.Printf("Sent test alert '%s' via %s\n", name, alert.Notify)
+	return 0
+}
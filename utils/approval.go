@@ -0,0 +1,451 @@
+package utils
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+/*
+ * Pending change to a target's policy, waiting for review. It carries the
+ * complete overrides to apply and the changes they make to the deployed ones.
+ */
+type Proposal struct {
+	Id      int
+	Author  string
+	Time    time.Time
+	Message string `json:",omitempty"`
+	// Hash of the overrides last deployed when proposed, approving is refused once they moved on
+	BaseHash string `json:",omitempty"`
+	Changes  []ProposedChange
+	// The overrides.yaml the proposal applies
+	Overrides string
+	// pending or approved
+	Status     string
+	Approver   string `json:",omitempty"`
+	ApprovedAt time.Time
+	// Hash of the overrides once applied, deploys of exactly these are allowed
+	AppliedHash string `json:",omitempty"`
+}
+
+type ProposedChange struct {
+	Key string `json:"key"`
+	Old string `json:"old"`
+	New string `json:"new"`
+}
+
+func getProposalDir(name string) string {
+	return filepath.Join(getHostDataDir(name), "proposals")
+}
+
+func getProposalPath(name string, id int) string {
+	return filepath.Join(getProposalDir(name), fmt.Sprintf("%d.json", id))
+}
+
+func loadProposal(name string, id int) (Proposal, error) {
+	var proposal Proposal
+	data, err := ioutil.ReadFile(getProposalPath(name, id))
+	if os.IsNotExist(err) {
+		return proposal, fmt.Errorf("proposal #%d of '%s' does not exist", id, name)
+	} else if err != nil {
+		return proposal, err
+	}
+	err = json.Unmarshal(data, &proposal)
+	return proposal, err
+}
+
+/*
+ * All proposals of a target, oldest first
+ */
+func loadProposals(name string) ([]Proposal, error) {
+	entries, err := ioutil.ReadDir(getProposalDir(name))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var proposals []Proposal
+	for _, entry := range entries {
+		id, err := strconv.Atoi(strings.TrimSuffix(entry.Name(), ".json"))
+		if err != nil || !strings.HasSuffix(entry.Name(), ".json") {
+			continue
+		}
+		proposal, err := loadProposal(name, id)
+		if err != nil {
+			return nil, err
+		}
+		proposals = append(proposals, proposal)
+	}
+	sort.Slice(proposals, func(i, j int) bool { return proposals[i].Id < proposals[j].Id })
+	return proposals, nil
+}
+
+func saveProposal(name string, proposal Proposal) error {
+	data, err := json.MarshalIndent(proposal, "", "  ")
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(getProposalDir(name), privateDirMode)
+	if err != nil {
+		return err
+	}
+	// Overrides hold the database and API passwords
+	f, err := createPrivateFile(getProposalPath(name, proposal.Id))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = f.Write(data)
+	return err
+}
+
+/*
+ * Hash of the overrides of the target's last successful deploy, empty if there was none
+ */
+func lastDeployedHash(name string) (string, error) {
+	records, err := loadDeployHistory(name, 0)
+	if err != nil {
+		return "", err
+	}
+	for i := len(records) - 1; i >= 0; i-- {
+		if records[i].Result == "success" {
+			return records[i].OverridesHash, nil
+		}
+	}
+	return "", nil
+}
+
+/*
+ * Refuse to deploy overrides nobody approved, when approvers are configured.
+ * Redeploying what was last deployed needs no new approval.
+ */
+func checkDeployApproved(name string) error {
+	config, err := loadConfig()
+	if err != nil || len(config.Approvers) == 0 {
+		return err
+	}
+	hash, err := hashHostFilterConfig(name)
+	if err != nil {
+		return err
+	}
+	deployed, err := lastDeployedHash(name)
+	if err != nil {
+		return err
+	}
+	if hash == deployed {
+		return nil
+	}
+	proposals, err := loadProposals(name)
+	if err != nil {
+		return err
+	}
+	for _, proposal := range proposals {
+		if proposal.Status == "approved" && proposal.AppliedHash == hash {
+			return nil
+		}
+	}
+	return fmt.Errorf("changes to '%s' need approval: run 'filter propose', then have one of %s run 'filter approve --id N'",
+		name, strings.Join(config.Approvers, ", "))
+}
+
+/*
+ * Changes the local overrides make to the values deployed on the target
+ */
+func overridesChanges(host Host, overrides []byte) ([]ProposedChange, error) {
+	local, err := parseFlatValues(overrides)
+	if err != nil {
+		return nil, err
+	}
+	deployed, err := getDeployedValues(host)
+	if err != nil {
+		log.Printf("Comparing with empty values, nothing is deployed on the target yet: %s\n", err)
+		deployed = map[string]interface{}{}
+	}
+
+	keys := map[string]bool{}
+	for key := range local {
+		keys[key] = true
+	}
+	for key := range deployed {
+		keys[key] = true
+	}
+	var changes []ProposedChange
+	for key := range keys {
+		if key == "revision" || reflect.DeepEqual(local[key], deployed[key]) {
+			continue
+		}
+		oldValue, inDeployed := deployed[key]
+		newValue, inLocal := local[key]
+		changes = append(changes, ProposedChange{
+			Key: key,
+			Old: formatDriftValue(redactValue(key, oldValue), inDeployed),
+			New: formatDriftValue(redactValue(key, newValue), inLocal),
+		})
+	}
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Key < changes[j].Key })
+	return changes, nil
+}
+
+/*
+ * Record the target's local overrides as a proposal for review instead of deploying them
+ */
+func ProposeChanges(targetName string, message string) int {
+
+	config, err := loadConfig()
+	if err != nil {
+		log.Fatal("Failed to load config: ", err)
+		return -1
+	}
+
+	_, host := FindHost(config, targetName)
+	if host.Name != targetName {
+		log.Fatalf("Host %s doesn't exist, create it first", targetName)
+		return -1
+	}
+
+	overrides, err := ioutil.ReadFile(getHostFilterConfigPath(targetName))
+	if err != nil {
+		log.Fatal("Failed to read host config: ", err)
+		return -1
+	}
+	// Compared as a deploy would render them
+	rendered, err := renderDeployOverrides(targetName)
+	if err != nil {
+		log.Fatal("Failed to read host config: ", err)
+		return -1
+	}
+
+	changes, err := overridesChanges(host, rendered)
+	if err != nil {
+		log.Fatal("Failed to compare with the deployed values: ", err)
+		return -1
+	}
+	if len(changes) == 0 {
+		log.Println("Nothing to propose: the local overrides match the deployed values")
+		return 0
+	}
+
+	baseHash, err := lastDeployedHash(targetName)
+	if err != nil {
+		log.Fatal("Failed to read deploy history: ", err)
+		return -1
+	}
+
+	proposals, err := loadProposals(targetName)
+	if err != nil {
+		log.Fatal("Failed to read proposals: ", err)
+		return -1
+	}
+	id := 1
+	if len(proposals) > 0 {
+		id = proposals[len(proposals)-1].Id + 1
+	}
+
+	proposal := Proposal{
+		Id:        id,
+		Author:    getOperator(),
+		Time:      time.Now().UTC(),
+		Message:   message,
+		BaseHash:  baseHash,
+		Changes:   changes,
+		Overrides: string(overrides),
+		Status:    "pending",
+	}
+	err = saveProposal(targetName, proposal)
+	if err != nil {
+		log.Fatal("Failed to save proposal: ", err)
+		return -1
+	}
+
+	log.Printf("Recorded proposal #%d with %d change(s); 'filter approve --id %d' applies and deploys it\n", id, len(changes), id)
+	return 0
+}
+
+/*
+ * Apply a proposal to the target's overrides and deploy them
+ */
+func ApproveProposal(targetName string, id int) int {
+
+	config, err := loadConfig()
+	if err != nil {
+		log.Fatal("Failed to load config: ", err)
+		return -1
+	}
+
+	_, host := FindHost(config, targetName)
+	if host.Name != targetName {
+		log.Fatalf("Host %s doesn't exist, create it first", targetName)
+		return -1
+	}
+
+	proposal, err := loadProposal(targetName, id)
+	if err != nil {
+		log.Fatal(err)
+		return -1
+	}
+	if proposal.Status != "pending" {
+		log.Fatalf("Proposal #%d was already %s by %s\n", id, proposal.Status, proposal.Approver)
+		return -1
+	}
+
+	// With approvers configured, changes are reviewed by someone other than their author
+	operator := getOperator()
+	if len(config.Approvers) > 0 {
+		if !contains(config.Approvers, operator) {
+			log.Fatalf("%s may not approve changes, approvers are %s\n", operator, strings.Join(config.Approvers, ", "))
+			return -1
+		}
+		if operator == proposal.Author {
+			log.Fatalf("Proposal #%d is by %s, it needs another approver\n", id, operator)
+			return -1
+		}
+	}
+
+	deployed, err := lastDeployedHash(targetName)
+	if err != nil {
+		log.Fatal("Failed to read deploy history: ", err)
+		return -1
+	}
+	if deployed != proposal.BaseHash {
+		log.Fatalf("'%s' was deployed since proposal #%d was made, propose the changes again\n", targetName, id)
+		return -1
+	}
+
+	var filterConfig FilterConfig
+	err = yaml.Unmarshal([]byte(proposal.Overrides), &filterConfig)
+	if err != nil {
+		log.Fatal("Proposal is not a valid filter config: ", err)
+		return -1
+	}
+	err = writeHostFilterConfig(targetName, filterConfig)
+	if err != nil {
+		log.Fatal("Failed to write host config: ", err)
+		return -1
+	}
+
+	proposal.AppliedHash, err = hashHostFilterConfig(targetName)
+	if err != nil {
+		log.Fatal("Failed to hash host config: ", err)
+		return -1
+	}
+	proposal.Status = "approved"
+	proposal.Approver = operator
+	proposal.ApprovedAt = time.Now().UTC()
+	err = saveProposal(targetName, proposal)
+	if err != nil {
+		log.Fatal("Failed to save proposal: ", err)
+		return -1
+	}
+	log.Printf("Approved proposal #%d by %s\n", id, proposal.Author)
+
+	message := fmt.Sprintf("proposal #%d", id)
+	if proposal.Message != "" {
+		message = fmt.Sprintf("%s: %s", message, proposal.Message)
+	}
+	err = deployHost(host, message, false, false)
+	if err == errPostDeployHook {
+		return -1
+	} else if err != nil {
+		log.Fatal(err)
+		return -1
+	}
+	return 0
+}
+
+/*
+ * List the target's proposals, or show the changes of one
+ */
+func ShowProposals(targetName string, id int) int {
+
+	if id > 0 {
+		proposal, err := loadProposal(targetName, id)
+		if err != nil {
+			log.Fatal(err)
+			return -1
+		}
+		fmt.Fprintf(showOutput(), "Proposal #%d by %s at %s: %s\n", proposal.Id, proposal.Author, proposal.Time.Local().Format(time.RFC3339), proposal.Status)
+		if proposal.Message != "" {
+			fmt.Fprintf(showOutput(), "Message: %s\n", proposal.Message)
+		}
+		if proposal.Approver != "" {
+			fmt.Fprintf(showOutput(), "Approved by %s at %s\n", proposal.Approver, proposal.ApprovedAt.Local().Format(time.RFC3339))
+		}
+		w := tabwriter.NewWriter(showOutput(), 1, 1, 3, ' ', 0)
+		fmt.Fprintln(w, "Key\tDeployed\tProposed")
+		for _, change := range proposal.Changes {
+			fmt.Fprintf(w, "%s\t%s\t%s\n", change.Key, change.Old, change.New)
+		}
+		w.Flush()
+		return 0
+	}
+
+	proposals, err := loadProposals(targetName)
+	if err != nil {
+		log.Fatal("Failed to read proposals: ", err)
+		return -1
+	}
+	w := tabwriter.NewWriter(showOutput(), 1, 1, 3, ' ', 0)
+	fmt.Fprintln(w, "Id\tTime\tAuthor\tChanges\tStatus\tMessage")
+	for _, proposal := range proposals {
+		status := proposal.Status
+		if proposal.Approver != "" {
+			status = fmt.Sprintf("%s by %s", status, proposal.Approver)
+		}
+		fmt.Fprintf(w, "%d\t%s\t%s\t%d\t%s\t%s\n", proposal.Id, proposal.Time.Local().Format(time.RFC3339), proposal.Author, len(proposal.Changes), status, proposal.Message)
+	}
+	w.Flush()
+	return 0
+}
+
+/*
+ * Require deploys to go through approved proposals, reviewed by one of approvers;
+ * no approvers lets anyone deploy again. Once there are approvers only they may
+ * change the list, so an author can't clear it to deploy unreviewed.
+ */
+func SetApprovers(approvers []string) int {
+
+	err := initLocal()
+	if err != nil {
+		log.Fatal("Failed to initialize: ", err)
+		return -1
+	}
+
+	config, err := loadConfig()
+	if err != nil {
+		log.Fatal("Failed to load config: ", err)
+		return -1
+	}
+
+	operator := getOperator()
+	if len(config.Approvers) > 0 && !contains(config.Approvers, operator) {
+		log.Fatalf("%s may not change the approvers, only %s may\n", operator, strings.Join(config.Approvers, ", "))
+		return -1
+	}
+
+	previous := config.Approvers
+	config.Approvers = approvers
+	err = writeConfig(config)
+	if err != nil {
+		log.Fatal("Failed to write config: ", err)
+		return -1
+	}
+	AuditAction(fmt.Sprintf("config approvers: [%s] to [%s]", strings.Join(previous, ", "), strings.Join(approvers, ", ")), "", "success")
+
+	if len(approvers) == 0 {
+		log.Println("Deploys no longer need approval")
+	} else {
+		log.Printf("Deploys now need a proposal approved by one of %s\n", strings.Join(approvers, ", "))
+	}
+	return 0
+}
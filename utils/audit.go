@@ -0,0 +1,336 @@
+package utils
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// A slow collector must not hold up the command being audited
+const auditSendTimeout = 5 * time.Second
+
+// Private enterprise number reserved for documentation, names the structured data
+const auditSdId = "guardian@32473"
+
+// Facility 13 is log audit
+const auditFacility = 13
+
+type AuditConfig struct {
+	// Collector every administrative action is also sent to, udp://, tcp:// or tls://
+	Syslog string `json:",omitempty"`
+	// syslog (RFC 5424 with structured data) or cef
+	Format string `json:",omitempty"`
+	// CA to verify a tls:// collector with instead of the system roots
+	CaFile string `json:",omitempty"`
+}
+
+type AuditEvent struct {
+	Time     time.Time
+	Operator string
+	Machine  string
+	Command  string
+	Target   string `json:",omitempty"`
+	// started, success or failure
+	Outcome string
+}
+
+func getAuditLogPath() string {
+	return filepath.Join(GuardianConfigHome(), "audit.jsonl")
+}
+
+func newAuditEvent(command string, target string, outcome string) AuditEvent {
+	machine, _ := os.Hostname()
+	return AuditEvent{
+		Time:     time.Now().UTC(),
+		Operator: getOperator(),
+		Machine:  machine,
+		Command:  command,
+		Target:   target,
+		Outcome:  outcome,
+	}
+}
+
+func (event AuditEvent) summary() string {
+	on := ""
+	if event.Target != "" {
+		on = " on " + event.Target
+	}
+	return fmt.Sprintf("%s ran '%s'%s: %s", event.Operator, event.Command, on, event.Outcome)
+}
+
+func syslogSdEscape(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, `]`, `\]`).Replace(s)
+}
+
+/*
+ * RFC 5424 message for an event, with its fields as structured data
+ */
+func formatSyslog(event AuditEvent) string {
+	severity := 5 // notice
+	if event.Outcome == "failure" {
+		severity = 4 // warning
+	}
+	return fmt.Sprintf("<%d>1 %s %s guardian-cli %d action [%s operator=\"%s\" command=\"%s\" target=\"%s\" outcome=\"%s\"] %s",
+		auditFacility*8+severity, event.Time.Format(time.RFC3339Nano), event.Machine, os.Getpid(), auditSdId,
+		syslogSdEscape(event.Operator), syslogSdEscape(event.Command), syslogSdEscape(event.Target), syslogSdEscape(event.Outcome),
+		event.summary())
+}
+
+/*
+ * ArcSight CEF message for an event, carried in a syslog message
+ */
+func formatCef(event AuditEvent) string {
+	header := strings.NewReplacer(`\`, `\\`, `|`, `\|`)
+	extension := strings.NewReplacer(`\`, `\\`, `=`, `\=`, "\n", `\n`)
+	severity := 3
+	if event.Outcome == "failure" {
+		severity = 6
+	}
+	cef := fmt.Sprintf("CEF:0|e2guardian-angel|guardian-cli|%s|%s|%s|%d|rt=%d suser=%s shost=%s dhost=%s outcome=%s",
+		CliVersion, header.Replace(event.Command), header.Replace(event.summary()), severity, event.Time.UnixMilli(),
+		extension.Replace(event.Operator), extension.Replace(event.Machine), extension.Replace(event.Target), extension.Replace(event.Outcome))
+	return fmt.Sprintf("<%d>1 %s %s guardian-cli %d action - %s",
+		auditFacility*8+5, event.Time.Format(time.RFC3339Nano), event.Machine, os.Getpid(), cef)
+}
+
+/*
+ * Parse a collector url, filling in the default syslog ports
+ */
+func parseSyslogUrl(collector string) (*url.URL, error) {
+	u, err := url.Parse(collector)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("invalid syslog collector '%s', use udp://, tcp:// or tls://host[:port]", collector)
+	}
+	switch u.Scheme {
+	case "udp", "tcp":
+		if u.Port() == "" {
+			u.Host = net.JoinHostPort(u.Hostname(), "514")
+		}
+	case "tls":
+		if u.Port() == "" {
+			u.Host = net.JoinHostPort(u.Hostname(), "6514")
+		}
+	default:
+		return nil, fmt.Errorf("unsupported syslog transport '%s', use udp, tcp or tls", u.Scheme)
+	}
+	return u, nil
+}
+
+func sendAuditEvent(audit AuditConfig, event AuditEvent) error {
+	u, err := parseSyslogUrl(audit.Syslog)
+	if err != nil {
+		return err
+	}
+	message := formatSyslog(event)
+	if audit.Format == "cef" {
+		message = formatCef(event)
+	}
+
+	dialer := &net.Dialer{Timeout: auditSendTimeout}
+	var conn net.Conn
+	switch u.Scheme {
+	case "tls":
+		tlsConfig := &tls.Config{ServerName: u.Hostname()}
+		if audit.CaFile != "" {
+			pem, err := ioutil.ReadFile(audit.CaFile)
+			if err != nil {
+				return err
+			}
+			tlsConfig.RootCAs = x509.NewCertPool()
+			if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+				return fmt.Errorf("no certificates in %s", audit.CaFile)
+			}
+		}
+		conn, err = tls.DialWithDialer(dialer, "tcp", u.Host, tlsConfig)
+	default:
+		conn, err = dialer.Dial(u.Scheme, u.Host)
+	}
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(auditSendTimeout))
+
+	// Stream transports frame messages by octet counting (RFC 5425, RFC 6587)
+	if u.Scheme != "udp" {
+		message = fmt.Sprintf("%d %s", len(message), message)
+	}
+	_, err = conn.Write([]byte(message))
+	return err
+}
+
+func appendAuditEvent(event AuditEvent) error {
+	line, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	if useLocalDb() {
+		db, err := localDb()
+		if err != nil {
+			return err
+		}
+		_, err = db.Exec("INSERT INTO audit_log (time, event) VALUES (?, ?)", event.Time.Format(deployTimeFormat), string(line))
+		return err
+	}
+	os.MkdirAll(GuardianConfigHome(), privateDirMode)
+	f, err := os.OpenFile(getAuditLogPath(), os.O_APPEND|os.O_CREATE|os.O_WRONLY, privateFileMode)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = f.WriteString(string(line) + "\n")
+	return err
+}
+
+/*
+ * Record an administrative action in the local audit log and send it to the
+ * remote collector, if there is one. Actions are recorded when they start too,
+ * since a failing command may exit before it returns.
+ */
+func AuditAction(command string, target string, outcome string) {
+	event := newAuditEvent(command, target, outcome)
+	if err := appendAuditEvent(event); err != nil {
+		log.Printf("Warning: failed to write the audit log: %s\n", err)
+	}
+
+	config, err := loadConfig()
+	if err != nil || config.Audit.Syslog == "" {
+		return
+	}
+	if err := sendAuditEvent(config.Audit, event); err != nil {
+		log.Printf("Warning: failed to send audit event to %s: %s\n", config.Audit.Syslog, err)
+	}
+}
+
+/*
+ * Send every administrative action to a syslog or CEF collector as well, or
+ * stop when collector is empty
+ */
+func SetRemoteAudit(collector string, format string, caFile string) int {
+
+	err := initLocal()
+	if err != nil {
+		log.Fatal("Failed to initialize: ", err)
+		return -1
+	}
+
+	config, err := loadConfig()
+	if err != nil {
+		log.Fatal("Failed to load config: ", err)
+		return -1
+	}
+
+	audit := AuditConfig{Syslog: collector, Format: format, CaFile: caFile}
+	if collector != "" {
+		if _, err := parseSyslogUrl(collector); err != nil {
+			log.Fatal(err)
+			return -1
+		}
+		if caFile != "" {
+			if audit.CaFile, err = filepath.Abs(caFile); err != nil {
+				log.Fatal("Invalid CA file: ", err)
+				return -1
+			}
+		}
+		// Find out now rather than with the first action that nothing arrives
+		err = sendAuditEvent(audit, newAuditEvent("audit remote", "", "test"))
+		if err != nil {
+			log.Fatalf("Failed to reach %s: %s\n", collector, err)
+			return -1
+		}
+	} else {
+		audit = AuditConfig{}
+	}
+
+	config.Audit = audit
+	err = writeConfig(config)
+	if err != nil {
+		log.Fatal("Failed to write config: ", err)
+		return -1
+	}
+
+	if collector == "" {
+		log.Println("Stopped sending audit events")
+	} else {
+		log.Printf("Sending audit events to %s as %s\n", collector, format)
+	}
+	return 0
+}
+
+func loadAuditLog(limit int) ([]AuditEvent, error) {
+	var lines []string
+	if useLocalDb() {
+		db, err := localDb()
+		if err != nil {
+			return nil, err
+		}
+		// A negative limit is none
+		if limit <= 0 {
+			limit = -1
+		}
+		rows, err := queryStrings(db, "SELECT event FROM audit_log ORDER BY time DESC LIMIT ?", limit)
+		if err != nil {
+			return nil, err
+		}
+		// Selected newest first for the limit
+		for i := len(rows) - 1; i >= 0; i-- {
+			lines = append(lines, rows[i])
+		}
+	} else {
+		f, err := os.Open(getAuditLogPath())
+		if os.IsNotExist(err) {
+			return nil, nil
+		} else if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			lines = append(lines, scanner.Text())
+		}
+		if limit > 0 && len(lines) > limit {
+			lines = lines[len(lines)-limit:]
+		}
+	}
+
+	var events []AuditEvent
+	for _, line := range lines {
+		var event AuditEvent
+		if err := json.Unmarshal([]byte(line), &event); err != nil {
+			return nil, err
+		}
+		events = append(events, event)
+	}
+	return events, nil
+}
+
+/*
+ * Show the administrative actions run from this machine
+ */
+func ShowAuditLog(limit int) int {
+
+	events, err := loadAuditLog(limit)
+	if err != nil {
+		log.Fatal("Failed to read audit log: ", err)
+		return -1
+	}
+
+	w := tabwriter.NewWriter(showOutput(), 1, 1, 3, ' ', 0)
+	fmt.Fprintln(w, "Time\tOperator\tMachine\tCommand\tTarget\tOutcome")
+	for _, event := range events {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", event.Time.Local().Format(time.RFC3339), event.Operator, event.Machine, event.Command, event.Target, event.Outcome)
+	}
+	w.Flush()
+	return 0
+}
@@ -0,0 +1,196 @@
+package utils
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"sort"
+	"text/tabwriter"
+)
+
+// Locales mapped to the language directories bundled with e2guardian
+var blockPageLanguages = map[string]string{
+	"en":    "ukenglish",
+	"en-GB": "ukenglish",
+	"en-US": "ukenglish",
+	"ar-ES": "arspanish",
+	"zh-TW": "chinesebig5",
+	"zh-CN": "chinesegb2312",
+	"cs":    "czech",
+	"da":    "danish",
+	"nl":    "dutch",
+	"fr":    "french",
+	"de":    "german",
+	"he":    "hebrew",
+	"hu":    "hungarian",
+	"id":    "indonesian",
+	"it":    "italian",
+	"ja":    "japanese",
+	"lt":    "lithuanian",
+	"ms":    "malay",
+	"pl":    "polish",
+	"pt":    "portuguese",
+	"pt-BR": "portuguese",
+	"ru":    "russian-1251",
+	"sk":    "slovak",
+	"es":    "spanish",
+	"sv":    "swedish",
+	"tr":    "turkish",
+}
+
+type BlockPageConfig struct {
+	// e2guardian language used for the denied, warn and quota pages
+	Language string `yaml:"language,omitempty"`
+	// Custom messages files by name, used in place of a bundled language
+	CustomMessages map[string]string `yaml:"customMessages,omitempty"`
+}
+
+/*
+ * Resolve a locale or custom translation name to the language the stack should use
+ */
+func (config *FilterConfig) resolveBlockPageLanguage(locale string) (string, error) {
+	if _, ok := config.BlockPage.CustomMessages[locale]; ok {
+		return locale, nil
+	}
+	if language, ok := blockPageLanguages[locale]; ok {
+		return language, nil
+	}
+	// Also accept a bundled language directory name directly
+	for _, language := range blockPageLanguages {
+		if language == locale {
+			return language, nil
+		}
+	}
+	return "", fmt.Errorf("unknown locale '%s'; use 'filter blockpage language list' for options or import a custom translation", locale)
+}
+
+func SetBlockPageLanguage(targetName string, locale string) int {
+
+	config, err := getHostFilterConfig(targetName)
+	if err != nil {
+		log.Fatal("Failed to get host config: ", err)
+		return -1
+	}
+
+	language, err := config.resolveBlockPageLanguage(locale)
+	if err != nil {
+		log.Fatal(err)
+		return -1
+	}
+
+	config.BlockPage.Language = language
+
+	err = writeHostFilterConfig(targetName, config)
+	if err != nil {
+		log.Fatal("Failed to write host config: ", err)
+		return -1
+	}
+
+	log.Printf("Block pages will be shown in '%s'\n", language)
+	return 0
+}
+
+/*
+ * Store a custom e2guardian messages file under a name usable with 'language set'
+ */
+func ImportBlockPageTranslation(targetName string, name string, fileName string) int {
+
+	if _, ok := blockPageLanguages[name]; ok {
+		log.Fatalf("'%s' is a bundled locale, choose another name\n", name)
+		return -1
+	}
+
+	data, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		log.Fatal("Failed to read translation file: ", err)
+		return -1
+	}
+
+	config, err := getHostFilterConfig(targetName)
+	if err != nil {
+		log.Fatal("Failed to get host config: ", err)
+		return -1
+	}
+
+	if config.BlockPage.CustomMessages == nil {
+		config.BlockPage.CustomMessages = map[string]string{}
+	}
+	config.BlockPage.CustomMessages[name] = string(data)
+
+	err = writeHostFilterConfig(targetName, config)
+	if err != nil {
+		log.Fatal("Failed to write host config: ", err)
+		return -1
+	}
+
+	log.Printf("Imported translation '%s'\n", name)
+	return 0
+}
+
+func ListBlockPageLanguages(targetName string) int {
+
+	config, err := getHostFilterConfig(targetName)
+	if err != nil {
+		log.Fatal("Failed to get host config: ", err)
+		return -1
+	}
+
+	current := config.BlockPage.Language
+	if current == "" {
+		current = "ukenglish"
+	}
+	fmt.Printf("Current language: %s\n", current)
+
+	var locales []string
+	for locale := range blockPageLanguages {
+		locales = append(locales, locale)
+	}
+	sort.Strings(locales)
+
+	w := tabwriter.NewWriter(os.Stdout, 1, 1, 3, ' ', 0)
+	fmt.Fprintln(w, "Locale\tLanguage")
+	for _, locale := range locales {
+		fmt.Fprintf(w, "%s\t%s\n", locale, blockPageLanguages[locale])
+	}
+	var custom []string
+	for name := range config.BlockPage.CustomMessages {
+		custom = append(custom, name)
+	}
+	sort.Strings(custom)
+	for _, name := range custom {
+		fmt.Fprintf(w, "%s\t(custom)\n", name)
+	}
+	w.Flush()
+
+	return 0
+}
+
+func RemoveBlockPageTranslation(targetName string, name string) int {
+
+	config, err := getHostFilterConfig(targetName)
+	if err != nil {
+		log.Fatal("Failed to get host config: ", err)
+		return -1
+	}
+
+	if _, ok := config.BlockPage.CustomMessages[name]; !ok {
+		log.Fatalf("Custom translation '%s' does not exist\n", name)
+		return -1
+	}
+	if config.BlockPage.Language == name {
+		log.Fatalf("Translation '%s' is in use; set another language first\n", name)
+		return -1
+	}
+
+	delete(config.BlockPage.CustomMessages, name)
+
+	err = writeHostFilterConfig(targetName, config)
+	if err != nil {
+		log.Fatal("Failed to write host config: ", err)
+		return -1
+	}
+
+	log.Printf("Removed translation '%s'\n", name)
+	return 0
+}
@@ -0,0 +1,93 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// Set by the '--step-timeout' flag to override the default timeout of every remote step
+var StepTimeout time.Duration
+
+// Default timeouts of the long-running remote steps
+const (
+	helmUpgradeTimeout = 20 * time.Minute
+	playbookTimeout    = time.Hour
+)
+
+// Cleanup after an abort gets its own deadline, the interrupted operation's is gone
+const cleanupTimeout = time.Minute
+
+// How long an interrupted remote command gets to exit before its connection is closed
+const interruptGracePeriod = 5 * time.Second
+
+// Cancelled on the first Ctrl-C or SIGTERM
+var interruptContext = context.Background()
+
+// Number of remote operations in flight
+var remoteOperations int32
+
+/*
+ * Count a remote operation as in flight until the returned function is called
+ */
+func trackRemoteOperation() func() {
+	atomic.AddInt32(&remoteOperations, 1)
+	return func() { atomic.AddInt32(&remoteOperations, -1) }
+}
+
+/*
+ * Cancel remote operations on Ctrl-C so they can clean up. With none running, or on a
+ * second Ctrl-C, the CLI exits as usual.
+ */
+func HandleInterrupts() {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	interruptContext = ctx
+	go func() {
+		<-ctx.Done()
+		// Restore the default handling so a second signal kills the CLI
+		stop()
+		if atomic.LoadInt32(&remoteOperations) == 0 {
+			os.Exit(130)
+		}
+		log.Println("Interrupted, stopping remote operations and cleaning up; interrupt again to exit now")
+	}()
+}
+
+/*
+ * Context for one remote step, cancelled on interrupt or after its timeout
+ */
+func stepContext(defaultTimeout time.Duration) (context.Context, context.CancelFunc) {
+	timeout := defaultTimeout
+	if StepTimeout > 0 {
+		timeout = StepTimeout
+	}
+	if timeout <= 0 {
+		return context.WithCancel(interruptContext)
+	}
+	return context.WithTimeout(interruptContext, timeout)
+}
+
+/*
+ * Context for undoing the partial work of an aborted operation, not cancelled by the interrupt
+ */
+func cleanupContext() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), cleanupTimeout)
+}
+
+/*
+ * Describe why a remote operation was stopped, or pass its own error through
+ */
+func contextError(ctx context.Context, err error) error {
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return fmt.Errorf("timed out: %s", err)
+	} else if ctx.Err() != nil {
+		return fmt.Errorf("interrupted: %s", err)
+	}
+	return err
+}
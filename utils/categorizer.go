@@ -0,0 +1,191 @@
+package utils
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+/*
+ * An external service that suggests categories for domains the local DB doesn't know.
+ * It is called as GET <Url>?domain=<domain> and must answer with either a JSON array
+ * of category names or an object with a "categories" array.
+ */
+type CategorizerConfig struct {
+	Url string
+	Key string `json:",omitempty"`
+}
+
+/*
+ * Ask the external categorization service about a domain
+ */
+func externalCategories(categorizer CategorizerConfig, domain string) ([]string, error) {
+	if categorizer.Url == "" {
+		return nil, errors.New("no external categorizer configured")
+	}
+
+	req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("%s?domain=%s", categorizer.Url, url.QueryEscape(domain)), nil)
+	if err != nil {
+		return nil, err
+	}
+	if categorizer.Key != "" {
+		req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", categorizer.Key))
+	}
+
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("received code %d from categorizer", resp.StatusCode)
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	var categories []string
+	if err = json.Unmarshal(body, &categories); err == nil {
+		return categories, nil
+	}
+	var wrapped struct {
+		Categories []string `json:"categories"`
+	}
+	if err = json.Unmarshal(body, &wrapped); err != nil {
+		return nil, fmt.Errorf("unexpected categorizer response: %s", err)
+	}
+	return wrapped.Categories, nil
+}
+
+/*
+ * Categories for a domain from the local DB, falling back to the external service.
+ * The source is "local", "external" or "" when neither knows the domain.
+ */
+func categorizeDomain(targetName string, domain string) ([]string, string, error) {
+	categories, err := lookupCategories(targetName, domain)
+	if err != nil {
+		return nil, "", err
+	}
+	if len(categories) > 0 {
+		return categories, "local", nil
+	}
+
+	config, err := loadConfig()
+	if err != nil || config.Categorizer.Url == "" {
+		return nil, "", nil
+	}
+	categories, err = externalCategories(config.Categorizer, domain)
+	if err != nil {
+		log.Printf("External categorizer failed for '%s': %s\n", domain, err)
+		return nil, "", nil
+	}
+	if len(categories) == 0 {
+		return nil, "", nil
+	}
+	return categories, "external", nil
+}
+
+/*
+ * Configure the external categorization service, an empty url disables it
+ */
+func SetCategorizer(serviceUrl string, key string) int {
+
+	err := initLocal()
+	if err != nil {
+		log.Fatal("Failed to initialize: ", err)
+		return -1
+	}
+
+	config, err := loadConfig()
+	if err != nil {
+		log.Fatal("Failed to load config: ", err)
+		return -1
+	}
+
+	if serviceUrl != "" {
+		if u, err := url.Parse(serviceUrl); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			log.Fatalf("Invalid categorizer url '%s'\n", serviceUrl)
+			return -1
+		}
+	}
+
+	config.Categorizer = CategorizerConfig{Url: serviceUrl, Key: key}
+	err = writeConfig(config)
+	if err != nil {
+		log.Fatal("Failed to write config: ", err)
+		return -1
+	}
+
+	if serviceUrl == "" {
+		fmt.Println("External categorizer disabled.")
+	} else {
+		fmt.Printf("External categorizer set to '%s'.\n", serviceUrl)
+	}
+	return 0
+}
+
+/*
+ * Show how a URL would be categorized and which acl rule applies to it
+ */
+func TestUrl(targetName string, rawUrl string) int {
+
+	domain := rawUrl
+	if strings.Contains(rawUrl, "://") {
+		u, err := url.Parse(rawUrl)
+		if err != nil {
+			log.Fatalf("Invalid url '%s'\n", rawUrl)
+			return -1
+		}
+		domain = u.Hostname()
+	}
+	domain, err := normalizeDomain(domain)
+	if err != nil {
+		log.Fatal(err)
+		return -1
+	}
+
+	filterConfig, err := getHostFilterConfig(targetName)
+	if err != nil {
+		log.Fatal("Failed to get host config: ", err)
+		return -1
+	}
+
+	categories, source, err := categorizeDomain(targetName, domain)
+	if err != nil {
+		log.Fatal("Failed to look up categories: ", err)
+		return -1
+	}
+
+	if source == "" {
+		fmt.Fprintf(showOutput(), "Domain '%s' is not categorized\n", domain)
+		return 0
+	}
+	fmt.Fprintf(showOutput(), "Domain '%s' categories (%s): %s\n", domain, source, strings.Join(categories, ", "))
+	if source == "external" {
+		fmt.Fprintln(showOutput(), "External categories are not in the local DB and are not applied by the filter")
+		return 0
+	}
+
+	// First matching rule wins
+	for _, rule := range filterConfig.AllowRules {
+		if contains(categories, rule.Category) {
+			action := "allow"
+			if !rule.Allow {
+				action = "deny"
+			}
+			fmt.Fprintf(showOutput(), "Matched acl rule '%s=%s'\n", rule.Category, action)
+			return 0
+		}
+	}
+	fmt.Fprintln(showOutput(), "No acl rule matches")
+	return 0
+}
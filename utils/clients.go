@@ -0,0 +1,432 @@
+package utils
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+type Client struct {
+	Name string `yaml:"name"`
+	Ip   string `yaml:"ip,omitempty"`
+	Mac  string `yaml:"mac,omitempty"`
+	// Policy group applied instead of the default rules
+	Group string `yaml:"group,omitempty"`
+	// Filtering is bypassed for this client; "always" or an RFC3339 expiry time
+	ExemptUntil string `yaml:"exemptUntil,omitempty"`
+	// TLS traffic of this client is never intercepted
+	NoDecrypt bool `yaml:"noDecrypt,omitempty"`
+}
+
+func (config *FilterConfig) findClient(name string) *Client {
+	for i := range config.Clients {
+		client := &config.Clients[i]
+		if client.Name == name {
+			return client
+		}
+	}
+	return nil
+}
+
+func (config *FilterConfig) findClientByAddress(address string) *Client {
+	for i := range config.Clients {
+		client := &config.Clients[i]
+		if (client.Ip != "" && client.Ip == address) || (client.Mac != "" && strings.EqualFold(client.Mac, address)) {
+			return client
+		}
+	}
+	return nil
+}
+
+func (config *FilterConfig) deleteClient(name string) bool {
+	for i := range config.Clients {
+		if config.Clients[i].Name == name {
+			config.Clients = append(config.Clients[:i], config.Clients[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+/*
+ * Build a client from an IP or MAC address
+ */
+func newClient(name string, address string) (Client, error) {
+	if ip := net.ParseIP(address); ip != nil {
+		return Client{Name: name, Ip: ip.String()}, nil
+	}
+	if mac, err := net.ParseMAC(address); err == nil {
+		return Client{Name: name, Mac: mac.String()}, nil
+	}
+	return Client{}, fmt.Errorf("'%s' is not an IP or MAC address", address)
+}
+
+/*
+ * Resolve a client name to its address; anything else is passed through as-is
+ */
+func (config *FilterConfig) resolveClient(nameOrAddress string) string {
+	if client := config.findClient(nameOrAddress); client != nil {
+		if client.Ip != "" {
+			return client.Ip
+		}
+		return client.Mac
+	}
+	return nameOrAddress
+}
+
+func AddClient(targetName string, name string, address string) int {
+
+	config, err := getHostFilterConfig(targetName)
+	if err != nil {
+		log.Fatal("Failed to get host config: ", err)
+		return -1
+	}
+
+	client, err := newClient(name, address)
+	if err != nil {
+		log.Fatal(err)
+		return -1
+	}
+
+	if config.findClient(name) != nil {
+		log.Fatalf("Client '%s' already exists\n", name)
+		return -1
+	}
+	if existing := config.findClientByAddress(address); existing != nil {
+		log.Fatalf("Address '%s' already belongs to client '%s'\n", address, existing.Name)
+		return -1
+	}
+
+	config.Clients = append(config.Clients, client)
+
+	err = writeHostFilterConfig(targetName, config)
+	if err != nil {
+		log.Fatal("Failed to write host config: ", err)
+		return -1
+	}
+
+	log.Printf("Successfully added client '%s'\n", name)
+	return 0
+}
+
+func RemoveClient(targetName string, name string) int {
+
+	config, err := getHostFilterConfig(targetName)
+	if err != nil {
+		log.Fatal("Failed to get host config: ", err)
+		return -1
+	}
+
+	if !config.deleteClient(name) {
+		log.Fatalf("Client '%s' does not exist\n", name)
+		return -1
+	}
+
+	err = writeHostFilterConfig(targetName, config)
+	if err != nil {
+		log.Fatal("Failed to write host config: ", err)
+		return -1
+	}
+
+	log.Printf("Successfully removed client '%s'\n", name)
+	return 0
+}
+
+func ListClients(targetName string) int {
+
+	config, err := getHostFilterConfig(targetName)
+	if err != nil {
+		log.Fatal("Failed to get host config: ", err)
+		return -1
+	}
+
+	location := targetLocation(targetName)
+	w := tabwriter.NewWriter(showOutput(), 1, 1, 3, ' ', 0)
+	fmt.Fprintln(w, "Name\tIP\tMAC\tGroup\tExempt until\tNo decrypt")
+	for _, client := range config.Clients {
+		// Exemptions are stored in UTC, show them in the target's time
+		until := client.ExemptUntil
+		if t, err := time.Parse(time.RFC3339, until); err == nil {
+			until = t.In(location).Format("2006-01-02 15:04 MST")
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%t\n", client.Name, client.Ip, client.Mac, client.Group, until, client.NoDecrypt)
+	}
+	w.Flush()
+
+	return 0
+}
+
+/*
+ * Filter groups the target's policy defines, the LAN's and the guests' if enabled
+ */
+func (config *FilterConfig) filterGroupNames() []string {
+	groups := []string{"default"}
+	if config.Guest.Enabled {
+		groups = append(groups, config.Guest.Group)
+	}
+	return groups
+}
+
+/*
+ * Put a client in a policy group, or back on the default rules if group is empty
+ */
+func AssignClient(targetName string, name string, group string) int {
+
+	config, err := getHostFilterConfig(targetName)
+	if err != nil {
+		log.Fatal("Failed to get host config: ", err)
+		return -1
+	}
+
+	client := config.findClient(name)
+	if client == nil {
+		log.Fatalf("Client '%s' does not exist\n", name)
+		return -1
+	}
+	if groups := config.filterGroupNames(); group != "" && !contains(groups, group) {
+		log.Fatalf("Filter group '%s' does not exist, valid options are %s\n", group, strings.Join(groups, ", "))
+		return -1
+	}
+
+	client.Group = group
+
+	err = writeHostFilterConfig(targetName, config)
+	if err != nil {
+		log.Fatal("Failed to write host config: ", err)
+		return -1
+	}
+
+	if group == "" {
+		log.Printf("Client '%s' now uses the default policy\n", name)
+	} else {
+		log.Printf("Assigned client '%s' to group '%s'\n", name, group)
+	}
+	return 0
+}
+
+/*
+ * The clients without the exemptions that have expired, so a deploy stops
+ * exempting them. The stored clients keep the expiry for the record.
+ */
+func (config *FilterConfig) unexpiredClients() []Client {
+	var clients []Client
+	for _, client := range config.Clients {
+		if t, err := time.Parse(time.RFC3339, client.ExemptUntil); err == nil && !t.After(time.Now()) {
+			client.ExemptUntil = ""
+		}
+		clients = append(clients, client)
+	}
+	return clients
+}
+
+/*
+ * Exempt a client from filtering, for a duration or until revoked
+ */
+func ExemptClient(targetName string, name string, duration string, revoke bool) int {
+
+	config, err := getHostFilterConfig(targetName)
+	if err != nil {
+		log.Fatal("Failed to get host config: ", err)
+		return -1
+	}
+
+	client := config.findClient(name)
+	if client == nil {
+		log.Fatalf("Client '%s' does not exist\n", name)
+		return -1
+	}
+
+	if revoke {
+		client.ExemptUntil = ""
+	} else if duration == "" {
+		client.ExemptUntil = "always"
+	} else {
+		d, err := time.ParseDuration(duration)
+		if err != nil || d <= 0 {
+			log.Fatalf("Invalid duration '%s'\n", duration)
+			return -1
+		}
+		client.ExemptUntil = time.Now().Add(d).UTC().Format(time.RFC3339)
+	}
+
+	err = writeHostFilterConfig(targetName, config)
+	if err != nil {
+		log.Fatal("Failed to write host config: ", err)
+		return -1
+	}
+
+	if revoke {
+		log.Printf("Revoked exemption for client '%s'\n", name)
+	} else {
+		until := client.ExemptUntil
+		if t, err := time.Parse(time.RFC3339, until); err == nil {
+			until = t.In(targetLocation(targetName)).Format("2006-01-02 15:04 MST")
+		}
+		log.Printf("Client '%s' is exempt from filtering until %s\n", name, until)
+	}
+	return 0
+}
+
+// Lease file of the Kea DHCPv4 server
+const keaLeasesFile = "/var/lib/kea/kea-leases4.csv"
+
+// Run on a Windows DHCP server over OpenSSH
+const windowsLeasesCommand = "powershell -NoProfile -Command \"Get-DhcpServerv4Scope | Get-DhcpServerv4Lease | ForEach-Object { $_.ClientId + ' ' + $_.IPAddress + ' ' + $_.HostName }\""
+
+type dhcpLease struct {
+	Mac      string
+	Ip       string
+	Hostname string
+}
+
+/*
+ * dnsmasq format: <expiry> <mac> <ip> <hostname> <client-id>
+ */
+func parseDnsmasqLeases(data string) []dhcpLease {
+	var leases []dhcpLease
+	for _, line := range strings.Split(data, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 4 || fields[3] == "*" {
+			continue
+		}
+		leases = append(leases, dhcpLease{Mac: fields[1], Ip: fields[2], Hostname: fields[3]})
+	}
+	return leases
+}
+
+/*
+ * Kea memfile CSV: address,hwaddr,client_id,valid_lifetime,expire,subnet_id,fqdn_fwd,fqdn_rev,hostname,state,...
+ * Leases are appended as they change, so later lines win.
+ */
+func parseKeaLeases(data string) []dhcpLease {
+	byMac := map[string]int{}
+	var leases []dhcpLease
+	for _, line := range strings.Split(data, "\n") {
+		fields := strings.Split(line, ",")
+		if len(fields) < 9 || fields[0] == "address" || fields[1] == "" {
+			continue
+		}
+		lease := dhcpLease{Mac: fields[1], Ip: fields[0], Hostname: strings.TrimSuffix(fields[8], ".")}
+		if i, ok := byMac[lease.Mac]; ok {
+			leases[i] = lease
+			continue
+		}
+		byMac[lease.Mac] = len(leases)
+		leases = append(leases, lease)
+	}
+	return leases
+}
+
+/*
+ * Output of windowsLeasesCommand: <client-id> <ip> <hostname>, the client id being the MAC with dashes
+ */
+func parseWindowsLeases(data string) []dhcpLease {
+	var leases []dhcpLease
+	for _, line := range strings.Split(data, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 3 {
+			continue
+		}
+		// Hostnames are fully qualified with the AD domain
+		hostname := strings.SplitN(fields[2], ".", 2)[0]
+		leases = append(leases, dhcpLease{Mac: strings.ReplaceAll(fields[0], "-", ":"), Ip: fields[1], Hostname: hostname})
+	}
+	return leases
+}
+
+/*
+ * Add a client for every lease with a hostname, skipping ones already known. Hostnames
+ * are whatever the clients sent the DHCP server, so only valid ones become client names.
+ */
+func (config *FilterConfig) addLeaseClients(leases []dhcpLease) int {
+	added := 0
+	for _, lease := range leases {
+		if lease.Hostname == "" || config.findClient(lease.Hostname) != nil || config.findClientByAddress(lease.Mac) != nil {
+			continue
+		}
+		if len(lease.Hostname) > 253 || !hostnamePattern.MatchString(lease.Hostname) {
+			log.Printf("Skipped lease of %s with invalid hostname %q\n", lease.Mac, lease.Hostname)
+			continue
+		}
+		client, err := newClient(lease.Hostname, lease.Mac)
+		if err != nil {
+			continue
+		}
+		config.Clients = append(config.Clients, client)
+		log.Printf("Imported client '%s' (%s)\n", lease.Hostname, lease.Mac)
+		added++
+	}
+	return added
+}
+
+/*
+ * Add clients from DHCP leases read on the target, or on a router over SSH.
+ * The source is a dnsmasq leases file path, kea or windows.
+ */
+func DiscoverClients(targetName string, source string, router string, routerPort uint16) int {
+
+	guardianConf, err := loadConfig()
+	if err != nil {
+		log.Fatal("Failed to load config: ", err)
+		return -1
+	}
+
+	_, host := FindHost(guardianConf, targetName)
+	if host.Name != targetName {
+		log.Fatalf("Host %s doesn't exist, create it first", targetName)
+		return -1
+	}
+
+	if router != "" {
+		// The router must accept the guardian SSH key, like a target
+		username, address, err := parseMigrateDestination(router)
+		if err != nil {
+			log.Fatal("Invalid router: ", err)
+			return -1
+		}
+		host = Host{Name: router, Address: address, Port: routerPort, Username: username}
+	}
+
+	command := fmt.Sprintf("cat %s", shellQuote(source))
+	parse := parseDnsmasqLeases
+	switch source {
+	case "kea":
+		command = fmt.Sprintf("cat %s", keaLeasesFile)
+		parse = parseKeaLeases
+	case "windows":
+		command = windowsLeasesCommand
+		parse = parseWindowsLeases
+	}
+
+	config, err := getHostFilterConfig(targetName)
+	if err != nil {
+		log.Fatal("Failed to get host config: ", err)
+		return -1
+	}
+
+	var results RemoteResult
+	if source == "windows" {
+		// Windows OpenSSH has no sh to wrap the command in
+		results, err = runHostCommandUnwrapped(interruptContext, host, command, false)
+	} else {
+		results, err = runHostCommandResults(interruptContext, host, []string{command}, nil, false)
+	}
+	if err != nil {
+		log.Fatalf("Failed to read leases from %s: %s\n", host.Address, err)
+		return -1
+	}
+
+	added := config.addLeaseClients(parse(strings.ReplaceAll(results.Stdout(), "\r", "")))
+
+	err = writeHostFilterConfig(targetName, config)
+	if err != nil {
+		log.Fatal("Failed to write host config: ", err)
+		return -1
+	}
+
+	log.Printf("Imported %d clients\n", added)
+	return 0
+}
@@ -0,0 +1,111 @@
+package utils
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+)
+
+// Version of this CLI, compared against the minimum a chart declares
+const CliVersion = "1.4.0"
+
+// Version of the FilterConfig layout written to overrides.yaml. Bump it whenever
+// a field is added that the chart has to render for the setting to take effect.
+// 4 added timeZone, newDomains, homographProtection, resources, profile, ipv6,
+// vpn, geo, upstream, pac, e2gStats, probes and weighted phrase lists.
+const ConfigSchemaVersion = 4
+
+// Chart annotations declaring what the chart needs from the CLI, and the newest
+// config schema it renders
+const (
+	chartMinCliAnnotation    = "guardian-angel/min-cli-version"
+	chartMinSchemaAnnotation = "guardian-angel/min-config-schema"
+	chartSchemaAnnotation    = "guardian-angel/config-schema"
+)
+
+/*
+ * Compare dotted versions numerically, ignoring a leading v and any pre-release suffix
+ */
+func compareVersions(a string, b string) int {
+	parse := func(version string) []int {
+		version = strings.TrimPrefix(version, "v")
+		version = strings.SplitN(version, "-", 2)[0]
+		var parts []int
+		for _, part := range strings.Split(version, ".") {
+			n, _ := strconv.Atoi(part)
+			parts = append(parts, n)
+		}
+		return parts
+	}
+	pa, pb := parse(a), parse(b)
+	for i := 0; i < len(pa) || i < len(pb); i++ {
+		var x, y int
+		if i < len(pa) {
+			x = pa[i]
+		}
+		if i < len(pb) {
+			y = pb[i]
+		}
+		if x != y {
+			if x < y {
+				return -1
+			}
+			return 1
+		}
+	}
+	return 0
+}
+
+/*
+ * Check the checked out chart and this CLI agree on the config they exchange
+ */
+func checkChartCompatibility(chart chartMetadata) error {
+	if chart.Version == "" {
+		return fmt.Errorf("chart declares no version")
+	}
+
+	if minCli, ok := chart.Annotations[chartMinCliAnnotation]; ok && compareVersions(CliVersion, minCli) < 0 {
+		return fmt.Errorf("chart %s needs guardian-cli %s or newer, this is %s", chart.Version, minCli, CliVersion)
+	}
+	if minSchema, ok := chart.Annotations[chartMinSchemaAnnotation]; ok {
+		n, err := strconv.Atoi(minSchema)
+		if err != nil {
+			return fmt.Errorf("chart %s declares an invalid config schema '%s'", chart.Version, minSchema)
+		}
+		if ConfigSchemaVersion < n {
+			return fmt.Errorf("chart %s needs config schema %d, this CLI writes %d", chart.Version, n, ConfigSchemaVersion)
+		}
+	}
+
+	// Only the chart knows what it renders, releases that don't say can't be checked
+	declared, ok := chart.Annotations[chartSchemaAnnotation]
+	if !ok {
+		log.Printf("Chart %s doesn't declare the config schema it renders, settings added since it was released may be ignored\n", chart.Version)
+		return nil
+	}
+	schema, err := strconv.Atoi(declared)
+	if err != nil {
+		return fmt.Errorf("chart %s declares an invalid config schema '%s'", chart.Version, declared)
+	}
+	if schema < ConfigSchemaVersion {
+		return fmt.Errorf("chart %s understands config schema %d, this CLI writes %d; settings would be silently ignored", chart.Version, schema, ConfigSchemaVersion)
+	}
+	return nil
+}
+
+/*
+ * Refuse to deploy a chart that can't interpret this CLI's config, or only warn when forced
+ */
+func ensureChartCompatible(force bool) error {
+	chart, err := getChartMetadata()
+	if err != nil {
+		return fmt.Errorf("failed to read chart metadata: %s", err)
+	}
+	err = checkChartCompatibility(chart)
+	if err != nil && force {
+		log.Printf("Warning: %s; deploying anyway because of --force\n", err)
+		return nil
+	}
+	return err
+}
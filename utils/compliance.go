@@ -0,0 +1,354 @@
+package utils
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"html/template"
+	"io/ioutil"
+	"log"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+/*
+ * A titled part of the compliance report: facts, then an optional table
+ */
+type reportSection struct {
+	Title string
+	Facts [][2]string
+	// Header of the table, no table when empty
+	Header []string
+	Rows   [][]string
+	// Shown when the table has no rows
+	Empty string
+}
+
+func (section *reportSection) fact(name string, value string) {
+	section.Facts = append(section.Facts, [2]string{name, value})
+}
+
+type complianceReport struct {
+	Title     string
+	Generated string
+	Sections  []reportSection
+}
+
+func yesNo(value bool) string {
+	if value {
+		return "yes"
+	}
+	return "no"
+}
+
+func aclSection(config FilterConfig) reportSection {
+	section := reportSection{
+		Title:  "Access control rules",
+		Header: []string{"#", "Kind", "Category", "Action"},
+		Empty:  "No rules, all traffic is allowed and nothing is decrypted",
+	}
+	section.fact("Evaluation", "First matching rule wins, decrypt rules before allow rules")
+	for i, rule := range config.DecryptRules {
+		action := "decrypt"
+		if !rule.Decrypt {
+			action = "nodecrypt"
+		}
+		section.Rows = append(section.Rows, []string{fmt.Sprint(i), "decrypt", rule.Category, action})
+	}
+	for i, rule := range config.AllowRules {
+		action := "allow"
+		if !rule.Allow {
+			action = "deny"
+		}
+		section.Rows = append(section.Rows, []string{fmt.Sprint(i), "allow", rule.Category, action})
+	}
+	for i, rule := range config.Geo.Rules {
+		action := "allow"
+		if !rule.Allow {
+			action = "deny"
+		}
+		section.Rows = append(section.Rows, []string{fmt.Sprint(i), "country", fmt.Sprintf("%s (%s)", rule.Country, rule.Direction), action})
+	}
+	return section
+}
+
+func listsSection(config FilterConfig) reportSection {
+	section := reportSection{
+		Title:  "Content and phrase lists",
+		Header: []string{"List", "Type", "Used by", "Groups", "Entries"},
+		Empty:  "No lists",
+	}
+	for _, list := range config.E2guardianConf.Lists {
+		entries := 0
+		for _, group := range list.Groups {
+			entries += len(group.Items)
+		}
+		section.Rows = append(section.Rows, []string{list.ListName, list.Type, strings.Join(list.IncludeIn, ", "),
+			fmt.Sprint(len(list.Groups)), fmt.Sprint(entries)})
+	}
+	phraseLists := func(lists []PhraseList, kind string) {
+		for _, list := range lists {
+			entries := 0
+			for _, group := range list.Groups {
+				entries += len(group.Phrases)
+			}
+			section.Rows = append(section.Rows, []string{list.ListName, kind, strings.Join(list.IncludeIn, ", "),
+				fmt.Sprint(len(list.Groups)), fmt.Sprint(entries)})
+		}
+	}
+	phraseLists(config.E2guardianConf.PhraseLists, "phraselist")
+	phraseLists(config.E2guardianConf.WeightedPhraseLists, "weightedphraselist")
+	return section
+}
+
+func protectionSection(config FilterConfig) reportSection {
+	section := reportSection{Title: "Protections"}
+	section.fact("Safe search enforced", yesNo(config.SafeSearchEnforced))
+	section.fact("Transparent proxy", yesNo(config.Transparent))
+	section.fact("Lookalike domain protection", yesNo(config.HomographProtection))
+	section.fact("Threat feeds", fmt.Sprint(len(config.ThreatFeeds.Feeds)))
+	section.fact("Content scanners", fmt.Sprint(len(config.Scanners)))
+	section.fact("Local network", config.LocalNetwork)
+	return section
+}
+
+func decryptionSection(targetName string, config FilterConfig) reportSection {
+	section := reportSection{
+		Title:  "Decryption scope",
+		Header: []string{"Client", "Address", "Decrypted", "Filtered"},
+		Empty:  "No client is exempt",
+	}
+	section.fact("HTTPS decryption", yesNo(config.DecryptHTTPS))
+	if len(config.DecryptExclusions.Presets) > 0 {
+		section.fact("Never decrypted presets", strings.Join(config.DecryptExclusions.Presets, ", "))
+	}
+	section.fact("Never decrypted domains", fmt.Sprint(len(config.DecryptExclusions.allDomains())))
+	for _, client := range config.Clients {
+		filtered := "yes"
+		if client.ExemptUntil == "always" {
+			filtered = "no"
+		} else if t, err := time.Parse(time.RFC3339, client.ExemptUntil); err == nil && t.After(time.Now()) {
+			filtered = "not until " + t.In(targetLocation(targetName)).Format("2006-01-02 15:04 MST")
+		}
+		if !client.NoDecrypt && filtered == "yes" {
+			continue
+		}
+		address := client.Ip
+		if address == "" {
+			address = client.Mac
+		}
+		section.Rows = append(section.Rows, []string{client.Name, address, yesNo(!client.NoDecrypt), filtered})
+	}
+	return section
+}
+
+func certificateSection(targetName string, config FilterConfig) reportSection {
+	section := reportSection{Title: "Root certificate"}
+	certPem, err := ioutil.ReadFile(getCaPathDir(targetName))
+	if err != nil {
+		section.fact("Status", "not generated yet, the target has not been deployed")
+		section.fact("Configured subject", fmt.Sprintf("CN=%s, O=%s", config.CommonName, config.Organization))
+		return section
+	}
+	block, _ := pem.Decode(certPem)
+	if block == nil {
+		section.fact("Status", "root CA file is not a PEM certificate")
+		return section
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		section.fact("Status", fmt.Sprintf("unreadable: %s", err))
+		return section
+	}
+	section.fact("Subject", cert.Subject.String())
+	section.fact("Issuer", cert.Issuer.String())
+	section.fact("Serial", cert.SerialNumber.String())
+	section.fact("Valid from", cert.NotBefore.UTC().Format(time.RFC3339))
+	section.fact("Valid until", cert.NotAfter.UTC().Format(time.RFC3339))
+	if time.Now().After(cert.NotAfter) {
+		section.fact("Status", "EXPIRED")
+	}
+	section.fact("SHA-256 fingerprint", certificateFingerprint(block.Bytes))
+	return section
+}
+
+func deploySection(targetName string) reportSection {
+	section := reportSection{Title: "Last deploy"}
+	records, err := loadDeployHistory(targetName, 0)
+	if err != nil {
+		section.fact("Status", fmt.Sprintf("deploy history unreadable: %s", err))
+		return section
+	}
+	var last *DeployRecord
+	for i := len(records) - 1; i >= 0; i-- {
+		if records[i].Result == "success" {
+			last = &records[i]
+			break
+		}
+	}
+	if last == nil {
+		section.fact("Status", "never deployed successfully")
+		return section
+	}
+	section.fact("Time", last.Time.UTC().Format(time.RFC3339))
+	section.fact("Operator", last.Operator)
+	if last.Message != "" {
+		section.fact("Message", last.Message)
+	}
+	section.fact("Chart version", last.ChartVersion)
+	if last.ReleaseTag != "" {
+		section.fact("Release tag", last.ReleaseTag)
+	}
+	section.fact("Overrides hash", last.OverridesHash)
+	if hash, err := hashHostFilterConfig(targetName); err == nil {
+		section.fact("Policy in this report deployed", yesNo(hash == last.OverridesHash))
+	}
+	return section
+}
+
+func buildComplianceReport(host Host, config FilterConfig) complianceReport {
+	report := complianceReport{
+		Title:     fmt.Sprintf("Filtering policy of %s", host.Name),
+		Generated: time.Now().UTC().Format(time.RFC3339),
+	}
+	target := reportSection{Title: "Target"}
+	target.fact("Name", host.Name)
+	target.fact("Address", host.Address)
+	target.fact("Report generated by", getOperator())
+	report.Sections = append(report.Sections,
+		target,
+		aclSection(config),
+		listsSection(config),
+		protectionSection(config),
+		decryptionSection(host.Name, config),
+		certificateSection(host.Name, config),
+		deploySection(host.Name),
+	)
+	return report
+}
+
+var complianceHtml = template.Must(template.New("compliance").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>{{.Title}}</title>
+<style>
+body { font-family: sans-serif; max-width: 60em; margin: auto; padding: 1em; color: #222 }
+table { border-collapse: collapse; margin: 0.5em 0 1em }
+th, td { border: 1px solid #bbb; padding: 0.2em 0.6em; text-align: left }
+th { background: #eee }
+table.facts th { background: none; border: none; padding-left: 0 }
+table.facts td { border: none }
+</style></head>
+<body>
+<h1>{{.Title}}</h1>
+<p>Generated {{.Generated}}</p>
+{{range .Sections}}<h2>{{.Title}}</h2>
+{{if .Facts}}<table class="facts">
+{{range .Facts}}<tr><th>{{index . 0}}</th><td>{{index . 1}}</td></tr>
+{{end}}</table>
+{{end}}{{if .Header}}{{if .Rows}}<table>
+<tr>{{range .Header}}<th>{{.}}</th>{{end}}</tr>
+{{range .Rows}}<tr>{{range .}}<td>{{.}}</td>{{end}}</tr>
+{{end}}</table>
+{{else}}<p>{{.Empty}}</p>
+{{end}}{{end}}{{end}}</body>
+</html>
+`))
+
+/*
+ * Lay the report out as lines of monospaced text, bold for headings
+ */
+func (report complianceReport) textLines() []pdfLine {
+	lines := []pdfLine{{Text: report.Title, Bold: true}, {Text: "Generated " + report.Generated}}
+	for _, section := range report.Sections {
+		lines = append(lines, pdfLine{}, pdfLine{Text: section.Title, Bold: true})
+		width := 0
+		for _, fact := range section.Facts {
+			if len(fact[0])+1 > width {
+				width = len(fact[0]) + 1
+			}
+		}
+		for _, fact := range section.Facts {
+			lines = append(lines, pdfLine{Text: fmt.Sprintf("%-*s  %s", width, fact[0]+":", fact[1])})
+		}
+		if len(section.Header) == 0 {
+			continue
+		}
+		if len(section.Rows) == 0 {
+			lines = append(lines, pdfLine{Text: section.Empty})
+			continue
+		}
+		widths := make([]int, len(section.Header))
+		for _, row := range append([][]string{section.Header}, section.Rows...) {
+			for i, cell := range row {
+				if len(cell) > widths[i] {
+					widths[i] = len(cell)
+				}
+			}
+		}
+		format := func(row []string) string {
+			var cells []string
+			for i, cell := range row {
+				cells = append(cells, fmt.Sprintf("%-*s", widths[i], cell))
+			}
+			return strings.TrimRight(strings.Join(cells, "  "), " ")
+		}
+		lines = append(lines, pdfLine{Text: format(section.Header), Bold: true})
+		for _, row := range section.Rows {
+			lines = append(lines, pdfLine{Text: format(row)})
+		}
+	}
+	return lines
+}
+
+/*
+ * Write a report documenting the active policy of a target, as PDF or HTML
+ * depending on the extension of output
+ */
+func ComplianceReport(targetName string, output string) int {
+
+	config, err := loadConfig()
+	if err != nil {
+		log.Fatal("Failed to load config: ", err)
+		return -1
+	}
+
+	_, host := FindHost(config, targetName)
+	if host.Name != targetName {
+		log.Fatalf("Host %s doesn't exist, create it first", targetName)
+		return -1
+	}
+
+	filterConfig, err := getHostFilterConfig(targetName)
+	if err != nil {
+		log.Fatal("Failed to get host config: ", err)
+		return -1
+	}
+
+	report := buildComplianceReport(host, filterConfig)
+	var data []byte
+	switch strings.ToLower(filepath.Ext(output)) {
+	case ".html", ".htm":
+		var buf bytes.Buffer
+		err = complianceHtml.Execute(&buf, report)
+		data = buf.Bytes()
+	case ".pdf":
+		data = renderPdf(report.textLines())
+	default:
+		log.Fatalf("Unsupported report format '%s', use a .pdf or .html output\n", output)
+		return -1
+	}
+	if err != nil {
+		log.Fatal("Failed to render report: ", err)
+		return -1
+	}
+
+	err = ioutil.WriteFile(output, data, 0644)
+	if err != nil {
+		log.Fatal("Failed to write report: ", err)
+		return -1
+	}
+	log.Printf("Wrote compliance report of %s to '%s'\n", targetName, output)
+	return 0
+}
@@ -6,26 +6,68 @@ import (
 	"io/ioutil"
 	"log"
 	"os"
-	"path"
+	"path/filepath"
+	"strings"
 	"text/tabwriter"
-
-	"github.com/justinschw/gofigure/crypto"
+	"time"
 )
 
 /*
  * DATA DEFINITIONS
  */
 
+/*
+ * Bastion that SSH connections to a target are tunnelled through
+ */
+type ProxyJump struct {
+	Address  string
+	Port     uint16
+	Username string
+}
+
 type Host struct {
 	Name     string
 	Address  string
 	Username string
 	Port     uint16
 	HomePath string
+	Hooks    []Hook `json:",omitempty"`
+	// Optional bastion for targets that can't be reached directly
+	ProxyJump *ProxyJump `json:",omitempty"`
+	// Existing private key to log in with instead of the CLI's key pair
+	IdentityFile string `json:",omitempty"`
+	// SOCKS5 or HTTP proxy SSH connections go through, 'direct' to bypass the global one
+	SshProxy string `json:",omitempty"`
+	// IANA time zone schedules run in, detected unless overridden
+	TimeZone         string `json:",omitempty"`
+	TimeZoneOverride bool   `json:",omitempty"`
+	// Commands run on this machine against Kubeconfig instead of over SSH, for devtest clusters
+	Local      bool   `json:",omitempty"`
+	Kubeconfig string `json:",omitempty"`
+	// Worker nodes joined to the target's cluster with 'target node add'
+	Nodes []ClusterNode `json:",omitempty"`
+	// Passwords kept in the OS keyring with 'target credentials set', sudo and/or ssh
+	Credentials []string `json:",omitempty"`
 }
 
 type Configuration struct {
-	Hosts []Host
+	Hosts       []Host
+	Groups      []HostGroup `json:",omitempty"`
+	Categorizer CategorizerConfig
+	// Change-management webhook that must allow every deploy
+	DeployGate DeployGateConfig
+	// Collector administrative actions are sent to
+	Audit AuditConfig
+	// Operators who review proposals; when set, only approved overrides are deployed
+	Approvers []string `json:",omitempty"`
+	// SOCKS5 or HTTP proxy SSH connections to targets go through, unless they set their own
+	SshProxy string `json:",omitempty"`
+	// Refuse commands that change policy or targets
+	ReadOnly bool `json:",omitempty"`
+	// Scoped tokens helpers run commands through the daemon with
+	Delegates []Delegate `json:",omitempty"`
+	// Where local caches and logs are kept, json (the default) or sqlite
+	LocalStore string `json:",omitempty"`
 }
 
 /*
@@ -37,7 +79,7 @@ type Configuration struct {
  */
 func loadConfig() (Configuration, error) {
 	guardianHome := GuardianConfigHome()
-	configFile := path.Join(guardianHome, "config.json")
+	configFile := filepath.Join(guardianHome, "config.json")
 	data, err := ioutil.ReadFile(configFile)
 	if err != nil {
 		return Configuration{}, err
@@ -45,8 +87,7 @@ func loadConfig() (Configuration, error) {
 	var config Configuration
 	err = json.Unmarshal([]byte(data), &config)
 	if err != nil {
-		log.Fatal("Failed to parse config file: ", err)
-		return Configuration{}, err
+		return Configuration{}, fmt.Errorf("failed to parse config file: %s", err)
 	}
 	return config, err
 }
@@ -57,19 +98,17 @@ func loadConfig() (Configuration, error) {
 func writeConfig(config Configuration) error {
 
 	guardianHome := GuardianConfigHome()
-	configFile := path.Join(guardianHome, "config.json")
+	configFile := filepath.Join(guardianHome, "config.json")
 
 	jsonString, err := json.Marshal(config)
 	if err != nil {
-		log.Fatal("Failed to marshal default config: ", err)
-		return err
+		return fmt.Errorf("failed to marshal config: %s", err)
 	}
 
 	// Create config file
-	f, err := os.Create(configFile)
+	f, err := createPrivateFile(configFile)
 	if err != nil {
-		log.Fatal("Failed to create config file: ", err)
-		return err
+		return fmt.Errorf("failed to create config file: %s", err)
 	}
 	defer f.Close()
 	_, err = f.WriteString(string(jsonString))
@@ -95,12 +134,12 @@ func FindHost(config Configuration, name string) (int, Host) {
 
 func getHostDataDir(name string) string {
 	guardianHome := GuardianConfigHome()
-	return path.Join(guardianHome, "host_data", name)
+	return filepath.Join(guardianHome, "host_data", name)
 }
 
 func getCaPathDir(name string) string {
 	hostData := getHostDataDir(name)
-	return path.Join(hostData, "rootCa.crt")
+	return filepath.Join(hostData, "rootCa.crt")
 }
 
 /*
@@ -111,12 +150,12 @@ func initLocal() error {
 
 	_, err := os.Stat(guardianHome)
 	if os.IsNotExist(err) {
-		os.MkdirAll(guardianHome, 0o755)
-		os.MkdirAll(path.Join(guardianHome, "host_data"), 0o755)
+		os.MkdirAll(guardianHome, privateDirMode)
+		os.MkdirAll(filepath.Join(guardianHome, "host_data"), privateDirMode)
 	}
 
 	// If configuration file doesn't already exist, create a default one
-	configFile := path.Join(guardianHome, "config.json")
+	configFile := filepath.Join(guardianHome, "config.json")
 	_, err = os.Stat(configFile)
 	if os.IsNotExist(err) {
 
@@ -139,15 +178,47 @@ func initLocal() error {
 /*
  * setup a new target host
  */
-func AddHost(name string, host string, port uint16, username string, noPassword bool, homePath string) int {
+func AddHost(name string, host string, port uint16, username string, noPassword bool, homePath string, jumpHost string, skipProbe bool, timeZone string, identityFile string, sshProxy string, preflight bool) int {
 
-	err := initLocal()
+	if identityFile != "" {
+		var err error
+		identityFile, err = resolveIdentityFile(identityFile)
+		if err != nil {
+			log.Fatal("Invalid identity file: ", err)
+			return -1
+		}
+	}
+
+	var jump *ProxyJump
+	if jumpHost != "" {
+		var err error
+		jump, err = parseProxyJump(jumpHost, username)
+		if err != nil {
+			log.Fatal("Invalid jump host: ", err)
+			return -1
+		}
+	}
+
+	// Catch bad input and unreachable hosts before any SSH or key work
+	err := validateTarget(name, host, port, username, jump, sshProxy, skipProbe)
 	if err != nil {
+		log.Fatal("Invalid target: ", err)
+		return -1
+	}
+	if err := validateTimeZone(timeZone); err != nil {
+		log.Fatal("Invalid target: ", err)
+		return -1
+	}
+
+	err = initLocal()
+	if err != nil {
+		log.Fatal("Failed to initialize: ", err)
 		return -1
 	}
 
 	config, err := loadConfig()
 	if err != nil {
+		log.Fatal("Failed to load config: ", err)
 		return -1
 	}
 
@@ -164,12 +235,13 @@ func AddHost(name string, host string, port uint16, username string, noPassword
 	} else {
 		hostHomePath = fmt.Sprintf("/home/%s", username)
 	}
-	newHost := Host{name, host, username, port, hostHomePath}
+	newHost := Host{Name: name, Address: host, Username: username, Port: port, HomePath: hostHomePath, ProxyJump: jump, IdentityFile: identityFile, SshProxy: sshProxy}
+	warnDuplicateHosts(config, newHost)
 
 	hostDataPath := getHostDataDir(newHost.Name)
 	_, err = os.Stat(hostDataPath)
 	if os.IsNotExist(err) {
-		os.MkdirAll(hostDataPath, 0o755)
+		os.MkdirAll(hostDataPath, privateDirMode)
 	}
 
 	err = initSsh(4096)
@@ -178,42 +250,56 @@ func AddHost(name string, host string, port uint16, username string, noPassword
 		return -1
 	}
 
-	password := os.Getenv("NEWHOST_PASSWORD")
-	if password == "" {
-		fmt.Println("Need remote password to copy keys to remote host.")
-		password, err = getUserCredentials()
-		if err != nil {
-			log.Fatal("Failed to retrieve user password: ", err)
+	// Reachability first, there is no point in asking for a password otherwise
+	var findings []doctorFinding
+	if preflight {
+		findings = preflightSsh(newHost)
+		if findings[0].Status != "ok" || findings[1].Status != "ok" {
+			reportFindings(findings)
+			log.Fatalf("Preflight failed, '%s' was not added\n", name)
 			return -1
 		}
 	}
 
-	// Copy SSH keys to remote host
-	sshClient := crypto.SshClient{
-		Address:         newHost.Address,
-		Port:            newHost.Port,
-		Username:        newHost.Username,
-		HostKeyCallback: PromptAtKey,
-		KnownHostsFile:  getKnownHostsFile(),
-	}
-
-	sshClient.SetPasswordAuth(password)
-
-	err = sshClient.NewCryptoContext()
-	if err != nil {
-		log.Fatal("Failed to establish SSH connection: ", err)
-		return -1
-	}
+	if identityFile != "" {
+		// The key is authorized on the host already, nothing to install
+		err = checkIdentityLogin(newHost)
+		if err != nil {
+			log.Fatal("Failed to log in: ", err)
+			return -1
+		}
+	} else {
+		password := os.Getenv("NEWHOST_PASSWORD")
+		if password == "" {
+			fmt.Println("Need remote password to copy keys to remote host.")
+			password, err = getUserCredentials()
+			if err != nil {
+				log.Fatal("Failed to retrieve user password: ", err)
+				return -1
+			}
+		}
 
-	pair := crypto.SshKeyPair{
-		PrivateKeyFile: getPrivateKeyFilename(),
-		PublicKeyFile:  getPublicKeyFilename(),
-		BitSize:        4096,
+		// Copy SSH keys to remote host
+		err = copyKeyToHost(newHost, password)
+		if err != nil {
+			log.Fatalf("Failed to copy keys: %s\n", err)
+			return -1
+		}
 	}
-	err = sshClient.CopyKeyToRemote(pair)
-	if err != nil {
-		log.Fatalf("Failed to copy keys: %s\n", err)
-		return -1
+	setHostTimeZone(&newHost, timeZone)
+
+	if preflight {
+		if reportFindings(append(findings, preflightRemote(newHost)...)) != 0 {
+			// Unless another target logs in to the same account with it
+			if identityFile == "" && len(findDuplicateHosts(config, newHost)) == 0 {
+				if err := unauthorizeKey(newHost); err != nil {
+					log.Printf("Warning: failed to remove the CLI's key from %s: %s\n", newHost.Address, err)
+				}
+			}
+			log.Fatalf("Preflight failed, '%s' was not added\n", name)
+			return -1
+		}
+		fmt.Fprintln(showOutput())
 	}
 
 	config.Hosts = append(config.Hosts, newHost)
@@ -235,21 +321,29 @@ func DeleteHost(name string) int {
 
 	err := initLocal()
 	if err != nil {
+		log.Fatal("Failed to initialize: ", err)
 		return -1
 	}
 
 	config, err := loadConfig()
 	if err != nil {
+		log.Fatal("Failed to load config: ", err)
 		return -1
 	}
 
-	index, _ := FindHost(config, name)
+	index, host := FindHost(config, name)
 	if index >= 0 {
+		// A failure leaves the passwords in the keyring, where they do no harm
+		if err := clearHostCredentials(&host, ""); err != nil {
+			log.Printf("Warning: failed to remove the passwords of %s from the keyring: %s\n", name, err)
+		}
 		config.Hosts = append(config.Hosts[:index], config.Hosts[index+1:]...)
+		replaceInGroups(&config, name, "")
 	}
 
 	err = writeConfig(config)
 	if err != nil {
+		log.Fatal("Failed to write config: ", err)
 		return -1
 	}
 
@@ -261,15 +355,35 @@ func DeleteHost(name string) int {
 /*
  * Update a target host
  */
-func UpdateHost(name string, host Host, noPassword bool) int {
+func UpdateHost(name string, host Host, noPassword bool, jumpHost string, timeZone string, identityFile string, sshProxy string) int {
+
+	if err := validateTimeZone(timeZone); err != nil {
+		log.Fatal("Invalid target: ", err)
+		return -1
+	}
+	if err := validateHostSshProxy(sshProxy); err != nil {
+		log.Fatal("Invalid target: ", err)
+		return -1
+	}
+
+	if jumpHost != "" {
+		jump, err := parseProxyJump(jumpHost, host.Username)
+		if err != nil {
+			log.Fatal("Invalid jump host: ", err)
+			return -1
+		}
+		host.ProxyJump = jump
+	}
 
 	err := initLocal()
 	if err != nil {
+		log.Fatal("Failed to initialize: ", err)
 		return -1
 	}
 
 	config, err := loadConfig()
 	if err != nil {
+		log.Fatal("Failed to load config: ", err)
 		return -1
 	}
 
@@ -277,8 +391,25 @@ func UpdateHost(name string, host Host, noPassword bool) int {
 		host.HomePath = fmt.Sprintf("/home/%s", host.Username)
 	}
 
-	index, _ := FindHost(config, name)
+	index, existing := FindHost(config, name)
 	if index >= 0 {
+		// Hooks are not set from the command line, keep the existing ones
+		host.Hooks = existing.Hooks
+		host.TimeZone = existing.TimeZone
+		host.TimeZoneOverride = existing.TimeZoneOverride
+		host.IdentityFile = existing.IdentityFile
+		host.SshProxy = existing.SshProxy
+		if sshProxy != "" {
+			host.SshProxy = sshProxy
+		}
+		if identityFile != "" {
+			host.IdentityFile, err = resolveIdentityFile(identityFile)
+			if err != nil {
+				log.Fatal("Invalid identity file: ", err)
+				return -1
+			}
+		}
+		warnDuplicateHosts(config, host)
 		newHosts := config.Hosts[:index]
 		newHosts = append(newHosts, host)
 		newHosts = append(newHosts, config.Hosts[index+1:]...)
@@ -288,45 +419,33 @@ func UpdateHost(name string, host Host, noPassword bool) int {
 		return -1
 	}
 
-	password := os.Getenv(fmt.Sprintf("NEWHOST_PASSWORD_%s", host.Name))
-	if password == "" {
-		fmt.Println("Need remote password to copy keys to remote host.")
-		password, err = getUserCredentials()
+	if host.IdentityFile != "" {
+		err = checkIdentityLogin(host)
+		if err != nil {
+			log.Fatal("Failed to log in: ", err)
+			return -1
+		}
+	} else {
+		password, err := hostSshPassword(host)
 		if err != nil {
 			log.Fatal("Failed to retrieve user password: ", err)
 			return -1
 		}
-	}
 
-	// Copy SSH keys to remote host
-	sshClient := crypto.SshClient{
-		Address:         host.Address,
-		Port:            host.Port,
-		Username:        host.Username,
-		HostKeyCallback: PromptAtKey,
-		KnownHostsFile:  getKnownHostsFile(),
-	}
-
-	sshClient.SetPasswordAuth(password)
-
-	err = sshClient.NewCryptoContext()
-	if err != nil {
-		log.Fatal("Failed to establish SSH connection: ", err)
-		return -1
-	}
-
-	pair := crypto.SshKeyPair{
-		PrivateKeyFile: getPrivateKeyFilename(),
-		PublicKeyFile:  getPublicKeyFilename(),
-		BitSize:        4096,
-	}
-	err = sshClient.CopyKeyToRemote(pair)
-	if err != nil {
-		return -1
+		// Copy SSH keys to remote host
+		err = copyKeyToHost(host, password)
+		if err != nil {
+			log.Fatalf("Failed to copy keys: %s\n", err)
+			return -1
+		}
 	}
+	// The host may have moved, detect its time zone again unless it was overridden
+	setHostTimeZone(&host, timeZone)
+	config.Hosts[index] = host
 
 	err = writeConfig(config)
 	if err != nil {
+		log.Fatal("Failed to write config: ", err)
 		return -1
 	}
 
@@ -338,26 +457,122 @@ func UpdateHost(name string, host Host, noPassword bool) int {
 /*
  * list configured hosts - print to stdout
  */
-func ListHosts() int {
+func ListHosts(withStatus bool) int {
 
 	err := initLocal()
 	if err != nil {
+		log.Fatal("Failed to initialize: ", err)
 		return -1
 	}
 
 	config, err := loadConfig()
 	if err != nil {
+		log.Fatal("Failed to load config: ", err)
 		return -1
 	}
 
-	fmt.Println("Configured Target Hosts")
-	w := tabwriter.NewWriter(os.Stdout, 1, 1, 3, ' ', 0)
-	fmt.Fprintln(w, "Name\tHostname/IP\tSSH port")
-	for _, host := range config.Hosts {
-		fmt.Fprintf(w, "%s\t%s\t%d\n", host.Name, host.Address, host.Port)
+	fmt.Fprintln(showOutput(), "Configured Target Hosts")
+	w := tabwriter.NewWriter(showOutput(), 1, 1, 3, ' ', 0)
+	if !withStatus {
+		fmt.Fprintln(w, "Name\tHostname/IP\tSSH port\tJump host")
+		for _, host := range config.Hosts {
+			jump := ""
+			if host.ProxyJump != nil {
+				jump = fmt.Sprintf("%s@%s:%d", host.ProxyJump.Username, host.ProxyJump.Address, host.ProxyJump.Port)
+			}
+			fmt.Fprintf(w, "%s\t%s\t%d\t%s\n", host.Name, host.Address, host.Port, jump)
+		}
+		w.Flush()
+		return 0
+	}
+
+	fmt.Fprintln(w, "Name\tHostname/IP\tSSH port\tSSH\tk3s\tRelease\tChart\tRevision\tError")
+	for _, status := range probeHosts(config.Hosts) {
+		host := status.Host
+		ssh := "down"
+		if status.Reachable {
+			ssh = "up"
+		}
+		errString := ""
+		if status.Err != nil {
+			errString = status.Err.Error()
+		}
+		fmt.Fprintf(w, "%s\t%s\t%d\t%s\t%s\t%s\t%s\t%s\t%s\n", host.Name, host.Address, host.Port, ssh, status.K3s, status.Release, status.Chart, status.Revision, errString)
 	}
 	w.Flush()
 
 	return 0
 
 }
+
+/*
+ * Show the settings of a target
+ */
+func ShowHost(name string) int {
+
+	config, err := loadConfig()
+	if err != nil {
+		log.Fatal("Failed to load config: ", err)
+		return -1
+	}
+
+	_, host := FindHost(config, name)
+	if host.Name != name {
+		log.Fatalf("Host %s doesn't exist, create it first", name)
+		return -1
+	}
+
+	zone := "unknown (UTC)"
+	if host.TimeZone != "" {
+		now := time.Now().In(hostLocation(host))
+		source := "detected"
+		if host.TimeZoneOverride {
+			source = "override"
+		}
+		zone = fmt.Sprintf("%s (%s, now %s)", host.TimeZone, source, now.Format("15:04 MST"))
+	}
+	jump := ""
+	if host.ProxyJump != nil {
+		jump = fmt.Sprintf("%s@%s:%d", host.ProxyJump.Username, host.ProxyJump.Address, host.ProxyJump.Port)
+	}
+	var groups []string
+	for _, group := range config.Groups {
+		if contains(group.Members, name) {
+			groups = append(groups, group.Name)
+		}
+	}
+
+	w := tabwriter.NewWriter(showOutput(), 1, 1, 3, ' ', 0)
+	fmt.Fprintf(w, "Name\t%s\n", host.Name)
+	fmt.Fprintf(w, "Hostname/IP\t%s\n", host.Address)
+	fmt.Fprintf(w, "SSH port\t%d\n", host.Port)
+	fmt.Fprintf(w, "Username\t%s\n", host.Username)
+	fmt.Fprintf(w, "Home path\t%s\n", host.HomePath)
+	fmt.Fprintf(w, "Jump host\t%s\n", jump)
+	identity := "CLI key"
+	if host.IdentityFile != "" {
+		identity = host.IdentityFile
+	}
+	fmt.Fprintf(w, "SSH key\t%s\n", identity)
+	sshProxy := "none"
+	if raw := hostSshProxy(host); raw != "" {
+		sshProxy = raw
+		if u, err := parseSshProxy(raw); err == nil {
+			sshProxy = u.Redacted()
+		}
+		if host.SshProxy == "" {
+			sshProxy += " (global)"
+		}
+	}
+	fmt.Fprintf(w, "SSH proxy\t%s\n", sshProxy)
+	fmt.Fprintf(w, "Time zone\t%s\n", zone)
+	fmt.Fprintf(w, "Groups\t%s\n", strings.Join(groups, ", "))
+	fmt.Fprintf(w, "Hooks\t%d\n", len(host.Hooks))
+	var nodes []string
+	for _, node := range host.Nodes {
+		nodes = append(nodes, fmt.Sprintf("%s (%s)", node.Name, node.Address))
+	}
+	fmt.Fprintf(w, "Worker nodes\t%s\n", strings.Join(nodes, ", "))
+	w.Flush()
+	return 0
+}
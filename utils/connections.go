@@ -0,0 +1,185 @@
+package utils
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// How often --watch refreshes the view
+const connectionsWatchInterval = 2 * time.Second
+
+/*
+ * A request squid is proxying right now, from its cache manager's active_requests
+ */
+type ActiveConnection struct {
+	Client      string
+	Destination string
+	Bytes       int64
+	Duration    time.Duration
+	// decrypted, tunnel (passed through undecrypted) or plain
+	Decrypt string
+}
+
+/*
+ * How squid sees a request: bumped requests have https URLs, while tunnels are
+ * CONNECTs to host:port
+ */
+func decryptStatus(uri string) (string, string) {
+	if u, err := url.Parse(uri); err == nil && u.Host != "" {
+		if u.Scheme == "https" {
+			return u.Hostname(), "decrypted"
+		}
+		return u.Hostname(), "plain"
+	}
+	if host, _, err := net.SplitHostPort(uri); err == nil {
+		return host, "tunnel"
+	}
+	return uri, "plain"
+}
+
+/*
+ * Parse the output of squid's mgr:active_requests, one 'Connection:' block per request
+ */
+func parseActiveRequests(out string) []ActiveConnection {
+	var connections []ActiveConnection
+	var current *ActiveConnection
+	for _, line := range strings.Split(strings.ReplaceAll(out, "\r", ""), "\n") {
+		line = strings.TrimSpace(line)
+		switch {
+		case strings.HasPrefix(line, "Connection:"):
+			connections = append(connections, ActiveConnection{})
+			current = &connections[len(connections)-1]
+		case current == nil:
+		case strings.HasPrefix(line, "remote:"):
+			remote := strings.TrimSpace(strings.TrimPrefix(line, "remote:"))
+			if host, _, err := net.SplitHostPort(remote); err == nil {
+				remote = host
+			}
+			current.Client = remote
+		case strings.HasPrefix(line, "uri "):
+			current.Destination, current.Decrypt = decryptStatus(strings.TrimPrefix(line, "uri "))
+		case strings.HasPrefix(line, "FD "):
+			// FD 12, read 322, wrote 4567
+			for _, part := range strings.Split(line, ",") {
+				fields := strings.Fields(part)
+				if len(fields) == 2 && (fields[0] == "read" || fields[0] == "wrote") {
+					if n, err := strconv.ParseInt(fields[1], 10, 64); err == nil {
+						current.Bytes += n
+					}
+				}
+			}
+		case strings.HasPrefix(line, "start "):
+			// start 1700000000.123456 (5.123 seconds ago)
+			if i := strings.Index(line, "("); i >= 0 {
+				ago := strings.Fields(line[i+1:])
+				if len(ago) == 0 {
+					continue
+				}
+				if seconds, err := strconv.ParseFloat(ago[0], 64); err == nil {
+					current.Duration = time.Duration(seconds * float64(time.Second))
+				}
+			}
+		}
+	}
+	return connections
+}
+
+func fetchActiveConnections(host Host) ([]ActiveConnection, error) {
+	out, err := runHostCommands(host, []string{
+		"export KUBECONFIG=/etc/rancher/k3s/k3s.yaml",
+		// squidclient is gone from newer squid, whose cache manager answers plain HTTP instead
+		fmt.Sprintf("for pod in $(kubectl -n filter get pods -l app=squid -o name); do kubectl -n filter exec $pod -- sh -c 'squidclient -h 127.0.0.1 -p %[1]d mgr:active_requests 2>/dev/null || curl -s http://127.0.0.1:%[1]d/squid-internal-mgr/active_requests'; done", e2gSquidPort),
+	}, false)
+	if err != nil {
+		return nil, err
+	}
+	return parseActiveRequests(out), nil
+}
+
+func showConnections(connections []ActiveConnection, filterConfig FilterConfig) {
+	sort.Slice(connections, func(i, j int) bool { return connections[i].Duration > connections[j].Duration })
+	w := tabwriter.NewWriter(showOutput(), 1, 1, 3, ' ', 0)
+	fmt.Fprintln(w, "Client\tDestination\tBytes\tDuration\tDecrypt")
+	for _, connection := range connections {
+		client := connection.Client
+		if known := filterConfig.findClientByAddress(client); known != nil {
+			client = fmt.Sprintf("%s (%s)", known.Name, client)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", client, connection.Destination, humanBytes(connection.Bytes),
+			connection.Duration.Round(time.Second), connection.Decrypt)
+	}
+	w.Flush()
+	fmt.Fprintf(showOutput(), "%d active connection(s)\n", len(connections))
+}
+
+/*
+ * Show the connections squid is proxying right now, optionally of one client,
+ * refreshing until interrupted with watch
+ */
+func ShowConnections(targetName string, client string, watch bool) int {
+
+	config, err := loadConfig()
+	if err != nil {
+		log.Fatal("Failed to load config: ", err)
+		return -1
+	}
+
+	_, host := FindHost(config, targetName)
+	if host.Name != targetName {
+		log.Fatalf("Host %s doesn't exist, create it first", targetName)
+		return -1
+	}
+
+	filterConfig, err := getHostFilterConfig(targetName)
+	if err != nil {
+		log.Fatal("Failed to get host config: ", err)
+		return -1
+	}
+	address := ""
+	if client != "" {
+		address = filterConfig.resolveClient(client)
+	}
+
+	for {
+		connections, err := fetchActiveConnections(host)
+		if err != nil {
+			if interruptContext.Err() != nil {
+				return 0
+			}
+			log.Fatal("Failed to get active connections: ", err)
+			return -1
+		}
+		if address != "" {
+			var matching []ActiveConnection
+			for _, connection := range connections {
+				if connection.Client == address {
+					matching = append(matching, connection)
+				}
+			}
+			connections = matching
+		}
+
+		if watch {
+			// Redraw in place, like watch(1)
+			fmt.Fprint(showOutput(), "\033[H\033[2J")
+			fmt.Fprintf(showOutput(), "Every %s on %s, Ctrl-C to stop\n\n", connectionsWatchInterval, targetName)
+		}
+		showConnections(connections, filterConfig)
+		if !watch {
+			return 0
+		}
+
+		select {
+		case <-interruptContext.Done():
+			return 0
+		case <-time.After(connectionsWatchInterval):
+		}
+	}
+}
@@ -0,0 +1,318 @@
+package utils
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// How often idle daemon connections are pinged to keep them open
+const daemonKeepAliveInterval = 30 * time.Second
+
+var errDaemonUnavailable = errors.New("daemon is not running")
+var errDaemonNoTarget = errors.New("daemon does not manage this target")
+
+/*
+ * Either commands to run on a target, or CLI arguments a delegate token runs
+ */
+type daemonRequest struct {
+	Target   string   `json:"target,omitempty"`
+	Commands []string `json:"commands,omitempty"`
+	Token    string   `json:"token,omitempty"`
+	Args     []string `json:"args,omitempty"`
+}
+
+/*
+ * The daemon streams output chunks, followed by a final message with Done set
+ */
+type daemonMessage struct {
+	Output string `json:"output,omitempty"`
+	Done   bool   `json:"done,omitempty"`
+	Error  string `json:"error,omitempty"`
+	// Exit code of a delegated command
+	Code int `json:"code,omitempty"`
+}
+
+func getDaemonSocketPath() string {
+	return filepath.Join(GuardianConfigHome(), "daemon.sock")
+}
+
+func (conn *hostConn) run(commands []string, out *json.Encoder, hangup <-chan struct{}) error {
+	session, err := conn.newSession(context.Background())
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+
+	modes := ssh.TerminalModes{
+		ssh.TTY_OP_ISPEED: 14400,
+		ssh.TTY_OP_OSPEED: 14400,
+	}
+	err = session.RequestPty("xterm", 80, 40, modes)
+	if err != nil {
+		return err
+	}
+
+	// Closing the session hangs up on the command when the CLI that asked for it goes away
+	finished := make(chan struct{})
+	defer close(finished)
+	go func() {
+		select {
+		case <-hangup:
+			session.Close()
+		case <-finished:
+		}
+	}()
+
+	session.Stdout = daemonOutputWriter{out}
+	return session.Run(strings.Join(commands, "; "))
+}
+
+/*
+ * Forwards remote output to the requesting CLI as it arrives
+ */
+type daemonOutputWriter struct {
+	out *json.Encoder
+}
+
+func (w daemonOutputWriter) Write(p []byte) (int, error) {
+	err := w.out.Encode(daemonMessage{Output: string(p)})
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+/*
+ * Serve one request. Clients on the network may only run delegated commands.
+ */
+func handleDaemonClient(c net.Conn, conns map[string]*hostConn, delegatedOnly bool) {
+	defer c.Close()
+
+	var req daemonRequest
+	err := json.NewDecoder(c).Decode(&req)
+	if err != nil {
+		log.Printf("Bad daemon request: %s\n", err)
+		return
+	}
+
+	out := json.NewEncoder(c)
+	if req.Token == "" && delegatedOnly {
+		out.Encode(daemonMessage{Done: true, Error: errDelegateToken.Error()})
+		return
+	}
+
+	// The CLI sends nothing after its request, so a read only returns once it disconnects
+	hangup := make(chan struct{})
+	go func() {
+		c.Read(make([]byte, 1))
+		close(hangup)
+	}()
+
+	if req.Token != "" {
+		out.Encode(runDelegatedCommand(req, out, hangup))
+		return
+	}
+
+	conn, ok := conns[req.Target]
+	if !ok {
+		out.Encode(daemonMessage{Done: true, Error: errDaemonNoTarget.Error()})
+		return
+	}
+
+	result := daemonMessage{Done: true}
+	if err = conn.run(req.Commands, out, hangup); err != nil {
+		result.Error = err.Error()
+	}
+	out.Encode(result)
+}
+
+/*
+ * Run commands through the daemon if it is running and manages this host
+ */
+func daemonRunCommands(ctx context.Context, host Host, script string, out io.Writer) error {
+	c, err := net.DialTimeout("unix", getDaemonSocketPath(), time.Second)
+	if err != nil {
+		return errDaemonUnavailable
+	}
+	defer c.Close()
+
+	// Disconnecting makes the daemon hang up on the command
+	finished := make(chan struct{})
+	defer close(finished)
+	go func() {
+		select {
+		case <-ctx.Done():
+			c.Close()
+		case <-finished:
+		}
+	}()
+
+	err = json.NewEncoder(c).Encode(daemonRequest{Target: host.Name, Commands: []string{script}})
+	if err != nil {
+		return errDaemonUnavailable
+	}
+
+	decoder := json.NewDecoder(c)
+	for {
+		var msg daemonMessage
+		if err = decoder.Decode(&msg); err != nil {
+			if ctx.Err() != nil {
+				return contextError(ctx, err)
+			}
+			return fmt.Errorf("lost connection to daemon: %s", err)
+		}
+		if msg.Done {
+			if msg.Error == errDaemonNoTarget.Error() {
+				return errDaemonNoTarget
+			} else if msg.Error != "" {
+				return errors.New(msg.Error)
+			}
+			return nil
+		}
+		out.Write([]byte(msg.Output))
+	}
+}
+
+/*
+ * Tokens cross the network in plaintext, so only a loopback address is served.
+ * Helpers on other machines reach it through an SSH tunnel.
+ */
+func loopbackAddress(listen string) bool {
+	host, _, err := net.SplitHostPort(listen)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	return host == "localhost" || (ip != nil && ip.IsLoopback())
+}
+
+/*
+ * Keep SSH connections to the given targets open and serve commands over a local socket,
+ * and delegated commands on listen if given
+ */
+func RunDaemon(targets []string, listen string) int {
+
+	if listen != "" && !loopbackAddress(listen) {
+		log.Fatalf("Refusing to serve delegate tokens unencrypted on '%s', listen on a loopback address such as 127.0.0.1:%s and have helpers reach it through an SSH tunnel\n",
+			listen, listen[strings.LastIndex(listen, ":")+1:])
+		return -1
+	}
+
+	config, err := loadConfig()
+	if err != nil {
+		log.Fatal("Failed to load config: ", err)
+		return -1
+	}
+
+	if len(targets) == 0 {
+		for _, host := range config.Hosts {
+			targets = append(targets, host.Name)
+		}
+	}
+
+	conns := map[string]*hostConn{}
+	for _, name := range targets {
+		_, host := FindHost(config, name)
+		if host.Name != name {
+			log.Fatalf("Host '%s' is not configured\n", name)
+			return -1
+		}
+		conn := &hostConn{host: host}
+		if _, err = conn.get(context.Background()); err != nil {
+			log.Printf("Failed to connect to '%s', will retry on first use: %s\n", name, err)
+		}
+		conns[name] = conn
+	}
+
+	socketPath := getDaemonSocketPath()
+	if c, err := net.DialTimeout("unix", socketPath, time.Second); err == nil {
+		c.Close()
+		log.Fatalf("A daemon is already listening on '%s'\n", socketPath)
+		return -1
+	}
+	os.Remove(socketPath)
+
+	// Created private, so no other user can connect before the chmod
+	umask := setUmask(0o077)
+	listener, err := net.Listen("unix", socketPath)
+	setUmask(umask)
+	if err != nil {
+		log.Fatal("Failed to open daemon socket: ", err)
+		return -1
+	}
+	if err := os.Chmod(socketPath, 0o600); err != nil {
+		listener.Close()
+		log.Fatal("Failed to restrict the daemon socket: ", err)
+		return -1
+	}
+
+	// Helpers on other machines can only use delegate tokens
+	var networkListener net.Listener
+	if listen != "" {
+		networkListener, err = net.Listen("tcp", listen)
+		if err != nil {
+			listener.Close()
+			log.Fatal("Failed to listen for delegated commands: ", err)
+			return -1
+		}
+		go func() {
+			for {
+				c, err := networkListener.Accept()
+				if err != nil {
+					return
+				}
+				go handleDaemonClient(c, conns, true)
+			}
+		}()
+		log.Printf("Serving delegated commands on %s\n", listen)
+	}
+
+	// Clean up the socket on shutdown
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signals
+		listener.Close()
+		if networkListener != nil {
+			networkListener.Close()
+		}
+	}()
+
+	go refreshThreatFeeds(targets)
+
+	go func() {
+		for range time.Tick(daemonKeepAliveInterval) {
+			for _, conn := range conns {
+				conn.keepAlive()
+			}
+		}
+	}()
+
+	log.Printf("Daemon listening on '%s' for targets: %s\n", socketPath, strings.Join(targets, ", "))
+	for {
+		c, err := listener.Accept()
+		if err != nil {
+			break
+		}
+		go handleDaemonClient(c, conns, false)
+	}
+
+	for _, conn := range conns {
+		conn.drop()
+	}
+	log.Println("Daemon stopped")
+	return 0
+}
@@ -0,0 +1,143 @@
+package utils
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+)
+
+// Postgres container of the chart; credentials come from its environment
+const guardianDbDeployment = "deploy/guardian-db"
+
+// Cron schedules for maintenance runs installed as a CronJob by the chart
+var dbMaintenanceSchedules = map[string]string{
+	"daily":   "0 3 * * *",
+	"weekly":  "0 3 * * 0",
+	"monthly": "0 3 1 * *",
+}
+
+func dbMaintenanceScheduleNames() []string {
+	var names []string
+	for name := range dbMaintenanceSchedules {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Remove category assignments and domains nothing refers to any more
+var dbPruneStatements = []string{
+	"DELETE FROM domain_category WHERE category_id NOT IN (SELECT id FROM category)",
+	"DELETE FROM domain WHERE id NOT IN (SELECT domain_id FROM domain_category)",
+}
+
+type DbMaintenanceConfig struct {
+	Enabled  bool   `yaml:"enabled"`
+	Schedule string `yaml:"schedule,omitempty"`
+}
+
+/*
+ * Run a SQL statement in the guardian database
+ */
+func runDbStatement(host Host, statement string) (string, error) {
+	return runHostCommands(host, []string{
+		"export KUBECONFIG=/etc/rancher/k3s/k3s.yaml",
+		fmt.Sprintf("kubectl -n filter exec %s -- sh -c 'PGPASSWORD=$POSTGRES_PASSWORD psql -U $POSTGRES_USER -d $POSTGRES_DB -tA -c \"%s\"'",
+			guardianDbDeployment, statement),
+	}, false)
+}
+
+func getDbSize(host Host) (string, error) {
+	out, err := runDbStatement(host, "SELECT pg_size_pretty(pg_database_size(current_database()))")
+	return strings.TrimSpace(out), err
+}
+
+/*
+ * Install or remove the scheduled maintenance CronJob
+ */
+func scheduleDbMaintenance(targetName string, schedule string) int {
+
+	config, err := getHostFilterConfig(targetName)
+	if err != nil {
+		log.Fatal("Failed to get host config: ", err)
+		return -1
+	}
+
+	if schedule == "none" {
+		config.DbMaintenance = DbMaintenanceConfig{}
+	} else {
+		cron, ok := dbMaintenanceSchedules[schedule]
+		if !ok {
+			log.Fatalf("Invalid schedule '%s', valid options are %s, none\n", schedule, strings.Join(dbMaintenanceScheduleNames(), ", "))
+			return -1
+		}
+		config.DbMaintenance = DbMaintenanceConfig{Enabled: true, Schedule: cron}
+	}
+
+	err = writeHostFilterConfig(targetName, config)
+	if err != nil {
+		log.Fatal("Failed to write host config: ", err)
+		return -1
+	}
+
+	if schedule == "none" {
+		log.Println("Removed scheduled DB maintenance; deploy to apply")
+	} else {
+		log.Printf("Scheduled %s DB maintenance; deploy to apply\n", schedule)
+	}
+	return 0
+}
+
+/*
+ * Vacuum and prune the category DB now, or schedule it to run on the target
+ */
+func MaintainDb(targetName string, schedule string) int {
+
+	if schedule != "" {
+		return scheduleDbMaintenance(targetName, schedule)
+	}
+
+	config, err := loadConfig()
+	if err != nil {
+		log.Fatal("Failed to load config: ", err)
+		return -1
+	}
+
+	_, host := FindHost(config, targetName)
+	if host.Name != targetName {
+		log.Fatalf("Host %s doesn't exist, create it first", targetName)
+		return -1
+	}
+
+	before, err := getDbSize(host)
+	if err != nil {
+		log.Fatal("Failed to reach the guardian DB: ", err)
+		return -1
+	}
+
+	for _, statement := range dbPruneStatements {
+		out, err := runDbStatement(host, statement)
+		if err != nil {
+			log.Fatal("Failed to prune the guardian DB: ", err)
+			return -1
+		}
+		log.Println(strings.TrimSpace(out))
+	}
+
+	log.Println("Running VACUUM ANALYZE...")
+	_, err = runDbStatement(host, "VACUUM ANALYZE")
+	if err != nil {
+		log.Fatal("Failed to vacuum the guardian DB: ", err)
+		return -1
+	}
+
+	after, err := getDbSize(host)
+	if err != nil {
+		log.Fatal("Failed to get the guardian DB size: ", err)
+		return -1
+	}
+
+	log.Printf("DB maintenance complete, size %s before and %s after\n", before, after)
+	return 0
+}
@@ -0,0 +1,250 @@
+package utils
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+/*
+ * Verbose logging of a deployed component, switched with the chart value Value
+ */
+type debugComponent struct {
+	// Pod label of the component's workloads
+	App   string
+	Value string
+	On    string
+	Off   string
+}
+
+var debugComponents = map[string]debugComponent{
+	"e2guardian": {App: "e2guardian", Value: "e2guardianDebug", On: "true", Off: "false"},
+	"squid":      {App: "squid", Value: "squidDebug", On: "true", Off: "false"},
+	"lookup":     {App: "guardian-angel", Value: "guardianLogLevel", On: "debug", Off: "info"},
+}
+
+/*
+ * A component left in debug mode, and when it is turned off again if it was
+ * turned on for a while
+ */
+type DebugState struct {
+	Since    time.Time
+	RevertAt time.Time `json:",omitempty"`
+}
+
+func (state DebugState) active() bool {
+	return state.RevertAt.IsZero() || time.Now().Before(state.RevertAt)
+}
+
+func getDebugStatePath(name string) string {
+	return filepath.Join(getHostDataDir(name), "debug.json")
+}
+
+/*
+ * Components of a host turned to debug with 'filter debug on', by name
+ */
+func loadDebugState(name string) map[string]DebugState {
+	states := map[string]DebugState{}
+	data, err := ioutil.ReadFile(getDebugStatePath(name))
+	if err == nil {
+		json.Unmarshal(data, &states)
+	}
+	for component, state := range states {
+		if !state.active() {
+			delete(states, component)
+		}
+	}
+	return states
+}
+
+func writeDebugState(name string, states map[string]DebugState) error {
+	if len(states) == 0 {
+		err := os.Remove(getDebugStatePath(name))
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	jsonString, err := json.Marshal(states)
+	if err != nil {
+		return err
+	}
+	os.MkdirAll(getHostDataDir(name), privateDirMode)
+	return writePrivateFile(getDebugStatePath(name), jsonString)
+}
+
+/*
+ * Components still in debug mode, for reminders
+ */
+func debugComponentsOn(name string) []string {
+	var components []string
+	for component := range loadDebugState(name) {
+		components = append(components, component)
+	}
+	sort.Strings(components)
+	return components
+}
+
+// Pid of the job on the target that turns a component's debug mode off again
+func getRemoteDebugRevertPid(host Host, component string) string {
+	return path.Join(host.HomePath, ".guardian", fmt.Sprintf("debug-revert-%s.pid", component))
+}
+
+/*
+ * Command restarting a component's workloads so they pick up new values
+ */
+func debugRestartCommand(component debugComponent) string {
+	return fmt.Sprintf("for w in $(kubectl -n filter get deployment,statefulset,daemonset -l app=%s -o name); do kubectl -n filter rollout restart $w && kubectl -n filter rollout status $w --timeout=300s; done", component.App)
+}
+
+/*
+ * Command stopping a pending revert of a component, if there is one
+ */
+func cancelDebugRevertCommand(host Host, component string) string {
+	pidFile := shellQuote(getRemoteDebugRevertPid(host, component))
+	// The job leads its own process group, which takes its sleep down with it
+	return fmt.Sprintf("if [ -f %[1]s ]; then kill -- -$(cat %[1]s) 2>/dev/null; rm -f %[1]s; fi", pidFile)
+}
+
+/*
+ * Start a job on the target that turns a component's debug mode off after a while,
+ * so it happens even if this machine is gone by then
+ */
+func scheduleDebugRevert(host Host, name string, after time.Duration) error {
+	component := debugComponents[name]
+	pidFile := shellQuote(getRemoteDebugRevertPid(host, name))
+	revert := strings.Join([]string{
+		fmt.Sprintf("sleep %d", int(after.Seconds())),
+		fmt.Sprintf("cd %s", getRemoteHelmPath(host)),
+		"export KUBECONFIG=/etc/rancher/k3s/k3s.yaml",
+		fmt.Sprintf("helm upgrade --wait --reuse-values --set %s=%s -n filter guardian-angel guardian-angel", component.Value, component.Off),
+		debugRestartCommand(component),
+		fmt.Sprintf("rm -f %s", pidFile),
+	}, "; ")
+	// Detached from the session, which is closed as soon as the job is started
+	_, err := runHostCommands(host, []string{
+		fmt.Sprintf("mkdir -p %s", shellQuote(path.Dir(getRemoteDebugRevertPid(host, name)))),
+		fmt.Sprintf("setsid nohup sh -c %s >/dev/null 2>&1 < /dev/null & echo $! > %s", shellQuote(revert), pidFile),
+	}, false)
+	return err
+}
+
+/*
+ * Forget debug mode after a deploy, which sets every value from the overrides again
+ */
+func endDebugAfterDeploy(host Host) {
+	components := debugComponentsOn(host.Name)
+	if len(components) == 0 {
+		return
+	}
+	var commands []string
+	for _, component := range components {
+		commands = append(commands, cancelDebugRevertCommand(host, component))
+	}
+	if _, err := runHostCommands(host, commands, false); err != nil {
+		log.Printf("Failed to cancel the debug revert of %s: %s\n", strings.Join(components, ", "), err)
+	}
+	if err := writeDebugState(host.Name, nil); err != nil {
+		log.Printf("Failed to clear debug state: %s\n", err)
+	}
+	log.Printf("Debug logging of %s was turned off by the deploy\n", strings.Join(components, ", "))
+}
+
+/*
+ * Turn verbose logging of a deployed component on or off, restarting it to apply.
+ * With revertAfter, the target turns it off again by itself.
+ */
+func SetDebug(targetName string, state string, componentName string, revertAfter string) int {
+
+	config, err := loadConfig()
+	if err != nil {
+		log.Fatal("Failed to load config: ", err)
+		return -1
+	}
+
+	_, host := FindHost(config, targetName)
+	if host.Name != targetName {
+		log.Fatalf("Host %s doesn't exist, create it first", targetName)
+		return -1
+	}
+
+	component, ok := debugComponents[componentName]
+	if !ok {
+		log.Fatalf("Unknown component '%s'\n", componentName)
+		return -1
+	}
+	on := state == "on"
+
+	var after time.Duration
+	if revertAfter != "" {
+		if !on {
+			log.Fatalln("--revert-after only applies to 'filter debug on'")
+			return -1
+		}
+		after, err = parseLongDuration(revertAfter)
+		if err != nil || after <= 0 {
+			log.Fatalf("Invalid duration '%s'\n", revertAfter)
+			return -1
+		}
+	}
+
+	value := component.Off
+	if on {
+		value = component.On
+	}
+	err = setReleaseValues(host, map[string]string{component.Value: value})
+	if err != nil {
+		log.Fatal("Failed to set debug logging: ", err)
+		return -1
+	}
+	// A revert still pending from an earlier 'on' is replaced
+	_, err = runHostCommands(host, []string{
+		"export KUBECONFIG=/etc/rancher/k3s/k3s.yaml",
+		cancelDebugRevertCommand(host, componentName),
+		debugRestartCommand(component),
+	}, true)
+	if err != nil {
+		log.Fatalf("Failed to restart %s: %s\n", componentName, err)
+		return -1
+	}
+
+	states := loadDebugState(targetName)
+	if !on {
+		delete(states, componentName)
+		if err := writeDebugState(targetName, states); err != nil {
+			log.Printf("Failed to record debug state: %s\n", err)
+		}
+		log.Printf("Debug logging of %s is off\n", componentName)
+		return 0
+	}
+
+	debugState := DebugState{Since: time.Now().UTC()}
+	if after > 0 {
+		err = scheduleDebugRevert(host, componentName, after)
+		if err != nil {
+			log.Fatal("Failed to schedule turning debug logging off, it stays on: ", err)
+			return -1
+		}
+		debugState.RevertAt = debugState.Since.Add(after)
+	}
+	states[componentName] = debugState
+	if err := writeDebugState(targetName, states); err != nil {
+		log.Printf("Failed to record debug state: %s\n", err)
+	}
+
+	if after > 0 {
+		log.Printf("Debug logging of %s is on until %s, when the target turns it off\n", componentName,
+			debugState.RevertAt.In(hostLocation(host)).Format("2006-01-02 15:04 MST"))
+	} else {
+		log.Printf("Debug logging of %s is on. It fills the disk and logs browsing in detail, turn it off with 'filter debug off --component %s'\n",
+			componentName, componentName)
+	}
+	return 0
+}
@@ -0,0 +1,299 @@
+package utils
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"text/tabwriter"
+)
+
+// Category the exclusions are loaded into, with a nodecrypt rule ahead of every other rule
+const decryptExclusionCategory = "pinned-apps"
+
+// Curated domains of apps and services that pin certificates and break when decrypted.
+// Updated with each release; 'filter decrypt exclusions update' loads the current lists.
+var decryptExclusionPresets = map[string][]string{
+	"mobile-apps": {
+		"apple.com", "icloud.com", "mzstatic.com", "push.apple.com",
+		"googleapis.com", "gvt1.com", "android.clients.google.com",
+		"whatsapp.com", "whatsapp.net", "signal.org", "telegram.org",
+		"fbcdn.net", "instagram.com", "spotify.com", "dropbox.com",
+	},
+	"os-updates": {
+		"windowsupdate.com", "update.microsoft.com", "delivery.mp.microsoft.com",
+		"swcdn.apple.com", "mesu.apple.com", "swscan.apple.com",
+		"dl.google.com", "archive.ubuntu.com", "security.ubuntu.com",
+	},
+	"payments": {
+		"paypal.com", "stripe.com", "apple-pay-gateway.apple.com", "pay.google.com",
+	},
+}
+
+type DecryptExclusionsConfig struct {
+	Presets []string `yaml:"presets,omitempty"`
+	// Custom domains added on top of the presets
+	Domains []string `yaml:"domains,omitempty"`
+}
+
+func decryptExclusionPresetNames() []string {
+	var names []string
+	for name := range decryptExclusionPresets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (exclusions DecryptExclusionsConfig) allDomains() []string {
+	var domains []string
+	for _, preset := range exclusions.Presets {
+		for _, domain := range decryptExclusionPresets[preset] {
+			if !contains(domains, domain) {
+				domains = append(domains, domain)
+			}
+		}
+	}
+	for _, domain := range exclusions.Domains {
+		if !contains(domains, domain) {
+			domains = append(domains, domain)
+		}
+	}
+	return domains
+}
+
+/*
+ * Make sure the exclusion category is never decrypted, whatever rules follow
+ */
+func (config *FilterConfig) addDecryptExclusionRule() {
+	if !config.AclRuleExists(decryptExclusionCategory, "nodecrypt") {
+		config.AddAclRule(decryptExclusionCategory, "nodecrypt", 0)
+		log.Printf("Added acl rule '%s=nodecrypt'\n", decryptExclusionCategory)
+	}
+}
+
+/*
+ * Load the preset and custom exclusion domains into the category DB
+ */
+func UpdateDecryptExclusions(targetName string) int {
+
+	config, err := getHostFilterConfig(targetName)
+	if err != nil {
+		log.Fatal("Failed to get host config: ", err)
+		return -1
+	}
+
+	domains := config.DecryptExclusions.allDomains()
+	if len(domains) == 0 {
+		log.Fatalln("No decryption exclusions are enabled")
+		return -1
+	}
+
+	log.Printf("Adding %d domains to category '%s'\n", len(domains), decryptExclusionCategory)
+	return Categorize(targetName, domains, decryptExclusionCategory)
+}
+
+/*
+ * Exclude a curated preset of certificate pinning apps from decryption
+ */
+func EnableDecryptExclusions(targetName string, presets []string) int {
+
+	for _, preset := range presets {
+		if _, ok := decryptExclusionPresets[preset]; !ok {
+			log.Fatalf("Unknown preset '%s', valid options are %s\n", preset, strings.Join(decryptExclusionPresetNames(), ", "))
+			return -1
+		}
+	}
+
+	config, err := getHostFilterConfig(targetName)
+	if err != nil {
+		log.Fatal("Failed to get host config: ", err)
+		return -1
+	}
+
+	for _, preset := range presets {
+		if !contains(config.DecryptExclusions.Presets, preset) {
+			config.DecryptExclusions.Presets = append(config.DecryptExclusions.Presets, preset)
+		}
+	}
+	config.addDecryptExclusionRule()
+
+	err = writeHostFilterConfig(targetName, config)
+	if err != nil {
+		log.Fatal("Failed to write host config: ", err)
+		return -1
+	}
+
+	log.Printf("Enabled decryption exclusion presets: %s\n", strings.Join(presets, ", "))
+	return UpdateDecryptExclusions(targetName)
+}
+
+/*
+ * Exclude custom domains from decryption
+ */
+func AddDecryptExclusions(targetName string, domains []string) int {
+
+	var normalized []string
+	for _, domain := range domains {
+		if err := validateHostAddress(domain); err != nil {
+			log.Fatalf("Invalid domain '%s'\n", domain)
+			return -1
+		}
+		normalized = append(normalized, strings.ToLower(domain))
+	}
+
+	config, err := getHostFilterConfig(targetName)
+	if err != nil {
+		log.Fatal("Failed to get host config: ", err)
+		return -1
+	}
+
+	for _, domain := range normalized {
+		if !contains(config.DecryptExclusions.Domains, domain) {
+			config.DecryptExclusions.Domains = append(config.DecryptExclusions.Domains, domain)
+		}
+	}
+	config.addDecryptExclusionRule()
+
+	err = writeHostFilterConfig(targetName, config)
+	if err != nil {
+		log.Fatal("Failed to write host config: ", err)
+		return -1
+	}
+
+	return Categorize(targetName, normalized, decryptExclusionCategory)
+}
+
+/*
+ * Decrypt a custom domain again. Preset domains can't be removed one by one.
+ */
+func RemoveDecryptExclusion(targetName string, domain string) int {
+
+	domain = strings.ToLower(domain)
+
+	config, err := getHostFilterConfig(targetName)
+	if err != nil {
+		log.Fatal("Failed to get host config: ", err)
+		return -1
+	}
+
+	for i := range config.DecryptExclusions.Domains {
+		if config.DecryptExclusions.Domains[i] == domain {
+			config.DecryptExclusions.Domains = append(config.DecryptExclusions.Domains[:i], config.DecryptExclusions.Domains[i+1:]...)
+			err = writeHostFilterConfig(targetName, config)
+			if err != nil {
+				log.Fatal("Failed to write host config: ", err)
+				return -1
+			}
+			return DeCategorize(targetName, []string{domain}, decryptExclusionCategory)
+		}
+	}
+
+	for _, preset := range config.DecryptExclusions.Presets {
+		if contains(decryptExclusionPresets[preset], domain) {
+			log.Fatalf("'%s' is part of preset '%s'\n", domain, preset)
+			return -1
+		}
+	}
+	log.Fatalf("'%s' is not excluded from decryption\n", domain)
+	return -1
+}
+
+func ListDecryptExclusions(targetName string) int {
+
+	config, err := getHostFilterConfig(targetName)
+	if err != nil {
+		log.Fatal("Failed to get host config: ", err)
+		return -1
+	}
+
+	w := tabwriter.NewWriter(showOutput(), 1, 1, 3, ' ', 0)
+	fmt.Fprintln(w, "Domain\tSource")
+	for _, preset := range config.DecryptExclusions.Presets {
+		for _, domain := range decryptExclusionPresets[preset] {
+			fmt.Fprintf(w, "%s\tpreset %s\n", domain, preset)
+		}
+	}
+	for _, domain := range config.DecryptExclusions.Domains {
+		fmt.Fprintf(w, "%s\tcustom\n", domain)
+	}
+	w.Flush()
+
+	return 0
+}
+
+// squid ACL matching clients whose TLS traffic is spliced instead of bumped
+const noDecryptClientsAcl = "nodecrypt_clients"
+
+/*
+ * Render the squid ssl_bump ACLs for clients exempt from decryption
+ */
+func (config *FilterConfig) sslBumpExemptions() []string {
+	var lines []string
+	for _, client := range config.Clients {
+		if !client.NoDecrypt {
+			continue
+		}
+		if client.Ip != "" {
+			lines = append(lines, fmt.Sprintf("acl %s src %s", noDecryptClientsAcl, client.Ip))
+		}
+		if client.Mac != "" {
+			// Only matches clients on the same LAN segment as the filter
+			lines = append(lines, fmt.Sprintf("acl %s arp %s", noDecryptClientsAcl, client.Mac))
+		}
+	}
+	if len(lines) > 0 {
+		lines = append(lines, fmt.Sprintf("ssl_bump splice %s", noDecryptClientsAcl))
+	}
+	return lines
+}
+
+/*
+ * Never intercept TLS for a device, i.e. IoT devices or guests without the CA
+ */
+func ExemptClientFromDecryption(targetName string, nameOrAddress string, revoke bool) int {
+
+	config, err := getHostFilterConfig(targetName)
+	if err != nil {
+		log.Fatal("Failed to get host config: ", err)
+		return -1
+	}
+
+	client := config.findClient(nameOrAddress)
+	if client == nil {
+		client = config.findClientByAddress(nameOrAddress)
+	}
+	if client == nil {
+		if revoke {
+			log.Fatalf("Client '%s' does not exist\n", nameOrAddress)
+			return -1
+		}
+		// Unknown devices are added as clients named after their address
+		added, err := newClient(nameOrAddress, nameOrAddress)
+		if err != nil {
+			log.Fatalf("'%s' is not a client name, IP or MAC address\n", nameOrAddress)
+			return -1
+		}
+		config.Clients = append(config.Clients, added)
+		client = &config.Clients[len(config.Clients)-1]
+		log.Printf("Added client '%s'\n", client.Name)
+	}
+
+	client.NoDecrypt = !revoke
+
+	err = writeHostFilterConfig(targetName, config)
+	if err != nil {
+		log.Fatal("Failed to write host config: ", err)
+		return -1
+	}
+
+	if revoke {
+		log.Printf("Client '%s' is decrypted again; deploy to apply\n", client.Name)
+	} else {
+		log.Printf("Client '%s' is exempt from decryption; deploy to apply\n", client.Name)
+	}
+	if !config.DecryptHTTPS {
+		log.Println("Note: HTTPS decryption is currently disabled")
+	}
+	return 0
+}
@@ -0,0 +1,220 @@
+package utils
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/manifoldco/promptui"
+)
+
+/*
+ * Canonical form of a host's address so names and IPs for the same machine compare equal
+ */
+func canonicalAddress(address string) string {
+	address = strings.TrimSuffix(strings.ToLower(address), ".")
+	if ip := net.ParseIP(address); ip != nil {
+		return ip.String()
+	}
+	if ips, err := net.LookupIP(address); err == nil && len(ips) > 0 {
+		return ips[0].String()
+	}
+	return address
+}
+
+/*
+ * Two targets are the same if they share an address and port, or their cached
+ * facts show the same cluster. Node names like raspberrypi are shared by many
+ * machines, so the cluster is told apart by its kube-system namespace UID.
+ */
+func sameTarget(a Host, b Host) bool {
+	if a.Port == b.Port && canonicalAddress(a.Address) == canonicalAddress(b.Address) {
+		return true
+	}
+	factsA, errA := loadClusterFacts(a.Name)
+	factsB, errB := loadClusterFacts(b.Name)
+	return errA == nil && errB == nil && factsA.ClusterId != "" && factsA.ClusterId == factsB.ClusterId
+}
+
+/*
+ * Other configured targets that manage the same host
+ */
+func findDuplicateHosts(config Configuration, host Host) []Host {
+	var duplicates []Host
+	for _, other := range config.Hosts {
+		if other.Name != host.Name && sameTarget(host, other) {
+			duplicates = append(duplicates, other)
+		}
+	}
+	return duplicates
+}
+
+func warnDuplicateHosts(config Configuration, host Host) {
+	for _, other := range findDuplicateHosts(config, host) {
+		log.Printf("Warning: target '%s' already manages %s:%d; use 'target dedupe' to merge them\n", other.Name, other.Address, other.Port)
+	}
+}
+
+/*
+ * Group targets that manage the same host
+ */
+func groupDuplicateHosts(config Configuration) [][]Host {
+	var groups [][]Host
+	grouped := map[string]bool{}
+	for i, host := range config.Hosts {
+		if grouped[host.Name] {
+			continue
+		}
+		group := []Host{host}
+		for _, other := range config.Hosts[i+1:] {
+			if !grouped[other.Name] && sameTarget(host, other) {
+				group = append(group, other)
+				grouped[other.Name] = true
+			}
+		}
+		if len(group) > 1 {
+			groups = append(groups, group)
+		}
+	}
+	return groups
+}
+
+func hostNames(hosts []Host) []string {
+	var names []string
+	for _, host := range hosts {
+		names = append(names, host.Name)
+	}
+	return names
+}
+
+/*
+ * Merge a group of duplicate targets into the one the user keeps
+ */
+func mergeDuplicateHosts(config *Configuration, group []Host) error {
+	names := hostNames(group)
+	fmt.Printf("Targets %s manage the same host.\n", strings.Join(names, ", "))
+	if err := checkInteractive("a choice of target to keep"); err != nil {
+		return err
+	}
+
+	prompt := promptui.Select{
+		Label: "Which target do you want to keep?",
+		Items: names,
+	}
+	keepIndex, keepName, err := prompt.Run()
+	if err != nil {
+		return err
+	}
+	keep := group[keepIndex]
+
+	// Pick whose overrides survive if they diverge
+	overridesFrom := keepName
+	hashes := map[string]bool{}
+	for _, name := range names {
+		if hash, err := hashHostFilterConfig(name); err == nil {
+			hashes[hash] = true
+		}
+	}
+	if len(hashes) > 1 {
+		prompt = promptui.Select{
+			Label: "Filter overrides differ, whose do you want to keep?",
+			Items: names,
+		}
+		_, overridesFrom, err = prompt.Run()
+		if err != nil {
+			return err
+		}
+	}
+	if overridesFrom != keepName {
+		data, err := ioutil.ReadFile(getHostFilterConfigPath(overridesFrom))
+		if err != nil {
+			return err
+		}
+		os.MkdirAll(getHostDataDir(keepName), privateDirMode)
+		err = ioutil.WriteFile(getHostFilterConfigPath(keepName), data, privateFileMode)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Keep the hooks of every merged target
+	for _, host := range group {
+		if host.Name == keepName {
+			continue
+		}
+		for _, hook := range host.Hooks {
+			if !containsHook(keep.Hooks, hook) {
+				keep.Hooks = append(keep.Hooks, hook)
+			}
+		}
+		index, _ := FindHost(*config, host.Name)
+		config.Hosts = append(config.Hosts[:index], config.Hosts[index+1:]...)
+		replaceInGroups(config, host.Name, keepName)
+		log.Printf("Merged target '%s' into '%s'; its data is left in %s\n", host.Name, keepName, getHostDataDir(host.Name))
+	}
+	index, _ := FindHost(*config, keepName)
+	config.Hosts[index] = keep
+
+	// Move the selection to the surviving target
+	if selected, err := os.ReadFile(filepath.Join(GuardianConfigHome(), ".target")); err == nil {
+		selectedName := strings.TrimSpace(string(selected))
+		if selectedName != keepName && contains(names, selectedName) {
+			ioutil.WriteFile(filepath.Join(GuardianConfigHome(), ".target"), []byte(keepName), privateFileMode)
+		}
+	}
+	return nil
+}
+
+func containsHook(hooks []Hook, hook Hook) bool {
+	for _, existing := range hooks {
+		if existing == hook {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+ * Find targets that manage the same host and merge them
+ */
+func DedupeHosts() int {
+
+	err := initLocal()
+	if err != nil {
+		log.Fatal("Failed to initialize: ", err)
+		return -1
+	}
+
+	config, err := loadConfig()
+	if err != nil {
+		log.Fatal("Failed to load config: ", err)
+		return -1
+	}
+
+	groups := groupDuplicateHosts(config)
+	if len(groups) == 0 {
+		fmt.Println("No duplicate targets found.")
+		return 0
+	}
+
+	for _, group := range groups {
+		err = mergeDuplicateHosts(&config, group)
+		if err != nil {
+			log.Fatal("Failed to merge targets: ", err)
+			return -1
+		}
+	}
+
+	err = writeConfig(config)
+	if err != nil {
+		log.Fatalf("Failed to write config: %s\n", err)
+		return -1
+	}
+
+	fmt.Printf("Merged %d group(s) of duplicate targets.\n", len(groups))
+	return 0
+}
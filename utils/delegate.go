@@ -0,0 +1,348 @@
+package utils
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// Start of every delegate token, so they are easy to spot in logs and secret scanners
+const delegateTokenPrefix = "gcd_"
+
+/*
+ * A scoped credential letting a helper run only the Allow commands through the
+ * daemon. Only the hash of its token is kept.
+ */
+type Delegate struct {
+	Id        string
+	Name      string `json:",omitempty"`
+	TokenHash string
+	// Command paths, where a trailing * matches every command under the words before it
+	Allow     []string
+	Expires   time.Time
+	CreatedBy string
+}
+
+// Commands that would let a delegate widen its own access
+var undelegatableCommands = []string{"delegate", "daemon"}
+
+var errDelegateToken = errors.New("invalid or revoked delegate token")
+
+/*
+ * Parse a delegate's arguments into the command they run, set by main which
+ * knows the CLI grammar
+ */
+var ParseDelegatedCommand func(args []string) (string, error)
+
+/*
+ * A command path without its <argument> placeholders, i.e. 'filter snapshot restore'
+ */
+func commandWords(command string) string {
+	var words []string
+	for _, word := range strings.Fields(command) {
+		if !strings.HasPrefix(word, "<") {
+			words = append(words, word)
+		}
+	}
+	return strings.Join(words, " ")
+}
+
+func delegatePatternMatches(pattern string, command string) bool {
+	command = commandWords(command)
+	if strings.HasSuffix(pattern, "*") {
+		prefix := strings.TrimSpace(strings.TrimSuffix(pattern, "*"))
+		return prefix == "" || command == prefix || strings.HasPrefix(command, prefix+" ")
+	}
+	return command == pattern
+}
+
+func delegateAllows(delegate Delegate, command string) bool {
+	for _, pattern := range delegate.Allow {
+		if delegatePatternMatches(pattern, command) {
+			return true
+		}
+	}
+	return false
+}
+
+func hashDelegateToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+/*
+ * The delegate a token belongs to, if it is still valid
+ */
+func findDelegate(config Configuration, token string) (Delegate, error) {
+	parts := strings.SplitN(strings.TrimPrefix(token, delegateTokenPrefix), "_", 2)
+	if !strings.HasPrefix(token, delegateTokenPrefix) || len(parts) != 2 {
+		return Delegate{}, errDelegateToken
+	}
+	hash := hashDelegateToken(token)
+	for _, delegate := range config.Delegates {
+		if delegate.Id != parts[0] || subtle.ConstantTimeCompare([]byte(delegate.TokenHash), []byte(hash)) != 1 {
+			continue
+		}
+		if time.Now().After(delegate.Expires) {
+			return Delegate{}, fmt.Errorf("delegate token expired on %s", delegate.Expires.Local().Format("2006-01-02 15:04"))
+		}
+		return delegate, nil
+	}
+	return Delegate{}, errDelegateToken
+}
+
+/*
+ * Run a delegate's command as this CLI, streaming its output to the client
+ */
+func runDelegatedCommand(req daemonRequest, out *json.Encoder, hangup <-chan struct{}) daemonMessage {
+	config, err := loadConfig()
+	if err != nil {
+		return daemonMessage{Done: true, Error: fmt.Sprintf("failed to load config: %s", err)}
+	}
+	// Looked up on every request, so revoking takes effect without a restart
+	delegate, err := findDelegate(config, req.Token)
+	if err != nil {
+		return daemonMessage{Done: true, Error: err.Error()}
+	}
+	command, err := ParseDelegatedCommand(req.Args)
+	if err != nil {
+		return daemonMessage{Done: true, Error: err.Error()}
+	}
+	if !delegateAllows(delegate, command) {
+		log.Printf("Refused '%s' for delegate %s\n", commandWords(command), delegate.Id)
+		return daemonMessage{Done: true, Error: fmt.Sprintf("the token does not allow '%s'", commandWords(command))}
+	}
+
+	executable, err := os.Executable()
+	if err != nil {
+		return daemonMessage{Done: true, Error: err.Error()}
+	}
+	// Nobody is there to answer prompts
+	cmd := exec.Command(executable, append([]string{"--non-interactive"}, req.Args...)...)
+	// Without the token, which would send the command back here
+	for _, env := range os.Environ() {
+		if !strings.HasPrefix(env, "GUARDIAN_DELEGATE_TOKEN=") {
+			cmd.Env = append(cmd.Env, env)
+		}
+	}
+	cmd.Env = append(cmd.Env, fmt.Sprintf("GUARDIAN_DELEGATE=%s", delegate.label()))
+	writer := daemonOutputWriter{out}
+	cmd.Stdout = writer
+	cmd.Stderr = writer
+	log.Printf("Delegate %s runs '%s'\n", delegate.label(), commandWords(command))
+	if err := cmd.Start(); err != nil {
+		return daemonMessage{Done: true, Error: err.Error()}
+	}
+	exited := make(chan struct{})
+	defer close(exited)
+	go func() {
+		select {
+		case <-hangup:
+			cmd.Process.Signal(os.Interrupt)
+		case <-exited:
+		}
+	}()
+	err = cmd.Wait()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return daemonMessage{Done: true, Code: exitErr.ExitCode()}
+	} else if err != nil {
+		return daemonMessage{Done: true, Error: err.Error()}
+	}
+	return daemonMessage{Done: true}
+}
+
+func (delegate Delegate) label() string {
+	if delegate.Name == "" {
+		return delegate.Id
+	}
+	return fmt.Sprintf("%s (%s)", delegate.Name, delegate.Id)
+}
+
+/*
+ * Run a command through the daemon with a delegate token instead of this machine's
+ * config, for helpers without admin access. address is the daemon's --listen address,
+ * or empty for its socket on this machine.
+ */
+func RunDelegated(token string, address string, args []string) int {
+	var c net.Conn
+	var err error
+	if address != "" {
+		c, err = net.DialTimeout("tcp", address, targetProbeTimeout)
+	} else {
+		c, err = net.DialTimeout("unix", getDaemonSocketPath(), targetProbeTimeout)
+	}
+	if err != nil {
+		log.Fatalf("Failed to reach the daemon: %s\n", err)
+		return -1
+	}
+	defer c.Close()
+
+	err = json.NewEncoder(c).Encode(daemonRequest{Token: token, Args: args})
+	if err != nil {
+		log.Fatalf("Failed to send the command: %s\n", err)
+		return -1
+	}
+	in := json.NewDecoder(c)
+	for {
+		var msg daemonMessage
+		if err := in.Decode(&msg); err != nil {
+			log.Fatalf("Lost the daemon: %s\n", err)
+			return -1
+		}
+		if msg.Output != "" {
+			os.Stdout.WriteString(msg.Output)
+		}
+		if msg.Done {
+			if msg.Error != "" {
+				log.Fatalln(msg.Error)
+				return -1
+			}
+			return msg.Code
+		}
+	}
+}
+
+/*
+ * Create a token allowing only the given commands until it expires, for a helper
+ * running them through the daemon. commands are all the CLI's command paths.
+ */
+func CreateDelegate(allow string, expires string, name string, commands []string) int {
+
+	config, err := loadConfig()
+	if err != nil {
+		log.Fatal("Failed to load config: ", err)
+		return -1
+	}
+
+	var patterns []string
+	for _, pattern := range strings.Split(allow, ",") {
+		pattern = strings.Join(strings.Fields(pattern), " ")
+		if pattern == "" {
+			continue
+		}
+		matched := false
+		for _, command := range commands {
+			if !delegatePatternMatches(pattern, command) {
+				continue
+			}
+			matched = true
+			for _, forbidden := range undelegatableCommands {
+				if delegatePatternMatches(forbidden+" *", command) {
+					log.Fatalf("'%s' would allow '%s', which can't be delegated\n", pattern, commandWords(command))
+					return -1
+				}
+			}
+		}
+		if !matched {
+			log.Fatalf("'%s' matches no command\n", pattern)
+			return -1
+		}
+		patterns = append(patterns, pattern)
+	}
+	if len(patterns) == 0 {
+		log.Fatalln("Give the commands to allow with --allow")
+		return -1
+	}
+
+	lifetime, err := parseLongDuration(expires)
+	if err != nil || lifetime <= 0 {
+		log.Fatalf("Invalid duration '%s'\n", expires)
+		return -1
+	}
+
+	secret := make([]byte, 24)
+	idBytes := make([]byte, 4)
+	if _, err := rand.Read(secret); err != nil {
+		log.Fatal("Failed to generate token: ", err)
+		return -1
+	}
+	if _, err := rand.Read(idBytes); err != nil {
+		log.Fatal("Failed to generate token: ", err)
+		return -1
+	}
+	id := hex.EncodeToString(idBytes)
+	token := fmt.Sprintf("%s%s_%s", delegateTokenPrefix, id, hex.EncodeToString(secret))
+
+	delegate := Delegate{
+		Id:        id,
+		Name:      name,
+		TokenHash: hashDelegateToken(token),
+		Allow:     patterns,
+		Expires:   time.Now().Add(lifetime).UTC(),
+		CreatedBy: getOperator(),
+	}
+	config.Delegates = append(config.Delegates, delegate)
+	err = writeConfig(config)
+	if err != nil {
+		log.Fatal("Failed to write config: ", err)
+		return -1
+	}
+
+	log.Printf("Created delegate %s allowing %s until %s\n", delegate.label(), strings.Join(patterns, ", "),
+		delegate.Expires.Local().Format("2006-01-02 15:04"))
+	log.Println("Give the helper this token, it is not shown again. They run commands with it set in GUARDIAN_DELEGATE_TOKEN, through a running 'daemon'")
+	fmt.Println(token)
+	return 0
+}
+
+func ListDelegates() int {
+
+	config, err := loadConfig()
+	if err != nil {
+		log.Fatal("Failed to load config: ", err)
+		return -1
+	}
+
+	w := tabwriter.NewWriter(showOutput(), 1, 1, 3, ' ', 0)
+	fmt.Fprintln(w, "Id\tName\tAllow\tExpires\tCreated by")
+	for _, delegate := range config.Delegates {
+		expires := delegate.Expires.Local().Format("2006-01-02 15:04")
+		if time.Now().After(delegate.Expires) {
+			expires += " (expired)"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", delegate.Id, delegate.Name, strings.Join(delegate.Allow, ", "), expires, delegate.CreatedBy)
+	}
+	w.Flush()
+	return 0
+}
+
+func RevokeDelegate(id string) int {
+
+	config, err := loadConfig()
+	if err != nil {
+		log.Fatal("Failed to load config: ", err)
+		return -1
+	}
+
+	var kept []Delegate
+	for _, delegate := range config.Delegates {
+		if delegate.Id != id {
+			kept = append(kept, delegate)
+		}
+	}
+	if len(kept) == len(config.Delegates) {
+		log.Fatalf("No delegate with id '%s'\n", id)
+		return -1
+	}
+	config.Delegates = kept
+	err = writeConfig(config)
+	if err != nil {
+		log.Fatal("Failed to write config: ", err)
+		return -1
+	}
+
+	log.Printf("Revoked delegate %s\n", id)
+	return 0
+}
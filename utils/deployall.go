@@ -0,0 +1,145 @@
+package utils
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"text/tabwriter"
+	"time"
+)
+
+/*
+ * Outcome of a multi-target deploy, written for CI and used by --resume
+ */
+type DeploySummary struct {
+	Started  time.Time      `json:"started"`
+	Finished time.Time      `json:"finished"`
+	Message  string         `json:"message,omitempty"`
+	Results  []DeployResult `json:"results"`
+}
+
+type DeployResult struct {
+	Target string `json:"target"`
+	// success, failed, or hook-failed when only a post-deploy hook failed
+	Result   string  `json:"result"`
+	Error    string  `json:"error,omitempty"`
+	Duration float64 `json:"durationSeconds"`
+}
+
+func getDeploySummaryPath() string {
+	return filepath.Join(GuardianConfigHome(), "deploy-summary.json")
+}
+
+func loadDeploySummary(summaryFile string) (DeploySummary, error) {
+	var summary DeploySummary
+	data, err := ioutil.ReadFile(summaryFile)
+	if err != nil {
+		return summary, err
+	}
+	err = json.Unmarshal(data, &summary)
+	return summary, err
+}
+
+func writeDeploySummary(summaryFile string, summary DeploySummary) error {
+	data, err := json.MarshalIndent(summary, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(summaryFile, data, 0o644)
+}
+
+/*
+ * Deploy to every target, or with resume only those that failed last run
+ */
+func DeployAll(message string, forceUnlock bool, force bool, resume bool, summaryFile string) int {
+
+	if summaryFile == "" {
+		summaryFile = getDeploySummaryPath()
+	}
+
+	config, err := loadConfig()
+	if err != nil {
+		log.Fatal("Failed to load config: ", err)
+		return -1
+	}
+
+	var hosts []Host
+	if resume {
+		last, err := loadDeploySummary(summaryFile)
+		if err != nil {
+			log.Fatal("Failed to load last deploy summary: ", err)
+			return -1
+		}
+		for _, result := range last.Results {
+			if result.Result == "success" {
+				continue
+			}
+			if _, host := FindHost(config, result.Target); host.Name == result.Target {
+				hosts = append(hosts, host)
+			} else {
+				log.Printf("Skipping target '%s', it no longer exists\n", result.Target)
+			}
+		}
+		if len(hosts) == 0 {
+			fmt.Println("Nothing to resume, every target deployed successfully last run.")
+			return 0
+		}
+	} else {
+		hosts = config.Hosts
+	}
+
+	// Every target deploys the same chart, a failed checkout fails each of them
+	// in the summary rather than ending the run
+	checkoutErr := checkoutHelm(true)
+	if checkoutErr != nil {
+		checkoutErr = fmt.Errorf("failed to check out the chart: %s", checkoutErr)
+	}
+
+	summary := DeploySummary{Started: time.Now().UTC(), Message: message}
+	for _, host := range hosts {
+		stopOutput := PrefixTargetOutput(host.Name)
+		start := time.Now()
+		err := checkoutErr
+		if err == nil {
+			err = deployHost(host, message, forceUnlock, force)
+		}
+		result := DeployResult{Target: host.Name, Result: "success", Duration: time.Since(start).Seconds()}
+		if err == errPostDeployHook {
+			result.Result = "hook-failed"
+			result.Error = err.Error()
+		} else if err != nil {
+			log.Println(err)
+			result.Result = "failed"
+			result.Error = err.Error()
+		}
+		stopOutput()
+		summary.Results = append(summary.Results, result)
+	}
+	summary.Finished = time.Now().UTC()
+
+	err = writeDeploySummary(summaryFile, summary)
+	if err != nil {
+		log.Printf("Failed to write deploy summary: %s\n", err)
+	}
+
+	failed := 0
+	w := tabwriter.NewWriter(os.Stdout, 1, 1, 3, ' ', 0)
+	fmt.Fprintln(w, "Target\tResult\tError")
+	for _, result := range summary.Results {
+		fmt.Fprintf(w, "%s\t%s\t%s\n", result.Target, result.Result, result.Error)
+		if result.Result != "success" {
+			failed++
+		}
+	}
+	w.Flush()
+
+	if failed > 0 {
+		fmt.Printf("%d of %d targets failed; retry them with 'filter deploy --resume'. Summary written to %s\n", failed, len(summary.Results), summaryFile)
+		return -1
+	}
+	fmt.Printf("All %d targets deployed. Summary written to %s\n", len(summary.Results), summaryFile)
+	return 0
+}
@@ -0,0 +1,167 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+/*
+ * An external change-management service every deploy must be allowed by. It is
+ * called as POST <Url> with the DeployPlan as JSON and must answer 200 with
+ * {"allow": true}; anything else, including no answer, stops the deploy.
+ */
+type DeployGateConfig struct {
+	Url string
+	Key string `json:",omitempty"`
+}
+
+// Change-management systems may wait on a human, but not forever
+const deployGateTimeout = 60 * time.Second
+
+/*
+ * Summary of a deploy sent to the gate
+ */
+type DeployPlan struct {
+	Target        string           `json:"target"`
+	Address       string           `json:"address"`
+	Operator      string           `json:"operator"`
+	Message       string           `json:"message,omitempty"`
+	ChartVersion  string           `json:"chartVersion"`
+	ReleaseTag    string           `json:"releaseTag"`
+	OverridesHash string           `json:"overridesHash"`
+	Changes       []ProposedChange `json:"changes"`
+}
+
+type deployGateAnswer struct {
+	Allow  bool   `json:"allow"`
+	Reason string `json:"reason"`
+}
+
+/*
+ * Ask the deploy gate whether a deploy may go ahead, an error if it may not
+ */
+func checkDeployGate(gate DeployGateConfig, plan DeployPlan) error {
+	body, err := json.Marshal(plan)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, gate.Url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if gate.Key != "" {
+		req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", gate.Key))
+	}
+
+	client := &http.Client{Timeout: deployGateTimeout}
+	resp, err := client.Do(req.WithContext(interruptContext))
+	if err != nil {
+		return fmt.Errorf("deploy gate unreachable: %s", err)
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	var answer deployGateAnswer
+	json.Unmarshal(data, &answer)
+	if resp.StatusCode != 200 {
+		if answer.Reason != "" {
+			return fmt.Errorf("deploy gate answered %d: %s", resp.StatusCode, answer.Reason)
+		}
+		return fmt.Errorf("deploy gate answered %d", resp.StatusCode)
+	}
+	if !answer.Allow {
+		if answer.Reason == "" {
+			return errors.New("deploy gate did not allow the deploy")
+		}
+		return fmt.Errorf("deploy gate did not allow the deploy: %s", answer.Reason)
+	}
+	return nil
+}
+
+/*
+ * Send the plan of a deploy to the configured gate, if there is one. Secrets in
+ * the changes are masked, the gate only learns that they changed.
+ */
+func runDeployGate(host Host, filterConfig FilterConfig, message string, chartVersion string, overridesHash string) error {
+	config, err := loadConfig()
+	if err != nil || config.DeployGate.Url == "" {
+		return err
+	}
+
+	done := progressStep(host.Name, "deploy-gate")
+	overrides, err := renderDeployOverrides(host.Name)
+	if err != nil {
+		done(err)
+		return err
+	}
+	changes, err := overridesChanges(host, overrides)
+	if err != nil {
+		done(err)
+		return err
+	}
+	err = checkDeployGate(config.DeployGate, DeployPlan{
+		Target:        host.Name,
+		Address:       host.Address,
+		Operator:      getOperator(),
+		Message:       message,
+		ChartVersion:  chartVersion,
+		ReleaseTag:    filterConfig.ReleaseTag,
+		OverridesHash: overridesHash,
+		Changes:       changes,
+	})
+	done(err)
+	if err == nil {
+		log.Printf("Deploy allowed by %s\n", config.DeployGate.Url)
+	}
+	return err
+}
+
+/*
+ * Configure the deploy gate, an empty url disables it
+ */
+func SetDeployGate(gateUrl string, key string) int {
+
+	err := initLocal()
+	if err != nil {
+		log.Fatal("Failed to initialize: ", err)
+		return -1
+	}
+
+	config, err := loadConfig()
+	if err != nil {
+		log.Fatal("Failed to load config: ", err)
+		return -1
+	}
+
+	if gateUrl != "" {
+		if u, err := url.Parse(gateUrl); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			log.Fatalf("Invalid deploy gate url '%s'\n", gateUrl)
+			return -1
+		}
+	}
+
+	config.DeployGate = DeployGateConfig{Url: gateUrl, Key: key}
+	err = writeConfig(config)
+	if err != nil {
+		log.Fatal("Failed to write config: ", err)
+		return -1
+	}
+
+	if gateUrl == "" {
+		log.Println("Deploy gate disabled")
+	} else {
+		log.Printf("Deploys must now be allowed by %s\n", gateUrl)
+	}
+	return 0
+}
@@ -0,0 +1,280 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// Name of the local target devtest deploys to
+const DevtestTarget = "devtest"
+
+// Local cluster tools devtest can create a cluster with
+var DevtestProviders = []string{"kind", "k3d"}
+
+// Remote commands point kubectl and helm at k3s this way
+const k3sKubeconfigExport = "export KUBECONFIG=/etc/rancher/k3s/k3s.yaml"
+
+func getDevtestDir() string {
+	return filepath.Join(GuardianConfigHome(), "devtest")
+}
+
+/*
+ * Point the commands that use k3s's kubeconfig at the local target's cluster
+ */
+func localCommands(host Host, commands []string) []string {
+	var rewritten []string
+	for _, command := range commands {
+		if command == k3sKubeconfigExport {
+			command = fmt.Sprintf("export KUBECONFIG=%s", shellQuote(host.Kubeconfig))
+		}
+		rewritten = append(rewritten, command)
+	}
+	return rewritten
+}
+
+/*
+ * Run a script on this machine against a local target's cluster, like runSshCommands does over SSH
+ */
+func runLocalCommands(ctx context.Context, host Host, script string, out io.Writer) error {
+	cmd := exec.CommandContext(ctx, "sh", "-c", script)
+	cmd.Env = append(os.Environ(), fmt.Sprintf("KUBECONFIG=%s", host.Kubeconfig))
+	cmd.Stdout = out
+	cmd.Stderr = os.Stderr
+	err := cmd.Run()
+	if err != nil {
+		return contextError(ctx, err)
+	}
+	return nil
+}
+
+/*
+ * A target whose commands run on this machine against the cluster in kubeconfig
+ */
+func NewLocalHost(name string, kubeconfig string) Host {
+	return Host{
+		Name:       name,
+		Address:    "127.0.0.1",
+		HomePath:   filepath.Join(getDevtestDir(), name),
+		Local:      true,
+		Kubeconfig: kubeconfig,
+	}
+}
+
+/*
+ * Run commands on a configured target, for scripting and tests
+ */
+func RunTargetCommands(name string, commands []string) (string, error) {
+	config, err := loadConfig()
+	if err != nil {
+		return "", err
+	}
+	_, host := FindHost(config, name)
+	if host.Name != name {
+		return "", fmt.Errorf("host '%s' is not configured", name)
+	}
+	return runHostCommands(host, commands, false)
+}
+
+/*
+ * Write the kubeconfig of a local cluster, creating the cluster if it doesn't exist
+ */
+func devtestCluster(provider string, cluster string, kubeconfig string) error {
+	if _, err := exec.LookPath(provider); err != nil {
+		return fmt.Errorf("%s is not installed", provider)
+	}
+
+	var list, create, getConfig *exec.Cmd
+	if provider == "kind" {
+		list = exec.Command("kind", "get", "clusters")
+		create = exec.Command("kind", "create", "cluster", "--name", cluster, "--wait", "120s")
+		getConfig = exec.Command("kind", "get", "kubeconfig", "--name", cluster)
+	} else {
+		list = exec.Command("k3d", "cluster", "list", "--no-headers")
+		create = exec.Command("k3d", "cluster", "create", cluster, "--wait")
+		getConfig = exec.Command("k3d", "kubeconfig", "get", cluster)
+	}
+
+	out, err := list.Output()
+	if err != nil {
+		return fmt.Errorf("failed to list clusters: %s", err)
+	}
+	exists := false
+	for _, line := range strings.Split(string(out), "\n") {
+		if fields := strings.Fields(line); len(fields) > 0 && fields[0] == cluster {
+			exists = true
+		}
+	}
+	if !exists {
+		log.Printf("Creating %s cluster '%s'...\n", provider, cluster)
+		create.Stdout = os.Stdout
+		create.Stderr = os.Stderr
+		if err := create.Run(); err != nil {
+			return fmt.Errorf("failed to create cluster: %s", err)
+		}
+	}
+
+	out, err = getConfig.Output()
+	if err != nil {
+		return fmt.Errorf("failed to get kubeconfig: %s", err)
+	}
+	return ioutil.WriteFile(kubeconfig, out, privateFileMode)
+}
+
+/*
+ * Create a local kind or k3d cluster and add it as the devtest target
+ */
+func DevtestUp(provider string, cluster string) int {
+
+	if !contains(DevtestProviders, provider) {
+		log.Fatalf("Invalid provider '%s', valid options are %s\n", provider, strings.Join(DevtestProviders, ", "))
+		return -1
+	}
+	for _, tool := range []string{"kubectl", "helm"} {
+		if _, err := exec.LookPath(tool); err != nil {
+			log.Fatalf("%s is not installed\n", tool)
+			return -1
+		}
+	}
+
+	err := initLocal()
+	if err != nil {
+		log.Fatal("Failed to initialize: ", err)
+		return -1
+	}
+
+	err = os.MkdirAll(getDevtestDir(), 0o755)
+	if err != nil {
+		log.Fatal("Failed to create devtest directory: ", err)
+		return -1
+	}
+	kubeconfig := filepath.Join(getDevtestDir(), fmt.Sprintf("%s.kubeconfig", cluster))
+	err = devtestCluster(provider, cluster, kubeconfig)
+	if err != nil {
+		log.Fatal("Failed to set up cluster: ", err)
+		return -1
+	}
+
+	config, err := loadConfig()
+	if err != nil {
+		log.Fatal("Failed to load config: ", err)
+		return -1
+	}
+
+	host := NewLocalHost(DevtestTarget, kubeconfig)
+	if index, existing := FindHost(config, DevtestTarget); index >= 0 {
+		if !existing.Local {
+			log.Fatalf("Target '%s' already exists and is not a devtest target\n", DevtestTarget)
+			return -1
+		}
+		config.Hosts[index] = host
+	} else {
+		config.Hosts = append(config.Hosts, host)
+	}
+
+	err = writeConfig(config)
+	if err != nil {
+		log.Fatal("Failed to write config: ", err)
+		return -1
+	}
+
+	log.Printf("Target '%s' uses %s cluster '%s'; run 'devtest run' or any filter command with --target %s\n", DevtestTarget, provider, cluster, DevtestTarget)
+	return 0
+}
+
+/*
+ * Run a step of devtest as its own command against the devtest target. Commands
+ * end the process on failure, so running them here would skip reporting it.
+ */
+func runDevtestStep(args []string) error {
+	executable, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	// Nobody is there to answer prompts in CI
+	cmd := exec.Command(executable, append([]string{"--non-interactive"}, append(args, "--target", DevtestTarget)...)...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	err = cmd.Run()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return fmt.Errorf("exited with code %d", exitErr.ExitCode())
+	}
+	return err
+}
+
+/*
+ * Exercise the deploy, acl and list workflows end to end against the devtest target
+ */
+func DevtestRun() int {
+
+	config, err := loadConfig()
+	if err != nil {
+		log.Fatal("Failed to load config: ", err)
+		return -1
+	}
+	if _, host := FindHost(config, DevtestTarget); host.Name != DevtestTarget || !host.Local {
+		log.Fatalln("No devtest target; run 'devtest up' first")
+		return -1
+	}
+
+	steps := []struct {
+		name string
+		args []string
+	}{
+		{"deploy", []string{"filter", "deploy", "--message", "devtest", "--force-unlock"}},
+		{"add acl rule", []string{"filter", "acl", "add", "devtest", "deny", "--create"}},
+		{"show acl rules", []string{"filter", "acl", "show"}},
+		{"add phrase list", []string{"filter", "phrase-list", "add-list", "devtest"}},
+		{"add phrase", []string{"filter", "phrase-list", "add-phrase", "devtest", "devtest phrase"}},
+		{"show phrase list", []string{"filter", "phrase-list", "show", "--name", "devtest"}},
+		{"redeploy", []string{"filter", "deploy", "--message", "devtest with policy", "--force-unlock"}},
+		{"remove phrase list", []string{"filter", "phrase-list", "remove-list", "devtest"}},
+		{"delete acl rule", []string{"filter", "acl", "delete", "devtest", "deny"}},
+	}
+
+	for _, step := range steps {
+		log.Printf("== %s\n", step.name)
+		if err := runDevtestStep(step.args); err != nil {
+			log.Printf("Step '%s' failed: %s\n", step.name, err)
+			return -1
+		}
+	}
+
+	log.Println("All devtest steps passed")
+	return 0
+}
+
+/*
+ * Delete the local cluster and the devtest target
+ */
+func DevtestDown(provider string, cluster string) int {
+
+	if !contains(DevtestProviders, provider) {
+		log.Fatalf("Invalid provider '%s', valid options are %s\n", provider, strings.Join(DevtestProviders, ", "))
+		return -1
+	}
+
+	var cmd *exec.Cmd
+	if provider == "kind" {
+		cmd = exec.Command("kind", "delete", "cluster", "--name", cluster)
+	} else {
+		cmd = exec.Command("k3d", "cluster", "delete", cluster)
+	}
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		log.Printf("Failed to delete cluster: %s\n", err)
+	}
+
+	os.RemoveAll(getDevtestDir())
+	os.RemoveAll(getHostDataDir(DevtestTarget))
+	return DeleteHost(DevtestTarget)
+}
@@ -0,0 +1,317 @@
+package utils
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// Site fetched through the proxy to see which certificate clients are shown
+const doctorTestSite = "www.example.com:443"
+
+// Clock difference beyond which certificates and tokens start failing
+const maxClockSkew = 30 * time.Second
+
+type doctorFinding struct {
+	Check  string
+	Status string // ok, warn, fail or skipped
+	Detail string
+	Hint   string
+}
+
+/*
+ * Open a TLS connection through squid and return the certificates it presents
+ */
+func proxiedPeerCertificates(proxyAddress string, site string) ([]*x509.Certificate, error) {
+	conn, err := net.DialTimeout("tcp", proxyAddress, 5*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+
+	fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", site, site)
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("proxy answered CONNECT with %s", resp.Status)
+	}
+
+	host, _, _ := net.SplitHostPort(site)
+	client := tls.Client(conn, &tls.Config{ServerName: host, InsecureSkipVerify: true})
+	err = client.Handshake()
+	if err != nil {
+		return nil, err
+	}
+	return client.ConnectionState().PeerCertificates, nil
+}
+
+func verifyChain(certs []*x509.Certificate, roots *x509.CertPool, site string) error {
+	host, _, _ := net.SplitHostPort(site)
+	intermediates := x509.NewCertPool()
+	for _, cert := range certs[1:] {
+		intermediates.AddCert(cert)
+	}
+	_, err := certs[0].Verify(x509.VerifyOptions{DNSName: host, Roots: roots, Intermediates: intermediates})
+	return err
+}
+
+/*
+ * Check that intercepted sites chain to the filter CA and that a client here trusts it
+ */
+func doctorCheckCa(host Host, config FilterConfig) doctorFinding {
+	finding := doctorFinding{Check: "CA trusted"}
+	if !config.DecryptHTTPS {
+		finding.Status = "skipped"
+		finding.Detail = "HTTPS decryption is disabled"
+		return finding
+	}
+
+	caPem, err := ioutil.ReadFile(getCaPathDir(host.Name))
+	if err != nil {
+		finding.Status = "fail"
+		finding.Detail = "no root CA on file"
+		finding.Hint = "Deploy the filter, or fetch the CA again with 'filter deploy'"
+		return finding
+	}
+	guardianRoots := x509.NewCertPool()
+	guardianRoots.AppendCertsFromPEM(caPem)
+
+	certs, err := proxiedPeerCertificates(net.JoinHostPort(host.Address, strconv.Itoa(config.SquidPublicPort)), doctorTestSite)
+	if err != nil {
+		finding.Status = "skipped"
+		finding.Detail = fmt.Sprintf("could not connect through the proxy: %s", err)
+		return finding
+	}
+
+	if verifyChain(certs, guardianRoots, doctorTestSite) != nil {
+		finding.Status = "fail"
+		finding.Detail = fmt.Sprintf("%s is not signed by the CA on file", doctorTestSite)
+		finding.Hint = "The CA changed since it was last fetched; redeploy and reinstall it on clients with 'filter certificate serve-ca'"
+		return finding
+	}
+
+	systemRoots, err := x509.SystemCertPool()
+	if err != nil || verifyChain(certs, systemRoots, doctorTestSite) != nil {
+		finding.Status = "fail"
+		finding.Detail = "this machine does not trust the filter CA"
+		finding.Hint = "Install the CA on clients; 'filter certificate serve-ca' serves it with instructions per platform"
+		return finding
+	}
+
+	finding.Status = "ok"
+	finding.Detail = fmt.Sprintf("%s is intercepted and trusted", doctorTestSite)
+	return finding
+}
+
+/*
+ * Check nothing else, typically the systemd-resolved stub, holds the DNS port
+ */
+func doctorCheckDnsPort(host Host, config FilterConfig) doctorFinding {
+	finding := doctorFinding{Check: "DNS port"}
+	port := config.PublicDnsPort
+	if port == 0 {
+		port = 53
+	}
+
+	out, err := runHostCommands(host, []string{
+		fmt.Sprintf("sudo -n ss -Hlnup 'sport = :%d' 2>/dev/null || ss -Hlnup 'sport = :%d'", port, port),
+	}, false)
+	if err != nil {
+		finding.Status = "skipped"
+		finding.Detail = err.Error()
+		return finding
+	}
+
+	if strings.Contains(out, "systemd-resolve") {
+		finding.Status = "fail"
+		finding.Detail = fmt.Sprintf("systemd-resolved is listening on port %d", port)
+		finding.Hint = "Set DNSStubListener=no in /etc/systemd/resolved.conf and run 'sudo systemctl restart systemd-resolved'"
+		return finding
+	}
+	for _, process := range []string{"dnsmasq", "named", "unbound"} {
+		if strings.Contains(out, process) {
+			finding.Status = "fail"
+			finding.Detail = fmt.Sprintf("%s is listening on port %d", process, port)
+			finding.Hint = fmt.Sprintf("Stop and disable %s on the target, or move it to another port", process)
+			return finding
+		}
+	}
+
+	finding.Status = "ok"
+	finding.Detail = fmt.Sprintf("port %d is free or held by the filter", port)
+	return finding
+}
+
+/*
+ * Check squid answers from here, and whether here is inside the LAN CIDR it serves
+ */
+func doctorCheckSquid(host Host, config FilterConfig) doctorFinding {
+	finding := doctorFinding{Check: "Squid reachable"}
+	address := net.JoinHostPort(host.Address, strconv.Itoa(config.SquidPublicPort))
+
+	_, lan, err := net.ParseCIDR(config.LocalNetwork)
+	if err != nil {
+		finding.Status = "fail"
+		finding.Detail = fmt.Sprintf("invalid local network '%s'", config.LocalNetwork)
+		finding.Hint = "Set localNetwork to the LAN CIDR, i.e. 192.168.1.0/24"
+		return finding
+	}
+
+	conn, err := net.DialTimeout("tcp", address, 5*time.Second)
+	if err != nil {
+		finding.Status = "fail"
+		finding.Detail = fmt.Sprintf("cannot connect to %s: %s", address, err)
+		finding.Hint = fmt.Sprintf("Check squid is running ('target list --status') and no firewall on the target blocks port %d", config.SquidPublicPort)
+		return finding
+	}
+	local := conn.LocalAddr().(*net.TCPAddr).IP
+	conn.Close()
+
+	if !lan.Contains(local) {
+		finding.Status = "warn"
+		finding.Detail = fmt.Sprintf("reachable, but this machine (%s) is outside the local network %s", local, lan)
+		finding.Hint = "Squid only serves the local network; if clients are refused, check localNetwork matches the LAN"
+		return finding
+	}
+
+	finding.Status = "ok"
+	finding.Detail = fmt.Sprintf("%s answers from %s", address, local)
+	return finding
+}
+
+/*
+ * Check the category DB has anything in it to filter with
+ */
+func doctorCheckCategoryDb(host Host) doctorFinding {
+	finding := doctorFinding{Check: "Category DB"}
+	out, err := runDbStatement(host, "SELECT count(*) FROM domain_category")
+	if err != nil {
+		finding.Status = "skipped"
+		finding.Detail = err.Error()
+		return finding
+	}
+	count, err := strconv.Atoi(strings.TrimSpace(out))
+	if err != nil {
+		finding.Status = "skipped"
+		finding.Detail = fmt.Sprintf("unexpected output '%s'", strings.TrimSpace(out))
+		return finding
+	}
+	if count == 0 {
+		finding.Status = "fail"
+		finding.Detail = "no domains are categorized"
+		finding.Hint = "Load categories with 'filter acl categorize-domain' or 'filter threat-feed enable'; nothing is filtered by category until then"
+		return finding
+	}
+	finding.Status = "ok"
+	finding.Detail = fmt.Sprintf("%d categorized domains", count)
+	return finding
+}
+
+/*
+ * Check the target's clock agrees with this machine's
+ */
+func doctorCheckClock(host Host) doctorFinding {
+	finding := doctorFinding{Check: "Clock skew"}
+	before := time.Now()
+	out, err := runHostCommands(host, []string{"date +%s"}, false)
+	if err != nil {
+		finding.Status = "skipped"
+		finding.Detail = err.Error()
+		return finding
+	}
+	seconds, err := strconv.ParseInt(strings.TrimSpace(out), 10, 64)
+	if err != nil {
+		finding.Status = "skipped"
+		finding.Detail = fmt.Sprintf("unexpected output '%s'", strings.TrimSpace(out))
+		return finding
+	}
+	// Compare against the middle of the round trip
+	local := before.Add(time.Since(before) / 2)
+	skew := time.Unix(seconds, 0).Sub(local).Round(time.Second)
+	if skew < 0 {
+		skew = -skew
+	}
+	if skew > maxClockSkew {
+		finding.Status = "fail"
+		finding.Detail = fmt.Sprintf("target clock is off by %s", skew)
+		finding.Hint = "Enable time sync on the target with 'sudo timedatectl set-ntp true'; skew breaks certificates and API tokens"
+		return finding
+	}
+	finding.Status = "ok"
+	finding.Detail = fmt.Sprintf("within %s", maxClockSkew)
+	return finding
+}
+
+/*
+ * Run checks for the most common failure modes and suggest fixes
+ */
+func Doctor(targetName string) int {
+
+	config, err := loadConfig()
+	if err != nil {
+		log.Fatal("Failed to load config: ", err)
+		return -1
+	}
+
+	_, host := FindHost(config, targetName)
+	if host.Name != targetName {
+		log.Fatalf("Host %s doesn't exist, create it first", targetName)
+		return -1
+	}
+
+	filterConfig, err := getHostFilterConfig(targetName)
+	if err != nil {
+		log.Fatal("Failed to get host config: ", err)
+		return -1
+	}
+
+	findings := []doctorFinding{
+		doctorCheckClock(host),
+		doctorCheckDnsPort(host, filterConfig),
+		doctorCheckSquid(host, filterConfig),
+		doctorCheckCa(host, filterConfig),
+		doctorCheckCategoryDb(host),
+	}
+
+	return reportFindings(findings)
+}
+
+/*
+ * Print findings as a table followed by the hints, failing if any check failed
+ */
+func reportFindings(findings []doctorFinding) int {
+	w := tabwriter.NewWriter(showOutput(), 1, 1, 3, ' ', 0)
+	fmt.Fprintln(w, "Check\tStatus\tDetail")
+	for _, finding := range findings {
+		fmt.Fprintf(w, "%s\t%s\t%s\n", finding.Check, finding.Status, finding.Detail)
+	}
+	w.Flush()
+
+	failed := false
+	for _, finding := range findings {
+		if finding.Hint == "" {
+			continue
+		}
+		if finding.Status == "fail" {
+			failed = true
+		}
+		fmt.Fprintf(showOutput(), "\n%s: %s\n", finding.Check, finding.Hint)
+	}
+
+	if failed {
+		return -1
+	}
+	return 0
+}
@@ -0,0 +1,136 @@
+package utils
+
+import (
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+	"text/tabwriter"
+)
+
+var extensionPattern = regexp.MustCompile(`^[a-z0-9]{1,10}$`)
+
+type DownloadsConfig struct {
+	// Largest download allowed, i.e. 500M
+	MaxSize string `yaml:"maxSize,omitempty"`
+	// Block every download except the exception extensions
+	BlanketBlock        bool     `yaml:"blanketBlock"`
+	BlockExtensions     []string `yaml:"blockExtensions,omitempty"`
+	ExceptionExtensions []string `yaml:"exceptionExtensions,omitempty"`
+	// Downloads sent to the content scanners
+	ScanExtensions []string `yaml:"scanExtensions,omitempty"`
+}
+
+/*
+ * Normalize file extensions to lower case without the leading dot
+ */
+func normalizeExtensions(extensions []string) ([]string, error) {
+	var normalized []string
+	for _, extension := range extensions {
+		extension = strings.ToLower(strings.TrimPrefix(strings.TrimSpace(extension), "."))
+		if extension == "" {
+			continue
+		}
+		if !extensionPattern.MatchString(extension) {
+			return nil, fmt.Errorf("invalid extension '%s'", extension)
+		}
+		if !contains(normalized, extension) {
+			normalized = append(normalized, extension)
+		}
+	}
+	return normalized, nil
+}
+
+func validateDownloads(downloads DownloadsConfig) error {
+	if downloads.MaxSize != "" {
+		if size, err := parseQuantity(downloads.MaxSize); err != nil || size <= 0 {
+			return fmt.Errorf("invalid max size '%s', expected a size like 500M or 2Gi", downloads.MaxSize)
+		}
+	}
+	for _, extension := range downloads.BlockExtensions {
+		if contains(downloads.ScanExtensions, extension) {
+			return fmt.Errorf("'%s' is both blocked and scanned", extension)
+		}
+		if contains(downloads.ExceptionExtensions, extension) {
+			return fmt.Errorf("'%s' is both blocked and an exception", extension)
+		}
+	}
+	if downloads.BlanketBlock && len(downloads.ExceptionExtensions) == 0 {
+		log.Println("Warning: blanket block without exception extensions blocks every download")
+	}
+	return nil
+}
+
+/*
+ * Set download size limits and which file types are blocked or scanned.
+ * Only the options given are changed; an empty extension list clears it.
+ */
+func SetDownloads(targetName string, maxSize string, blanketBlock string, blockExtensions []string, exceptionExtensions []string, scanExtensions []string) int {
+
+	config, err := getHostFilterConfig(targetName)
+	if err != nil {
+		log.Fatal("Failed to get host config: ", err)
+		return -1
+	}
+
+	downloads := config.Downloads
+	if maxSize != "" {
+		downloads.MaxSize = maxSize
+	}
+	if blanketBlock != "" {
+		downloads.BlanketBlock = blanketBlock == "on"
+	}
+	if blockExtensions != nil {
+		downloads.BlockExtensions, err = normalizeExtensions(blockExtensions)
+	}
+	if err == nil && exceptionExtensions != nil {
+		downloads.ExceptionExtensions, err = normalizeExtensions(exceptionExtensions)
+	}
+	if err == nil && scanExtensions != nil {
+		downloads.ScanExtensions, err = normalizeExtensions(scanExtensions)
+	}
+	if err == nil {
+		err = validateDownloads(downloads)
+	}
+	if err != nil {
+		log.Fatal("Invalid download settings: ", err)
+		return -1
+	}
+	if len(downloads.ScanExtensions) > 0 && len(config.Scanners) == 0 {
+		log.Println("Warning: no content scanner configured; add one with 'filter scanner add'")
+	}
+	config.Downloads = downloads
+
+	err = writeHostFilterConfig(targetName, config)
+	if err != nil {
+		log.Fatal("Failed to write host config: ", err)
+		return -1
+	}
+
+	log.Println("Updated download controls; deploy to apply")
+	return 0
+}
+
+func ShowDownloads(targetName string) int {
+
+	config, err := getHostFilterConfig(targetName)
+	if err != nil {
+		log.Fatal("Failed to get host config: ", err)
+		return -1
+	}
+
+	downloads := config.Downloads
+	maxSize := downloads.MaxSize
+	if maxSize == "" {
+		maxSize = "unlimited"
+	}
+
+	w := tabwriter.NewWriter(showOutput(), 1, 1, 3, ' ', 0)
+	fmt.Fprintf(w, "Max size\t%s\n", maxSize)
+	fmt.Fprintf(w, "Blanket block\t%t\n", downloads.BlanketBlock)
+	fmt.Fprintf(w, "Blocked\t%s\n", strings.Join(downloads.BlockExtensions, ", "))
+	fmt.Fprintf(w, "Exceptions\t%s\n", strings.Join(downloads.ExceptionExtensions, ", "))
+	fmt.Fprintf(w, "Scanned\t%s\n", strings.Join(downloads.ScanExtensions, ", "))
+	w.Flush()
+	return 0
+}
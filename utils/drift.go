@@ -0,0 +1,191 @@
+package utils
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"gopkg.in/yaml.v2"
+)
+
+const driftValueWidth = 40
+
+// Keys of overrides holding passwords and keys, i.e. smtp.password or vpn.privateKey
+var secretValuePattern = regexp.MustCompile(`(?i)(password|passwordhash|privatekey|secret|token)$`)
+
+const redactedValue = "********"
+
+/*
+ * Flatten nested YAML values into dotted keys, i.e. {a: {b: 1}} to a.b=1.
+ * Empty values are dropped so a missing key and an empty one compare equal.
+ */
+func flattenValues(prefix string, value interface{}, out map[string]interface{}) {
+	switch v := value.(type) {
+	case map[interface{}]interface{}:
+		for key, child := range v {
+			name := fmt.Sprint(key)
+			if prefix != "" {
+				name = prefix + "." + name
+			}
+			flattenValues(name, child, out)
+		}
+	case nil:
+	case string:
+		if v != "" {
+			out[prefix] = v
+		}
+	case []interface{}:
+		if len(v) > 0 {
+			out[prefix] = v
+		}
+	default:
+		out[prefix] = v
+	}
+}
+
+func parseFlatValues(data []byte) (map[string]interface{}, error) {
+	var values map[interface{}]interface{}
+	err := yaml.Unmarshal(data, &values)
+	if err != nil {
+		return nil, err
+	}
+	flat := map[string]interface{}{}
+	flattenValues("", values, flat)
+	return flat, nil
+}
+
+/*
+ * Values deployed on the target, as helm reports them
+ */
+func getDeployedValues(host Host) (map[string]interface{}, error) {
+	out, err := runHostCommands(host, []string{
+		"export KUBECONFIG=/etc/rancher/k3s/k3s.yaml",
+		"helm get values -n filter guardian-angel -o yaml",
+	}, false)
+	if err != nil {
+		return nil, err
+	}
+	return parseFlatValues([]byte(out))
+}
+
+/*
+ * A value with any secrets in it masked, for changes that leave this machine
+ */
+func redactValue(key string, value interface{}) interface{} {
+	if secretValuePattern.MatchString(key[strings.LastIndex(key, ".")+1:]) {
+		return redactedValue
+	}
+	switch v := value.(type) {
+	case map[interface{}]interface{}:
+		redacted := map[interface{}]interface{}{}
+		for childKey, child := range v {
+			redacted[childKey] = redactValue(fmt.Sprint(childKey), child)
+		}
+		return redacted
+	case []interface{}:
+		redacted := make([]interface{}, len(v))
+		for i, child := range v {
+			redacted[i] = redactValue("", child)
+		}
+		return redacted
+	}
+	return value
+}
+
+func formatDriftValue(value interface{}, ok bool) string {
+	if !ok {
+		return "-"
+	}
+	s := fmt.Sprint(value)
+	if len(s) > driftValueWidth {
+		s = s[:driftValueWidth-3] + "..."
+	}
+	return s
+}
+
+/*
+ * Compare the local overrides with the values deployed on the target
+ */
+func ShowDrift(targetName string) int {
+
+	config, err := loadConfig()
+	if err != nil {
+		log.Fatal("Failed to load config: ", err)
+		return -1
+	}
+
+	_, host := FindHost(config, targetName)
+	if host.Name != targetName {
+		log.Fatalf("Host %s doesn't exist, create it first", targetName)
+		return -1
+	}
+
+	// As a deploy would render them, or derived values always look drifted
+	data, err := renderDeployOverrides(targetName)
+	if err != nil {
+		log.Fatal("Failed to read host config: ", err)
+		return -1
+	}
+	local, err := parseFlatValues(data)
+	if err != nil {
+		log.Fatal("Failed to parse host config: ", err)
+		return -1
+	}
+
+	defaults := map[string]interface{}{}
+	data, err = ioutil.ReadFile(filepath.Join(getHelmPath(), "guardian-angel", "values.yaml"))
+	if err == nil {
+		defaults, err = parseFlatValues(data)
+	}
+	if err != nil {
+		log.Printf("Chart defaults are unavailable: %s\n", err)
+	}
+
+	deployed, err := getDeployedValues(host)
+	if err != nil {
+		log.Fatal("Failed to get deployed values, has the filter been deployed? ", err)
+		return -1
+	}
+
+	keys := map[string]bool{}
+	for key := range local {
+		keys[key] = true
+	}
+	for key := range deployed {
+		keys[key] = true
+	}
+	var drifted []string
+	for key := range keys {
+		if !reflect.DeepEqual(local[key], deployed[key]) {
+			drifted = append(drifted, key)
+		}
+	}
+	sort.Strings(drifted)
+
+	if len(drifted) == 0 {
+		fmt.Fprintln(showOutput(), "No drift: deployed values match the local overrides.")
+		return 0
+	}
+
+	w := tabwriter.NewWriter(showOutput(), 1, 1, 3, ' ', 0)
+	fmt.Fprintln(w, "Key\tLocal\tDeployed\tChart default")
+	for _, key := range drifted {
+		localValue, inLocal := local[key]
+		deployedValue, inDeployed := deployed[key]
+		defaultValue, inDefaults := defaults[key]
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", key,
+			formatDriftValue(localValue, inLocal),
+			formatDriftValue(deployedValue, inDeployed),
+			formatDriftValue(defaultValue, inDefaults))
+	}
+	w.Flush()
+
+	fmt.Fprintf(showOutput(), "%d value(s) differ. Deploy to apply the local overrides, or 'filter adopt --force' to take the deployed values.\n", len(drifted))
+	return 0
+}
@@ -0,0 +1,217 @@
+package utils
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Where a standalone install keeps its configuration; list includes use absolute paths
+const e2gConfDir = "/etc/e2guardian"
+
+// Port squid listens on behind e2guardian in a standalone install
+const e2gSquidPort = 3128
+
+// Main list files every filter group refers to, by e2guardianf1.conf option
+var e2gMainLists = []string{
+	"bannedphraselist", "weightedphraselist", "exceptionphraselist",
+	"bannedsitelist", "bannedregexpurllist", "bannedmimetypelist", "bannedextensionlist",
+	"exceptionsitelist", "exceptionregexpurllist", "exceptionmimetypelist", "exceptionextensionlist",
+}
+
+func phraseListFile(list PhraseList) string {
+	var b strings.Builder
+	for _, group := range list.Groups {
+		if group.GroupName != "" {
+			fmt.Fprintf(&b, "#listcategory: \"%s\"\n", group.GroupName)
+		}
+		for _, phrase := range group.Phrases {
+			// Terms of a combination phrase are comma separated
+			var terms []string
+			for _, term := range phrase.Phrase {
+				terms = append(terms, fmt.Sprintf("<%s>", term))
+			}
+			b.WriteString(strings.Join(terms, ","))
+			if list.Weighted {
+				fmt.Fprintf(&b, "<%d>", phrase.Weight)
+			}
+			b.WriteString("\n")
+		}
+		b.WriteString("\n")
+	}
+	return b.String()
+}
+
+func contentListFile(list ContentList) string {
+	var b strings.Builder
+	for _, group := range list.Groups {
+		if group.GroupName != "" {
+			fmt.Fprintf(&b, "#listcategory: \"%s\"\n", group.GroupName)
+		}
+		for _, item := range group.Items {
+			b.WriteString(item + "\n")
+		}
+		b.WriteString("\n")
+	}
+	return b.String()
+}
+
+/*
+ * Build each main list from the .Include lines of the lists included in it
+ */
+func e2gMainListFiles(conf E2guardianConfig) map[string]string {
+	includes := map[string][]string{}
+	for _, name := range e2gMainLists {
+		includes[name] = nil
+	}
+	for _, list := range append(conf.PhraseLists, conf.WeightedPhraseLists...) {
+		for _, main := range list.IncludeIn {
+			includes[main] = append(includes[main], list.ListName)
+		}
+	}
+	for _, list := range conf.Lists {
+		for _, main := range list.IncludeIn {
+			includes[main] = append(includes[main], list.ListName)
+		}
+	}
+
+	files := map[string]string{}
+	for main, names := range includes {
+		var b strings.Builder
+		fmt.Fprintf(&b, "# %s, generated by guardian-cli\n", main)
+		for _, name := range names {
+			fmt.Fprintf(&b, ".Include<%s>\n", path.Join(e2gConfDir, "lists", name))
+		}
+		files[main] = b.String()
+	}
+	return files
+}
+
+func e2guardianConf(config FilterConfig) string {
+	language := config.BlockPage.Language
+	if language == "" {
+		language = "ukenglish"
+	}
+	port := config.SquidPublicPort
+	if port == 0 {
+		port = 8080
+	}
+	conf := fmt.Sprintf(`# e2guardian.conf, generated by guardian-cli
+filterports = %d
+proxyip = 127.0.0.1
+proxyport = %d
+filtergroups = 1
+filtergroupslist = '%s/lists/filtergroupslist'
+languagedir = '/usr/share/e2guardian/languages'
+language = '%s'
+loglevel = 3
+logfileformat = 1
+loglocation = '/var/log/e2guardian/access.log'
+maxchildren = 180
+`, port, e2gSquidPort, e2gConfDir, language)
+	if config.E2gStats.Enabled {
+		conf += fmt.Sprintf("dstatlocation = '%s'\ndstatinterval = %d\n", e2gStatsPath, config.E2gStats.interval())
+	}
+	return conf
+}
+
+func e2guardianGroupConf() string {
+	var b strings.Builder
+	b.WriteString("# e2guardianf1.conf, generated by guardian-cli\n")
+	b.WriteString("groupname = 'default'\n")
+	b.WriteString("naughtynesslimit = 50\n")
+	for _, main := range e2gMainLists {
+		fmt.Fprintf(&b, "%s = '%s'\n", main, path.Join(e2gConfDir, "lists", main))
+	}
+	return b.String()
+}
+
+func squidConf(config FilterConfig) string {
+	localNetwork := config.LocalNetwork
+	if localNetwork == "" {
+		localNetwork = "192.168.0.0/16"
+	}
+	conf := fmt.Sprintf(`# squid.conf, generated by guardian-cli
+# Clients connect to e2guardian, which forwards to squid on localhost
+http_port 127.0.0.1:%d
+acl localnet src %s
+acl localhost src 127.0.0.1/32
+`, e2gSquidPort, localNetwork)
+	// Snippet ACLs must come before the final deny
+	if config.SquidSnippet != "" {
+		conf += "\n# Custom snippet\n" + config.SquidSnippet + "\n"
+	}
+	if len(config.Upstream.SquidLines) > 0 {
+		conf += "\n# Upstream proxy\n" + strings.Join(config.Upstream.SquidLines, "\n") + "\n"
+	}
+	return conf + `http_access allow localhost
+http_access allow localnet
+http_access deny all
+cache_dir ufs /var/spool/squid 1000 16 256
+coredump_dir /var/spool/squid
+`
+}
+
+/*
+ * Write out the host's policy as a classic e2guardian and squid configuration
+ */
+func ExportE2guardian(targetName string, outputDir string) int {
+
+	config, err := getHostFilterConfig(targetName)
+	if err != nil {
+		log.Fatal("Failed to get host config: ", err)
+		return -1
+	}
+
+	files := map[string]string{
+		filepath.Join("e2guardian", "e2guardian.conf"):           e2guardianConf(config),
+		filepath.Join("e2guardian", "e2guardianf1.conf"):         e2guardianGroupConf(),
+		filepath.Join("e2guardian", "lists", "filtergroupslist"): "# All users are in the default group\n",
+		filepath.Join("squid", "squid.conf"):                     squidConf(config),
+	}
+	for main, contents := range e2gMainListFiles(config.E2guardianConf) {
+		files[filepath.Join("e2guardian", "lists", main)] = contents
+	}
+	for _, list := range append(config.E2guardianConf.PhraseLists, config.E2guardianConf.WeightedPhraseLists...) {
+		files[filepath.Join("e2guardian", "lists", list.ListName)] = phraseListFile(list)
+	}
+	for _, list := range config.E2guardianConf.Lists {
+		files[filepath.Join("e2guardian", "lists", list.ListName)] = contentListFile(list)
+	}
+
+	var names []string
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fileName := filepath.Join(outputDir, name)
+		err = os.MkdirAll(filepath.Dir(fileName), 0o755)
+		if err != nil {
+			log.Fatal("Failed to create output directory: ", err)
+			return -1
+		}
+		err = ioutil.WriteFile(fileName, []byte(files[name]), 0o644)
+		if err != nil {
+			log.Fatal("Failed to write config file: ", err)
+			return -1
+		}
+	}
+
+	log.Printf("Wrote %d files to %s\n", len(names), outputDir)
+	if len(config.AllowRules) > 0 || len(config.DecryptRules) > 0 {
+		log.Println("Warning: category ACL rules depend on the guardian lookup service and were not exported")
+	}
+	if len(config.Geo.Rules) > 0 {
+		log.Println("Warning: geo rules depend on the GeoIP database deployed with the stack and were not exported")
+	}
+	if config.DecryptHTTPS {
+		log.Println("Warning: HTTPS decryption needs a CA and ssl_bump setup in squid.conf, which was not exported")
+	}
+	return 0
+}
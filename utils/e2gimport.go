@@ -0,0 +1,309 @@
+package utils
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var e2gOptionPattern = regexp.MustCompile(`^\s*(\w+)\s*=\s*'?([^'#]*)'?`)
+var e2gIncludePattern = regexp.MustCompile(`^\s*\.Include<([^>]+)>`)
+var e2gCategoryPattern = regexp.MustCompile(`^\s*#listcategory:\s*"?([^"]*)"?`)
+var e2gPhrasePattern = regexp.MustCompile(`<([^>]*)>`)
+
+// Reads a file of the installation being imported
+type e2gReader func(fileName string) (string, error)
+
+/*
+ * Import state shared while walking the filter groups
+ */
+type e2gImport struct {
+	read     e2gReader
+	confDir  string
+	conf     E2guardianConfig
+	imported map[string]string
+	warnings []string
+}
+
+/*
+ * Map the paths in the configuration onto where it is being read from
+ */
+func (imp *e2gImport) resolve(fileName string) string {
+	fileName = strings.ReplaceAll(fileName, "__LISTDIR__", path.Join(imp.confDir, "lists"))
+	fileName = strings.ReplaceAll(fileName, "__CONFDIR__", imp.confDir)
+	if strings.HasPrefix(fileName, e2gConfDir+"/") {
+		fileName = path.Join(imp.confDir, strings.TrimPrefix(fileName, e2gConfDir+"/"))
+	}
+	return fileName
+}
+
+/*
+ * Name a list after its path under the lists directory, i.e. blacklists-ads-domains
+ */
+func (imp *e2gImport) listName(fileName string) string {
+	name := strings.TrimPrefix(fileName, path.Join(imp.confDir, "lists")+"/")
+	return strings.ReplaceAll(strings.TrimPrefix(name, "/"), "/", "-")
+}
+
+func (imp *e2gImport) warn(format string, args ...interface{}) {
+	imp.warnings = append(imp.warnings, fmt.Sprintf(format, args...))
+}
+
+/*
+ * Split a list file into its #listcategory groups
+ */
+func parseE2gListGroups(contents string) ([]string, map[string][]string, bool) {
+	var order []string
+	groups := map[string][]string{}
+	group := ""
+	timed := false
+	for _, line := range strings.Split(strings.ReplaceAll(contents, "\r", ""), "\n") {
+		line = strings.TrimSpace(line)
+		if match := e2gCategoryPattern.FindStringSubmatch(line); match != nil {
+			group = match[1]
+			continue
+		}
+		if strings.HasPrefix(line, "#time:") {
+			timed = true
+			continue
+		}
+		if line == "" || strings.HasPrefix(line, "#") || e2gIncludePattern.MatchString(line) {
+			continue
+		}
+		if _, ok := groups[group]; !ok {
+			order = append(order, group)
+		}
+		groups[group] = append(groups[group], line)
+	}
+	return order, groups, timed
+}
+
+func parseE2gPhrase(line string, weighted bool) (Phrase, bool) {
+	var terms []string
+	for _, match := range e2gPhrasePattern.FindAllStringSubmatch(line, -1) {
+		terms = append(terms, match[1])
+	}
+	if len(terms) == 0 {
+		return Phrase{}, false
+	}
+	phrase := Phrase{Phrase: terms}
+	if weighted && len(terms) > 1 {
+		if weight, err := strconv.Atoi(terms[len(terms)-1]); err == nil {
+			phrase = Phrase{Phrase: terms[:len(terms)-1], Weight: weight}
+		}
+	}
+	return phrase, true
+}
+
+/*
+ * Turn one list file into a phrase or content list included in the main list
+ */
+func (imp *e2gImport) importList(listName string, fileName string, mainList string) {
+	// A list shared by several main lists or filter groups is read once
+	contents := ""
+	if previous, ok := imp.imported[listName]; ok {
+		if previous != fileName {
+			imp.warn("skipped %s, a list named '%s' was already imported from %s", fileName, listName, previous)
+			return
+		}
+	} else {
+		var err error
+		contents, err = imp.read(fileName)
+		if err != nil {
+			imp.warn("skipped %s: %s", fileName, err)
+			return
+		}
+		if imp.conf.findPhraseList(listName) != nil || imp.conf.findWeightedPhraseList(listName) != nil || imp.conf.findContentList(listName) != nil {
+			imp.warn("list '%s' already exists, only its includes were updated", listName)
+		}
+		imp.imported[listName] = fileName
+	}
+	order, groups, timed := parseE2gListGroups(contents)
+	if timed {
+		imp.warn("list '%s' has #time: limits, which are not supported and were dropped", listName)
+	}
+
+	if strings.HasSuffix(mainList, "phraselist") {
+		weighted := mainList == "weightedphraselist"
+		phraseList := imp.conf.findPhraseList(listName)
+		if weighted {
+			phraseList = imp.conf.findWeightedPhraseList(listName)
+		}
+		if phraseList == nil {
+			list := PhraseList{ListName: listName, Weighted: weighted}
+			for _, group := range order {
+				phraseGroup := PhraseGroup{GroupName: group}
+				for _, line := range groups[group] {
+					if phrase, ok := parseE2gPhrase(line, weighted); ok {
+						phraseGroup.Phrases = append(phraseGroup.Phrases, phrase)
+					}
+				}
+				list.Groups = append(list.Groups, phraseGroup)
+			}
+			if weighted {
+				imp.conf.WeightedPhraseLists = append(imp.conf.WeightedPhraseLists, list)
+				phraseList = &imp.conf.WeightedPhraseLists[len(imp.conf.WeightedPhraseLists)-1]
+			} else {
+				imp.conf.PhraseLists = append(imp.conf.PhraseLists, list)
+				phraseList = &imp.conf.PhraseLists[len(imp.conf.PhraseLists)-1]
+			}
+		}
+		if phraseList.findInclude(mainList) == "" {
+			phraseList.IncludeIn = append(phraseList.IncludeIn, mainList)
+		}
+		return
+	}
+
+	listType := ""
+	for t, name := range banLists {
+		if name == mainList {
+			listType = t
+		}
+	}
+	for t, name := range allowLists {
+		if name == mainList {
+			listType = t
+		}
+	}
+	contentList := imp.conf.findContentList(listName)
+	if contentList == nil {
+		list := ContentList{ListName: listName, Type: listType}
+		for _, group := range order {
+			list.Groups = append(list.Groups, ContentGroup{GroupName: group, Items: groups[group]})
+		}
+		imp.conf.Lists = append(imp.conf.Lists, list)
+		contentList = &imp.conf.Lists[len(imp.conf.Lists)-1]
+	} else if contentList.Type != listType {
+		imp.warn("list '%s' is a %s, not including it in %s", listName, contentList.Type, mainList)
+		return
+	}
+	if contentList.findInclude(mainList) == "" {
+		contentList.IncludeIn = append(contentList.IncludeIn, mainList)
+	}
+}
+
+/*
+ * Import the lists one filter group's main lists refer to
+ */
+func (imp *e2gImport) importGroup(groupConf string) error {
+	contents, err := imp.read(groupConf)
+	if err != nil {
+		return err
+	}
+
+	for _, line := range strings.Split(strings.ReplaceAll(contents, "\r", ""), "\n") {
+		match := e2gOptionPattern.FindStringSubmatch(line)
+		if match == nil {
+			continue
+		}
+		option, value := match[1], strings.TrimSpace(match[2])
+		if strings.Contains(option, "time") {
+			imp.warn("%s: option '%s' has no equivalent and was skipped", path.Base(groupConf), option)
+			continue
+		}
+		if !contains(e2gMainLists, option) {
+			continue
+		}
+
+		mainFile := imp.resolve(value)
+		mainContents, err := imp.read(mainFile)
+		if err != nil {
+			imp.warn("skipped %s: %s", option, err)
+			continue
+		}
+		for _, entry := range strings.Split(strings.ReplaceAll(mainContents, "\r", ""), "\n") {
+			if include := e2gIncludePattern.FindStringSubmatch(entry); include != nil {
+				fileName := imp.resolve(include[1])
+				imp.importList(imp.listName(fileName), fileName, option)
+			}
+		}
+		// Entries kept directly in the main list become a list of their own
+		if order, _, _ := parseE2gListGroups(mainContents); len(order) > 0 {
+			imp.importList("imported-"+option, mainFile, option)
+		}
+	}
+	return nil
+}
+
+/*
+ * Convert the lists of a classic e2guardian installation, read locally or
+ * from the target, into phrase and content lists of the host's config
+ */
+func ImportE2guardian(targetName string, confDir string, remote bool) int {
+
+	config, err := getHostFilterConfig(targetName)
+	if err != nil {
+		log.Fatal("Failed to get host config: ", err)
+		return -1
+	}
+
+	var read e2gReader
+	var groupConfs []string
+	if remote {
+		sshConfig, err := loadConfig()
+		if err != nil {
+			log.Fatal("Failed to load config: ", err)
+			return -1
+		}
+		_, host := FindHost(sshConfig, targetName)
+		if host.Name != targetName {
+			log.Fatalf("Host %s doesn't exist, create it first", targetName)
+			return -1
+		}
+		read = func(fileName string) (string, error) {
+			return runHostCommands(host, []string{"cat " + shellQuote(fileName)}, false)
+		}
+		out, err := runHostCommands(host, []string{fmt.Sprintf("ls %s/e2guardianf*.conf", shellQuote(confDir))}, false)
+		if err != nil {
+			log.Fatal("No filter group configs found on target: ", err)
+			return -1
+		}
+		groupConfs = strings.Fields(strings.ReplaceAll(out, "\r", ""))
+	} else {
+		read = func(fileName string) (string, error) {
+			data, err := ioutil.ReadFile(filepath.FromSlash(fileName))
+			return string(data), err
+		}
+		groupConfs, _ = filepath.Glob(filepath.Join(confDir, "e2guardianf*.conf"))
+		for i := range groupConfs {
+			groupConfs[i] = filepath.ToSlash(groupConfs[i])
+		}
+		confDir = filepath.ToSlash(confDir)
+	}
+	sort.Strings(groupConfs)
+	if len(groupConfs) == 0 {
+		log.Fatalf("No e2guardianf*.conf filter group configs in %s\n", confDir)
+		return -1
+	}
+	if len(groupConfs) > 1 {
+		log.Printf("Warning: %d filter groups found; their lists are merged into one policy\n", len(groupConfs))
+	}
+
+	imp := &e2gImport{read: read, confDir: confDir, conf: config.E2guardianConf, imported: map[string]string{}}
+	for _, groupConf := range groupConfs {
+		err = imp.importGroup(groupConf)
+		if err != nil {
+			log.Fatal("Failed to read filter group config: ", err)
+			return -1
+		}
+	}
+
+	config.E2guardianConf = imp.conf
+	err = writeHostFilterConfig(targetName, config)
+	if err != nil {
+		log.Fatal("Failed to write host config: ", err)
+		return -1
+	}
+
+	for _, warning := range imp.warnings {
+		log.Printf("Warning: %s\n", warning)
+	}
+	log.Printf("Imported %d list(s) from %s; deploy to apply\n", len(imp.imported), confDir)
+	return 0
+}
@@ -0,0 +1,201 @@
+package utils
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// Where the chart has e2guardian write its statistics when they are enabled
+const e2gStatsPath = "/var/log/e2guardian/dstats.log"
+
+const defaultE2gStatsInterval = 60
+
+/*
+ * e2guardian's own statistics (dstatlocation), written every Interval seconds
+ */
+type E2gStatsConfig struct {
+	Enabled  bool `yaml:"enabled"`
+	Interval int  `yaml:"interval,omitempty"`
+}
+
+func (stats E2gStatsConfig) interval() int {
+	if stats.Interval > 0 {
+		return stats.Interval
+	}
+	return defaultE2gStatsInterval
+}
+
+/*
+ * The latest sample of one e2guardian pod, by dstats column name
+ */
+type e2gStatsSample struct {
+	Pod    string
+	Values map[string]string
+}
+
+func (sample e2gStatsSample) value(column string) string {
+	if value, ok := sample.Values[column]; ok {
+		return value
+	}
+	return "-"
+}
+
+/*
+ * Sample time of a dstats row, which is in epoch seconds unless stats_human_readable is on
+ */
+func (sample e2gStatsSample) time() string {
+	value := sample.value("time")
+	if seconds, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return time.Unix(seconds, 0).Local().Format("15:04:05")
+	}
+	return value
+}
+
+/*
+ * Parse the output of printing each pod's dstats header and last row, after a
+ * '=== pod/<name>' line
+ */
+func parseE2gStats(out string) []e2gStatsSample {
+	var samples []e2gStatsSample
+	var header []string
+	for _, line := range strings.Split(strings.ReplaceAll(out, "\r", ""), "\n") {
+		if strings.HasPrefix(line, "=== ") {
+			samples = append(samples, e2gStatsSample{Pod: strings.TrimPrefix(strings.TrimPrefix(line, "=== "), "pod/"), Values: map[string]string{}})
+			header = nil
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(samples) == 0 || len(fields) == 0 {
+			continue
+		}
+		if header == nil {
+			header = fields
+			continue
+		}
+		// Human readable times take two fields
+		if len(fields) == len(header)+1 {
+			fields = append([]string{fields[0] + " " + fields[1]}, fields[2:]...)
+		}
+		sample := samples[len(samples)-1]
+		for i, column := range header {
+			if i < len(fields) {
+				sample.Values[strings.ToLower(column)] = fields[i]
+			}
+		}
+	}
+	return samples
+}
+
+/*
+ * Requests and denials per filter group in access log lines. Lines name the
+ * filter group that handled the request.
+ */
+func countGroupActivity(logs string, groups []string) (map[string]int, map[string]int) {
+	requests := map[string]int{}
+	denied := map[string]int{}
+	for _, line := range strings.Split(logs, "\n") {
+		fields := strings.Fields(line)
+		for _, group := range groups {
+			if contains(fields, group) {
+				requests[group]++
+				if strings.Contains(line, "*DENIED*") {
+					denied[group]++
+				}
+				break
+			}
+		}
+	}
+	return requests, denied
+}
+
+/*
+ * Show e2guardian's current connections, request rates and filter group activity,
+ * or turn its statistics on
+ */
+func ShowE2gStats(targetName string, enable bool, interval int) int {
+
+	config, err := loadConfig()
+	if err != nil {
+		log.Fatal("Failed to load config: ", err)
+		return -1
+	}
+
+	_, host := FindHost(config, targetName)
+	if host.Name != targetName {
+		log.Fatalf("Host %s doesn't exist, create it first", targetName)
+		return -1
+	}
+
+	filterConfig, err := getHostFilterConfig(targetName)
+	if err != nil {
+		log.Fatal("Failed to get host config: ", err)
+		return -1
+	}
+
+	if enable {
+		filterConfig.E2gStats = E2gStatsConfig{Enabled: true, Interval: interval}
+		err = writeHostFilterConfig(targetName, filterConfig)
+		if err != nil {
+			log.Fatal("Failed to write host config: ", err)
+			return -1
+		}
+		log.Printf("Enabled e2guardian statistics every %ds; deploy to apply\n", filterConfig.E2gStats.interval())
+		return 0
+	}
+
+	if !filterConfig.E2gStats.Enabled {
+		log.Fatalln("e2guardian statistics are off, turn them on with 'filter stats e2g --enable' and deploy")
+		return -1
+	}
+
+	seconds := filterConfig.E2gStats.interval()
+	out, err := runHostCommands(host, []string{
+		"export KUBECONFIG=/etc/rancher/k3s/k3s.yaml",
+		fmt.Sprintf("for pod in $(kubectl -n filter get pods -l app=e2guardian -o name); do echo \"=== $pod\"; kubectl -n filter exec $pod -- sh -c 'head -1 %[1]s; tail -1 %[1]s' 2>/dev/null; done", e2gStatsPath),
+		"echo ---",
+		fmt.Sprintf("kubectl -n filter logs -l app=e2guardian --tail=-1 --since=%ds", seconds),
+	}, false)
+	if err != nil {
+		log.Fatal("Failed to get e2guardian statistics: ", err)
+		return -1
+	}
+	sections := strings.SplitN(out, "---\n", 2)
+	if len(sections) != 2 {
+		log.Fatalln("Unexpected output from target")
+		return -1
+	}
+
+	samples := parseE2gStats(sections[0])
+	if len(samples) == 0 {
+		log.Fatalln("No e2guardian pods are running, has the filter been deployed?")
+		return -1
+	}
+
+	w := tabwriter.NewWriter(showOutput(), 1, 1, 3, ' ', 0)
+	fmt.Fprintln(w, "Pod\tSampled\tChildren\tBusy\tFree\tConnections\tConn/s\tRequests\tReq/s")
+	for _, sample := range samples {
+		if len(sample.Values) == 0 {
+			fmt.Fprintf(w, "%s\tno statistics yet, deployed with them on?\t\t\t\t\t\t\t\n", sample.Pod)
+			continue
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n", sample.Pod, sample.time(),
+			sample.value("children"), sample.value("busy"), sample.value("free"),
+			sample.value("conx"), sample.value("conx/s"), sample.value("reqs"), sample.value("reqs/s"))
+	}
+	w.Flush()
+
+	groups := filterConfig.filterGroupNames()
+	requests, denied := countGroupActivity(sections[1], groups)
+	fmt.Fprintf(showOutput(), "\nFilter group activity, last %ds:\n", seconds)
+	w = tabwriter.NewWriter(showOutput(), 1, 1, 3, ' ', 0)
+	fmt.Fprintln(w, "Group\tRequests\tDenied")
+	for _, group := range groups {
+		fmt.Fprintf(w, "%s\t%d\t%d\n", group, requests[group], denied[group])
+	}
+	w.Flush()
+	return 0
+}
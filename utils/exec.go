@@ -0,0 +1,162 @@
+package utils
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Numbers of the signals an SSH server reports by name
+var sshSignalNumbers = map[string]int{
+	"HUP": 1, "INT": 2, "QUIT": 3, "ILL": 4, "ABRT": 6, "FPE": 8,
+	"KILL": 9, "USR1": 10, "SEGV": 11, "USR2": 12, "PIPE": 13, "ALRM": 14, "TERM": 15,
+}
+
+/*
+ * Run a script on a host without a terminal, so stdout and stderr stay apart,
+ * and return its exit code. Like other remote operations it is recorded with
+ * --record and answered from the transcript with --replay.
+ */
+func runHostExec(ctx context.Context, host Host, script string, stdout io.Writer, stderr io.Writer) (int, error) {
+	commands := []string{script}
+	if replaying() {
+		results, err := replayTranscript(host, transcriptExec, commands, false)
+		if len(results) != 1 {
+			return -1, err
+		}
+		io.WriteString(stdout, results[0].Stdout)
+		io.WriteString(stderr, results[0].Stderr)
+		return results[0].ExitCode, nil
+	}
+	if RecordFile == "" {
+		return runHostExecLive(ctx, host, script, stdout, stderr)
+	}
+
+	var recordedStdout, recordedStderr bytes.Buffer
+	start := time.Now()
+	code, err := runHostExecLive(ctx, host, script, io.MultiWriter(stdout, &recordedStdout), io.MultiWriter(stderr, &recordedStderr))
+	var results RemoteResult
+	if err == nil {
+		results = RemoteResult{{
+			Command:  script,
+			Stdout:   recordedStdout.String(),
+			Stderr:   recordedStderr.String(),
+			ExitCode: code,
+			Duration: time.Since(start),
+		}}
+	}
+	recordTranscript(host, transcriptExec, commands, results, err)
+	return code, err
+}
+
+func runHostExecLive(ctx context.Context, host Host, script string, stdout io.Writer, stderr io.Writer) (int, error) {
+	if host.Local {
+		cmd := exec.CommandContext(ctx, "sh", "-c", script)
+		cmd.Env = append(os.Environ(), fmt.Sprintf("KUBECONFIG=%s", host.Kubeconfig))
+		cmd.Stdout = stdout
+		cmd.Stderr = stderr
+		err := cmd.Run()
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) && ctx.Err() == nil {
+			if status, ok := exitErr.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+				return 128 + int(status.Signal()), nil
+			}
+			return exitErr.ExitCode(), nil
+		}
+		if err != nil {
+			return -1, contextError(ctx, err)
+		}
+		return 0, nil
+	}
+
+	conn := sharedHostConn(host)
+	session, err := conn.newSession(ctx)
+	if err != nil {
+		return -1, err
+	}
+	defer session.Close()
+	session.Stdout = stdout
+	session.Stderr = stderr
+
+	result := make(chan error, 1)
+	go func() {
+		result <- session.Run(script)
+	}()
+
+	select {
+	case err = <-result:
+	case <-ctx.Done():
+		// Without a terminal there is no Ctrl-C to send, ask the server to signal instead
+		session.Signal(ssh.SIGINT)
+		select {
+		case err = <-result:
+		case <-time.After(interruptGracePeriod):
+			conn.drop()
+			err = <-result
+		}
+		if err == nil {
+			err = ctx.Err()
+		}
+		return -1, contextError(ctx, err)
+	}
+
+	var exitErr *ssh.ExitError
+	if errors.As(err, &exitErr) {
+		if exitErr.Signal() != "" {
+			// Like a shell reports a command killed by a signal
+			return 128 + sshSignalNumbers[exitErr.Signal()], nil
+		}
+		return exitErr.ExitStatus(), nil
+	}
+	if err != nil {
+		return -1, err
+	}
+	return 0, nil
+}
+
+/*
+ * Run an arbitrary command on a target with KUBECONFIG set, streaming its stdout
+ * and stderr, and exit with its exit code.
+ * Arguments are joined like ssh does, so quote pipes and redirections as one argument.
+ */
+func ExecOnHost(name string, command []string) int {
+
+	if len(command) == 0 {
+		log.Fatalln("No command given")
+		return -1
+	}
+
+	config, err := loadConfig()
+	if err != nil {
+		log.Fatal("Failed to load config: ", err)
+		return -1
+	}
+
+	_, host := FindHost(config, name)
+	if host.Name != name {
+		log.Fatalf("Host %s doesn't exist, create it first", name)
+		return -1
+	}
+
+	kubeconfig := k3sKubeconfigExport
+	if host.Local {
+		kubeconfig = fmt.Sprintf("export KUBECONFIG=%s", shellQuote(host.Kubeconfig))
+	}
+	defer trackRemoteOperation()()
+	code, err := runHostExec(interruptContext, host, kubeconfig+"; "+strings.Join(command, " "), os.Stdout, os.Stderr)
+	if err != nil {
+		log.Printf("Command failed: %s\n", err)
+		return -1
+	}
+	return code
+}
@@ -0,0 +1,137 @@
+package utils
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// How long cached cluster facts are trusted before asking the target again
+const clusterFactsTTL = 24 * time.Hour
+
+// Label k3s puts on its server nodes
+const controlPlaneLabel = "node-role.kubernetes.io/control-plane"
+
+// Set by the '--refresh-facts' flag to bypass the cache
+var RefreshFacts bool
+
+type ClusterFacts struct {
+	MasterNode string
+	// UID of the kube-system namespace, unique to each cluster unlike node names
+	ClusterId string
+	// Number of nodes in the cluster
+	Nodes int
+	// Memory of the master node in bytes
+	MemoryBytes int64
+	FetchedAt   time.Time
+}
+
+func getClusterFactsPath(name string) string {
+	return filepath.Join(getHostDataDir(name), "facts.json")
+}
+
+/*
+ * load cached cluster facts for a host
+ */
+func loadClusterFacts(name string) (ClusterFacts, error) {
+	data, err := ioutil.ReadFile(getClusterFactsPath(name))
+	if err != nil {
+		return ClusterFacts{}, err
+	}
+	var facts ClusterFacts
+	err = json.Unmarshal(data, &facts)
+	return facts, err
+}
+
+/*
+ * Save cluster facts for a host
+ */
+func writeClusterFacts(name string, facts ClusterFacts) error {
+	jsonString, err := json.Marshal(facts)
+	if err != nil {
+		return err
+	}
+	os.MkdirAll(getHostDataDir(name), privateDirMode)
+	return writePrivateFile(getClusterFactsPath(name), jsonString)
+}
+
+/*
+ * Query the target's cluster for its facts over SSH
+ */
+func fetchClusterFacts(host Host) (ClusterFacts, error) {
+	results, err := runHostCommandResults(interruptContext, host, []string{
+		"export KUBECONFIG=/etc/rancher/k3s/k3s.yaml",
+		"kubectl get nodes -o json",
+		"kubectl get namespace kube-system -o jsonpath='{.metadata.uid}'",
+	}, nil, false)
+	if err != nil {
+		return ClusterFacts{}, err
+	}
+	nodes, _ := results.Find("kubectl get nodes")
+	if err := nodes.Err(); err != nil {
+		return ClusterFacts{}, err
+	}
+	namespace, _ := results.Find("kubectl get namespace")
+	var result workerJson
+	err = json.Unmarshal([]byte(nodes.Stdout), &result)
+	if err != nil {
+		return ClusterFacts{}, err
+	} else if len(result.Items) == 0 {
+		return ClusterFacts{}, errors.New("no nodes configured on remote host")
+	}
+
+	// Nodes are listed by name, so once workers join the server may not be first
+	master := 0
+	for i, node := range result.Items {
+		if _, ok := node.Metadata.Labels[controlPlaneLabel]; ok {
+			master = i
+			break
+		}
+	}
+
+	memory, err := parseQuantity(result.Items[master].Status.Capacity.Memory)
+	if err != nil {
+		log.Printf("Failed to parse node memory: %s\n", err)
+	}
+
+	return ClusterFacts{
+		MasterNode:  result.Items[master].Metadata.Name,
+		ClusterId:   strings.TrimSpace(namespace.Stdout),
+		Nodes:       len(result.Items),
+		MemoryBytes: memory,
+		FetchedAt:   time.Now(),
+	}, nil
+}
+
+/*
+ * Get cluster facts for a host, using the cache unless it is stale or a refresh was requested
+ */
+func getClusterFacts(host Host) (ClusterFacts, error) {
+	cached, cacheErr := loadClusterFacts(host.Name)
+	// Facts cached before node counts and cluster IDs were collected are treated as stale
+	if !RefreshFacts && cacheErr == nil && cached.Nodes > 0 && cached.ClusterId != "" && time.Since(cached.FetchedAt) < clusterFactsTTL {
+		return cached, nil
+	}
+
+	facts, err := fetchClusterFacts(host)
+	if err != nil {
+		if !RefreshFacts && cacheErr == nil {
+			// Target unreachable; stale facts are better than none
+			log.Printf("Failed to refresh cluster facts for '%s', using cached copy: %s\n", host.Name, err)
+			return cached, nil
+		}
+		return ClusterFacts{}, err
+	}
+
+	err = writeClusterFacts(host.Name, facts)
+	if err != nil {
+		log.Printf("Failed to cache cluster facts for '%s': %s\n", host.Name, err)
+	}
+
+	return facts, nil
+}
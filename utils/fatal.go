@@ -0,0 +1,61 @@
+package utils
+
+import (
+	"io"
+	"log"
+	"runtime"
+	"strings"
+	"sync/atomic"
+)
+
+// Run when a log.Fatal ends the process, which skips everything deferred
+var fatalHooks []func()
+
+// Set once the hooks started, a hook failing fatally itself must not run them again
+var fatalHooksRun int32
+
+/*
+ * Run hook before a log.Fatal anywhere ends the process, i.e. to save what the
+ * command changed. Hooks run in the reverse order they were added, while the
+ * logger is held, so they must not log themselves.
+ */
+func OnFatal(hook func()) {
+	fatalHooks = append(fatalHooks, hook)
+}
+
+// Passes log output on, then runs the fatal hooks if a log.Fatal wrote it
+type fatalHookWriter struct {
+	next io.Writer
+}
+
+func (w fatalHookWriter) Write(p []byte) (int, error) {
+	n, err := w.next.Write(p)
+	if calledFromLogFatal() && atomic.CompareAndSwapInt32(&fatalHooksRun, 0, 1) {
+		for i := len(fatalHooks) - 1; i >= 0; i-- {
+			fatalHooks[i]()
+		}
+	}
+	return n, err
+}
+
+func calledFromLogFatal() bool {
+	pcs := make([]uintptr, 8)
+	frames := runtime.CallersFrames(pcs[:runtime.Callers(3, pcs)])
+	for {
+		frame, more := frames.Next()
+		if strings.HasPrefix(frame.Function, "log.Fatal") || strings.HasPrefix(frame.Function, "log.(*Logger).Fatal") {
+			return true
+		}
+		if !more {
+			return false
+		}
+	}
+}
+
+/*
+ * Have log.Fatal run the hooks added with OnFatal. Call after anything else that
+ * sets the log output.
+ */
+func CatchFatal() {
+	log.SetOutput(fatalHookWriter{next: log.Writer()})
+}
@@ -51,7 +51,7 @@ type PhraseList struct {
 	ListName  string        `yaml:"listName"`
 	IncludeIn []string      `yaml:"includeIn"`
 	Groups    []PhraseGroup `yaml:"groups"`
-	Weighted  bool
+	Weighted  bool          `yaml:"weighted"`
 }
 
 type ContentGroup struct {
@@ -83,9 +83,13 @@ type E2guardianConfig struct {
 }
 
 type FilterConfig struct {
+	// Bumped by every write, so one based on a stale read is rejected
+	Revision int `yaml:"revision,omitempty"`
 	// Host specific
 	MasterNode string `yaml:"masterNode"`
 	VolumePath string `yaml:"volumePath"`
+	// Time zone of the target, for the schedules of the chart's CronJobs
+	TimeZone string `yaml:"timeZone,omitempty"`
 	// Network
 	LocalNetwork string `yaml:"localNetwork"`
 	// Lookup service
@@ -129,6 +133,83 @@ type FilterConfig struct {
 	Locality     string   `yaml:"locality"`
 	IpSANs       []string `yaml:"IpSANs"`
 	DnsNames     []string `yaml:"dnsNames"`
+
+	// Client devices
+	Clients []Client `yaml:"clients,omitempty"`
+
+	// Reports
+	Smtp            SmtpConfig       `yaml:"smtp,omitempty"`
+	ReportSchedules []ReportSchedule `yaml:"reportSchedules,omitempty"`
+
+	// Threat feeds
+	ThreatFeeds ThreatFeedConfig `yaml:"threatFeeds,omitempty"`
+	NewDomains  NewDomainsConfig `yaml:"newDomains,omitempty"`
+	// Deny lookalikes of allow-listed sites
+	HomographProtection bool `yaml:"homographProtection,omitempty"`
+
+	// Block page
+	BlockPage BlockPageConfig `yaml:"blockPage,omitempty"`
+
+	// Search terms
+	SearchTerms SearchTermsConfig `yaml:"searchTerms,omitempty"`
+
+	// Alerts
+	Alerts []AlertRule `yaml:"alerts,omitempty"`
+
+	// Guest network
+	Guest GuestConfig `yaml:"guest,omitempty"`
+
+	// DB maintenance
+	DbMaintenance DbMaintenanceConfig `yaml:"dbMaintenance,omitempty"`
+
+	// Postgres and Redis tuning
+	DbTuning    DbTuning    `yaml:"dbTuning,omitempty"`
+	RedisTuning RedisTuning `yaml:"redisTuning,omitempty"`
+
+	// Pod limits, and the 'filter profile' that set them
+	Resources ComponentResources `yaml:"resources,omitempty"`
+	Profile   string             `yaml:"profile,omitempty"`
+
+	// High availability
+	HighAvailability HighAvailabilityConfig `yaml:"highAvailability,omitempty"`
+
+	// Web UI
+	Web WebConfig `yaml:"web,omitempty"`
+
+	// Raw squid.conf fragment for cases the structured commands don't cover
+	SquidSnippet string `yaml:"squidSnippet,omitempty"`
+
+	// Content scanners
+	Scanners []ContentScanner `yaml:"scanners,omitempty"`
+
+	// Download management
+	Downloads DownloadsConfig `yaml:"downloads,omitempty"`
+
+	// Decryption exclusions
+	DecryptExclusions DecryptExclusionsConfig `yaml:"decryptExclusions,omitempty"`
+	// squid.conf lines splicing the TLS traffic of exempt clients, rendered for each deploy
+	SslBumpExemptions []string `yaml:"sslBumpExemptions,omitempty"`
+
+	// IPv6
+	Ipv6 Ipv6Config `yaml:"ipv6,omitempty"`
+
+	// WireGuard gateway for roaming devices
+	Vpn VpnConfig `yaml:"vpn,omitempty"`
+
+	// Country rules
+	Geo GeoConfig `yaml:"geo,omitempty"`
+
+	// Upstream proxy chaining
+	Upstream UpstreamConfig `yaml:"upstream,omitempty"`
+
+	// Proxy auto-config
+	Pac PacConfig `yaml:"pac,omitempty"`
+
+	// e2guardian statistics
+	E2gStats E2gStatsConfig `yaml:"e2gStats,omitempty"`
+
+	// Canary requests verifying filtering works
+	Probes ProbesConfig `yaml:"probes,omitempty"`
 }
 
 type HostCategory struct {
@@ -159,7 +240,7 @@ var allowLists = map[string]string{
 
 func getHelmPath() string {
 	guardianHome := GuardianConfigHome()
-	return path.Join(guardianHome, "helm")
+	return filepath.Join(guardianHome, "helm")
 }
 
 func getHostVolumePath(host Host) string {
@@ -170,9 +251,22 @@ func getRemoteHelmPath(host Host) string {
 	return path.Join(host.HomePath, ".guardian", "helm")
 }
 
+// Set once the chart was cloned, deploying to several targets clones it only once
+var helmCheckedOut bool
+
 func checkoutHelm(dumpOutput bool) error {
 
 	helmPath := getHelmPath()
+
+	if helmCheckedOut {
+		return nil
+	}
+
+	// Replays run offline, use the chart already checked out
+	if _, err := os.Stat(helmPath); err == nil && replaying() {
+		return nil
+	}
+
 	/*
 	 * TODO: instead of wiping the directory and re-cloning, just do a git pull
 	 */
@@ -186,6 +280,7 @@ func checkoutHelm(dumpOutput bool) error {
 		URL:      helmChartGit,
 		Progress: outputStream,
 	})
+	helmCheckedOut = err == nil
 
 	return err
 }
@@ -201,9 +296,9 @@ func loadFilterConfig(fileName string) (FilterConfig, error) {
 	var config FilterConfig
 	err = yaml.Unmarshal([]byte(data), &config)
 	if err != nil {
-		log.Fatal("Failed to parse config file: ", err)
-		return FilterConfig{}, err
+		return FilterConfig{}, fmt.Errorf("failed to parse %s: %s", fileName, err)
 	}
+	config.E2guardianConf.markPhraseListKinds()
 	return config, err
 }
 
@@ -212,7 +307,7 @@ func loadFilterConfig(fileName string) (FilterConfig, error) {
  */
 func loadDefaultFilterConfig() (FilterConfig, error) {
 	helmPath := getHelmPath()
-	defaultValuesFile := path.Join(helmPath, "guardian-angel", "values.yaml")
+	defaultValuesFile := filepath.Join(helmPath, "guardian-angel", "values.yaml")
 	config, err := loadFilterConfig(defaultValuesFile)
 	return config, err
 }
@@ -222,35 +317,58 @@ func loadDefaultFilterConfig() (FilterConfig, error) {
  */
 func loadHostFilterConfig(host string) (FilterConfig, error) {
 	filterConfigPath := getHostFilterConfigPath(host)
-	return loadFilterConfig(filterConfigPath)
+	config, err := loadFilterConfig(filterConfigPath)
+	if err == nil {
+		rememberRevision(host, config.Revision)
+	}
+	return config, err
 }
 
 /*
- * Save the host's filter config
+ * Save the host's filter config, unless another process changed it since it was read
  */
 func writeHostFilterConfig(host string, config FilterConfig) error {
 	filterConfigPath := getHostFilterConfigPath(host)
 
-	yamlString, err := yaml.Marshal(config)
+	unlock, err := lockOverrides(filterConfigPath)
 	if err != nil {
-		log.Fatal("Failed to marshal host filter config: ", err)
 		return err
 	}
+	defer unlock()
+	err = checkAndBumpRevision(host, filterConfigPath, &config)
+	if err != nil {
+		return err
+	}
+	// Rendered for each deploy instead, stored they would go stale
+	config.Ipv6.RedirectRules = nil
+	config.SslBumpExemptions = nil
+
+	yamlString, err := yaml.Marshal(config)
+	if err != nil {
+		return fmt.Errorf("failed to marshal host filter config: %s", err)
+	}
 
-	// Create config file
-	f, err := os.Create(filterConfigPath)
+	// Write a new file and move it over the old one so readers never see half a config
+	f, err := createPrivateFile(filterConfigPath + ".tmp")
 	if err != nil {
-		log.Fatal("Failed to create host filter config file: ", err)
+		return fmt.Errorf("failed to create host filter config file: %s", err)
+	}
+	_, err = f.WriteString(string(yamlString))
+	f.Close()
+	if err == nil {
+		err = os.Rename(filterConfigPath+".tmp", filterConfigPath)
+	}
+	if err != nil {
+		os.Remove(filterConfigPath + ".tmp")
 		return err
 	}
-	defer f.Close()
-	f.WriteString(string(yamlString))
+	rememberRevision(host, config.Revision)
 	return nil
 }
 
 func getHostFilterConfigPath(host string) string {
 	hostDataDir := getHostDataDir(host)
-	return path.Join(hostDataDir, "overrides.yaml")
+	return filepath.Join(hostDataDir, "overrides.yaml")
 }
 
 func randomString(n int) string {
@@ -266,7 +384,13 @@ func randomString(n int) string {
 type workerJson struct {
 	Items []struct {
 		Metadata struct {
-			Name string
+			Name   string
+			Labels map[string]string
+		}
+		Status struct {
+			Capacity struct {
+				Memory string
+			}
 		}
 	}
 }
@@ -292,36 +416,46 @@ func initHostConfig(host Host) (FilterConfig, error) {
 			return config, err
 		}
 
-		client, err := getHostSshClient(host)
+		facts, err := getClusterFacts(host)
 		if err != nil {
 			return FilterConfig{}, err
 		}
 
-		out, err := client.RunCommands([]string{
-			"export KUBECONFIG=/etc/rancher/k3s/k3s.yaml",
-			"kubectl get nodes -o json",
-		}, false)
-		if err != nil {
-			return FilterConfig{}, err
-		}
-		var result workerJson
-		err = json.Unmarshal([]byte(out), &result)
-		if err != nil {
-			return FilterConfig{}, err
-		} else if len(result.Items) == 0 {
-			return FilterConfig{}, errors.New("no nodes configured on remote host")
-		}
-
-		config.MasterNode = result.Items[0].Metadata.Name
+		config.MasterNode = facts.MasterNode
 		config.VolumePath = getHostVolumePath(host)
 		config.JwtPassword = randomString(32)
 		config.RedisPassword = randomString(32)
 		config.DbPassword = randomString(32)
 		config.IpSANs = append(config.IpSANs, host.Address)
 
-		// Write config to file
+		// Write config to file, and read it back with the revision the write gave it
 		err = writeHostFilterConfig(host.Name, config)
-		return config, err
+		if err != nil {
+			return config, err
+		}
+		return loadHostFilterConfig(host.Name)
+
+	} else if RefreshFacts {
+
+		config, err := loadHostFilterConfig(host.Name)
+		if err != nil {
+			return config, err
+		}
+
+		facts, err := getClusterFacts(host)
+		if err != nil {
+			return config, err
+		}
+
+		if config.MasterNode != facts.MasterNode {
+			config.MasterNode = facts.MasterNode
+			err = writeHostFilterConfig(host.Name, config)
+			if err != nil {
+				return config, err
+			}
+			return loadHostFilterConfig(host.Name)
+		}
+		return config, nil
 
 	} else {
 		return loadHostFilterConfig(host.Name)
@@ -329,10 +463,63 @@ func initHostConfig(host Host) (FilterConfig, error) {
 
 }
 
+/*
+ * Values derived from the rest of the overrides, filled in when deploying so they
+ * follow every change and are never stored
+ */
+func (config *FilterConfig) renderDerivedValues() {
+	config.Ipv6.RedirectRules = nil
+	if config.Ipv6.Enabled {
+		config.Ipv6.RedirectRules = config.ipv6RedirectRules()
+	}
+	config.SslBumpExemptions = config.sslBumpExemptions()
+	config.Clients = config.unexpiredClients()
+}
+
+/*
+ * The overrides a deploy uploads: the stored ones with their derived values rendered
+ */
+func renderDeployOverrides(hostName string) ([]byte, error) {
+	config, err := loadHostFilterConfig(hostName)
+	if err != nil {
+		return nil, err
+	}
+	config.renderDerivedValues()
+	data, err := yaml.Marshal(config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal host filter config: %s", err)
+	}
+	return data, nil
+}
+
+/*
+ * Write the overrides a deploy uploads to a private file next to the stored ones.
+ * The caller removes it.
+ */
+func writeDeployOverrides(host Host) (string, error) {
+	data, err := renderDeployOverrides(host.Name)
+	if err != nil {
+		return "", err
+	}
+	rendered := getHostFilterConfigPath(host.Name) + ".deploy"
+	f, err := createPrivateFile(rendered)
+	if err != nil {
+		return "", err
+	}
+	_, err = f.Write(data)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(rendered)
+		return "", err
+	}
+	return rendered, nil
+}
+
 func copyHelmToRemote(host Host) error {
 
 	srcPath := getHelmPath()
-	overrides := getHostFilterConfigPath(host.Name)
 	dstPath := getRemoteHelmPath(host)
 
 	err := checkoutHelm(true)
@@ -340,24 +527,31 @@ func copyHelmToRemote(host Host) error {
 		return err
 	}
 
-	client, err := getHostSshClient(host)
+	overrides, err := writeDeployOverrides(host)
 	if err != nil {
-		return err
+		return fmt.Errorf("failed to render overrides: %s", err)
 	}
+	defer os.Remove(overrides)
 
 	// delete existing remote helm to prevent conflicts
-	_, err = client.RunCommands([]string{fmt.Sprintf("rm -rf %s", dstPath)}, false)
+	_, err = runHostCommands(host, []string{fmt.Sprintf("rm -rf %s", dstPath)}, false)
 	if err != nil {
 		return fmt.Errorf("failed to wipe helm charts on remote target: %s", err)
 	}
 
-	err = client.Put(srcPath, dstPath)
+	err = putHostFile(host, srcPath, dstPath)
 	if err != nil {
 		return err
 	}
+	progressTransfer(host.Name, "copy-chart", srcPath)
 
 	overridesDst := path.Join(dstPath, "overrides.yaml")
-	return client.Put(overrides, overridesDst)
+	err = putHostFile(host, overrides, overridesDst)
+	if err != nil {
+		return err
+	}
+	progressTransfer(host.Name, "copy-chart", overrides)
+	return nil
 
 }
 
@@ -432,6 +626,23 @@ func (config *E2guardianConfig) findWeightedPhraseList(listName string) *PhraseL
 	return nil
 }
 
+/*
+ * A phrase list of either kind; a name used by both kinds is ambiguous
+ */
+func (config *E2guardianConfig) findAnyPhraseList(listName string) (*PhraseList, error) {
+	list := config.findPhraseList(listName)
+	weighted := config.findWeightedPhraseList(listName)
+	switch {
+	case list != nil && weighted != nil:
+		return nil, fmt.Errorf("phrase list '%s' exists both weighted and unweighted, remove one of them", listName)
+	case weighted != nil:
+		return weighted, nil
+	case list != nil:
+		return list, nil
+	}
+	return nil, fmt.Errorf("phrase list '%s' does not exist", listName)
+}
+
 func (config *E2guardianConfig) findContentList(listName string) *ContentList {
 	for i := range config.Lists {
 		list := &config.Lists[i]
@@ -664,13 +875,8 @@ func AddPhraseList(listName string, weighted bool, targetName string) int {
 		return -1
 	}
 
-	var phraseList *PhraseList
-	if weighted {
-		phraseList = config.E2guardianConf.findWeightedPhraseList(listName)
-	} else {
-		phraseList = config.E2guardianConf.findPhraseList(listName)
-	}
-	if phraseList != nil {
+	// Names are shared by both kinds so includes and lookups stay unambiguous
+	if config.E2guardianConf.findPhraseList(listName) != nil || config.E2guardianConf.findWeightedPhraseList(listName) != nil {
 		log.Fatalf("Phrase list '%s' already exists", listName)
 		return -1
 	}
@@ -883,6 +1089,11 @@ func DeleteEntryFromList(listName string, entry string, group string, targetName
 /* Include a phrase list in one of the main lists */
 func AddPhraseInclude(phraseList *PhraseList, config *FilterConfig, fileInclude string, targetName string) int {
 
+	if err := validatePhraseInclude(*phraseList, fileInclude); err != nil {
+		log.Fatal(err)
+		return -1
+	}
+
 	include := phraseList.findInclude(fileInclude)
 	if include != "" {
 		log.Fatalf("Phrase list '%s' is already included in '%s'\n", phraseList.ListName, include)
@@ -905,6 +1116,11 @@ func AddPhraseInclude(phraseList *PhraseList, config *FilterConfig, fileInclude
 /* Include a content list in one of the main lists */
 func AddInclude(contentList *ContentList, config *FilterConfig, fileInclude string, targetName string) int {
 
+	if err := validateContentInclude(*contentList, fileInclude); err != nil {
+		log.Fatal(err)
+		return -1
+	}
+
 	include := contentList.findInclude(fileInclude)
 	if include != "" {
 		log.Fatalf("List '%s' is already included in '%s'\n", contentList.ListName, include)
@@ -961,12 +1177,10 @@ func BlacklistPhrase(listName string, targetName string) int {
 		return -1
 	}
 
-	phraseList := config.E2guardianConf.findPhraseList(listName)
-	if phraseList == nil {
-		if phraseList = config.E2guardianConf.findWeightedPhraseList(listName); phraseList == nil {
-			log.Fatalf("Phrase list '%s' does not exist", listName)
-			return -1
-		}
+	phraseList, err := config.E2guardianConf.findAnyPhraseList(listName)
+	if err != nil {
+		log.Fatal(err)
+		return -1
 	}
 
 	if phraseList.Weighted {
@@ -983,12 +1197,10 @@ func WhitelistPhrase(listName string, targetName string) int {
 		return -1
 	}
 
-	phraseList := config.E2guardianConf.findPhraseList(listName)
-	if phraseList == nil {
-		if phraseList = config.E2guardianConf.findWeightedPhraseList(listName); phraseList == nil {
-			log.Fatalf("Phrase list '%s' does not exist", listName)
-			return -1
-		}
+	phraseList, err := config.E2guardianConf.findAnyPhraseList(listName)
+	if err != nil {
+		log.Fatal(err)
+		return -1
 	}
 
 	if phraseList.Weighted {
@@ -1060,7 +1272,7 @@ func DeleteIncludes(listName string, targetName string) int {
 }
 
 /* Dump a given phrase list, or list all of them */
-func ShowPhraseList(listName string, targetName string, group string) int {
+func ShowPhraseList(listName string, targetName string, group string, opts ShowOptions) int {
 
 	config, err := getHostFilterConfig(targetName)
 	if err != nil {
@@ -1068,15 +1280,27 @@ func ShowPhraseList(listName string, targetName string, group string) int {
 		return -1
 	}
 
+	w, err := newEntryWriter(opts)
+	if err != nil {
+		log.Fatal("Failed to open output: ", err)
+		return -1
+	}
+	defer w.Close()
+
 	if listName == "" {
 		// Just show the names of all phrase lists
-		log.Println("=== PHRASE LISTS ===")
+		w.section("=== PHRASE LISTS ===")
 		for i := range config.E2guardianConf.PhraseLists {
-			log.Println(config.E2guardianConf.PhraseLists[i].ListName)
+			if !w.entry(config.E2guardianConf.PhraseLists[i].ListName) {
+				break
+			}
 		}
-		log.Println("=== WEIGHTED PHRASE LISTS ===")
+		w.endSection()
+		w.section("=== WEIGHTED PHRASE LISTS ===")
 		for i := range config.E2guardianConf.WeightedPhraseLists {
-			log.Println(config.E2guardianConf.WeightedPhraseLists[i].ListName)
+			if !w.entry(config.E2guardianConf.WeightedPhraseLists[i].ListName) {
+				break
+			}
 		}
 		return -1
 	}
@@ -1103,18 +1327,15 @@ func ShowPhraseList(listName string, targetName string, group string) int {
 	}
 
 	// Dump includes
-	log.Printf("=== INCLUDES ===")
+	w.line("=== INCLUDES ===")
 	for _, inc := range phraseList.IncludeIn {
-		log.Println(inc)
+		w.line(inc)
 	}
 
 	for i := range groups {
 		group := groups[i]
-		log.Printf("Group: %s", group.GroupName)
-
-		// Dump includes
-
-		log.Printf("=== PHRASES ===")
+		w.section(fmt.Sprintf("Group: %s", group.GroupName))
+		w.section("=== PHRASES ===")
 		for j := range group.Phrases {
 			phrase := group.Phrases[j]
 			phraseString := ""
@@ -1125,8 +1346,11 @@ func ShowPhraseList(listName string, targetName string, group string) int {
 			if phraseList.Weighted {
 				phraseString = fmt.Sprintf("%s (weight=%d)", phraseString, phrase.Weight)
 			}
-			log.Println(phraseString)
+			if !w.entry(phraseString) {
+				return 0
+			}
 		}
+		w.endSection()
 	}
 
 	return 0
@@ -1227,7 +1451,7 @@ func AddEntryToContentList(listName string, group string, entry string, targetNa
 }
 
 /* Dump a given content list, or list all of them */
-func ShowContentList(listName string, targetName string, group string) int {
+func ShowContentList(listName string, targetName string, group string, opts ShowOptions) int {
 
 	config, err := getHostFilterConfig(targetName)
 	if err != nil {
@@ -1235,11 +1459,20 @@ func ShowContentList(listName string, targetName string, group string) int {
 		return -1
 	}
 
+	w, err := newEntryWriter(opts)
+	if err != nil {
+		log.Fatal("Failed to open output: ", err)
+		return -1
+	}
+	defer w.Close()
+
 	if listName == "" {
 		// Just show the names of all phrase lists
-		log.Println("=== CONTENT LISTS ===")
+		w.section("=== CONTENT LISTS ===")
 		for i := range config.E2guardianConf.Lists {
-			log.Printf("%s (type='%s')\n", config.E2guardianConf.Lists[i].ListName, config.E2guardianConf.Lists[i].Type)
+			if !w.entry(fmt.Sprintf("%s (type='%s')", config.E2guardianConf.Lists[i].ListName, config.E2guardianConf.Lists[i].Type)) {
+				break
+			}
 		}
 		return -1
 	}
@@ -1264,22 +1497,21 @@ func ShowContentList(listName string, targetName string, group string) int {
 	}
 
 	// Dump includes
-	log.Printf("=== INCLUDES ===")
+	w.line("=== INCLUDES ===")
 	for _, inc := range contentList.IncludeIn {
-		log.Println(inc)
+		w.line(inc)
 	}
 
 	for i := range groups {
 		group := groups[i]
-		log.Printf("Group: %s", group.GroupName)
-
-		// Dump includes
-
-		log.Printf("=== ENTRIES ===")
+		w.section(fmt.Sprintf("Group: %s", group.GroupName))
+		w.section("=== ENTRIES ===")
 		for j := range group.Items {
-			item := group.Items[j]
-			log.Println(item)
+			if !w.entry(group.Items[j]) {
+				return 0
+			}
 		}
+		w.endSection()
 	}
 
 	return 0
@@ -1294,7 +1526,7 @@ func validAction(action string) bool {
 	return false
 }
 
-func AddAclRule(category string, action string, targetName string, pos int) int {
+func AddAclRule(category string, action string, targetName string, pos int, create bool) int {
 
 	if !validAction(action) {
 		log.Fatalf("Invalid action '%s', valid options are %s\n", action, strings.Join(AclActions, ", "))
@@ -1312,6 +1544,13 @@ func AddAclRule(category string, action string, targetName string, pos int) int
 		return -1
 	}
 
+	if !create {
+		if err := checkCategory(targetName, config, category); err != nil {
+			log.Fatalf("Invalid acl rule: %s; use --create for a category you will add domains to later\n", err)
+			return -1
+		}
+	}
+
 	config.AddAclRule(category, action, pos)
 
 	// Set DecryptHTTPS if applicable
@@ -1373,22 +1612,34 @@ func ShowAclRules(targetName string) int {
 		return -1
 	}
 
-	log.Printf("=== DECRYPT RULES ===")
+	out := showOutput()
+	fmt.Fprintln(out, "=== DECRYPT RULES ===")
 	for i, rule := range config.DecryptRules {
 		action := "decrypt"
 		if !rule.Decrypt {
 			action = "nodecrypt"
 		}
-		log.Printf("%d | Category: '%s', Action: '%s'\n", i, rule.Category, action)
+		fmt.Fprintf(out, "%d | Category: '%s', Action: '%s'\n", i, rule.Category, action)
 	}
 
-	log.Printf("=== ALLOW RULES ===")
+	fmt.Fprintln(out, "=== ALLOW RULES ===")
 	for i, rule := range config.AllowRules {
 		action := "allow"
 		if !rule.Allow {
 			action = "deny"
 		}
-		log.Printf("%d | Category: '%s', Action: '%s'", i, rule.Category, action)
+		fmt.Fprintf(out, "%d | Category: '%s', Action: '%s'\n", i, rule.Category, action)
+	}
+
+	if len(config.Geo.Rules) > 0 {
+		fmt.Fprintln(out, "=== GEO RULES ===")
+		for i, rule := range config.Geo.Rules {
+			action := "allow"
+			if !rule.Allow {
+				action = "deny"
+			}
+			fmt.Fprintf(out, "%d | Country: '%s', Action: '%s', Direction: '%s'\n", i, rule.Country, action, rule.Direction)
+		}
 	}
 
 	return 0
@@ -1483,26 +1734,13 @@ func GetRootCa(targetName string) (string, error) {
 
 	_, host := FindHost(config, targetName)
 	if host.Name != targetName {
-		log.Fatalf("host '%s' not configured", targetName)
-		return "", err
-	}
-
-	client, err := getHostSshClient(host)
-	if err != nil {
-		log.Fatal("Failed to create SSH connection: ", err)
-		return "", err
-	}
-	err = client.NewCryptoContext()
-	if err != nil {
-		log.Fatal("Failed to create SSH connection: ", err)
-		return "", err
+		return "", fmt.Errorf("host '%s' not configured", targetName)
 	}
 
-	certOutput, err := client.RunCommands([]string{
+	certOutput, err := runHostCommands(host, []string{
 		"kubectl -n filter get secret guardian-ca-tls -o jsonpath='{.data.ca\\.crt}' | base64 -d",
 	}, false)
 	if err != nil {
-		log.Fatal("Failed to run command: ", err)
 		return "", err
 	}
 
@@ -1529,8 +1767,11 @@ func CopyRootCa(targetName string, outputPath string) int {
 	return 0
 }
 
+// How long the tokens the CLI signs for the filter API are valid
+const jwtTokenLifetime = time.Hour
+
 func GetJwtToken(secret string) (string, error) {
-	expirationTime := time.Now().Add(1 * time.Hour)
+	expirationTime := time.Now().Add(jwtTokenLifetime)
 	claims := &Claims{
 		Agent:            "guardian-cli",
 		RegisteredClaims: jwt.RegisteredClaims{ExpiresAt: jwt.NewNumericDate(expirationTime)},
@@ -1582,7 +1823,25 @@ func AddRootCa(targetName string) (*http.Transport, error) {
 	return customHttpTransport, nil
 }
 
-func ApiGet(targetName string, path string) (*http.Response, error) {
+/*
+ * An authenticated connection to a target's web API, reused across requests
+ */
+type apiSession struct {
+	client       *http.Client
+	baseUrl      string
+	jwtPassword  string
+	token        string
+	tokenExpires time.Time
+}
+
+// sessions opened during this invocation, by target name
+var apiSessions = map[string]*apiSession{}
+
+func getApiSession(targetName string) (*apiSession, error) {
+	if session, ok := apiSessions[targetName]; ok {
+		return session, nil
+	}
+
 	tr, err := AddRootCa(targetName)
 	if err != nil {
 		return nil, err
@@ -1603,68 +1862,72 @@ func ApiGet(targetName string, path string) (*http.Response, error) {
 		return nil, err
 	}
 
-	token, err := GetJwtToken(filterConfig.JwtPassword)
-	if err != nil {
-		return nil, err
-	}
-
-	url := fmt.Sprintf("https://%s:%d%s", target.Address, filterConfig.WebHttpsPublicPort, path)
-	client := &http.Client{Transport: tr}
-	req, err := http.NewRequest(http.MethodGet, url, nil)
-	if err != nil {
-		return nil, err
-	}
-	req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", token))
-	req.Header.Add("Content-Type", "application/json")
-	resp, err := client.Do(req)
-	if err != nil {
-		return nil, err
-	} else if resp.StatusCode != 200 {
-		return nil, fmt.Errorf("received code %d from server", resp.StatusCode)
+	session := &apiSession{
+		client:      &http.Client{Transport: tr},
+		baseUrl:     fmt.Sprintf("https://%s:%d", target.Address, filterConfig.WebHttpsPublicPort),
+		jwtPassword: filterConfig.JwtPassword,
 	}
-	return resp, nil
+	apiSessions[targetName] = session
+	return session, nil
 }
 
-func ApiPost(targetName string, path string, body string) (*http.Response, error) {
-	tr, err := AddRootCa(targetName)
-	if err != nil {
-		return nil, err
+/*
+ * Send a request, renewing the token if it is close to expiring
+ */
+func (session *apiSession) do(method string, urlPath string, body io.Reader, contentType string) (*http.Response, error) {
+	if time.Until(session.tokenExpires) < 5*time.Minute {
+		token, err := GetJwtToken(session.jwtPassword)
+		if err != nil {
+			return nil, err
+		}
+		session.token = token
+		session.tokenExpires = time.Now().Add(jwtTokenLifetime)
 	}
 
-	config, err := loadConfig()
+	req, err := http.NewRequest(method, session.baseUrl+urlPath, body)
 	if err != nil {
 		return nil, err
 	}
+	req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", session.token))
+	req.Header.Add("Content-Type", contentType)
+	return session.client.Do(req)
+}
 
-	_, target := FindHost(config, targetName)
-	if target.Name != targetName {
-		return nil, fmt.Errorf("host %s doesn't exist, create it first", targetName)
-	}
+/*
+ * Drain and close a response body so its connection can be reused
+ */
+func closeResponse(resp *http.Response) {
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+}
 
-	filterConfig, err := getHostFilterConfig(targetName)
+func ApiGet(targetName string, path string) (*http.Response, error) {
+	session, err := getApiSession(targetName)
 	if err != nil {
 		return nil, err
 	}
 
-	token, err := GetJwtToken(filterConfig.JwtPassword)
+	resp, err := session.do(http.MethodGet, path, nil, "application/json")
 	if err != nil {
 		return nil, err
+	} else if resp.StatusCode != 200 {
+		closeResponse(resp)
+		return nil, fmt.Errorf("received code %d from server", resp.StatusCode)
 	}
+	return resp, nil
+}
 
-	jsonBody := []byte(body)
-	bodyReader := bytes.NewReader(jsonBody)
-	url := fmt.Sprintf("https://%s:%d%s", target.Address, filterConfig.WebHttpsPublicPort, path)
-	client := &http.Client{Transport: tr}
-	req, err := http.NewRequest(http.MethodPost, url, bodyReader)
+func ApiPost(targetName string, path string, body string) (*http.Response, error) {
+	session, err := getApiSession(targetName)
 	if err != nil {
 		return nil, err
 	}
-	req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", token))
-	req.Header.Add("Content-Type", "application/json")
-	resp, err := client.Do(req)
+
+	resp, err := session.do(http.MethodPost, path, strings.NewReader(body), "application/json")
 	if err != nil {
 		return nil, err
 	} else if resp.StatusCode != 200 {
+		closeResponse(resp)
 		return nil, fmt.Errorf("received code %d from server", resp.StatusCode)
 	}
 	return resp, nil
@@ -1694,43 +1957,17 @@ func Upload(targetName string, urlPath string, filePath string) error {
 		return err
 	}
 
-	tr, err := AddRootCa(targetName)
-	if err != nil {
-		return err
-	}
-
-	config, err := loadConfig()
-	if err != nil {
-		return err
-	}
-
-	_, target := FindHost(config, targetName)
-	if target.Name != targetName {
-		return fmt.Errorf("host %s doesn't exist, create it first", targetName)
-	}
-
-	filterConfig, err := getHostFilterConfig(targetName)
-	if err != nil {
-		return err
-	}
-
-	token, err := GetJwtToken(filterConfig.JwtPassword)
+	session, err := getApiSession(targetName)
 	if err != nil {
 		return err
 	}
 
-	url := fmt.Sprintf("https://%s:%d%s", target.Address, filterConfig.WebHttpsPublicPort, urlPath)
-	client := &http.Client{Transport: tr}
-	req, err := http.NewRequest(http.MethodPost, url, body)
+	resp, err := session.do(http.MethodPost, urlPath, body, writer.FormDataContentType())
 	if err != nil {
 		return err
 	}
-	req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", token))
-	req.Header.Add("Content-Type", writer.FormDataContentType())
-	resp, err := client.Do(req)
-	if err != nil {
-		return err
-	} else if resp.StatusCode > 200 {
+	defer closeResponse(resp)
+	if resp.StatusCode > 200 {
 		return fmt.Errorf("received code %d from server", resp.StatusCode)
 	}
 	fmt.Println("OK")
@@ -1744,11 +1981,13 @@ func Download(targetName string, urlPath string, fileName string) error {
 	if err != nil {
 		log.Fatal(err)
 	}
+	defer file.Close()
 
 	resp, err := ApiGet(targetName, urlPath)
 	if err != nil {
 		return err
 	}
+	defer closeResponse(resp)
 
 	// Copy response to file
 	_, err = io.Copy(file, resp.Body)
@@ -1759,28 +1998,39 @@ func Download(targetName string, urlPath string, fileName string) error {
 	return nil
 }
 
-func Categorize(targetName string, domain string, category string) int {
+/*
+ * Post one request per domain over a single API session, reporting each result as it completes
+ */
+func batchHostRequest(targetName string, urlPath string, domains []string, category string) int {
 
-	_, err := ApiPost(targetName, "/api/addhost", fmt.Sprintf("{\"category\": \"%s\", \"hostname\": \"%s\"}", category, domain))
-	if err != nil {
-		log.Fatal("Failed to categorize domain in database: ", err)
-		return -1
+	failed := 0
+	for _, domain := range domains {
+		resp, err := ApiPost(targetName, urlPath, fmt.Sprintf("{\"category\": \"%s\", \"hostname\": \"%s\"}", category, domain))
+		if err != nil {
+			log.Printf("FAILED %s: %s\n", domain, err)
+			failed++
+			continue
+		}
+		closeResponse(resp)
+		log.Printf("OK %s\n", domain)
 	}
-	log.Println("OK")
 
+	if failed > 0 {
+		log.Printf("%d of %d domains failed\n", failed, len(domains))
+		return -1
+	}
 	return 0
 }
 
-func DeCategorize(targetName string, domain string, category string) int {
-
-	_, err := ApiPost(targetName, "/api/delhost", fmt.Sprintf("{\"category\": \"%s\", \"hostname\": \"%s\"}", category, domain))
-	if err != nil {
-		log.Fatal("Failed to decategorize domain in database: ", err)
-		return -1
-	}
-	log.Println("OK")
+/*
+ * Domains are stored in both their punycode and unicode forms, so either matches
+ */
+func Categorize(targetName string, domains []string, category string) int {
+	return batchHostRequest(targetName, "/api/addhost", normalizeDomainList(domains), category)
+}
 
-	return 0
+func DeCategorize(targetName string, domains []string, category string) int {
+	return batchHostRequest(targetName, "/api/delhost", normalizeDomainList(domains), category)
 }
 
 type CatList []string
@@ -1789,47 +2039,61 @@ func ListCategory(targetName string, domain string) int {
 
 	body := ""
 	if domain != "" {
-		body = fmt.Sprintf("{\"hostname\": \"%s\"}", domain)
+		ascii, err := normalizeDomain(domain)
+		if err != nil {
+			log.Fatal(err)
+			return -1
+		}
+		body = fmt.Sprintf("{\"hostname\": \"%s\"}", ascii)
 	}
 	resp, err := ApiPost(targetName, "/api/listCategories", body)
 	if err != nil {
 		log.Fatal("failed to list categories in database: ", err)
 		return -1
 	}
-	resBody, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
+	defer closeResponse(resp)
+
+	// Stream the array rather than buffering it, large databases have many categories
+	decoder := json.NewDecoder(resp.Body)
+	if _, err = decoder.Token(); err != nil {
 		log.Fatal("failed to read body: ", err)
+		return -1
 	}
-	var categories CatList
-	json.Unmarshal(resBody, &categories)
 
-	fmt.Println("[")
-	for _, category := range categories {
-		fmt.Printf("\t%s\n", category)
+	fmt.Fprintln(showOutput(), "[")
+	for decoder.More() {
+		var category string
+		if err = decoder.Decode(&category); err != nil {
+			log.Fatal("failed to read body: ", err)
+			return -1
+		}
+		fmt.Fprintf(showOutput(), "\t%s\n", category)
 	}
-	fmt.Println("]")
+	fmt.Fprintln(showOutput(), "]")
 
 	return 0
 }
 
 func DeleteCategory(targetName string, category string) int {
 
-	_, err := ApiPost(targetName, "/api/deletecategory", fmt.Sprintf("{\"category\": \"%s\"}", category))
+	resp, err := ApiPost(targetName, "/api/deletecategory", fmt.Sprintf("{\"category\": \"%s\"}", category))
 	if err != nil {
 		log.Fatal("Failed to delete category in database: ", err)
 		return -1
 	}
+	closeResponse(resp)
 
 	return 0
 }
 
 func ClearAll(targetName string) int {
 
-	_, err := ApiGet(targetName, "/api/cleanup")
+	resp, err := ApiGet(targetName, "/api/cleanup")
 	if err != nil {
 		log.Fatal("Failed to clear the database: ", err)
 		return -1
 	}
+	closeResponse(resp)
 
 	return 0
 }
@@ -1856,10 +2120,11 @@ type ListStatus struct {
 
 func GenerateAndDownload(targetName string, filePath string) int {
 
-	_, err := ApiGet(targetName, "/api/generateLists")
+	resp, err := ApiGet(targetName, "/api/generateLists")
 	if err != nil {
 		log.Fatalf("Failed to generate list file: %s", err)
 	}
+	closeResponse(resp)
 	//err := errors.New("blah")
 
 	// Wait until file is ready
@@ -1871,6 +2136,7 @@ func GenerateAndDownload(targetName string, filePath string) int {
 		if err == nil {
 			// TODO: check resp
 			body, err := ioutil.ReadAll(resp.Body)
+			closeResponse(resp)
 			if err != nil {
 				log.Fatalf("Failed to get lists status: %s", err)
 			}
@@ -1903,7 +2169,7 @@ func GenerateAndDownload(targetName string, filePath string) int {
 }
 
 /* Deploy changes to target */
-func Deploy(name string) int {
+func Deploy(name string, message string, forceUnlock bool, force bool) int {
 
 	config, err := loadConfig()
 	if err != nil {
@@ -1917,57 +2183,249 @@ func Deploy(name string) int {
 		return -1
 	}
 
-	_, err = initHostConfig(host)
-	if err != nil {
-		log.Fatal("Failed to initialize host filter config: ", err)
+	err = deployHost(host, message, forceUnlock, force)
+	if err == errPostDeployHook {
 		return -1
+	} else if err != nil {
+		log.Fatal(err)
+		return -1
+	}
+
+	return 0
+}
+
+// Deployed, but a post-deploy hook failed; already reported
+var errPostDeployHook = errors.New("post-deploy hook failed")
+
+/*
+ * Deploy the filter stack to a host, recording the result in its history
+ */
+func deployHost(host Host, message string, forceUnlock bool, force bool) error {
+
+	name := host.Name
+
+	err := checkDeployApproved(name)
+	if err != nil {
+		return err
+	}
+
+	filterConfig, err := initHostConfig(host)
+	if err != nil {
+		return fmt.Errorf("failed to initialize host filter config: %s", err)
+	}
+
+	// Schedules run in the target's time zone, not this machine's
+	err = syncHostTimeZone(&host, &filterConfig)
+	if err != nil {
+		return fmt.Errorf("failed to set the target's time zone: %s", err)
+	}
+
+	done := progressStep(name, "check-chart")
+	err = ensureChartCompatible(force)
+	done(err)
+	if err != nil {
+		return fmt.Errorf("refusing to deploy: %s (use --force to deploy anyway)", err)
+	}
+
+	// Only informs, a deploy that can't be sized still runs
+	err = estimateDeployTransfer(host, filterConfig.MasterNode)
+	if err != nil {
+		log.Printf("Failed to estimate the transfer: %s\n", err)
+	}
+
+	// Keep other deploys from colliding with this one
+	done = progressStep(name, "lock")
+	release, err := acquireTargetLock(host, "deploy", forceUnlock)
+	done(err)
+	if err != nil {
+		return fmt.Errorf("failed to lock target: %s", err)
 	}
 
 	// Copy helm files to remote host
+	done = progressStep(name, "copy-chart")
 	err = copyHelmToRemote(host)
+	done(err)
 	if err != nil {
-		log.Fatal("Failed to copy helm data to remote host: ", err)
-		return -1
+		release()
+		return fmt.Errorf("failed to copy helm data to remote host: %s", err)
 	}
 
-	// Run helm deploy
-	client, err := getHostSshClient(host)
+	chartVersion, err := getChartVersion()
 	if err != nil {
-		log.Fatal("Failed to create SSH connection: ", err)
-		return -1
+		log.Printf("Failed to read chart version: %s\n", err)
+	}
+
+	overridesHash, err := hashHostFilterConfig(name)
+	if err != nil {
+		log.Printf("Failed to hash host filter config: %s\n", err)
+	}
+
+	// Keep a record of this deploy in the host's history
+	recordDeploy := func(result string, deployErr error) {
+		record := DeployRecord{
+			Time:          time.Now().UTC(),
+			ChartVersion:  chartVersion,
+			ReleaseTag:    filterConfig.ReleaseTag,
+			OverridesHash: overridesHash,
+			Result:        result,
+			Operator:      getOperator(),
+			Message:       message,
+		}
+		if deployErr != nil {
+			record.Error = deployErr.Error()
+		}
+		if err := appendDeployRecord(name, record); err != nil {
+			log.Printf("Failed to record deploy history: %s\n", err)
+		}
+	}
+
+	err = runDeployGate(host, filterConfig, message, chartVersion, overridesHash)
+	if err != nil {
+		recordDeploy("aborted", err)
+		release()
+		return fmt.Errorf("aborting deploy: %s", err)
+	}
+
+	done = progressStep(name, "pre-deploy-hooks")
+	err = runHooks(host, "pre-deploy", hookEnvironment(host, "pre-deploy", chartVersion, filterConfig.ReleaseTag))
+	done(err)
+	if err != nil {
+		recordDeploy("aborted", err)
+		release()
+		return fmt.Errorf("aborting deploy: %s", err)
+	}
+
+	// The release to return to if this deploy fails verification
+	previousRevision := 0
+	if AutoRollback {
+		previousRevision, err = deployedRevision(host)
+		if err != nil {
+			recordDeploy("aborted", err)
+			release()
+			return fmt.Errorf("aborting deploy, failed to find the release to roll back to: %s", err)
+		}
+		if previousRevision == 0 {
+			log.Println("Nothing is deployed yet, this deploy can't be rolled back if it fails verification")
+		}
 	}
 
-	_, err = client.RunCommands([]string{
+	// Run helm deploy
+	done = progressStep(name, "helm-upgrade")
+	ctx, cancel := stepContext(helmUpgradeTimeout)
+	results, err := runHostCommandResults(ctx, host, []string{
 		fmt.Sprintf("cd %s", getRemoteHelmPath(host)),
 		"export KUBECONFIG=/etc/rancher/k3s/k3s.yaml",
 		"helm upgrade --install --wait --create-namespace -f overrides.yaml -n filter guardian-angel guardian-angel",
 		"dd if=/dev/null of=overrides.yaml",
 		"rm overrides.yaml",
-	}, true)
+	}, nil, true)
+	// The overrides are removed whatever helm did, so its own result decides
+	if helm, ok := results.Find("helm upgrade"); ok && err == nil {
+		err = helm.Err()
+	}
+	aborted := ctx.Err() != nil
+	cancel()
+	done(err)
+	if aborted {
+		// The overrides hold passwords, don't leave them on the target
+		removePartialUpload(host, path.Join(getRemoteHelmPath(host), "overrides.yaml"))
+	}
 	if err != nil {
-		log.Fatal("Failed to deploy filter config: ", err)
-		return -1
+		recordDeploy("failed", err)
+		release()
+		return fmt.Errorf("failed to deploy filter config: %s", err)
 	}
 
-	caCertOutputPath := getCaPathDir(name)
+	hookEnv := hookEnvironment(host, "post-deploy", chartVersion, filterConfig.ReleaseTag)
+	if AutoRollback {
+		done = progressStep(name, "verify")
+		err = verifyDeploy(host, hookEnv)
+		done(err)
+		if err != nil {
+			log.Printf("Deploy failed verification: %s\n", err)
+			done = progressStep(name, "rollback")
+			rollbackErr := rollbackDeploy(host, previousRevision)
+			done(rollbackErr)
+			release()
+			if rollbackErr != nil {
+				recordDeploy("failed", err)
+				return fmt.Errorf("deploy failed verification and was not rolled back: %s", rollbackErr)
+			}
+			recordDeploy("rolled-back", err)
+			return fmt.Errorf("deploy failed verification and was rolled back: %s", err)
+		}
+	}
+	recordDeploy("success", nil)
+	// What a later deploy rolls back to
+	if err := saveSnapshot(name, deployedSnapshot); err != nil {
+		log.Printf("Failed to save the deployed overrides: %s\n", err)
+	}
+	release()
+	endDebugAfterDeploy(host)
+
+	done = progressStep(name, "fetch-ca")
 	caCertData, err := GetRootCa(name)
 	if err != nil {
-		log.Fatalf("Failed to fetch the root CA: %s\n", err)
+		done(err)
+		return fmt.Errorf("failed to fetch the root CA: %s", err)
+	}
+	err = ioutil.WriteFile(getCaPathDir(name), []byte(caCertData), 0o644)
+	done(err)
+	if err != nil {
+		return fmt.Errorf("failed to write ca certificate to disk: %s", err)
+	}
+
+	fmt.Println("Deployment successful.")
+
+	// Verification already ran them
+	if AutoRollback {
+		return nil
+	}
+	done = progressStep(name, "post-deploy-hooks")
+	err = runHooks(host, "post-deploy", hookEnv)
+	done(err)
+	if err != nil {
+		log.Printf("Deployed, but %s\n", err)
+		return errPostDeployHook
+	}
+
+	return nil
+}
+
+/*
+ * Remove the filter stack from a target host
+ */
+func Uninstall(name string, forceUnlock bool) int {
+
+	config, err := loadConfig()
+	if err != nil {
+		log.Fatal("Failed to load config: ", err)
+		return -1
+	}
+
+	_, host := FindHost(config, name)
+	if host.Name != name {
+		log.Fatalf("Host %s doesn't exist, create it first", name)
 		return -1
 	}
 
-	// Create caCert file
-	f, err := os.Create(caCertOutputPath)
+	release, err := acquireTargetLock(host, "uninstall", forceUnlock)
 	if err != nil {
-		log.Fatal("Failed to create host filter config file: ", err)
+		log.Fatal("Failed to lock target: ", err)
 		return -1
 	}
-	defer f.Close()
-	_, err = f.WriteString(string(caCertData))
+	defer release()
+
+	_, err = runHostCommands(host, []string{
+		"export KUBECONFIG=/etc/rancher/k3s/k3s.yaml",
+		"helm uninstall --wait -n filter guardian-angel",
+	}, true)
 	if err != nil {
-		log.Fatal("Failed to write ca certificate to disk: ", err)
+		release()
+		log.Fatal("Failed to uninstall filter stack: ", err)
+		return -1
 	}
 
-	fmt.Println("Deployment successful.")
+	fmt.Println("Uninstall successful.")
 	return 0
 }
@@ -0,0 +1,202 @@
+package utils
+
+import (
+	"fmt"
+	"log"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Free country database from DB-IP, published monthly under CC BY 4.0
+const defaultGeoDatabaseUrl = "https://download.db-ip.com/free/dbip-country-lite-%s.mmdb.gz"
+
+var geoDirections = []string{"both", "to", "from"}
+
+var countryCodePattern = regexp.MustCompile(`^[A-Z]{2}$`)
+
+/*
+ * Allow or deny traffic to and/or from the addresses of a country
+ */
+type GeoRule struct {
+	Country   string `yaml:"country"`
+	Allow     bool   `yaml:"allow"`
+	Direction string `yaml:"direction"`
+}
+
+type GeoConfig struct {
+	Rules []GeoRule `yaml:"rules,omitempty"`
+	// Where 'acl geo update' downloaded the database from, and when
+	DatabaseUrl     string `yaml:"databaseUrl,omitempty"`
+	DatabaseUpdated string `yaml:"databaseUpdated,omitempty"`
+}
+
+/*
+ * Path of the country database on the target, mounted into the filter by the chart
+ */
+func geoDatabasePath(volumePath string) string {
+	return path.Join(volumePath, "geoip", "country.mmdb")
+}
+
+func normalizeCountryCode(country string) (string, error) {
+	code := strings.ToUpper(country)
+	if !countryCodePattern.MatchString(code) {
+		return "", fmt.Errorf("invalid country code '%s', use a two-letter ISO 3166 code like 'DE'", country)
+	}
+	return code, nil
+}
+
+func (config *FilterConfig) findGeoRule(country string) int {
+	for i, rule := range config.Geo.Rules {
+		if rule.Country == country {
+			return i
+		}
+	}
+	return -1
+}
+
+/*
+ * Add a rule for a country, replacing any rule it already has
+ */
+func AddGeoRule(targetName string, country string, action string, direction string) int {
+
+	code, err := normalizeCountryCode(country)
+	if err != nil {
+		log.Fatal(err)
+		return -1
+	}
+	if action != "allow" && action != "deny" {
+		log.Fatalf("Invalid action '%s', valid options are allow, deny\n", action)
+		return -1
+	}
+	if !contains(geoDirections, direction) {
+		log.Fatalf("Invalid direction '%s', valid options are %s\n", direction, strings.Join(geoDirections, ", "))
+		return -1
+	}
+
+	config, err := getHostFilterConfig(targetName)
+	if err != nil {
+		log.Fatal("Failed to get host config: ", err)
+		return -1
+	}
+
+	rule := GeoRule{Country: code, Allow: action == "allow", Direction: direction}
+	if i := config.findGeoRule(code); i >= 0 {
+		if config.Geo.Rules[i] == rule {
+			log.Fatalf("Geo rule '%s=%s' already exists\n", code, action)
+			return -1
+		}
+		config.Geo.Rules[i] = rule
+	} else {
+		config.Geo.Rules = append(config.Geo.Rules, rule)
+	}
+
+	err = writeHostFilterConfig(targetName, config)
+	if err != nil {
+		log.Fatal("Failed to write host config: ", err)
+		return -1
+	}
+
+	log.Printf("Added geo rule '%s=%s' (%s); deploy to apply\n", code, action, direction)
+	if config.Geo.DatabaseUpdated == "" {
+		log.Println("Warning: the target has no GeoIP database yet, run 'filter acl geo update' before deploying")
+	}
+	return 0
+}
+
+func DeleteGeoRule(targetName string, country string) int {
+
+	code, err := normalizeCountryCode(country)
+	if err != nil {
+		log.Fatal(err)
+		return -1
+	}
+
+	config, err := getHostFilterConfig(targetName)
+	if err != nil {
+		log.Fatal("Failed to get host config: ", err)
+		return -1
+	}
+
+	i := config.findGeoRule(code)
+	if i < 0 {
+		log.Fatalf("No geo rule for '%s'\n", code)
+		return -1
+	}
+	config.Geo.Rules = append(config.Geo.Rules[:i], config.Geo.Rules[i+1:]...)
+
+	err = writeHostFilterConfig(targetName, config)
+	if err != nil {
+		log.Fatal("Failed to write host config: ", err)
+		return -1
+	}
+
+	log.Printf("Deleted geo rule for '%s'; deploy to apply\n", code)
+	return 0
+}
+
+/*
+ * Download the country database onto the target. The update time is recorded in the
+ * overrides so the next deploy restarts the filter with the new database.
+ */
+func UpdateGeoDatabase(targetName string, databaseUrl string) int {
+
+	config, err := loadConfig()
+	if err != nil {
+		log.Fatal("Failed to load config: ", err)
+		return -1
+	}
+
+	_, host := FindHost(config, targetName)
+	if host.Name != targetName {
+		log.Fatalf("Host %s doesn't exist, create it first", targetName)
+		return -1
+	}
+
+	filterConfig, err := getHostFilterConfig(targetName)
+	if err != nil {
+		log.Fatal("Failed to get host config: ", err)
+		return -1
+	}
+
+	now := time.Now().UTC()
+	if databaseUrl == "" {
+		databaseUrl = filterConfig.Geo.DatabaseUrl
+	}
+	if databaseUrl == "" {
+		databaseUrl = defaultGeoDatabaseUrl
+	}
+	source := databaseUrl
+	if strings.Contains(source, "%s") {
+		source = fmt.Sprintf(source, now.Format("2006-01"))
+	}
+
+	dbPath := geoDatabasePath(filterConfig.VolumePath)
+	download := dbPath + ".download"
+	fetch := fmt.Sprintf("curl -sfL %s -o %s", shellQuote(source), shellQuote(download))
+	if strings.HasSuffix(source, ".gz") {
+		fetch = fmt.Sprintf("curl -sfL %s -o %s.gz && gunzip -f %s.gz", shellQuote(source), shellQuote(download), shellQuote(download))
+	}
+	log.Printf("Downloading GeoIP database from %s...\n", source)
+	// Swap the download in only once it is complete, so a failed one keeps the old database
+	_, err = runHostCommands(host, []string{
+		fmt.Sprintf("mkdir -p %s", shellQuote(path.Dir(dbPath))),
+		fmt.Sprintf("%s && mv %s %s", fetch, shellQuote(download), shellQuote(dbPath)),
+	}, false)
+	if err != nil {
+		log.Fatal("Failed to download GeoIP database: ", err)
+		return -1
+	}
+
+	filterConfig.Geo.DatabaseUrl = databaseUrl
+	filterConfig.Geo.DatabaseUpdated = now.Format(time.RFC3339)
+	err = writeHostFilterConfig(targetName, filterConfig)
+	if err != nil {
+		log.Fatal("Failed to write host config: ", err)
+		return -1
+	}
+
+	log.Println("Updated the GeoIP database; deploy to load it")
+	return 0
+}
@@ -0,0 +1,204 @@
+package utils
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"text/tabwriter"
+)
+
+/*
+ * Named set of targets that filter commands can be run against with --target-group
+ */
+type HostGroup struct {
+	Name    string
+	Members []string
+}
+
+func findGroup(config Configuration, name string) int {
+	for i, group := range config.Groups {
+		if group.Name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+/*
+ * Replace a target in every group it was in, or drop it when replacement is empty
+ */
+func replaceInGroups(config *Configuration, target string, replacement string) {
+	for i, group := range config.Groups {
+		var members []string
+		for _, member := range group.Members {
+			if member == target {
+				member = replacement
+			}
+			if member != "" && !contains(members, member) {
+				members = append(members, member)
+			}
+		}
+		config.Groups[i].Members = members
+	}
+}
+
+/*
+ * The targets of a group, in the order they were added
+ */
+func GroupMembers(name string) ([]string, error) {
+	config, err := loadConfig()
+	if err != nil {
+		return nil, err
+	}
+	i := findGroup(config, name)
+	if i < 0 {
+		return nil, fmt.Errorf("group '%s' doesn't exist, create it with 'target group create'", name)
+	}
+	if len(config.Groups[i].Members) == 0 {
+		return nil, fmt.Errorf("group '%s' has no targets, add some with 'target group add'", name)
+	}
+	return config.Groups[i].Members, nil
+}
+
+func CreateGroup(name string) int {
+
+	// Group names share the target name rules so they read the same in logs
+	if err := validateTargetName(name); err != nil {
+		log.Fatal(strings.Replace(err.Error(), "target", "group", 1))
+		return -1
+	}
+
+	config, err := loadConfig()
+	if err != nil {
+		log.Fatal("Failed to load config: ", err)
+		return -1
+	}
+
+	if findGroup(config, name) >= 0 {
+		log.Fatalf("Group '%s' already exists\n", name)
+		return -1
+	}
+	config.Groups = append(config.Groups, HostGroup{Name: name})
+
+	err = writeConfig(config)
+	if err != nil {
+		log.Fatal("Failed to write config: ", err)
+		return -1
+	}
+
+	log.Printf("Created group '%s'\n", name)
+	return 0
+}
+
+func DeleteGroup(name string) int {
+
+	config, err := loadConfig()
+	if err != nil {
+		log.Fatal("Failed to load config: ", err)
+		return -1
+	}
+
+	i := findGroup(config, name)
+	if i < 0 {
+		log.Fatalf("Group '%s' doesn't exist\n", name)
+		return -1
+	}
+	config.Groups = append(config.Groups[:i], config.Groups[i+1:]...)
+
+	err = writeConfig(config)
+	if err != nil {
+		log.Fatal("Failed to write config: ", err)
+		return -1
+	}
+
+	log.Printf("Deleted group '%s', its targets are unchanged\n", name)
+	return 0
+}
+
+func AddToGroup(name string, targets []string) int {
+
+	config, err := loadConfig()
+	if err != nil {
+		log.Fatal("Failed to load config: ", err)
+		return -1
+	}
+
+	i := findGroup(config, name)
+	if i < 0 {
+		log.Fatalf("Group '%s' doesn't exist, create it first\n", name)
+		return -1
+	}
+	for _, target := range targets {
+		if _, host := FindHost(config, target); host.Name != target {
+			log.Fatalf("Host %s doesn't exist, create it first", target)
+			return -1
+		}
+		if contains(config.Groups[i].Members, target) {
+			log.Printf("Target '%s' is already in group '%s'\n", target, name)
+			continue
+		}
+		config.Groups[i].Members = append(config.Groups[i].Members, target)
+	}
+
+	err = writeConfig(config)
+	if err != nil {
+		log.Fatal("Failed to write config: ", err)
+		return -1
+	}
+
+	log.Printf("Group '%s' has %d targets\n", name, len(config.Groups[i].Members))
+	return 0
+}
+
+func RemoveFromGroup(name string, targets []string) int {
+
+	config, err := loadConfig()
+	if err != nil {
+		log.Fatal("Failed to load config: ", err)
+		return -1
+	}
+
+	i := findGroup(config, name)
+	if i < 0 {
+		log.Fatalf("Group '%s' doesn't exist\n", name)
+		return -1
+	}
+	var members []string
+	for _, member := range config.Groups[i].Members {
+		if !contains(targets, member) {
+			members = append(members, member)
+		}
+	}
+	for _, target := range targets {
+		if !contains(config.Groups[i].Members, target) {
+			log.Printf("Target '%s' is not in group '%s'\n", target, name)
+		}
+	}
+	config.Groups[i].Members = members
+
+	err = writeConfig(config)
+	if err != nil {
+		log.Fatal("Failed to write config: ", err)
+		return -1
+	}
+
+	log.Printf("Group '%s' has %d targets\n", name, len(members))
+	return 0
+}
+
+func ListGroups() int {
+
+	config, err := loadConfig()
+	if err != nil {
+		log.Fatal("Failed to load config: ", err)
+		return -1
+	}
+
+	w := tabwriter.NewWriter(showOutput(), 1, 1, 3, ' ', 0)
+	fmt.Fprintln(w, "Group\tTargets")
+	for _, group := range config.Groups {
+		fmt.Fprintf(w, "%s\t%s\n", group.Name, strings.Join(group.Members, ", "))
+	}
+	w.Flush()
+	return 0
+}
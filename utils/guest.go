@@ -0,0 +1,129 @@
+package utils
+
+import (
+	"io/ioutil"
+	"log"
+	"net"
+	"sort"
+	"strings"
+)
+
+// Categories denied for guests under each policy
+var GuestPolicies = map[string][]string{
+	"strict":   {"adult", "gambling", "malware", "phishing", "proxy", "violence", "drugs", "weapons"},
+	"moderate": {"adult", "malware", "phishing"},
+}
+
+// Filter group guests are placed in, separate from the LAN policy
+const guestGroup = "guest"
+
+type GuestConfig struct {
+	Enabled bool   `yaml:"enabled"`
+	Network string `yaml:"network"`
+	Policy  string `yaml:"policy"`
+	Group   string `yaml:"group"`
+	// Categories denied to guests in addition to the LAN acl rules
+	DenyCategories []string `yaml:"denyCategories"`
+	// Splash page guests must accept before browsing
+	TermsPage string `yaml:"termsPage,omitempty"`
+}
+
+func guestPolicyNames() []string {
+	var names []string
+	for name := range GuestPolicies {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+/*
+ * Networks overlap if either contains the other's base address
+ */
+func networksOverlap(a *net.IPNet, b *net.IPNet) bool {
+	return a.Contains(b.IP) || b.Contains(a.IP)
+}
+
+/*
+ * Filter a guest network under its own policy behind an acceptance page
+ */
+func EnableGuestNetwork(targetName string, network string, policy string, termsPage string) int {
+
+	_, guestNet, err := net.ParseCIDR(network)
+	if err != nil {
+		log.Fatalf("Invalid guest network '%s', expected CIDR notation\n", network)
+		return -1
+	}
+	categories, ok := GuestPolicies[policy]
+	if !ok {
+		log.Fatalf("Invalid policy '%s', valid options are %s\n", policy, strings.Join(guestPolicyNames(), ", "))
+		return -1
+	}
+
+	terms := ""
+	if termsPage != "" {
+		data, err := ioutil.ReadFile(termsPage)
+		if err != nil {
+			log.Fatal("Failed to read terms page: ", err)
+			return -1
+		}
+		terms = string(data)
+	}
+
+	config, err := getHostFilterConfig(targetName)
+	if err != nil {
+		log.Fatal("Failed to get host config: ", err)
+		return -1
+	}
+
+	if _, localNet, err := net.ParseCIDR(config.LocalNetwork); err == nil && networksOverlap(guestNet, localNet) {
+		log.Fatalf("Guest network %s overlaps the local network %s\n", guestNet, localNet)
+		return -1
+	}
+
+	// Keep the existing splash page when none is given
+	if terms == "" {
+		terms = config.Guest.TermsPage
+	}
+
+	config.Guest = GuestConfig{
+		Enabled:        true,
+		Network:        guestNet.String(),
+		Policy:         policy,
+		Group:          guestGroup,
+		DenyCategories: categories,
+		TermsPage:      terms,
+	}
+
+	err = writeHostFilterConfig(targetName, config)
+	if err != nil {
+		log.Fatal("Failed to write host config: ", err)
+		return -1
+	}
+
+	if terms == "" {
+		log.Println("Warning: no terms page set; guests will not see a splash page")
+	}
+	log.Printf("Enabled guest network %s with %s policy\n", guestNet, policy)
+	return 0
+}
+
+func DisableGuestNetwork(targetName string) int {
+
+	config, err := getHostFilterConfig(targetName)
+	if err != nil {
+		log.Fatal("Failed to get host config: ", err)
+		return -1
+	}
+
+	config.Guest = GuestConfig{}
+
+	err = writeHostFilterConfig(targetName, config)
+	if err != nil {
+		log.Fatal("Failed to write host config: ", err)
+		return -1
+	}
+
+	log.Println("Disabled guest network")
+	return 0
+}
@@ -0,0 +1,101 @@
+package utils
+
+import (
+	"log"
+)
+
+type HighAvailabilityConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// required spreads replicas over distinct nodes, preferred only tries to
+	AntiAffinity string `yaml:"antiAffinity,omitempty"`
+	// Replicas kept running during voluntary disruptions such as node drains
+	MinAvailable int `yaml:"minAvailable,omitempty"`
+}
+
+/*
+ * Run filter, DNS and nginx with several replicas spread across nodes
+ */
+func EnableHighAvailability(targetName string, replicas int, soft bool) int {
+
+	if replicas < 2 {
+		log.Fatalf("High availability needs at least 2 replicas\n")
+		return -1
+	}
+
+	config, err := loadConfig()
+	if err != nil {
+		log.Fatal("Failed to load config: ", err)
+		return -1
+	}
+
+	_, host := FindHost(config, targetName)
+	if host.Name != targetName {
+		log.Fatalf("Host %s doesn't exist, create it first", targetName)
+		return -1
+	}
+
+	facts, err := getClusterFacts(host)
+	if err != nil {
+		log.Fatal("Failed to get cluster facts: ", err)
+		return -1
+	}
+
+	antiAffinity := "required"
+	if facts.Nodes < replicas {
+		if !soft {
+			log.Fatalf("The cluster has %d node(s), too few to spread %d replicas; add nodes or use --soft\n", facts.Nodes, replicas)
+			return -1
+		}
+		log.Printf("Warning: the cluster has %d node(s); some replicas will share a node\n", facts.Nodes)
+	}
+	if soft {
+		antiAffinity = "preferred"
+	}
+
+	filterConfig, err := getHostFilterConfig(targetName)
+	if err != nil {
+		log.Fatal("Failed to get host config: ", err)
+		return -1
+	}
+
+	filterConfig.FilterReplicas = replicas
+	filterConfig.ReverseDnsReplicas = replicas
+	filterConfig.NginxReplicas = replicas
+	filterConfig.HighAvailability = HighAvailabilityConfig{
+		Enabled:      true,
+		AntiAffinity: antiAffinity,
+		MinAvailable: replicas - 1,
+	}
+
+	err = writeHostFilterConfig(targetName, filterConfig)
+	if err != nil {
+		log.Fatal("Failed to write host config: ", err)
+		return -1
+	}
+
+	log.Printf("Enabled high availability with %d replicas (%s anti-affinity); deploy to apply\n", replicas, antiAffinity)
+	return 0
+}
+
+func DisableHighAvailability(targetName string) int {
+
+	filterConfig, err := getHostFilterConfig(targetName)
+	if err != nil {
+		log.Fatal("Failed to get host config: ", err)
+		return -1
+	}
+
+	filterConfig.FilterReplicas = 1
+	filterConfig.ReverseDnsReplicas = 1
+	filterConfig.NginxReplicas = 1
+	filterConfig.HighAvailability = HighAvailabilityConfig{}
+
+	err = writeHostFilterConfig(targetName, filterConfig)
+	if err != nil {
+		log.Fatal("Failed to write host config: ", err)
+		return -1
+	}
+
+	log.Println("Disabled high availability; deploy to apply")
+	return 0
+}
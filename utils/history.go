@@ -0,0 +1,175 @@
+package utils
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/user"
+	"path/filepath"
+	"text/tabwriter"
+	"time"
+)
+
+type DeployRecord struct {
+	Time          time.Time
+	ChartVersion  string
+	ReleaseTag    string
+	OverridesHash string
+	Result        string
+	Error         string `json:",omitempty"`
+	Operator      string
+	Message       string `json:",omitempty"`
+}
+
+// Fixed width, so deploy times sort as text in the local database
+const deployTimeFormat = "2006-01-02T15:04:05.000000000Z07:00"
+
+func getDeployHistoryPath(name string) string {
+	return filepath.Join(getHostDataDir(name), "history.jsonl")
+}
+
+/*
+ * Name of the local user running the CLI
+ */
+func getOperator() string {
+	operator := os.Getenv("USER")
+	if u, err := user.Current(); err == nil {
+		operator = u.Username
+	}
+	// Commands a helper runs through the daemon are done on their behalf
+	if delegate := os.Getenv("GUARDIAN_DELEGATE"); delegate != "" {
+		operator = fmt.Sprintf("%s for delegate %s", operator, delegate)
+	}
+	return operator
+}
+
+/*
+ * sha256 of the host's overrides file
+ */
+func hashHostFilterConfig(name string) (string, error) {
+	data, err := ioutil.ReadFile(getHostFilterConfigPath(name))
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+/*
+ * Append a deploy record to the host's history
+ */
+func appendDeployRecord(name string, record DeployRecord) error {
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	if useLocalDb() {
+		importLegacyCaches(name)
+		db, err := localDb()
+		if err != nil {
+			return err
+		}
+		_, err = db.Exec("INSERT INTO deploy_history (target, time, record) VALUES (?, ?, ?)",
+			name, record.Time.UTC().Format(deployTimeFormat), string(line))
+		return err
+	}
+	f, err := os.OpenFile(getDeployHistoryPath(name), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = f.WriteString(string(line) + "\n")
+	return err
+}
+
+/*
+ * The latest limit deploys of a host, oldest first; all of them if limit is 0
+ */
+func loadDeployHistory(name string, limit int) ([]DeployRecord, error) {
+	if !useLocalDb() {
+		records, err := loadDeployHistoryFile(name)
+		if limit > 0 && len(records) > limit {
+			records = records[len(records)-limit:]
+		}
+		return records, err
+	}
+	importLegacyCaches(name)
+
+	db, err := localDb()
+	if err != nil {
+		return nil, err
+	}
+	// A negative limit is none
+	if limit <= 0 {
+		limit = -1
+	}
+	rows, err := queryStrings(db, "SELECT record FROM deploy_history WHERE target = ? ORDER BY time DESC LIMIT ?", name, limit)
+	if err != nil {
+		return nil, err
+	}
+	// Selected newest first for the limit
+	var records []DeployRecord
+	for i := len(rows) - 1; i >= 0; i-- {
+		var record DeployRecord
+		if err := json.Unmarshal([]byte(rows[i]), &record); err != nil {
+			return nil, err
+		}
+		records = append(records, record)
+	}
+	return records, nil
+}
+
+func loadDeployHistoryFile(name string) ([]DeployRecord, error) {
+	f, err := os.Open(getDeployHistoryPath(name))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var records []DeployRecord
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var record DeployRecord
+		if err = json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			return nil, err
+		}
+		records = append(records, record)
+	}
+	return records, scanner.Err()
+}
+
+/*
+ * Show the deploy history for a target
+ */
+func ShowDeployHistory(targetName string, limit int) int {
+
+	records, err := loadDeployHistory(targetName, limit)
+	if err != nil {
+		log.Fatal("Failed to read deploy history: ", err)
+		return -1
+	}
+
+	w := tabwriter.NewWriter(showOutput(), 1, 1, 3, ' ', 0)
+	fmt.Fprintln(w, "Time\tResult\tChart\tRelease tag\tOverrides\tOperator\tMessage")
+	for _, record := range records {
+		result := record.Result
+		if record.Error != "" {
+			result = fmt.Sprintf("%s (%s)", result, record.Error)
+		}
+		hash := record.OverridesHash
+		if len(hash) > 12 {
+			hash = hash[:12]
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", record.Time.Local().Format(time.RFC3339), result, record.ChartVersion, record.ReleaseTag, hash, record.Operator, record.Message)
+	}
+	w.Flush()
+
+	return 0
+}
@@ -0,0 +1,240 @@
+package utils
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+var HookStages = []string{"pre-deploy", "post-deploy"}
+
+type Hook struct {
+	Stage   string
+	Remote  bool
+	Command string
+}
+
+type chartMetadata struct {
+	Version     string            `yaml:"version"`
+	AppVersion  string            `yaml:"appVersion"`
+	Annotations map[string]string `yaml:"annotations"`
+}
+
+func validHookStage(stage string) bool {
+	for _, s := range HookStages {
+		if s == stage {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+ * Read the Chart.yaml of the checked out helm chart
+ */
+func getChartMetadata() (chartMetadata, error) {
+	var chart chartMetadata
+	data, err := ioutil.ReadFile(filepath.Join(getHelmPath(), "guardian-angel", "Chart.yaml"))
+	if err != nil {
+		return chart, err
+	}
+	err = yaml.Unmarshal(data, &chart)
+	return chart, err
+}
+
+/*
+ * Read the version of the checked out helm chart
+ */
+func getChartVersion() (string, error) {
+	chart, err := getChartMetadata()
+	return chart.Version, err
+}
+
+/*
+ * Environment describing the deploy, passed to every hook
+ */
+func hookEnvironment(host Host, stage string, chartVersion string, releaseTag string) map[string]string {
+	return map[string]string{
+		"GUARDIAN_TARGET":         host.Name,
+		"GUARDIAN_TARGET_ADDRESS": host.Address,
+		"GUARDIAN_HOOK_STAGE":     stage,
+		"GUARDIAN_CHART_VERSION":  chartVersion,
+		"GUARDIAN_RELEASE_TAG":    releaseTag,
+	}
+}
+
+func runLocalHook(command string, env map[string]string) error {
+	var cmd *exec.Cmd
+	if runtime.GOOS == "windows" {
+		cmd = exec.Command("cmd", "/C", command)
+	} else {
+		cmd = exec.Command("sh", "-c", command)
+	}
+	cmd.Env = os.Environ()
+	for k, v := range env {
+		cmd.Env = append(cmd.Env, fmt.Sprintf("%s=%s", k, v))
+	}
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	return cmd.Run()
+}
+
+func runRemoteHook(host Host, command string, env map[string]string) error {
+	// sorted so the command line is stable
+	keys := make([]string, 0, len(env))
+	for k := range env {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var commands []string
+	for _, k := range keys {
+		commands = append(commands, fmt.Sprintf("export %s='%s'", k, strings.ReplaceAll(env[k], "'", "'\\''")))
+	}
+	commands = append(commands, command)
+	_, err := runHostCommands(host, commands, true)
+	return err
+}
+
+/*
+ * Run all of a host's hooks for a stage, in the order they were added
+ */
+func runHooks(host Host, stage string, env map[string]string) error {
+	for _, hook := range host.Hooks {
+		if hook.Stage != stage {
+			continue
+		}
+		where := "locally"
+		if hook.Remote {
+			where = "on target"
+		}
+		log.Printf("Running %s hook %s: %s\n", stage, where, hook.Command)
+
+		var err error
+		if hook.Remote {
+			err = runRemoteHook(host, hook.Command, env)
+		} else {
+			err = runLocalHook(hook.Command, env)
+		}
+		if err != nil {
+			return fmt.Errorf("%s hook '%s' failed: %s", stage, hook.Command, err)
+		}
+	}
+	return nil
+}
+
+/*
+ * Add a deploy hook to a target
+ */
+func AddHook(name string, stage string, command string, remote bool) int {
+
+	if !validHookStage(stage) {
+		log.Fatalf("Invalid stage '%s', valid options are %s\n", stage, strings.Join(HookStages, ", "))
+		return -1
+	}
+
+	config, err := loadConfig()
+	if err != nil {
+		log.Fatal("Failed to load config: ", err)
+		return -1
+	}
+
+	index, host := FindHost(config, name)
+	if index < 0 {
+		log.Fatalf("Host '%s' is not configured\n", name)
+		return -1
+	}
+
+	for _, hook := range host.Hooks {
+		if hook.Stage == stage && hook.Command == command && hook.Remote == remote {
+			log.Fatalf("Hook already exists for stage '%s'\n", stage)
+			return -1
+		}
+	}
+
+	config.Hosts[index].Hooks = append(host.Hooks, Hook{Stage: stage, Remote: remote, Command: command})
+	err = writeConfig(config)
+	if err != nil {
+		log.Fatal("Failed to write config: ", err)
+		return -1
+	}
+
+	fmt.Printf("Added %s hook to target '%s'\n", stage, name)
+	return 0
+}
+
+/*
+ * Remove a deploy hook from a target
+ */
+func RemoveHook(name string, stage string, command string) int {
+
+	config, err := loadConfig()
+	if err != nil {
+		log.Fatal("Failed to load config: ", err)
+		return -1
+	}
+
+	index, host := FindHost(config, name)
+	if index < 0 {
+		log.Fatalf("Host '%s' is not configured\n", name)
+		return -1
+	}
+
+	for i, hook := range host.Hooks {
+		if hook.Stage == stage && hook.Command == command {
+			config.Hosts[index].Hooks = append(host.Hooks[:i], host.Hooks[i+1:]...)
+			err = writeConfig(config)
+			if err != nil {
+				log.Fatal("Failed to write config: ", err)
+				return -1
+			}
+			fmt.Printf("Removed %s hook from target '%s'\n", stage, name)
+			return 0
+		}
+	}
+
+	log.Fatalf("No %s hook '%s' on target '%s'\n", stage, command, name)
+	return -1
+}
+
+/*
+ * List deploy hooks for a target
+ */
+func ListHooks(name string) int {
+
+	config, err := loadConfig()
+	if err != nil {
+		log.Fatal("Failed to load config: ", err)
+		return -1
+	}
+
+	index, host := FindHost(config, name)
+	if index < 0 {
+		log.Fatalf("Host '%s' is not configured\n", name)
+		return -1
+	}
+
+	for _, stage := range HookStages {
+		fmt.Fprintf(showOutput(), "=== %s ===\n", strings.ToUpper(stage))
+		for _, hook := range host.Hooks {
+			if hook.Stage != stage {
+				continue
+			}
+			where := "local"
+			if hook.Remote {
+				where = "remote"
+			}
+			fmt.Fprintf(showOutput(), "[%s] %s\n", where, hook.Command)
+		}
+	}
+
+	return 0
+}
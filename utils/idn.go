@@ -0,0 +1,196 @@
+package utils
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+
+	"golang.org/x/net/idna"
+)
+
+// Category that lookalikes of allow-listed sites are loaded into and denied by
+const homographCategory = "homograph"
+
+// Cyrillic and Greek letters that render like Latin ones
+var confusables = map[rune][]rune{
+	'a': {'а'},
+	'c': {'с'},
+	'd': {'ԁ'},
+	'e': {'е'},
+	'h': {'һ'},
+	'i': {'і'},
+	'j': {'ј'},
+	'o': {'о', 'ο'},
+	'p': {'р'},
+	'q': {'ԛ'},
+	's': {'ѕ'},
+	'v': {'ν'},
+	'w': {'ԝ'},
+	'x': {'х'},
+	'y': {'у'},
+}
+
+/*
+ * The punycode form of a domain, lowercased, as the lookup service matches it
+ */
+func normalizeDomain(domain string) (string, error) {
+	ascii, err := idna.Lookup.ToASCII(strings.TrimSuffix(strings.TrimSpace(domain), "."))
+	if err != nil {
+		return "", fmt.Errorf("invalid domain '%s': %s", domain, err)
+	}
+	return strings.ToLower(ascii), nil
+}
+
+/*
+ * The punycode and, for internationalized domains, unicode forms of a domain
+ */
+func domainForms(domain string) ([]string, error) {
+	ascii, err := normalizeDomain(domain)
+	if err != nil {
+		return nil, err
+	}
+	forms := []string{ascii}
+	if unicode, err := idna.Lookup.ToUnicode(ascii); err == nil && unicode != ascii {
+		forms = append(forms, unicode)
+	}
+	return forms, nil
+}
+
+/*
+ * Both forms of every domain, skipping and reporting ones that aren't valid
+ */
+func normalizeDomainList(domains []string) []string {
+	seen := map[string]bool{}
+	var normalized []string
+	for _, domain := range domains {
+		forms, err := domainForms(domain)
+		if err != nil {
+			log.Printf("Skipping %s\n", err)
+			continue
+		}
+		for _, form := range forms {
+			if !seen[form] {
+				seen[form] = true
+				normalized = append(normalized, form)
+			}
+		}
+	}
+	return normalized
+}
+
+/*
+ * Punycode lookalikes of a domain that swap one, or every, Latin letter for a
+ * confusable Cyrillic or Greek one
+ */
+func homographVariants(domain string) []string {
+	// Only the registrable labels, a lookalike TLD doesn't resolve
+	end := strings.LastIndex(domain, ".")
+	if end < 0 {
+		return nil
+	}
+	letters := []rune(domain)
+	seen := map[string]bool{}
+	var variants []string
+	add := func(variant []rune) {
+		ascii, err := normalizeDomain(string(variant))
+		if err == nil && ascii != domain && !seen[ascii] {
+			seen[ascii] = true
+			variants = append(variants, ascii)
+		}
+	}
+
+	all := append([]rune{}, letters...)
+	for i, letter := range letters[:end] {
+		for _, lookalike := range confusables[letter] {
+			variant := append([]rune{}, letters...)
+			variant[i] = lookalike
+			add(variant)
+		}
+		if lookalikes, ok := confusables[letter]; ok {
+			all[i] = lookalikes[0]
+		}
+	}
+	add(all)
+	return variants
+}
+
+/*
+ * Domains of the site lists that are allow-listed
+ */
+func allowListedSites(config FilterConfig) []string {
+	seen := map[string]bool{}
+	var sites []string
+	for _, list := range config.E2guardianConf.Lists {
+		if list.Type != "sitelist" || !contains(list.IncludeIn, allowLists["sitelist"]) {
+			continue
+		}
+		for _, group := range list.Groups {
+			for _, item := range group.Items {
+				site, err := normalizeDomain(item)
+				// Internationalized sites have no Latin letters to swap
+				if err != nil || seen[site] || strings.Contains(site, "xn--") {
+					continue
+				}
+				seen[site] = true
+				sites = append(sites, site)
+			}
+		}
+	}
+	sort.Strings(sites)
+	return sites
+}
+
+/*
+ * Deny mixed-script lookalikes of the allow-listed sites. Turning it on again
+ * reloads the lookalikes after the allow lists changed.
+ */
+func HomographProtection(targetName string, enabled bool) int {
+
+	config, err := getHostFilterConfig(targetName)
+	if err != nil {
+		log.Fatal("Failed to get host config: ", err)
+		return -1
+	}
+
+	var variants []string
+	if enabled {
+		sites := allowListedSites(config)
+		if len(sites) == 0 {
+			log.Fatalln("No allow-listed sites to protect; whitelist a sitelist content list first")
+			return -1
+		}
+		for _, site := range sites {
+			variants = append(variants, homographVariants(site)...)
+		}
+		log.Printf("Generated %d lookalikes of %d allow-listed sites\n", len(variants), len(sites))
+	}
+
+	config.HomographProtection = enabled
+	if enabled && !config.AclRuleExists(homographCategory, "deny") {
+		// Deny rules go first so they win over any allow rule
+		config.AddAclRule(homographCategory, "deny", 0)
+	} else if !enabled {
+		config.AllowRules = config.DeleteAllowRule(homographCategory, "deny")
+	}
+
+	err = writeHostFilterConfig(targetName, config)
+	if err != nil {
+		log.Fatal("Failed to write host config: ", err)
+		return -1
+	}
+
+	// Start from an empty category so lookalikes of sites no longer allow-listed go
+	if DeleteCategory(targetName, homographCategory) != 0 {
+		return -1
+	}
+	if !enabled {
+		log.Println("Homograph protection is off; deploy to apply")
+		return 0
+	}
+	if batchHostRequest(targetName, "/api/addhost", variants, homographCategory) != 0 {
+		return -1
+	}
+	log.Println("Homograph protection is on; deploy to apply")
+	return 0
+}
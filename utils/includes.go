@@ -0,0 +1,310 @@
+package utils
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"sort"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Main lists the chart includes phrase lists in
+var phraseMainLists = []string{"bannedphraselist", "weightedphraselist", "exceptionphraselist"}
+
+// Includes this far from a main list name are taken as typos of it
+const maxIncludeTypoDistance = 3
+
+/*
+ * Main lists a content list can be included in, by its type
+ */
+func contentListIncludes(listType string) []string {
+	ban, ok := banLists[listType]
+	if !ok {
+		return nil
+	}
+	return []string{ban, allowLists[listType]}
+}
+
+func validateContentInclude(list ContentList, include string) error {
+	valid := contentListIncludes(list.Type)
+	if valid == nil {
+		return fmt.Errorf("list '%s' has unknown type '%s'", list.ListName, list.Type)
+	}
+	if !contains(valid, include) {
+		return fmt.Errorf("%s '%s' can't be included in '%s', only in %s or %s", list.Type, list.ListName, include, valid[0], valid[1])
+	}
+	return nil
+}
+
+/*
+ * Set each phrase list's kind from the section it is in, which is what the chart
+ * renders; overrides from older versions or hand edits may disagree
+ */
+func (config *E2guardianConfig) markPhraseListKinds() {
+	for i := range config.PhraseLists {
+		config.PhraseLists[i].Weighted = false
+	}
+	for i := range config.WeightedPhraseLists {
+		config.WeightedPhraseLists[i].Weighted = true
+	}
+}
+
+/*
+ * Main lists a phrase list can be included in, by its kind. Weighted lists
+ * can't be excepted, their phrases take a negative weight instead.
+ */
+func phraseListIncludes(weighted bool) []string {
+	if weighted {
+		return []string{"weightedphraselist"}
+	}
+	return []string{"bannedphraselist", "exceptionphraselist"}
+}
+
+func validatePhraseInclude(list PhraseList, include string) error {
+	valid := phraseListIncludes(list.Weighted)
+	if contains(valid, include) {
+		return nil
+	}
+	if list.Weighted {
+		return fmt.Errorf("weighted phrase list '%s' can't be included in '%s', only in %s", list.ListName, include, valid[0])
+	}
+	return fmt.Errorf("phrase list '%s' can't be included in '%s', only in %s or %s", list.ListName, include, valid[0], valid[1])
+}
+
+/*
+ * The main list name closest to include, if it is close enough to be a typo
+ */
+func closestMainList(include string, names []string) string {
+	closest := ""
+	best := maxIncludeTypoDistance + 1
+	for _, name := range names {
+		if distance := editDistance(include, name); distance < best {
+			closest, best = name, distance
+		}
+	}
+	return closest
+}
+
+/*
+ * The include a content list should have instead of include, or "" to drop it.
+ * Ban and exception lists of another type become those of the list's own type.
+ */
+func repairContentInclude(listType string, include string) string {
+	if contains(contentListIncludes(listType), include) {
+		return include
+	}
+	var names []string
+	for t := range banLists {
+		names = append(names, banLists[t], allowLists[t])
+	}
+	sort.Strings(names)
+	if !contains(names, include) {
+		include = closestMainList(include, names)
+	}
+	for t := range banLists {
+		if include == banLists[t] {
+			return banLists[listType]
+		}
+		if include == allowLists[t] {
+			return allowLists[listType]
+		}
+	}
+	return ""
+}
+
+/*
+ * The include a phrase list should have instead of include, or "" to drop it.
+ * Banning moves to the main list of the list's kind; a weighted exception has
+ * no equivalent and is dropped.
+ */
+func repairPhraseInclude(weighted bool, include string) string {
+	if !contains(phraseMainLists, include) {
+		include = closestMainList(include, phraseMainLists)
+	}
+	if include == "" || contains(phraseListIncludes(weighted), include) {
+		return include
+	}
+	if weighted {
+		if include == "bannedphraselist" {
+			return "weightedphraselist"
+		}
+		return ""
+	}
+	return "bannedphraselist"
+}
+
+/*
+ * Repair the includes of every phrase list for its kind
+ */
+func repairPhraseIncludes(config *E2guardianConfig) []string {
+	var changes []string
+	for _, phraseLists := range [][]PhraseList{config.PhraseLists, config.WeightedPhraseLists} {
+		for i := range phraseLists {
+			weighted := phraseLists[i].Weighted
+			var listChanges []string
+			phraseLists[i].IncludeIn, listChanges = repairIncludes(phraseLists[i].ListName, phraseLists[i].IncludeIn, func(include string) string {
+				return repairPhraseInclude(weighted, include)
+			})
+			changes = append(changes, listChanges...)
+		}
+	}
+	return changes
+}
+
+/*
+ * Repaired includes of a list, with what changed for the report
+ */
+func repairIncludes(listName string, includes []string, repair func(string) string) ([]string, []string) {
+	var repaired []string
+	var changes []string
+	for _, include := range includes {
+		fixed := repair(include)
+		switch {
+		case fixed == "":
+			changes = append(changes, fmt.Sprintf("'%s': dropped invalid include '%s'", listName, include))
+			continue
+		case fixed != include:
+			changes = append(changes, fmt.Sprintf("'%s': '%s' -> '%s'", listName, include, fixed))
+		}
+		if contains(repaired, fixed) {
+			if fixed == include {
+				changes = append(changes, fmt.Sprintf("'%s': dropped duplicate include '%s'", listName, include))
+			}
+			continue
+		}
+		repaired = append(repaired, fixed)
+	}
+	return repaired, changes
+}
+
+/*
+ * Repair dangling includes: typos of main lists, and lists included in the main
+ * list of another type or kind
+ */
+func FixIncludes(targetName string, dryRun bool) int {
+
+	config, err := getHostFilterConfig(targetName)
+	if err != nil {
+		log.Fatal("Failed to get host config: ", err)
+		return -1
+	}
+
+	var changes []string
+	lists := config.E2guardianConf.Lists
+	for i := range lists {
+		if contentListIncludes(lists[i].Type) == nil {
+			log.Printf("Skipping list '%s' with unknown type '%s', recreate it with a valid type\n", lists[i].ListName, lists[i].Type)
+			continue
+		}
+		listType := lists[i].Type
+		var listChanges []string
+		lists[i].IncludeIn, listChanges = repairIncludes(lists[i].ListName, lists[i].IncludeIn, func(include string) string {
+			return repairContentInclude(listType, include)
+		})
+		changes = append(changes, listChanges...)
+	}
+	changes = append(changes, repairPhraseIncludes(&config.E2guardianConf)...)
+
+	if len(changes) == 0 {
+		log.Println("All list includes are valid")
+		return 0
+	}
+	for _, change := range changes {
+		fmt.Fprintln(showOutput(), change)
+	}
+	if dryRun {
+		log.Printf("Would repair %d includes; run without --dry-run to apply\n", len(changes))
+		return 0
+	}
+
+	err = writeHostFilterConfig(targetName, config)
+	if err != nil {
+		log.Fatal("Failed to write host config: ", err)
+		return -1
+	}
+	log.Printf("Repaired %d includes; deploy to apply\n", len(changes))
+	return 0
+}
+
+/*
+ * Bring an overrides file written by an older version up to date: persist each
+ * phrase list's kind and repair includes that don't match it
+ */
+func MigratePhraseLists(targetName string, dryRun bool) int {
+
+	// Initializes the overrides if the target has none yet
+	if _, err := getHostFilterConfig(targetName); err != nil {
+		log.Fatal("Failed to get host config: ", err)
+		return -1
+	}
+
+	// Read the file as written, loading it would already correct the kinds
+	data, err := ioutil.ReadFile(getHostFilterConfigPath(targetName))
+	if err != nil {
+		log.Fatal("Failed to read host config: ", err)
+		return -1
+	}
+	var config FilterConfig
+	if err = yaml.Unmarshal(data, &config); err != nil {
+		log.Fatal("Failed to parse host config: ", err)
+		return -1
+	}
+
+	// The kind each list has on disk, nil where older versions didn't write one
+	var stored struct {
+		E2guardianConf struct {
+			PhraseLists []struct {
+				Weighted *bool `yaml:"weighted"`
+			} `yaml:"phraseLists"`
+			WeightedPhraseLists []struct {
+				Weighted *bool `yaml:"weighted"`
+			} `yaml:"weightedPhraseLists"`
+		} `yaml:"e2guardianConf"`
+	}
+	if err = yaml.Unmarshal(data, &stored); err != nil {
+		log.Fatal("Failed to parse host config: ", err)
+		return -1
+	}
+
+	var changes []string
+	conf := &config.E2guardianConf
+	for i, list := range stored.E2guardianConf.PhraseLists {
+		if list.Weighted == nil || *list.Weighted {
+			changes = append(changes, fmt.Sprintf("'%s': marked unweighted", conf.PhraseLists[i].ListName))
+		}
+	}
+	for i, list := range stored.E2guardianConf.WeightedPhraseLists {
+		if list.Weighted == nil || !*list.Weighted {
+			changes = append(changes, fmt.Sprintf("'%s': marked weighted", conf.WeightedPhraseLists[i].ListName))
+		}
+	}
+	conf.markPhraseListKinds()
+	changes = append(changes, repairPhraseIncludes(conf)...)
+
+	for _, list := range conf.PhraseLists {
+		if conf.findWeightedPhraseList(list.ListName) != nil {
+			log.Printf("Warning: phrase list '%s' exists both weighted and unweighted; remove one of them, the migration can't tell which is meant\n", list.ListName)
+		}
+	}
+
+	if len(changes) == 0 {
+		log.Println("Phrase lists are up to date")
+		return 0
+	}
+	for _, change := range changes {
+		fmt.Fprintln(showOutput(), change)
+	}
+	if dryRun {
+		log.Printf("Would make %d changes; run without --dry-run to apply\n", len(changes))
+		return 0
+	}
+
+	err = writeHostFilterConfig(targetName, config)
+	if err != nil {
+		log.Fatal("Failed to write host config: ", err)
+		return -1
+	}
+	log.Printf("Made %d changes; deploy to apply\n", len(changes))
+	return 0
+}
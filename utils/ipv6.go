@@ -0,0 +1,105 @@
+package utils
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"strings"
+)
+
+// How DNS answers AAAA queries: filter applies the category rules to them like A
+// records, strip drops them so clients fall back to IPv4, pass leaves them alone
+var AaaaModes = []string{"filter", "strip", "pass"}
+
+type Ipv6Config struct {
+	Enabled bool `yaml:"enabled"`
+	// LAN prefix squid and DNS accept IPv6 clients from, i.e. fd00:1::/64
+	LocalNetwork string `yaml:"localNetwork"`
+	AaaaMode     string `yaml:"aaaaMode"`
+	// ip6tables rules sending the LAN's web and DNS traffic to the filter in transparent
+	// mode, rendered for each deploy and never stored
+	RedirectRules []string `yaml:"redirectRules,omitempty"`
+}
+
+/*
+ * Render the ip6tables rules redirecting LAN traffic to squid and DNS
+ */
+func (config *FilterConfig) ipv6RedirectRules() []string {
+	if !config.Transparent {
+		return nil
+	}
+	lan := config.Ipv6.LocalNetwork
+	// HTTPS is redirected whether or not it is decrypted, or IPv6 clients would bypass the filter
+	var rules []string
+	for _, port := range []int{80, 443} {
+		rules = append(rules, fmt.Sprintf("-t nat -A PREROUTING -s %s -p tcp --dport %d -j REDIRECT --to-ports %d", lan, port, config.SquidPublicPort))
+	}
+	if config.PublicDnsPort != 0 && config.PublicDnsPort != 53 {
+		// Keep clients from bypassing the filter's DNS over IPv6
+		for _, protocol := range []string{"udp", "tcp"} {
+			rules = append(rules, fmt.Sprintf("-t nat -A PREROUTING -s %s -p %s --dport 53 -j REDIRECT --to-ports %d", lan, protocol, config.PublicDnsPort))
+		}
+	}
+	return rules
+}
+
+/*
+ * Serve IPv6 clients: dual-stack services, an IPv6 LAN prefix and AAAA handling
+ */
+func EnableIpv6(targetName string, network string, aaaaMode string) int {
+
+	ip, lan, err := net.ParseCIDR(network)
+	if err != nil || ip.To4() != nil {
+		log.Fatalf("Invalid IPv6 network '%s', expected CIDR notation like fd00:1::/64\n", network)
+		return -1
+	}
+	if !contains(AaaaModes, aaaaMode) {
+		log.Fatalf("Invalid AAAA mode '%s', valid options are %s\n", aaaaMode, strings.Join(AaaaModes, ", "))
+		return -1
+	}
+
+	config, err := getHostFilterConfig(targetName)
+	if err != nil {
+		log.Fatal("Failed to get host config: ", err)
+		return -1
+	}
+
+	config.Ipv6 = Ipv6Config{
+		Enabled:      true,
+		LocalNetwork: lan.String(),
+		AaaaMode:     aaaaMode,
+	}
+
+	err = writeHostFilterConfig(targetName, config)
+	if err != nil {
+		log.Fatal("Failed to write host config: ", err)
+		return -1
+	}
+
+	if aaaaMode == "pass" {
+		log.Println("Warning: AAAA answers are not filtered; clients can reach blocked sites over IPv6")
+	}
+	log.Println("Note: services are only exposed on IPv6 if k3s was installed with dual-stack cluster and service CIDRs")
+	log.Printf("Enabled IPv6 for %s; deploy to apply\n", lan)
+	return 0
+}
+
+func DisableIpv6(targetName string) int {
+
+	config, err := getHostFilterConfig(targetName)
+	if err != nil {
+		log.Fatal("Failed to get host config: ", err)
+		return -1
+	}
+
+	config.Ipv6 = Ipv6Config{}
+
+	err = writeHostFilterConfig(targetName, config)
+	if err != nil {
+		log.Fatal("Failed to write host config: ", err)
+		return -1
+	}
+
+	log.Println("Disabled IPv6; deploy to apply")
+	return 0
+}
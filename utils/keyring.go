@@ -0,0 +1,178 @@
+package utils
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strings"
+)
+
+// Service the CLI's secrets are stored under in the OS keyring
+const keyringService = "guardian-cli"
+
+// Passwords a target can keep in the keyring, and the variables that override them
+var credentialKinds = map[string]string{
+	"sudo": "SUDO_PASSWORD",
+	"ssh":  "NEWHOST_PASSWORD_<name>",
+}
+
+/*
+ * Keyring entry of one of a target's passwords
+ */
+func credentialAccount(hostName string, kind string) string {
+	return fmt.Sprintf("%s/%s", hostName, kind)
+}
+
+/*
+ * A target's password from the keyring, if it was stored with 'target credentials set'.
+ * A keyring that can't be read is reported and treated as empty, so the caller prompts.
+ */
+func keyringCredential(host Host, kind string) string {
+	if !contains(host.Credentials, kind) {
+		return ""
+	}
+	secret, found, err := keyringGet(credentialAccount(host.Name, kind))
+	if err != nil {
+		log.Printf("Warning: failed to read the %s password of %s from the keyring: %s\n", kind, host.Name, err)
+		return ""
+	}
+	if !found {
+		log.Printf("Warning: the %s password of %s is gone from the keyring, store it again with 'target credentials set'\n", kind, host.Name)
+	}
+	return secret
+}
+
+/*
+ * Password to copy the CLI's key to a target with: from NEWHOST_PASSWORD_<name>,
+ * the keyring or a prompt
+ */
+func hostSshPassword(host Host) (string, error) {
+	password := os.Getenv(fmt.Sprintf("NEWHOST_PASSWORD_%s", host.Name))
+	if password == "" {
+		password = keyringCredential(host, "ssh")
+	}
+	if password == "" {
+		fmt.Println("Need remote password to copy keys to remote host.")
+		return getUserCredentials()
+	}
+	return password, nil
+}
+
+/*
+ * Check a password works before it is stored: sudo's by running sudo over the
+ * key login, the SSH one by logging in with it
+ */
+func checkCredential(host Host, kind string, password string) error {
+	if kind == "sudo" {
+		_, err := runHostCommandsWithPrompts(host, []string{"sudo -k", "sudo -v"},
+			map[string]string{"[sudo] password for ": password}, false)
+		return err
+	}
+	return checkPasswordLogin(host, password)
+}
+
+/*
+ * Keep a target's sudo or SSH password in the OS keyring, so commands stop asking for it
+ */
+func SetCredential(name string, kind string) int {
+
+	config, err := loadConfig()
+	if err != nil {
+		log.Fatal("Failed to load config: ", err)
+		return -1
+	}
+
+	index, host := FindHost(config, name)
+	if host.Name != name {
+		log.Fatalf("Host %s doesn't exist, create it first", name)
+		return -1
+	}
+	if host.Local {
+		log.Fatalf("%s runs commands on this machine and needs no passwords\n", name)
+		return -1
+	}
+
+	fmt.Printf("Enter the %s password of %s@%s.\n", kind, host.Username, host.Address)
+	password, err := getUserCredentials()
+	if err != nil {
+		log.Fatal("Failed to retrieve user password: ", err)
+		return -1
+	}
+	err = checkCredential(host, kind, password)
+	if err != nil {
+		log.Fatalf("The %s password doesn't work, it was not stored: %s\n", kind, err)
+		return -1
+	}
+
+	err = keyringSet(credentialAccount(name, kind), password)
+	if err != nil {
+		log.Fatal("Failed to store password in the keyring: ", err)
+		return -1
+	}
+	if !contains(host.Credentials, kind) {
+		config.Hosts[index].Credentials = append(host.Credentials, kind)
+		err = writeConfig(config)
+		if err != nil {
+			log.Fatal("Failed to write config: ", err)
+			return -1
+		}
+	}
+
+	log.Printf("Stored the %s password of %s in the keyring, %s still overrides it\n", kind, name,
+		strings.ReplaceAll(credentialKinds[kind], "<name>", name))
+	return 0
+}
+
+/*
+ * Remove a target's passwords from the keyring, all of them unless kind is given
+ */
+func ClearCredentials(name string, kind string) int {
+
+	config, err := loadConfig()
+	if err != nil {
+		log.Fatal("Failed to load config: ", err)
+		return -1
+	}
+
+	index, host := FindHost(config, name)
+	if host.Name != name {
+		log.Fatalf("Host %s doesn't exist, create it first", name)
+		return -1
+	}
+	if kind != "" && !contains(host.Credentials, kind) {
+		log.Printf("No %s password of %s is stored\n", kind, name)
+		return 0
+	}
+
+	err = clearHostCredentials(&config.Hosts[index], kind)
+	if err != nil {
+		log.Fatal("Failed to remove password from the keyring: ", err)
+		return -1
+	}
+	err = writeConfig(config)
+	if err != nil {
+		log.Fatal("Failed to write config: ", err)
+		return -1
+	}
+
+	log.Printf("Removed the stored passwords of %s\n", name)
+	return 0
+}
+
+/*
+ * Delete a host's passwords from the keyring and forget them, all unless kind is given
+ */
+func clearHostCredentials(host *Host, kind string) error {
+	var kept []string
+	for _, stored := range host.Credentials {
+		if kind != "" && stored != kind {
+			kept = append(kept, stored)
+			continue
+		}
+		if err := keyringDelete(credentialAccount(host.Name, stored)); err != nil {
+			return err
+		}
+	}
+	host.Credentials = kept
+	return nil
+}
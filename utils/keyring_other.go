@@ -0,0 +1,103 @@
+//go:build !windows
+
+package utils
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os/exec"
+	"runtime"
+	"strings"
+)
+
+// Longest command line security -i reads
+const macKeychainCommandLimit = 4096
+
+/*
+ * Run a keyring tool, with its error output as the error
+ */
+func runKeyringTool(stdin string, name string, args ...string) (string, error) {
+	cmd := exec.Command(name, args...)
+	cmd.Stdin = strings.NewReader(stdin)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	err := cmd.Run()
+	if errors.Is(err, exec.ErrNotFound) {
+		if runtime.GOOS == "darwin" {
+			return "", fmt.Errorf("%s not found", name)
+		}
+		return "", fmt.Errorf("%s not found, install libsecret-tools or your distribution's equivalent", name)
+	}
+	if err != nil && strings.TrimSpace(stderr.String()) != "" {
+		return stdout.String(), fmt.Errorf("%s: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return stdout.String(), err
+}
+
+/*
+ * A secret from the login keychain on macOS, or the Secret Service (GNOME Keyring,
+ * KWallet) elsewhere
+ */
+func keyringGet(account string) (string, bool, error) {
+	var exitErr *exec.ExitError
+	if runtime.GOOS == "darwin" {
+		out, err := runKeyringTool("", "security", "find-generic-password", "-s", keyringService, "-a", account, "-w")
+		// 44 is errSecItemNotFound
+		if errors.As(err, &exitErr) && exitErr.ExitCode() == 44 {
+			return "", false, nil
+		} else if err != nil {
+			return "", false, err
+		}
+		return strings.TrimSuffix(out, "\n"), true, nil
+	}
+	out, err := runKeyringTool("", "secret-tool", "lookup", "service", keyringService, "account", account)
+	// secret-tool exits 1 without output when there is no such secret
+	if errors.As(err, &exitErr) && out == "" && exitErr.ExitCode() == 1 {
+		return "", false, nil
+	} else if err != nil {
+		return "", false, err
+	}
+	return out, true, nil
+}
+
+func keyringSet(account string, secret string) error {
+	if runtime.GOOS == "darwin" {
+		// Given as a command on stdin rather than an argument, so the secret never shows
+		// in the process list, and hex encoded so it needs no quoting
+		command := fmt.Sprintf("add-generic-password -U -s %s -a %s -X %s\n", shellQuote(keyringService), shellQuote(account), hex.EncodeToString([]byte(secret)))
+		if len(command) > macKeychainCommandLimit {
+			return fmt.Errorf("the secret is too long for the keychain")
+		}
+		if _, err := runKeyringTool(command, "security", "-i"); err != nil {
+			return err
+		}
+		// Interactive mode exits 0 even when the command fails
+		stored, found, err := keyringGet(account)
+		if err != nil {
+			return err
+		} else if !found || stored != secret {
+			return fmt.Errorf("the keychain did not store the secret")
+		}
+		return nil
+	}
+	// Read from stdin, so the secret never shows in the process list
+	_, err := runKeyringTool(secret, "secret-tool", "store", "--label", fmt.Sprintf("%s %s", keyringService, account),
+		"service", keyringService, "account", account)
+	return err
+}
+
+func keyringDelete(account string) error {
+	if runtime.GOOS == "darwin" {
+		_, err := runKeyringTool("", "security", "delete-generic-password", "-s", keyringService, "-a", account)
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) && exitErr.ExitCode() == 44 {
+			return nil
+		}
+		return err
+	}
+	_, err := runKeyringTool("", "secret-tool", "clear", "service", keyringService, "account", account)
+	return err
+}
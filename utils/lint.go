@@ -0,0 +1,342 @@
+package utils
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"regexp"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Generated secrets are 32 characters; anything much shorter was set by hand
+const minSecretLength = 16
+
+var lintSeverities = map[string]int{"error": 0, "warning": 1, "info": 2}
+
+type lintFinding struct {
+	Severity string // error, warning or info
+	Check    string
+	Detail   string
+	Fix      string
+}
+
+/*
+ * Rules that repeat a category; only the first one of each ever matches
+ */
+func lintAcl(config FilterConfig) []lintFinding {
+	var findings []lintFinding
+	seen := map[string]bool{}
+	for _, rule := range config.AllowRules {
+		if seen[rule.Category] {
+			findings = append(findings, lintFinding{"warning", "acl",
+				fmt.Sprintf("category '%s' has more than one allow/deny rule, only the first applies", rule.Category),
+				fmt.Sprintf("filter acl delete %s <action>", rule.Category)})
+		}
+		seen[rule.Category] = true
+	}
+	seen = map[string]bool{}
+	for _, rule := range config.DecryptRules {
+		if seen[rule.Category] {
+			findings = append(findings, lintFinding{"warning", "acl",
+				fmt.Sprintf("category '%s' has more than one decrypt rule, only the first applies", rule.Category),
+				fmt.Sprintf("filter acl delete %s <action>", rule.Category)})
+		}
+		seen[rule.Category] = true
+	}
+	return findings
+}
+
+/*
+ * Rules for categories the cached taxonomy doesn't know, which never match
+ */
+func lintAclCategories(targetName string, config FilterConfig) []lintFinding {
+	var categories []string
+	for _, rule := range config.AllowRules {
+		categories = append(categories, rule.Category)
+	}
+	for _, rule := range config.DecryptRules {
+		categories = append(categories, rule.Category)
+	}
+	unknown, err := uncachedCategories(targetName, categories)
+	if err != nil {
+		return []lintFinding{{"info", "acl", "no cached categories to check acl rules against",
+			"filter acl categories sync-builtin"}}
+	}
+	if len(unknown) == 0 {
+		return nil
+	}
+	// Only needed for suggestions
+	taxonomy, _ := loadCategoryTaxonomy(targetName)
+	var findings []lintFinding
+	for _, category := range unknown {
+		detail := fmt.Sprintf("acl rule for unknown category '%s'", category)
+		if similar := similarCategories(category, taxonomy.Categories); len(similar) > 0 {
+			detail += fmt.Sprintf(" (did you mean %s?)", similar[0])
+		}
+		findings = append(findings, lintFinding{"warning", "acl", detail,
+			"categorize domains into it, or fix the rule"})
+	}
+	return findings
+}
+
+/*
+ * Entries that don't parse as their list type, duplicates and unused lists
+ */
+func lintContentLists(config FilterConfig) []lintFinding {
+	var findings []lintFinding
+	for _, list := range config.E2guardianConf.Lists {
+		if !contains(ListTypes, list.Type) {
+			findings = append(findings, lintFinding{"error", "lists",
+				fmt.Sprintf("list '%s' has unknown type '%s'", list.ListName, list.Type),
+				fmt.Sprintf("recreate it as one of %s", strings.Join(ListTypes, ", "))})
+			continue
+		}
+		if len(list.IncludeIn) == 0 {
+			findings = append(findings, lintFinding{"info", "lists",
+				fmt.Sprintf("list '%s' isn't included anywhere and has no effect", list.ListName),
+				fmt.Sprintf("filter content-list blacklist|whitelist %s", list.ListName)})
+		}
+		seen := map[string]bool{}
+		entries := 0
+		for _, group := range list.Groups {
+			for _, item := range group.Items {
+				entries++
+				if seen[item] {
+					findings = append(findings, lintFinding{"info", "lists",
+						fmt.Sprintf("list '%s' has '%s' more than once", list.ListName, item),
+						fmt.Sprintf("filter content-list remove-entry %s %s", list.ListName, item)})
+				}
+				seen[item] = true
+				if err := lintListEntry(list.Type, item); err != nil {
+					findings = append(findings, lintFinding{"error", "lists",
+						fmt.Sprintf("list '%s': %s", list.ListName, err),
+						fmt.Sprintf("filter content-list remove-entry %s %s", list.ListName, item)})
+				}
+			}
+		}
+		if entries == 0 {
+			findings = append(findings, lintFinding{"info", "lists",
+				fmt.Sprintf("list '%s' is empty", list.ListName),
+				fmt.Sprintf("filter content-list add-entry %s <entry>", list.ListName)})
+		}
+	}
+	return findings
+}
+
+func lintListEntry(listType string, entry string) error {
+	switch listType {
+	case "sitelist":
+		// A leading dot or wildcard matches subdomains
+		site, err := normalizeDomain(strings.TrimPrefix(strings.TrimPrefix(entry, "*"), "."))
+		if err != nil || validateHostAddress(site) != nil {
+			return fmt.Errorf("'%s' is not a valid site", entry)
+		}
+	case "regexpurllist":
+		if _, err := regexp.Compile(entry); err != nil {
+			return fmt.Errorf("'%s' is not a valid regular expression", entry)
+		}
+	case "mimetypelist":
+		if !strings.Contains(entry, "/") {
+			return fmt.Errorf("'%s' is not a MIME type like 'video/mp4'", entry)
+		}
+	case "extensionslist":
+		if !strings.HasPrefix(entry, ".") {
+			return fmt.Errorf("'%s' is not an extension like '.exe'", entry)
+		}
+	}
+	return nil
+}
+
+/*
+ * Keys of the overrides file the CLI doesn't know, usually typos from hand edits
+ */
+func lintSchema(targetName string) []lintFinding {
+	data, err := ioutil.ReadFile(getHostFilterConfigPath(targetName))
+	if err != nil {
+		return []lintFinding{{"error", "schema", fmt.Sprintf("cannot read overrides: %s", err), ""}}
+	}
+	var strict FilterConfig
+	err = yaml.UnmarshalStrict(data, &strict)
+	if err == nil {
+		return nil
+	}
+	var findings []lintFinding
+	if typeErr, ok := err.(*yaml.TypeError); ok {
+		for _, problem := range typeErr.Errors {
+			findings = append(findings, lintFinding{"warning", "schema", problem,
+				"fix or remove the key in " + getHostFilterConfigPath(targetName)})
+		}
+		return findings
+	}
+	return []lintFinding{{"error", "schema", err.Error(), "fix the YAML in " + getHostFilterConfigPath(targetName)}}
+}
+
+/*
+ * Values the chart can't deploy with
+ */
+func lintRequired(config FilterConfig) []lintFinding {
+	var findings []lintFinding
+	if config.MasterNode == "" {
+		findings = append(findings, lintFinding{"error", "schema", "masterNode is empty", "filter deploy --refresh-facts"})
+	}
+	if config.VolumePath == "" {
+		findings = append(findings, lintFinding{"error", "schema", "volumePath is empty", "set volumePath in the overrides"})
+	}
+	ports := map[string]int{
+		"squidPublicPort":    config.SquidPublicPort,
+		"publicDnsPort":      config.PublicDnsPort,
+		"webHttpsPublicPort": config.WebHttpsPublicPort,
+	}
+	var names []string
+	for name := range ports {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if port := ports[name]; port < 0 || port > 65535 {
+			findings = append(findings, lintFinding{"error", "schema", fmt.Sprintf("%s %d is not a valid port", name, port), ""})
+		}
+	}
+	return findings
+}
+
+/*
+ * Secrets that are missing, short or left at the chart's defaults
+ */
+func lintSecrets(config FilterConfig) []lintFinding {
+	defaults, err := loadDefaultFilterConfig()
+	if err != nil {
+		// Without the chart checked out only the length can be checked
+		defaults = FilterConfig{}
+	}
+	secrets := []struct {
+		name    string
+		value   string
+		initial string
+	}{
+		{"jwtPassword", config.JwtPassword, defaults.JwtPassword},
+		{"dbPassword", config.DbPassword, defaults.DbPassword},
+		{"redisPassword", config.RedisPassword, defaults.RedisPassword},
+	}
+	var findings []lintFinding
+	for _, secret := range secrets {
+		switch {
+		case secret.value == "":
+			findings = append(findings, lintFinding{"error", "secrets", secret.name + " is empty",
+				"set it to a random string of 32 characters"})
+		case secret.initial != "" && secret.value == secret.initial:
+			findings = append(findings, lintFinding{"error", "secrets", secret.name + " is the chart's default",
+				"set it to a random string of 32 characters"})
+		case len(secret.value) < minSecretLength:
+			findings = append(findings, lintFinding{"warning", "secrets",
+				fmt.Sprintf("%s is only %d characters", secret.name, len(secret.value)),
+				"set it to a random string of 32 characters"})
+		}
+	}
+	if config.Smtp.Server != "" && config.Smtp.Username != "" && config.Smtp.Password == "" {
+		findings = append(findings, lintFinding{"warning", "secrets", "smtp has a username but no password",
+			"filter report smtp"})
+	}
+	return findings
+}
+
+/*
+ * Includes naming a main list the chart doesn't have for the list's type
+ */
+func lintIncludes(config FilterConfig) []lintFinding {
+	var findings []lintFinding
+	for _, list := range config.E2guardianConf.Lists {
+		if contentListIncludes(list.Type) == nil {
+			// Reported with the other list problems
+			continue
+		}
+		for _, include := range list.IncludeIn {
+			if err := validateContentInclude(list, include); err != nil {
+				findings = append(findings, lintFinding{"error", "includes", err.Error(), "filter lists fix-includes"})
+			}
+		}
+	}
+	phraseLists := append(append([]PhraseList{}, config.E2guardianConf.PhraseLists...), config.E2guardianConf.WeightedPhraseLists...)
+	for _, list := range phraseLists {
+		for _, include := range list.IncludeIn {
+			if err := validatePhraseInclude(list, include); err != nil {
+				findings = append(findings, lintFinding{"error", "includes", err.Error(), "filter lists fix-includes"})
+			}
+		}
+	}
+	for _, list := range config.E2guardianConf.PhraseLists {
+		if config.E2guardianConf.findWeightedPhraseList(list.ListName) != nil {
+			findings = append(findings, lintFinding{"error", "includes",
+				fmt.Sprintf("phrase list '%s' exists both weighted and unweighted, commands can't tell them apart", list.ListName),
+				fmt.Sprintf("filter phrase-list remove-list %s", list.ListName)})
+		}
+	}
+	return findings
+}
+
+/*
+ * Weighted phrases without a weight never count towards the naughtiness limit
+ */
+func lintWeightedLists(config FilterConfig) []lintFinding {
+	var findings []lintFinding
+	for _, list := range config.E2guardianConf.WeightedPhraseLists {
+		unweighted := 0
+		for _, group := range list.Groups {
+			for _, phrase := range group.Phrases {
+				if phrase.Weight == 0 {
+					unweighted++
+				}
+			}
+		}
+		if unweighted > 0 {
+			findings = append(findings, lintFinding{"warning", "weighted-lists",
+				fmt.Sprintf("weighted list '%s' has %d phrases without a weight, they never add up to a block", list.ListName, unweighted),
+				fmt.Sprintf("filter phrase-list add-phrase %s <phrase> --weight <n>", list.ListName)})
+		}
+	}
+	return findings
+}
+
+/*
+ * Run every check of a target's profile and report the findings by severity
+ */
+func Lint(targetName string) int {
+
+	config, err := getHostFilterConfig(targetName)
+	if err != nil {
+		log.Fatal("Failed to get host config: ", err)
+		return -1
+	}
+
+	var findings []lintFinding
+	findings = append(findings, lintSchema(targetName)...)
+	findings = append(findings, lintRequired(config)...)
+	findings = append(findings, lintSecrets(config)...)
+	findings = append(findings, lintAcl(config)...)
+	findings = append(findings, lintAclCategories(targetName, config)...)
+	findings = append(findings, lintContentLists(config)...)
+	findings = append(findings, lintIncludes(config)...)
+	findings = append(findings, lintWeightedLists(config)...)
+	sort.SliceStable(findings, func(i, j int) bool {
+		return lintSeverities[findings[i].Severity] < lintSeverities[findings[j].Severity]
+	})
+
+	counts := map[string]int{}
+	w := tabwriter.NewWriter(showOutput(), 1, 1, 3, ' ', 0)
+	fmt.Fprintln(w, "Severity\tCheck\tFinding\tFix")
+	for _, finding := range findings {
+		counts[finding.Severity]++
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", finding.Severity, finding.Check, finding.Detail, finding.Fix)
+	}
+	w.Flush()
+	fmt.Fprintf(showOutput(), "\n%d errors, %d warnings, %d info\n", counts["error"], counts["warning"], counts["info"])
+
+	if counts["error"] > 0 {
+		return -1
+	}
+	return 0
+}
@@ -0,0 +1,204 @@
+package utils
+
+import (
+	"database/sql"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+/*
+ * Local caches and logs that grow with use, kept in one SQLite database with
+ * indexes instead of JSON files parsed whole on every command. The JSON files
+ * stay the default; 'config local-store sqlite' switches.
+ */
+const localDbSchema = `CREATE TABLE IF NOT EXISTS categories (target TEXT NOT NULL, category TEXT NOT NULL, PRIMARY KEY (target, category));
+CREATE TABLE IF NOT EXISTS category_syncs (target TEXT PRIMARY KEY, fetched_at TEXT NOT NULL);
+CREATE TABLE IF NOT EXISTS deploy_history (target TEXT NOT NULL, time TEXT NOT NULL, record TEXT NOT NULL);
+CREATE INDEX IF NOT EXISTS deploy_history_target_time ON deploy_history (target, time);
+CREATE TABLE IF NOT EXISTS audit_log (time TEXT NOT NULL, event TEXT NOT NULL);
+CREATE INDEX IF NOT EXISTS audit_log_time ON audit_log (time);
+`
+
+func getLocalDbPath() string {
+	return filepath.Join(GuardianConfigHome(), "local.db")
+}
+
+const (
+	localStoreSqlite = "sqlite"
+	localStoreJson   = "json"
+)
+
+var localStore struct {
+	sync.Once
+	sqlite bool
+	// Opened by the first query of a process
+	open sync.Once
+	db   *sql.DB
+	err  error
+}
+
+/*
+ * Whether the local database holds the caches and logs
+ */
+func useLocalDb() bool {
+	localStore.Do(func() {
+		config, err := loadConfig()
+		localStore.sqlite = err == nil && config.LocalStore == localStoreSqlite
+	})
+	return localStore.sqlite
+}
+
+/*
+ * The local database, created with its schema on first use
+ */
+func localDb() (*sql.DB, error) {
+	localStore.open.Do(func() {
+		os.MkdirAll(GuardianConfigHome(), privateDirMode)
+		db, err := openSqlite(getLocalDbPath())
+		if err == nil {
+			if _, err = db.Exec(localDbSchema); err != nil {
+				db.Close()
+			}
+		}
+		localStore.db, localStore.err = db, err
+	})
+	return localStore.db, localStore.err
+}
+
+/*
+ * Run fn in a transaction on the local database, committed if fn succeeds
+ */
+func updateLocalDb(fn func(tx *sql.Tx) error) error {
+	db, err := localDb()
+	if err != nil {
+		return err
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	if err := fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+/*
+ * Move a target's JSON caches into the local database the first time it is used
+ */
+func importLegacyCaches(name string) {
+	if taxonomy, err := loadCategoryTaxonomyFile(name); err == nil {
+		if err := writeCategoryTaxonomy(name, taxonomy); err != nil {
+			log.Printf("Failed to move cached categories into %s: %s\n", getLocalDbPath(), err)
+			return
+		}
+		os.Remove(getCategoryTaxonomyPath(name))
+	}
+
+	records, err := loadDeployHistoryFile(name)
+	if err != nil || len(records) == 0 {
+		return
+	}
+	err = updateLocalDb(func(tx *sql.Tx) error {
+		for _, record := range records {
+			line, err := json.Marshal(record)
+			if err != nil {
+				return err
+			}
+			_, err = tx.Exec("INSERT INTO deploy_history (target, time, record) VALUES (?, ?, ?)",
+				name, record.Time.UTC().Format(deployTimeFormat), string(line))
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("Failed to move deploy history into %s: %s\n", getLocalDbPath(), err)
+		return
+	}
+	os.Remove(getDeployHistoryPath(name))
+}
+
+/*
+ * Move the audit log into the local database
+ */
+func importLegacyAuditLog() error {
+	data, err := ioutil.ReadFile(getAuditLogPath())
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	err = updateLocalDb(func(tx *sql.Tx) error {
+		for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+			var event AuditEvent
+			if line == "" || json.Unmarshal([]byte(line), &event) != nil {
+				continue
+			}
+			_, err := tx.Exec("INSERT INTO audit_log (time, event) VALUES (?, ?)", event.Time.Format(deployTimeFormat), line)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return os.Remove(getAuditLogPath())
+}
+
+/*
+ * Keep the local caches and logs in SQLite or in JSON files. Switching to SQLite
+ * moves the audit log over now and each target's caches on first use; switching
+ * back leaves what is in local.db there.
+ */
+func SetLocalStore(store string) int {
+
+	if store != localStoreJson && store != localStoreSqlite {
+		log.Fatalf("Invalid store '%s', use %s or %s\n", store, localStoreJson, localStoreSqlite)
+		return -1
+	}
+
+	config, err := loadConfig()
+	if err != nil {
+		log.Fatal("Failed to load config: ", err)
+		return -1
+	}
+
+	if store == localStoreSqlite {
+		// Fails here rather than on every later command if the build can't
+		if _, err := localDb(); err != nil {
+			log.Fatalf("Failed to open %s: %s\n", getLocalDbPath(), err)
+			return -1
+		}
+		if err := importLegacyAuditLog(); err != nil {
+			log.Fatalf("Failed to move the audit log into %s: %s\n", getLocalDbPath(), err)
+			return -1
+		}
+	}
+
+	config.LocalStore = store
+	err = writeConfig(config)
+	if err != nil {
+		log.Fatal("Failed to write config: ", err)
+		return -1
+	}
+	// The rest of this command, i.e. its audit event, goes to the new store
+	useLocalDb()
+	localStore.sqlite = store == localStoreSqlite
+
+	if _, err := os.Stat(getLocalDbPath()); store == localStoreJson && err == nil {
+		log.Printf("Keeping caches and logs in JSON files; what is already in %s stays there\n", getLocalDbPath())
+	} else {
+		log.Printf("Keeping caches and logs in %s\n", store)
+	}
+	return 0
+}
@@ -0,0 +1,114 @@
+package utils
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// A lock older than this is assumed to be left over from a crashed run
+const staleLockAge = time.Hour
+
+type targetLock struct {
+	Operator  string    `json:"operator"`
+	Operation string    `json:"operation"`
+	Machine   string    `json:"machine"`
+	Pid       int       `json:"pid"`
+	Time      time.Time `json:"time"`
+}
+
+func getRemoteLockPath(host Host) string {
+	return path.Join(host.HomePath, ".guardian", "deploy.lock")
+}
+
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+/*
+ * Read who holds the lock on a target
+ */
+func readTargetLock(host Host) (targetLock, error) {
+	out, err := runHostCommands(host, []string{
+		fmt.Sprintf("cat %s/owner", getRemoteLockPath(host)),
+	}, false)
+	if err != nil {
+		return targetLock{}, err
+	}
+	var lock targetLock
+	err = json.Unmarshal([]byte(strings.TrimSpace(out)), &lock)
+	return lock, err
+}
+
+func removeTargetLock(host Host) error {
+	// Runs after an interrupt too, so the target isn't left locked
+	ctx, cancel := cleanupContext()
+	defer cancel()
+	_, err := runHostCommandsContext(ctx, host, []string{
+		fmt.Sprintf("rm -rf %s", getRemoteLockPath(host)),
+	}, false)
+	return err
+}
+
+/*
+ * Take the lock on a target for a deploy or uninstall. mkdir is atomic, so
+ * only one CLI can create the lock directory. Returns a function that releases it.
+ */
+func acquireTargetLock(host Host, operation string, forceUnlock bool) (func(), error) {
+	lockPath := getRemoteLockPath(host)
+
+	if forceUnlock {
+		log.Printf("Removing any existing lock on target '%s'\n", host.Name)
+		if err := removeTargetLock(host); err != nil {
+			return nil, err
+		}
+	}
+
+	machine, _ := os.Hostname()
+	owner, err := json.Marshal(targetLock{
+		Operator:  getOperator(),
+		Operation: operation,
+		Machine:   machine,
+		Pid:       os.Getpid(),
+		Time:      time.Now().UTC(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	// One command, since a run only fails on its last command's exit code
+	lockCommands := []string{
+		fmt.Sprintf("mkdir -p %s && mkdir %s && echo %s > %s/owner",
+			path.Dir(lockPath), lockPath, shellQuote(string(owner)), lockPath),
+	}
+
+	for attempt := 0; attempt < 2; attempt++ {
+		_, err = runHostCommands(host, lockCommands, false)
+		if err == nil {
+			release := func() {
+				if err := removeTargetLock(host); err != nil {
+					log.Printf("Failed to release lock on target '%s': %s\n", host.Name, err)
+				}
+			}
+			return release, nil
+		}
+
+		holder, readErr := readTargetLock(host)
+		if readErr != nil {
+			// Either the lock vanished meanwhile or the command failed for another reason
+			continue
+		}
+		if time.Since(holder.Time) < staleLockAge {
+			return nil, fmt.Errorf("target '%s' is locked by %s@%s (%s, pid %d) since %s; use --force-unlock if that run is gone",
+				host.Name, holder.Operator, holder.Machine, holder.Operation, holder.Pid, holder.Time.Local().Format(time.RFC1123))
+		}
+		log.Printf("Breaking stale lock held by %s@%s since %s\n", holder.Operator, holder.Machine, holder.Time.Local().Format(time.RFC1123))
+		if err := removeTargetLock(host); err != nil {
+			return nil, err
+		}
+	}
+	return nil, err
+}
@@ -0,0 +1,162 @@
+package utils
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"strings"
+	"text/template"
+
+	"gopkg.in/yaml.v2"
+)
+
+/*
+ * Per-target values substituted into a shared policy manifest
+ */
+type ManifestVars struct {
+	Defaults map[string]interface{}            `yaml:"defaults"`
+	Targets  map[string]map[string]interface{} `yaml:"targets"`
+}
+
+/*
+ * The variables for one target: built-ins, then defaults, the target's own values and --set values
+ */
+func manifestVars(host Host, varsFile string, set []string) (map[string]interface{}, error) {
+	vars := map[string]interface{}{
+		"target":  host.Name,
+		"address": host.Address,
+	}
+
+	if varsFile != "" {
+		data, err := ioutil.ReadFile(varsFile)
+		if err != nil {
+			return nil, err
+		}
+		var fileVars ManifestVars
+		err = yaml.UnmarshalStrict(data, &fileVars)
+		if err != nil {
+			return nil, fmt.Errorf("invalid variables file: %s", err)
+		}
+		for key, value := range fileVars.Defaults {
+			vars[key] = value
+		}
+		for key, value := range fileVars.Targets[host.Name] {
+			vars[key] = value
+		}
+	}
+
+	for _, assignment := range set {
+		parts := strings.SplitN(assignment, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("invalid --set '%s', expected name=value", assignment)
+		}
+		vars[parts[0]] = parts[1]
+	}
+	return vars, nil
+}
+
+/*
+ * Render a manifest for one target; referencing an undefined variable is an error
+ */
+func renderManifest(manifest string, name string, vars map[string]interface{}) ([]byte, error) {
+	tmpl, err := template.New(name).Option("missingkey=error").Parse(manifest)
+	if err != nil {
+		return nil, err
+	}
+	var out bytes.Buffer
+	err = tmpl.Execute(&out, vars)
+	return out.Bytes(), err
+}
+
+/*
+ * Apply the overrides of a templated policy manifest to a target
+ */
+func ApplyManifest(targetName string, manifestFile string, varsFile string, set []string, dryRun bool) int {
+
+	manifest, err := ioutil.ReadFile(manifestFile)
+	if err != nil {
+		log.Fatal("Failed to read manifest: ", err)
+		return -1
+	}
+
+	guardianConf, err := loadConfig()
+	if err != nil {
+		log.Fatal("Failed to load config: ", err)
+		return -1
+	}
+
+	_, host := FindHost(guardianConf, targetName)
+	if host.Name != targetName {
+		log.Fatalf("Host %s doesn't exist, create it first", targetName)
+		return -1
+	}
+
+	vars, err := manifestVars(host, varsFile, set)
+	if err != nil {
+		log.Fatal("Failed to load variables: ", err)
+		return -1
+	}
+	rendered, err := renderManifest(string(manifest), manifestFile, vars)
+	if err != nil {
+		log.Fatal("Failed to render manifest: ", err)
+		return -1
+	}
+
+	overrides := map[string]interface{}{}
+	err = yaml.Unmarshal(rendered, &overrides)
+	if err != nil {
+		log.Fatal("Rendered manifest is not valid YAML: ", err)
+		return -1
+	}
+	keys := filterConfigKeys()
+	for key := range overrides {
+		if !contains(keys, key) {
+			log.Fatalf("Unknown override '%s' in manifest\n", key)
+			return -1
+		}
+	}
+
+	if dryRun {
+		fmt.Print(string(rendered))
+		return 0
+	}
+
+	config, err := getHostFilterConfig(targetName)
+	if err != nil {
+		log.Fatal("Failed to get host config: ", err)
+		return -1
+	}
+
+	// Keys the manifest sets replace the target's, everything else is kept
+	merged, err := filterConfigMap(config)
+	if err != nil {
+		log.Fatal("Failed to read host config: ", err)
+		return -1
+	}
+	for key, value := range overrides {
+		merged[key] = value
+	}
+	data, err := yaml.Marshal(merged)
+	if err != nil {
+		log.Fatal("Failed to merge manifest: ", err)
+		return -1
+	}
+	config = FilterConfig{}
+	err = yaml.UnmarshalStrict(data, &config)
+	if err != nil {
+		log.Fatal("Manifest doesn't match the filter config: ", err)
+		return -1
+	}
+
+	config.DecryptHTTPS = config.shouldDecrypt()
+
+	err = writeHostFilterConfig(targetName, config)
+	if err != nil {
+		log.Fatal("Failed to write host config: ", err)
+		return -1
+	}
+
+	log.Printf("Applied %d overrides from %s; deploy to apply\n", len(overrides), manifestFile)
+	return 0
+}
@@ -0,0 +1,159 @@
+package utils
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/justinschw/gofigure/crypto"
+)
+
+// Relative to the new machine's home directory
+const migrateArchive = ".guardian-migrate.tar.gz"
+
+/*
+ * Split user@host into its parts
+ */
+func parseMigrateDestination(destination string) (string, string, error) {
+	parts := strings.SplitN(destination, "@", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", fmt.Errorf("invalid destination '%s', expected user@host", destination)
+	}
+	if err := validateUsername(parts[0]); err != nil {
+		return "", "", err
+	}
+	if err := validateHostAddress(parts[1]); err != nil {
+		return "", "", err
+	}
+	return parts[0], parts[1], nil
+}
+
+/*
+ * Copy the whole guardian home - keys, known_hosts, host data and selection -
+ * to a new admin machine, then check it can reach every target
+ */
+func Migrate(destination string, port uint16, remoteHome string) int {
+
+	username, address, err := parseMigrateDestination(destination)
+	if err != nil {
+		log.Fatal(err)
+		return -1
+	}
+
+	config, err := loadConfig()
+	if err != nil {
+		log.Fatal("Failed to load config: ", err)
+		return -1
+	}
+
+	var buf bytes.Buffer
+	err = compress(GuardianConfigHome(), &buf)
+	if err != nil {
+		log.Fatalf("Compression failed: %s\n", err)
+		return -1
+	}
+	archive, err := ioutil.TempFile("", "guardian-migrate-*.tar.gz")
+	if err != nil {
+		log.Fatal("Failed to create archive: ", err)
+		return -1
+	}
+	defer os.Remove(archive.Name())
+	_, err = archive.Write(buf.Bytes())
+	archive.Close()
+	if err != nil {
+		log.Fatal("Failed to write archive: ", err)
+		return -1
+	}
+
+	password := os.Getenv("MIGRATE_PASSWORD")
+	if password == "" {
+		fmt.Printf("Need password for %s to copy the configuration.\n", destination)
+		password, err = getUserCredentials()
+		if err != nil {
+			log.Fatal("Failed to retrieve user password: ", err)
+			return -1
+		}
+	}
+
+	client := crypto.SshClient{
+		Address:         address,
+		Port:            port,
+		Username:        username,
+		HostKeyCallback: PromptAtKey,
+		KnownHostsFile:  getKnownHostsFile(),
+	}
+	client.SetPasswordAuth(password)
+	err = client.NewCryptoContext()
+	if err != nil {
+		log.Fatal("Failed to establish SSH connection: ", err)
+		return -1
+	}
+
+	log.Printf("Copying configuration to %s...\n", destination)
+	err = client.Put(archive.Name(), migrateArchive)
+	if err != nil {
+		log.Fatal("Failed to copy configuration: ", err)
+		return -1
+	}
+
+	// One command, so an existing configuration stops it before tar overwrites anything
+	_, err = client.RunCommands([]string{
+		strings.Join([]string{
+			fmt.Sprintf("test ! -e %s/config.json", remoteHome),
+			fmt.Sprintf("mkdir -p -m 700 %s", remoteHome),
+			fmt.Sprintf("tar -xzf %s -C %s", migrateArchive, remoteHome),
+			fmt.Sprintf("chmod 600 %s/ssh-keys/id_rsa", remoteHome),
+			fmt.Sprintf("rm -f %s", migrateArchive),
+		}, " && "),
+	}, false)
+	if err != nil {
+		client.RunCommands([]string{fmt.Sprintf("rm -f %s", migrateArchive)}, false)
+		log.Fatalf("Failed to unpack configuration, does %s already exist on %s? %s\n", remoteHome, address, err)
+		return -1
+	}
+	log.Printf("Configuration copied to %s:%s\n", address, remoteHome)
+
+	// Check that the new machine can reach each target with the migrated keys
+	failed := 0
+	w := tabwriter.NewWriter(os.Stdout, 1, 1, 3, ' ', 0)
+	fmt.Fprintln(w, "Target\tSSH from new machine")
+	// ssh can't ask for the passphrase without a terminal
+	encrypted := privateKeyEncrypted(getPrivateKeyFilename())
+	for _, host := range config.Hosts {
+		if host.IdentityFile != "" {
+			// Keys of the operator's own aren't part of the configuration
+			fmt.Fprintf(w, "%s\tnot checked, copy %s to the new machine\n", host.Name, host.IdentityFile)
+			continue
+		}
+		if encrypted {
+			fmt.Fprintf(w, "%s\tnot checked, the key is protected by a passphrase\n", host.Name)
+			continue
+		}
+		sshOptions := fmt.Sprintf("-i %[1]s/ssh-keys/id_rsa -o UserKnownHostsFile=%[1]s/ssh-keys/known_hosts -o BatchMode=yes -o ConnectTimeout=10", remoteHome)
+		// -J wouldn't pass the key and known_hosts on to the jump host connection
+		jumpOption := ""
+		if jump := host.ProxyJump; jump != nil {
+			jumpOption = fmt.Sprintf(" -o %s", shellQuote(fmt.Sprintf("ProxyCommand=ssh %s -W %%h:%%p -p %d %s@%s", sshOptions, jump.Port, jump.Username, jump.Address)))
+		}
+		_, err := client.RunCommands([]string{
+			fmt.Sprintf("ssh %s%s -p %d %s@%s true", sshOptions, jumpOption, host.Port, host.Username, host.Address),
+		}, false)
+		status := "ok"
+		if err != nil {
+			status = fmt.Sprintf("failed: %s", err)
+			failed++
+		}
+		fmt.Fprintf(w, "%s\t%s\n", host.Name, status)
+	}
+	w.Flush()
+
+	if failed > 0 {
+		log.Printf("%d target(s) are not reachable from %s\n", failed, address)
+		return -1
+	}
+	return 0
+}
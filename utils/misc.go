@@ -1,17 +1,29 @@
 package utils
 
 import (
+	"bufio"
+	"errors"
 	"fmt"
 	"log"
 	"os"
-	"path"
+	"path/filepath"
 	"runtime"
-	"syscall"
+	"strings"
 
+	"github.com/manifoldco/promptui"
 	"golang.org/x/term"
 )
 
+// Local state holds keys and passwords, so keep it private to the user
+const (
+	privateDirMode  = 0o700
+	privateFileMode = 0o600
+)
+
 func UserHomeDir() string {
+	if home, err := os.UserHomeDir(); err == nil {
+		return home
+	}
 	if runtime.GOOS == "windows" {
 		home := os.Getenv("HOMEDRIVE") + os.Getenv("HOMEPATH")
 		if home == "" {
@@ -22,15 +34,57 @@ func UserHomeDir() string {
 	return os.Getenv("HOME")
 }
 
+/*
+ * Local state lives in GUARDIAN_HOME, otherwise ~/.guardian on Linux and in
+ * the user config dir on Windows and macOS. An existing ~/.guardian is kept.
+ */
 func GuardianConfigHome() string {
-	var guardianHome string = os.Getenv("GUARDIAN_HOME")
-	var homePath string
-	if guardianHome != "" {
-		homePath = path.Join(guardianHome)
-	} else {
-		homePath = path.Join(UserHomeDir(), ".guardian")
-	}
-	return homePath
+	if guardianHome := os.Getenv("GUARDIAN_HOME"); guardianHome != "" {
+		return filepath.Clean(guardianHome)
+	}
+	legacyHome := filepath.Join(UserHomeDir(), ".guardian")
+	if runtime.GOOS != "windows" && runtime.GOOS != "darwin" {
+		return legacyHome
+	}
+	if _, err := os.Stat(legacyHome); err == nil {
+		return legacyHome
+	}
+	configDir, err := os.UserConfigDir()
+	if err != nil {
+		return legacyHome
+	}
+	return filepath.Join(configDir, "guardian")
+}
+
+/*
+ * Create or truncate a file readable only by the user. The mode only applies to
+ * new files, so one left readable by an older version is narrowed too.
+ */
+func createPrivateFile(name string) (*os.File, error) {
+	f, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, privateFileMode)
+	if err != nil {
+		return nil, err
+	}
+	if err = f.Chmod(privateFileMode); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+/*
+ * Write data to a file readable only by the user
+ */
+func writePrivateFile(name string, data []byte) error {
+	f, err := createPrivateFile(name)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
 }
 
 /*
@@ -38,8 +92,12 @@ func GuardianConfigHome() string {
  */
 func getUserCredentials() (string, error) {
 
+	if err := checkInteractive("a password"); err != nil {
+		return "", fmt.Errorf("%s; provide it in the environment (i.e. NEWHOST_PASSWORD, SUDO_PASSWORD)", err)
+	}
+
 	fmt.Print("Enter Password: ")
-	bytePassword, err := term.ReadPassword(int(syscall.Stdin))
+	bytePassword, err := term.ReadPassword(int(os.Stdin.Fd()))
 	if err != nil {
 		return "", err
 	}
@@ -50,12 +108,70 @@ func getUserCredentials() (string, error) {
 }
 
 /*
- * Get currently selected target
+ * Why no usable target is selected, and how to fix it
+ */
+type TargetSelectionError struct {
+	Target      string
+	Reason      string
+	Remediation string
+}
+
+func (e *TargetSelectionError) Error() string {
+	return fmt.Sprintf("%s; %s", e.Reason, e.Remediation)
+}
+
+/*
+ * Get currently selected target, checking that it still exists
  */
 func GetTargetSelection() (string, error) {
-	targetSelectFile := path.Join(GuardianConfigHome(), ".target")
+	targetSelectFile := filepath.Join(GuardianConfigHome(), ".target")
 	content, err := os.ReadFile(targetSelectFile)
-	return string(content), err
+	if err != nil {
+		return "", &TargetSelectionError{
+			Reason:      "no target selected",
+			Remediation: "use the '--target' flag, or select a target using 'guardian-cli target select'",
+		}
+	}
+	target := strings.TrimSpace(string(content))
+
+	config, err := loadConfig()
+	if err != nil {
+		return "", err
+	}
+	if _, host := FindHost(config, target); host.Name != target {
+		return "", &TargetSelectionError{
+			Target:      target,
+			Reason:      fmt.Sprintf("selected target '%s' no longer exists", target),
+			Remediation: "select another target using 'guardian-cli target select'",
+		}
+	}
+	return target, nil
+}
+
+/*
+ * Ask the user to pick one of the configured hosts
+ */
+func promptTargetHost() (string, error) {
+	config, err := loadConfig()
+	if err != nil {
+		return "", err
+	}
+	if len(config.Hosts) == 0 {
+		return "", errors.New("no hosts configured, add one with 'guardian-cli target add'")
+	}
+	if err := checkInteractive("a target"); err != nil {
+		return "", fmt.Errorf("%s; pass --target", err)
+	}
+	var names []string
+	for _, host := range config.Hosts {
+		names = append(names, host.Name)
+	}
+	prompt := promptui.Select{
+		Label: "Select target",
+		Items: names,
+	}
+	_, name, err := prompt.Run()
+	return name, err
 }
 
 /*
@@ -63,7 +179,7 @@ func GetTargetSelection() (string, error) {
  */
 func SelectTargetHost(name string) int {
 
-	targetSelectFile := path.Join(GuardianConfigHome(), ".target")
+	targetSelectFile := filepath.Join(GuardianConfigHome(), ".target")
 
 	if name == "show" {
 		// Show currently selected target
@@ -72,7 +188,7 @@ func SelectTargetHost(name string) int {
 		} else {
 			target, err := GetTargetSelection()
 			if err != nil {
-				log.Fatalln("Failed to read target select file")
+				log.Fatalln(err)
 				return -1
 			}
 			log.Printf("Target '%s' is currently selected\n", target)
@@ -86,11 +202,23 @@ func SelectTargetHost(name string) int {
 		}
 		log.Println("Unselected target")
 		return 0
+	} else if name == "" {
+		var err error
+		name, err = promptTargetHost()
+		if err != nil {
+			log.Fatal("Failed to select target: ", err)
+			return -1
+		}
 	}
 
-	_, err := getHostFilterConfig(name)
+	// Only check that the host exists; the filter config is initialized on first use
+	config, err := loadConfig()
 	if err != nil {
-		log.Fatalf("Failed to get host config: for target '%s': %s \n", name, err)
+		log.Fatalf("Failed to load config: %s\n", err)
+		return -1
+	}
+	if _, host := FindHost(config, name); host.Name != name {
+		log.Fatalf("Host '%s' is not configured\n", name)
 		return -1
 	}
 
@@ -111,3 +239,30 @@ func SelectTargetHost(name string) int {
 
 	return 0
 }
+
+/*
+ * Combine domains given as arguments with those listed one per line in a file
+ */
+func ReadDomains(domains []string, fromFile string) []string {
+	if fromFile != "" {
+		f, err := os.Open(fromFile)
+		if err != nil {
+			log.Fatalf("Failed to open domain file: %s\n", err)
+		}
+		defer f.Close()
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+			if line != "" && !strings.HasPrefix(line, "#") {
+				domains = append(domains, line)
+			}
+		}
+		if err = scanner.Err(); err != nil {
+			log.Fatalf("Failed to read domain file: %s\n", err)
+		}
+	}
+	if len(domains) == 0 {
+		log.Fatalln("No domains given; pass them as arguments or with '--from-file'")
+	}
+	return domains
+}
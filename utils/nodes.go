@@ -0,0 +1,440 @@
+package utils
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+)
+
+// Where the k3s server keeps the token agents join with
+const k3sTokenFile = "/var/lib/rancher/k3s/server/node-token"
+
+// Reads the join token, its output is kept out of transcripts
+const readK3sTokenCommand = "sudo cat " + k3sTokenFile
+
+// Where a worker's agent reads the join token from, root-only
+const k3sJoinTokenFile = "/etc/rancher/k3s/join-token"
+
+/*
+ * Worker node of a target's cluster, reached over SSH like the target itself
+ */
+type ClusterNode struct {
+	// Kubernetes node name, the node's hostname
+	Name     string
+	Address  string
+	Username string
+	Port     uint16
+}
+
+/*
+ * The target's settings pointed at one of its worker nodes; workers share the
+ * target's jump host since they sit on the same network
+ */
+func nodeHost(host Host, node ClusterNode) Host {
+	return Host{
+		Name:      host.Name,
+		Address:   node.Address,
+		Username:  node.Username,
+		Port:      node.Port,
+		HomePath:  fmt.Sprintf("/home/%s", node.Username),
+		ProxyJump: host.ProxyJump,
+	}
+}
+
+/*
+ * Put the cluster join token in a root-only file on a worker. It goes over SFTP
+ * into a file only the user can read, never on a command line.
+ */
+func putJoinToken(worker Host, targetName string, token string, prompts map[string]string) error {
+	local := filepath.Join(getHostDataDir(targetName), "join-token")
+	f, err := createPrivateFile(local)
+	if err != nil {
+		return err
+	}
+	_, err = f.WriteString(token)
+	f.Close()
+	defer os.Remove(local)
+	if err != nil {
+		return err
+	}
+
+	staged := path.Join(worker.HomePath, ".guardian-join-token")
+	_, err = runHostCommands(worker, []string{fmt.Sprintf("install -m 600 /dev/null %s", shellQuote(staged))}, false)
+	if err == nil {
+		err = putHostFile(worker, local, staged)
+	}
+	if err == nil {
+		_, err = runHostCommandsWithPrompts(worker, []string{
+			fmt.Sprintf("sudo install -D -m 600 -o root -g root %s %s", shellQuote(staged), k3sJoinTokenFile),
+		}, prompts, false)
+	}
+	runHostCommands(worker, []string{fmt.Sprintf("rm -f %s", shellQuote(staged))}, false)
+	return err
+}
+
+func findNode(host Host, name string) int {
+	for i, node := range host.Nodes {
+		if node.Name == name || node.Address == name {
+			return i
+		}
+	}
+	return -1
+}
+
+func fetchNodes(host Host) (nodeList, error) {
+	var nodes nodeList
+	out, err := runHostCommands(host, []string{
+		"export KUBECONFIG=/etc/rancher/k3s/k3s.yaml",
+		"kubectl get nodes -o json",
+	}, false)
+	if err != nil {
+		return nodes, err
+	}
+	err = json.Unmarshal([]byte(out), &nodes)
+	return nodes, err
+}
+
+/*
+ * Address agents reach the k3s server at; the target's own address may be a
+ * public one or only valid through its jump host
+ */
+func k3sServerAddress(host Host) (string, error) {
+	nodes, err := fetchNodes(host)
+	if err != nil {
+		return "", err
+	}
+	for _, node := range nodes.Items {
+		if _, ok := node.Metadata.Labels[controlPlaneLabel]; !ok {
+			continue
+		}
+		for _, address := range node.Status.Addresses {
+			if address.Type == "InternalIP" {
+				return address.Address, nil
+			}
+		}
+	}
+	return "", fmt.Errorf("no server node with an internal address")
+}
+
+/*
+ * Password for sudo on a target: from SUDO_PASSWORD, the keyring or a prompt
+ */
+func sudoPassword(host Host) (string, error) {
+	password := os.Getenv("SUDO_PASSWORD")
+	if password != "" || replaying() {
+		return password, nil
+	}
+	if password = keyringCredential(host, "sudo"); password != "" {
+		return password, nil
+	}
+	log.Printf("You will need to enter your password for sudo access.")
+	return getUserCredentials()
+}
+
+/*
+ * Keep replica placement satisfiable after the node count changed: required
+ * anti-affinity can't schedule more replicas than there are nodes
+ */
+func updateReplicaPlacement(targetName string, nodes int) error {
+	filterConfig, err := getHostFilterConfig(targetName)
+	if err != nil {
+		return err
+	}
+	ha := filterConfig.HighAvailability
+	if !ha.Enabled {
+		if nodes > 1 {
+			log.Printf("The cluster has %d nodes; spread the filter over them with 'filter ha enable'\n", nodes)
+		}
+		return nil
+	}
+	if ha.AntiAffinity == "required" && nodes < filterConfig.FilterReplicas {
+		log.Printf("Warning: %d node(s) can't hold %d replicas on separate nodes; switching to preferred anti-affinity\n", nodes, filterConfig.FilterReplicas)
+		filterConfig.HighAvailability.AntiAffinity = "preferred"
+		if err := writeHostFilterConfig(targetName, filterConfig); err != nil {
+			return err
+		}
+		log.Println("Updated replica placement; deploy to apply")
+		return nil
+	}
+	if ha.AntiAffinity == "preferred" && nodes >= filterConfig.FilterReplicas {
+		log.Printf("The cluster now has enough nodes to require separate nodes per replica; run 'filter ha enable --replicas %d'\n", filterConfig.FilterReplicas)
+	}
+	return nil
+}
+
+/*
+ * Re-read the node count and adjust replica placement to it
+ */
+func refreshNodePlacement(host Host) {
+	RefreshFacts = true
+	facts, err := getClusterFacts(host)
+	if err != nil {
+		log.Printf("Warning: failed to refresh cluster facts: %s\n", err)
+		return
+	}
+	if err := updateReplicaPlacement(host.Name, facts.Nodes); err != nil {
+		log.Printf("Warning: failed to update replica placement: %s\n", err)
+	}
+}
+
+/*
+ * Install k3s as an agent on a machine and join it to the target's cluster
+ */
+func AddNode(targetName string, address string, username string, port uint16) int {
+
+	config, err := loadConfig()
+	if err != nil {
+		log.Fatal("Failed to load config: ", err)
+		return -1
+	}
+
+	index, host := FindHost(config, targetName)
+	if host.Name != targetName {
+		log.Fatalf("Host %s doesn't exist, create it first", targetName)
+		return -1
+	}
+	if host.Local {
+		log.Fatalf("Target '%s' runs against a local kubeconfig, add nodes to that cluster directly\n", targetName)
+		return -1
+	}
+	if err := validateHostAddress(address); err != nil {
+		log.Fatal("Invalid node: ", err)
+		return -1
+	}
+	if address == host.Address || findNode(host, address) >= 0 {
+		log.Fatalf("%s is already a node of '%s'\n", address, targetName)
+		return -1
+	}
+
+	node := ClusterNode{Address: address, Username: username, Port: port}
+	worker := nodeHost(host, node)
+
+	err = initSsh(4096)
+	if err != nil {
+		log.Fatal("Failed to initialize SSH: ", err)
+		return -1
+	}
+	password := os.Getenv("NEWHOST_PASSWORD")
+	if password == "" {
+		fmt.Println("Need remote password to copy keys to the new node.")
+		password, err = getUserCredentials()
+		if err != nil {
+			log.Fatal("Failed to retrieve user password: ", err)
+			return -1
+		}
+	}
+	done := progressStep(targetName, "copy-keys")
+	err = copyKeyToHost(worker, password)
+	done(err)
+	if err != nil {
+		log.Fatalf("Failed to copy keys: %s\n", err)
+		return -1
+	}
+
+	out, err := runHostCommands(worker, []string{"hostname"}, false)
+	if err != nil {
+		log.Fatal("Failed to reach the new node: ", err)
+		return -1
+	}
+	node.Name = strings.TrimSpace(out)
+	nodes, err := fetchNodes(host)
+	if err != nil {
+		log.Fatal("Failed to list cluster nodes: ", err)
+		return -1
+	}
+	for _, existing := range nodes.Items {
+		if existing.Metadata.Name == node.Name {
+			log.Fatalf("The cluster already has a node named '%s'\n", node.Name)
+			return -1
+		}
+	}
+
+	server, err := k3sServerAddress(host)
+	if err != nil {
+		log.Fatal("Failed to find the k3s server address: ", err)
+		return -1
+	}
+	sudo, err := sudoPassword(host)
+	if err != nil {
+		log.Fatal("Failed to get password: ", err)
+		return -1
+	}
+	prompts := map[string]string{"[sudo] password for ": sudo}
+
+	// Not printed, the token lets anything join the cluster
+	out, err = runHostCommandsWithPrompts(host, []string{readK3sTokenCommand}, prompts, false)
+	if err != nil {
+		log.Fatal("Failed to read the cluster join token: ", err)
+		return -1
+	}
+	out = strings.TrimSpace(out)
+	token := out[strings.LastIndex(out, "\n")+1:]
+	if token == "" {
+		log.Fatal("Failed to read the cluster join token: ", "token file is empty")
+		return -1
+	}
+
+	log.Printf("Joining %s (%s) to the cluster of '%s'...\n", node.Name, address, targetName)
+	done = progressStep(targetName, "join-node")
+	err = putJoinToken(worker, targetName, token, prompts)
+	if err != nil {
+		done(err)
+		log.Fatal("Failed to copy the cluster join token: ", err)
+		return -1
+	}
+	ctx, cancel := stepContext(playbookTimeout)
+	defer cancel()
+	// The agent reads the token from its file, so it never shows in the process list
+	_, err = runHostCommandsWithPromptsContext(ctx, worker, []string{
+		fmt.Sprintf("curl -sfL https://get.k3s.io | sudo K3S_URL=%s K3S_TOKEN_FILE=%s INSTALL_K3S_CHANNEL=stable sh -",
+			shellQuote(fmt.Sprintf("https://%s:6443", server)), k3sJoinTokenFile),
+	}, prompts, false)
+	if err == nil {
+		_, err = runHostCommandsContext(ctx, host, []string{
+			"export KUBECONFIG=/etc/rancher/k3s/k3s.yaml",
+			fmt.Sprintf("kubectl wait --for=condition=Ready node/%s --timeout=300s", shellQuote(node.Name)),
+		}, false)
+	}
+	done(err)
+	if err != nil {
+		log.Fatal("Failed to join the node: ", err)
+		return -1
+	}
+
+	config.Hosts[index].Nodes = append(config.Hosts[index].Nodes, node)
+	err = writeConfig(config)
+	if err != nil {
+		log.Fatal("Failed to write config: ", err)
+		return -1
+	}
+	log.Printf("Node %s joined '%s'\n", node.Name, targetName)
+
+	refreshNodePlacement(config.Hosts[index])
+	return 0
+}
+
+/*
+ * Drain a worker node, remove it from the cluster and uninstall its agent
+ */
+func RemoveNode(targetName string, nodeName string) int {
+
+	config, err := loadConfig()
+	if err != nil {
+		log.Fatal("Failed to load config: ", err)
+		return -1
+	}
+
+	index, host := FindHost(config, targetName)
+	if host.Name != targetName {
+		log.Fatalf("Host %s doesn't exist, create it first", targetName)
+		return -1
+	}
+	i := findNode(host, nodeName)
+	if i < 0 {
+		log.Fatalf("'%s' is not a worker node added to '%s'; see 'target node list %s'\n", nodeName, targetName, targetName)
+		return -1
+	}
+	node := host.Nodes[i]
+
+	log.Printf("Draining %s...\n", node.Name)
+	done := progressStep(targetName, "drain-node")
+	ctx, cancel := stepContext(playbookTimeout)
+	defer cancel()
+	_, err = runHostCommandsContext(ctx, host, []string{
+		"export KUBECONFIG=/etc/rancher/k3s/k3s.yaml",
+		fmt.Sprintf("kubectl drain %s --ignore-daemonsets --delete-emptydir-data --timeout=300s", shellQuote(node.Name)),
+		fmt.Sprintf("kubectl delete node %s", shellQuote(node.Name)),
+	}, false)
+	done(err)
+	if err != nil {
+		log.Fatal("Failed to remove the node from the cluster: ", err)
+		return -1
+	}
+
+	// The node is out of the cluster either way, a leftover agent only wastes resources
+	sudo, err := sudoPassword(host)
+	if err == nil {
+		_, err = runHostCommandsWithPrompts(nodeHost(host, node), []string{"sudo /usr/local/bin/k3s-agent-uninstall.sh"},
+			map[string]string{"[sudo] password for ": sudo}, false)
+	}
+	if err != nil {
+		log.Printf("Warning: failed to uninstall k3s from %s, remove it by hand: %s\n", node.Address, err)
+	}
+
+	config.Hosts[index].Nodes = append(host.Nodes[:i], host.Nodes[i+1:]...)
+	err = writeConfig(config)
+	if err != nil {
+		log.Fatal("Failed to write config: ", err)
+		return -1
+	}
+	log.Printf("Removed node %s from '%s'\n", node.Name, targetName)
+
+	refreshNodePlacement(config.Hosts[index])
+	return 0
+}
+
+/*
+ * Nodes of the target's cluster, with the workers this CLI joined
+ */
+func ListNodes(targetName string) int {
+
+	config, err := loadConfig()
+	if err != nil {
+		log.Fatal("Failed to load config: ", err)
+		return -1
+	}
+
+	_, host := FindHost(config, targetName)
+	if host.Name != targetName {
+		log.Fatalf("Host %s doesn't exist, create it first", targetName)
+		return -1
+	}
+
+	nodes, err := fetchNodes(host)
+	if err != nil {
+		log.Fatal("Failed to list cluster nodes: ", err)
+		return -1
+	}
+
+	w := tabwriter.NewWriter(showOutput(), 1, 1, 3, ' ', 0)
+	fmt.Fprintln(w, "Node\tRole\tStatus\tAddress\tAdded by CLI")
+	listed := map[string]bool{}
+	for _, item := range nodes.Items {
+		role := "worker"
+		if _, ok := item.Metadata.Labels[controlPlaneLabel]; ok {
+			role = "server"
+		}
+		status := "NotReady"
+		for _, condition := range item.Status.Conditions {
+			if condition.Type == "Ready" && condition.Status == "True" {
+				status = "Ready"
+			}
+		}
+		address := ""
+		for _, a := range item.Status.Addresses {
+			if a.Type == "InternalIP" {
+				address = a.Address
+			}
+		}
+		added := "no"
+		if i := findNode(host, item.Metadata.Name); i >= 0 {
+			added = "yes"
+			address = host.Nodes[i].Address
+		}
+		listed[item.Metadata.Name] = true
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", item.Metadata.Name, role, status, address, added)
+	}
+	// Added nodes the cluster no longer knows, i.e. deleted with kubectl
+	for _, node := range host.Nodes {
+		if !listed[node.Name] {
+			fmt.Fprintf(w, "%s\tworker\tMissing\t%s\tyes\n", node.Name, node.Address)
+		}
+	}
+	w.Flush()
+	return 0
+}
@@ -0,0 +1,290 @@
+package utils
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Category the newly registered domains are loaded into and denied by
+const newDomainsCategory = "newly-registered"
+
+// NRD feeds are daily lists, and free ones only keep a few months
+const (
+	minNewDomainsAge = 24 * time.Hour
+	maxNewDomainsAge = 90 * 24 * time.Hour
+)
+
+type NewDomainsConfig struct {
+	// Domains registered within this long are blocked, i.e. 30d
+	Age string `yaml:"age"`
+	// Daily list of newly registered domains, {date} is replaced by the day; empty for WhoisDS
+	Url string `yaml:"url,omitempty"`
+}
+
+func getNewDomainsDir(name string) string {
+	return filepath.Join(getHostDataDir(name), "new-domains")
+}
+
+/*
+ * URL of the list of domains registered on a day
+ */
+func newDomainsUrl(template string, day time.Time) string {
+	if template == "" {
+		// WhoisDS names its free daily lists after the base64 of the zip file name
+		file := base64.StdEncoding.EncodeToString([]byte(day.Format("2006-01-02") + ".zip"))
+		return fmt.Sprintf("https://www.whoisds.com/whois-database/newly-registered-domains/%s/nrd", file)
+	}
+	return strings.ReplaceAll(template, "{date}", day.Format("2006-01-02"))
+}
+
+/*
+ * Distinct domains from a list with one domain per line
+ */
+func parseDomainList(r io.Reader, seen map[string]bool) ([]string, error) {
+	var domains []string
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		domain := strings.ToLower(strings.TrimSpace(scanner.Text()))
+		if domain == "" || strings.HasPrefix(domain, "#") {
+			continue
+		}
+		if err := validateHostAddress(domain); err != nil {
+			continue
+		}
+		if !seen[domain] {
+			seen[domain] = true
+			domains = append(domains, domain)
+		}
+	}
+	return domains, scanner.Err()
+}
+
+/*
+ * Download one day's list, which may be plain text or a zip of text files
+ */
+func fetchNewDomains(listUrl string) ([]string, error) {
+	client := &http.Client{Timeout: 5 * time.Minute}
+	resp, err := client.Get(listUrl)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("received code %d from %s", resp.StatusCode, listUrl)
+	}
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	seen := map[string]bool{}
+	if !bytes.HasPrefix(data, []byte("PK")) {
+		return parseDomainList(bytes.NewReader(data), seen)
+	}
+	archive, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return nil, err
+	}
+	var domains []string
+	for _, file := range archive.File {
+		f, err := file.Open()
+		if err != nil {
+			return nil, err
+		}
+		fileDomains, err := parseDomainList(f, seen)
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+		domains = append(domains, fileDomains...)
+	}
+	return domains, nil
+}
+
+/*
+ * Load the days within the blocking window into the category, in one upload.
+ * Downloaded days are kept per target so each sync only fetches new days.
+ */
+func syncNewDomains(targetName string, config NewDomainsConfig) error {
+	age, err := parseLongDuration(config.Age)
+	if err != nil {
+		return err
+	}
+	dir := getNewDomainsDir(targetName)
+	err = os.MkdirAll(dir, privateDirMode)
+	if err != nil {
+		return err
+	}
+
+	// Today's list is only complete tomorrow
+	today := time.Now().UTC().Truncate(24 * time.Hour)
+	days := int(age / (24 * time.Hour))
+	window := map[string]bool{}
+	for i := 1; i <= days; i++ {
+		day := today.AddDate(0, 0, -i)
+		fileName := filepath.Join(dir, day.Format("2006-01-02")+".txt")
+		window[filepath.Base(fileName)] = true
+		if _, err := os.Stat(fileName); err == nil {
+			continue
+		}
+		listUrl := newDomainsUrl(config.Url, day)
+		domains, err := fetchNewDomains(listUrl)
+		if err != nil {
+			log.Printf("Skipping new domains of %s: %s\n", day.Format("2006-01-02"), err)
+			continue
+		}
+		log.Printf("Fetched %d domains registered on %s\n", len(domains), day.Format("2006-01-02"))
+		err = ioutil.WriteFile(fileName, []byte(strings.Join(domains, "\n")+"\n"), privateFileMode)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Drop the days that aged out of the window
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	var kept []string
+	for _, entry := range entries {
+		if window[entry.Name()] {
+			kept = append(kept, entry.Name())
+		} else {
+			os.Remove(filepath.Join(dir, entry.Name()))
+		}
+	}
+	if len(kept) == 0 {
+		return fmt.Errorf("no new domain lists could be fetched")
+	}
+	sort.Strings(kept)
+
+	// Build a squidguard-style list with the category's domains
+	listDir, err := ioutil.TempDir("", "guardian-nrd-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(listDir)
+	err = os.Mkdir(filepath.Join(listDir, newDomainsCategory), privateDirMode)
+	if err != nil {
+		return err
+	}
+	list, err := os.Create(filepath.Join(listDir, newDomainsCategory, "domains"))
+	if err != nil {
+		return err
+	}
+	for _, name := range kept {
+		data, err := ioutil.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			list.Close()
+			return err
+		}
+		list.Write(data)
+	}
+	list.Close()
+
+	archive, err := ioutil.TempFile("", "guardian-nrd-*.tar.gz")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(archive.Name())
+	err = compress(listDir, archive)
+	archive.Close()
+	if err != nil {
+		return err
+	}
+
+	// Replace the category so domains older than the window are unblocked
+	log.Printf("Loading %d days of new domains into category '%s'...\n", len(kept), newDomainsCategory)
+	if DeleteCategory(targetName, newDomainsCategory) != 0 {
+		return fmt.Errorf("failed to clear category '%s'", newDomainsCategory)
+	}
+	return Upload(targetName, "/api/upload", archive.Name())
+}
+
+/*
+ * Deny domains registered within age, refreshed with the threat feeds
+ */
+func BlockNewDomains(targetName string, age string, feedUrl string) int {
+
+	duration, err := parseLongDuration(age)
+	if err != nil {
+		log.Fatalf("Invalid age '%s'\n", age)
+		return -1
+	}
+	if duration < minNewDomainsAge || duration > maxNewDomainsAge {
+		log.Fatalf("Age must be between 1d and %dd\n", int(maxNewDomainsAge.Hours()/24))
+		return -1
+	}
+	if feedUrl != "" && !strings.Contains(feedUrl, "{date}") {
+		log.Fatalln("The feed URL must contain {date} for the day of each list")
+		return -1
+	}
+
+	config, err := getHostFilterConfig(targetName)
+	if err != nil {
+		log.Fatal("Failed to get host config: ", err)
+		return -1
+	}
+
+	config.NewDomains = NewDomainsConfig{Age: age, Url: feedUrl}
+
+	// Deny rules go first so they win over any allow rule
+	if !config.AclRuleExists(newDomainsCategory, "deny") {
+		config.AddAclRule(newDomainsCategory, "deny", 0)
+		log.Printf("Added acl rule '%s=deny'\n", newDomainsCategory)
+	}
+
+	err = writeHostFilterConfig(targetName, config)
+	if err != nil {
+		log.Fatal("Failed to write host config: ", err)
+		return -1
+	}
+
+	log.Printf("Blocking domains registered in the last %s, refreshed with 'filter threat-feed update'\n", age)
+	err = syncNewDomains(targetName, config.NewDomains)
+	if err != nil {
+		log.Fatal("Failed to load new domains: ", err)
+		return -1
+	}
+	return 0
+}
+
+/*
+ * Stop blocking new domains, dropping their rule and category
+ */
+func UnblockNewDomains(targetName string) int {
+
+	config, err := getHostFilterConfig(targetName)
+	if err != nil {
+		log.Fatal("Failed to get host config: ", err)
+		return -1
+	}
+
+	config.NewDomains = NewDomainsConfig{}
+	config.AllowRules = config.DeleteAllowRule(newDomainsCategory, "deny")
+
+	err = writeHostFilterConfig(targetName, config)
+	if err != nil {
+		log.Fatal("Failed to write host config: ", err)
+		return -1
+	}
+	os.RemoveAll(getNewDomainsDir(targetName))
+
+	if DeleteCategory(targetName, newDomainsCategory) != 0 {
+		return -1
+	}
+	log.Println("Stopped blocking new domains")
+	return 0
+}
@@ -0,0 +1,165 @@
+package utils
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha512"
+	"encoding/binary"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+
+	"golang.org/x/crypto/blowfish"
+	"golang.org/x/crypto/ssh"
+)
+
+// What ssh-keygen uses for a new passphrase, see PROTOCOL.key in openssh-portable
+const (
+	openSSHKeyCipher     = "aes256-ctr"
+	openSSHKeyKdf        = "bcrypt"
+	openSSHKeyKdfRounds  = 16
+	openSSHKeySaltLength = 16
+)
+
+/*
+ * Encrypt an RSA key with a passphrase in the OpenSSH key format, which derives
+ * the key with bcrypt_pbkdf and is what ssh-keygen writes. The x/crypto this
+ * module builds with can read that format but not write it yet.
+ */
+func marshalOpenSSHPrivateKey(key *rsa.PrivateKey, passphrase string) (*pem.Block, error) {
+	salt := make([]byte, openSSHKeySaltLength)
+	var check [4]byte
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	if _, err := rand.Read(check[:]); err != nil {
+		return nil, err
+	}
+	publicKey, err := ssh.NewPublicKey(&key.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+
+	key.Precompute()
+	private := ssh.Marshal(struct {
+		Check1  uint32
+		Check2  uint32
+		Keytype string
+		N       *big.Int
+		E       *big.Int
+		D       *big.Int
+		Iqmp    *big.Int
+		P       *big.Int
+		Q       *big.Int
+		Comment string
+	}{
+		Check1:  binary.BigEndian.Uint32(check[:]),
+		Check2:  binary.BigEndian.Uint32(check[:]),
+		Keytype: ssh.KeyAlgoRSA,
+		N:       key.N,
+		E:       big.NewInt(int64(key.E)),
+		D:       key.D,
+		Iqmp:    key.Precomputed.Qinv,
+		P:       key.Primes[0],
+		Q:       key.Primes[1],
+	})
+	// Padded 1, 2, 3... to the cipher block size
+	for i := byte(1); len(private)%aes.BlockSize != 0; i++ {
+		private = append(private, i)
+	}
+
+	derived, err := bcryptPbkdf([]byte(passphrase), salt, openSSHKeyKdfRounds, 32+aes.BlockSize)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(derived[:32])
+	if err != nil {
+		return nil, err
+	}
+	cipher.NewCTR(block, derived[32:]).XORKeyStream(private, private)
+
+	kdfOptions := ssh.Marshal(struct {
+		Salt   []byte
+		Rounds uint32
+	}{salt, openSSHKeyKdfRounds})
+	body := ssh.Marshal(struct {
+		CipherName string
+		KdfName    string
+		KdfOptions []byte
+		NumKeys    uint32
+		PublicKey  []byte
+		Private    []byte
+	}{openSSHKeyCipher, openSSHKeyKdf, kdfOptions, 1, publicKey.Marshal(), private})
+
+	return &pem.Block{Type: "OPENSSH PRIVATE KEY", Bytes: append([]byte("openssh-key-v1\x00"), body...)}, nil
+}
+
+/*
+ * bcrypt_pbkdf(3) from OpenBSD, as in x/crypto's internal copy the parser uses
+ */
+func bcryptPbkdf(password []byte, salt []byte, rounds int, keyLen int) ([]byte, error) {
+	if len(password) == 0 {
+		return nil, fmt.Errorf("empty passphrase")
+	}
+	const blockSize = 32
+	numBlocks := (keyLen + blockSize - 1) / blockSize
+	key := make([]byte, numBlocks*blockSize)
+
+	h := sha512.New()
+	h.Write(password)
+	shapass := h.Sum(nil)
+
+	shasalt := make([]byte, 0, sha512.Size)
+	count, tmp := make([]byte, 4), make([]byte, blockSize)
+	for block := 1; block <= numBlocks; block++ {
+		h.Reset()
+		h.Write(salt)
+		binary.BigEndian.PutUint32(count, uint32(block))
+		h.Write(count)
+		if err := bcryptHash(tmp, shapass, h.Sum(shasalt)); err != nil {
+			return nil, err
+		}
+
+		out := make([]byte, blockSize)
+		copy(out, tmp)
+		for i := 2; i <= rounds; i++ {
+			h.Reset()
+			h.Write(tmp)
+			if err := bcryptHash(tmp, shapass, h.Sum(shasalt)); err != nil {
+				return nil, err
+			}
+			for j := range out {
+				out[j] ^= tmp[j]
+			}
+		}
+
+		for i, v := range out {
+			key[i*numBlocks+(block-1)] = v
+		}
+	}
+	return key[:keyLen], nil
+}
+
+func bcryptHash(out []byte, shapass []byte, shasalt []byte) error {
+	c, err := blowfish.NewSaltedCipher(shapass, shasalt)
+	if err != nil {
+		return err
+	}
+	for i := 0; i < 64; i++ {
+		blowfish.ExpandKey(shasalt, c)
+		blowfish.ExpandKey(shapass, c)
+	}
+	copy(out, "OxychromaticBlowfishSwatDynamite")
+	for i := 0; i < 32; i += 8 {
+		for j := 0; j < 64; j++ {
+			c.Encrypt(out[i:i+8], out[i:i+8])
+		}
+	}
+	// Blowfish works on big endian words, bcrypt_pbkdf outputs little endian ones
+	for i := 0; i < 32; i += 4 {
+		out[i+3], out[i+2], out[i+1], out[i] = out[i], out[i+1], out[i+2], out[i+3]
+	}
+	return nil
+}
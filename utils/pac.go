@@ -0,0 +1,144 @@
+package utils
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"strings"
+)
+
+type PacConfig struct {
+	// Served by nginx at /wpad.dat and /proxy.pac when set
+	File          string   `yaml:"file,omitempty"`
+	DirectDomains []string `yaml:"directDomains,omitempty"`
+}
+
+/*
+ * Render a proxy auto-config file sending everything but the LAN and direct domains to squid
+ */
+func pacFile(proxyHost string, config FilterConfig, directDomains []string) string {
+	var b strings.Builder
+	b.WriteString("// Proxy auto-config, generated by guardian-cli\n")
+	b.WriteString("function FindProxyForURL(url, host) {\n")
+	b.WriteString("    if (isPlainHostName(host) || host == \"localhost\") {\n        return \"DIRECT\";\n    }\n")
+
+	if ip, network, err := net.ParseCIDR(config.LocalNetwork); err == nil && ip.To4() != nil {
+		fmt.Fprintf(&b, "    if (isInNet(dnsResolve(host), \"%s\", \"%s\")) {\n        return \"DIRECT\";\n    }\n",
+			network.IP, net.IP(network.Mask))
+	}
+
+	for _, domain := range directDomains {
+		fmt.Fprintf(&b, "    if (host == \"%s\" || dnsDomainIs(host, \".%s\")) {\n        return \"DIRECT\";\n    }\n", domain, domain)
+	}
+
+	// No DIRECT fallback, clients must not get around the filter when it is down
+	fmt.Fprintf(&b, "    return \"PROXY %s\";\n}\n", net.JoinHostPort(proxyHost, fmt.Sprint(config.SquidPublicPort)))
+	return b.String()
+}
+
+/*
+ * Generate a PAC file for explicit-proxy clients, optionally serving it at /wpad.dat
+ */
+func GeneratePac(targetName string, directDomains []string, output string, serve bool) int {
+
+	var domains []string
+	for _, domain := range directDomains {
+		domain = strings.ToLower(strings.TrimPrefix(strings.TrimSpace(domain), "."))
+		if domain == "" {
+			continue
+		}
+		if err := validateHostAddress(domain); err != nil {
+			log.Fatalf("Invalid domain '%s'\n", domain)
+			return -1
+		}
+		if !contains(domains, domain) {
+			domains = append(domains, domain)
+		}
+	}
+
+	guardianConf, err := loadConfig()
+	if err != nil {
+		log.Fatal("Failed to load config: ", err)
+		return -1
+	}
+
+	_, host := FindHost(guardianConf, targetName)
+	if host.Name != targetName {
+		log.Fatalf("Host %s doesn't exist, create it first", targetName)
+		return -1
+	}
+
+	config, err := getHostFilterConfig(targetName)
+	if err != nil {
+		log.Fatal("Failed to get host config: ", err)
+		return -1
+	}
+
+	if config.SquidPublicPort == 0 {
+		log.Fatalln("Squid has no public port; a PAC file only works with an explicit proxy")
+		return -1
+	}
+	if config.Transparent {
+		log.Println("Warning: the filter is transparent; clients don't need a PAC file")
+	}
+
+	// Keep the domains given last time unless new ones are given
+	if directDomains == nil {
+		domains = config.Pac.DirectDomains
+	}
+	pac := pacFile(host.Address, config, domains)
+
+	if output == "" {
+		fmt.Print(pac)
+	} else {
+		err = ioutil.WriteFile(output, []byte(pac), 0o644)
+		if err != nil {
+			log.Fatal("Failed to write PAC file: ", err)
+			return -1
+		}
+		log.Printf("Wrote PAC file to %s\n", output)
+	}
+
+	// Keep a served PAC file in step with the ports and domains
+	if !serve && config.Pac.File == "" {
+		return 0
+	}
+	config.Pac = PacConfig{File: pac, DirectDomains: domains}
+	if config.NginxReplicas < 1 {
+		config.NginxReplicas = 1
+	}
+
+	err = writeHostFilterConfig(targetName, config)
+	if err != nil {
+		log.Fatal("Failed to write host config: ", err)
+		return -1
+	}
+
+	log.Printf("Serving the PAC file at http://%s/wpad.dat; deploy to apply\n", host.Address)
+	log.Println("For WPAD discovery, point the DNS name 'wpad' or DHCP option 252 at that URL")
+	return 0
+}
+
+/*
+ * Stop serving the PAC file
+ */
+func RemovePac(targetName string) int {
+
+	config, err := getHostFilterConfig(targetName)
+	if err != nil {
+		log.Fatal("Failed to get host config: ", err)
+		return -1
+	}
+
+	config.Pac = PacConfig{}
+
+	err = writeHostFilterConfig(targetName, config)
+	if err != nil {
+		log.Fatal("Failed to write host config: ", err)
+		return -1
+	}
+
+	log.Println("Stopped serving the PAC file; deploy to apply")
+	return 0
+}
@@ -0,0 +1,219 @@
+package utils
+
+import (
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"sync"
+
+	"github.com/justinschw/gofigure/crypto"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+	"golang.org/x/term"
+)
+
+// Environment variable holding the passphrase of the private keys, for scripts and the daemon
+const keyPassphraseEnv = "GUARDIAN_KEY_PASSPHRASE"
+
+// Passphrases of the private keys decrypted so far, so each is asked for once per run
+var keyPassphrases = map[string]string{}
+
+// Held while asking, so connections opened in parallel prompt only once
+var keyPassphrasesLock sync.Mutex
+
+/*
+ * Passphrase of an encrypted private key, from the environment or a prompt
+ */
+func privateKeyPassphrase(file string, pemBytes []byte) (string, error) {
+	keyPassphrasesLock.Lock()
+	defer keyPassphrasesLock.Unlock()
+
+	if passphrase, ok := keyPassphrases[file]; ok {
+		return passphrase, nil
+	}
+	passphrase, ok := os.LookupEnv(keyPassphraseEnv)
+	if !ok {
+		if err := checkInteractive(fmt.Sprintf("the passphrase of %s", file)); err != nil {
+			return "", fmt.Errorf("%s; provide it in %s", err, keyPassphraseEnv)
+		}
+		fmt.Printf("Enter passphrase for %s: ", file)
+		answer, err := term.ReadPassword(int(os.Stdin.Fd()))
+		fmt.Println("")
+		if err != nil {
+			return "", err
+		}
+		passphrase = string(answer)
+	}
+	if _, err := ssh.ParseRawPrivateKeyWithPassphrase(pemBytes, []byte(passphrase)); err != nil {
+		return "", fmt.Errorf("wrong passphrase for %s", file)
+	}
+	keyPassphrases[file] = passphrase
+	return passphrase, nil
+}
+
+/*
+ * Whether a private key is protected by a passphrase
+ */
+func privateKeyEncrypted(file string) bool {
+	pemBytes, err := ioutil.ReadFile(file)
+	if err != nil {
+		return false
+	}
+	_, err = ssh.ParseRawPrivateKey(pemBytes)
+	var missing *ssh.PassphraseMissingError
+	return errors.As(err, &missing)
+}
+
+/*
+ * Read a private key, decrypting it when it is protected by a passphrase
+ */
+func readPrivateKey(file string) (interface{}, error) {
+	pemBytes, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	key, err := ssh.ParseRawPrivateKey(pemBytes)
+	var missing *ssh.PassphraseMissingError
+	if !errors.As(err, &missing) {
+		return key, err
+	}
+	passphrase, err := privateKeyPassphrase(file, pemBytes)
+	if err != nil {
+		return nil, err
+	}
+	return ssh.ParseRawPrivateKeyWithPassphrase(pemBytes, []byte(passphrase))
+}
+
+/*
+ * Set up a client's SSH config to log in with a private key, then to answer
+ * keyboard-interactive challenges. Replaces the crypto package's NewCryptoContext,
+ * which only reads encrypted keys in the old PEM format.
+ */
+func newKeyCryptoContext(client *crypto.SshClient, file string) error {
+	key, err := readPrivateKey(file)
+	if err != nil {
+		return fmt.Errorf("failed to read private key %s: %s", file, err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		return err
+	}
+	if client.HostKeyCallback == nil {
+		client.HostKeyCallback, err = knownhosts.New(client.KnownHostsFile)
+		if err != nil {
+			return err
+		}
+	}
+	if client.Port == 0 {
+		client.Port = 22
+	}
+	client.SshConfig = &ssh.ClientConfig{
+		User: client.Username,
+		Auth: []ssh.AuthMethod{
+			ssh.PublicKeys(signer),
+			// Hardened targets ask for a one-time password on top of the key
+			keyboardInteractive(""),
+		},
+		HostKeyCallback: client.HostKeyCallback,
+	}
+	return nil
+}
+
+/*
+ * Ask for a new passphrase twice, unless it is given in GUARDIAN_NEW_KEY_PASSPHRASE
+ */
+func newKeyPassphrase() (string, error) {
+	if passphrase, ok := os.LookupEnv("GUARDIAN_NEW_KEY_PASSPHRASE"); ok {
+		return passphrase, nil
+	}
+	if err := checkInteractive("a new passphrase"); err != nil {
+		return "", fmt.Errorf("%s; provide it in GUARDIAN_NEW_KEY_PASSPHRASE", err)
+	}
+	fmt.Print("Enter new passphrase (empty for none): ")
+	first, err := term.ReadPassword(int(os.Stdin.Fd()))
+	fmt.Println("")
+	if err != nil {
+		return "", err
+	}
+	fmt.Print("Enter the same passphrase again: ")
+	second, err := term.ReadPassword(int(os.Stdin.Fd()))
+	fmt.Println("")
+	if err != nil {
+		return "", err
+	}
+	if string(first) != string(second) {
+		return "", fmt.Errorf("the passphrases do not match")
+	}
+	return string(first), nil
+}
+
+/*
+ * Protect the CLI's private key with a passphrase, change it, or remove it with
+ * an empty one. Commands then ask for it, or read it from GUARDIAN_KEY_PASSPHRASE.
+ */
+func SetKeyPassphrase() int {
+
+	err := initSsh(4096)
+	if err != nil {
+		return -1
+	}
+
+	file := getPrivateKeyFilename()
+	key, err := readPrivateKey(file)
+	if err != nil {
+		log.Fatal("Failed to read private key: ", err)
+		return -1
+	}
+	rsaKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		log.Fatalf("%s is not an RSA key\n", file)
+		return -1
+	}
+
+	passphrase, err := newKeyPassphrase()
+	if err != nil {
+		log.Fatal("Failed to read passphrase: ", err)
+		return -1
+	}
+
+	// Unprotected keys stay in the PEM format they were generated in, so older versions can still read them
+	block := &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(rsaKey)}
+	if passphrase != "" {
+		block, err = marshalOpenSSHPrivateKey(rsaKey, passphrase)
+		if err != nil {
+			log.Fatal("Failed to encrypt private key: ", err)
+			return -1
+		}
+	}
+
+	// Replaced in one step, a key lost halfway would lock the CLI out of every target
+	f, err := createPrivateFile(file + ".tmp")
+	if err != nil {
+		log.Fatal("Failed to write private key: ", err)
+		return -1
+	}
+	_, err = f.Write(pem.EncodeToMemory(block))
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(file+".tmp", file)
+	}
+	if err != nil {
+		os.Remove(file + ".tmp")
+		log.Fatal("Failed to write private key: ", err)
+		return -1
+	}
+
+	if passphrase == "" {
+		log.Printf("Removed the passphrase from %s\n", file)
+	} else {
+		log.Printf("%s is now protected by a passphrase, commands ask for it or read it from %s\n", file, keyPassphraseEnv)
+	}
+	return 0
+}
@@ -0,0 +1,152 @@
+package utils
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// How long to wait for a rebooted host to accept SSH again
+const rebootTimeout = 10 * time.Minute
+
+// Count pending package updates with whichever package manager the host has
+const pendingUpdatesCommand = `if command -v apt-get >/dev/null; then sudo apt-get update -qq >/dev/null; apt-get -s upgrade | grep -c '^Inst' || true; ` +
+	`elif command -v dnf >/dev/null; then dnf -q check-update | grep -c '\.' || true; else echo unsupported; fi`
+
+const upgradePackagesCommand = `if command -v apt-get >/dev/null; then sudo DEBIAN_FRONTEND=noninteractive apt-get -y upgrade; else sudo dnf -y upgrade; fi`
+
+const rebootRequiredCommand = `if [ -f /var/run/reboot-required ]; then echo yes; ` +
+	`elif command -v needs-restarting >/dev/null && ! needs-restarting -r >/dev/null; then echo yes; else echo no; fi`
+
+/*
+ * Run commands needing sudo on a host, answering the password prompt
+ */
+func runSudoCommands(host Host, commands []string, password string) (string, error) {
+	return runHostCommandsWithPrompts(host, commands, map[string]string{
+		"[sudo] password for ": password,
+	}, true)
+}
+
+/*
+ * Wait for a rebooting host to come back
+ */
+func waitForHost(host Host) error {
+	// Give the host time to go down first
+	time.Sleep(30 * time.Second)
+	deadline := time.Now().Add(rebootTimeout)
+	for time.Now().Before(deadline) {
+		if probeHostPort(host) == nil {
+			return nil
+		}
+		time.Sleep(10 * time.Second)
+	}
+	return fmt.Errorf("host did not come back within %s", rebootTimeout)
+}
+
+/*
+ * Check that k3s and the filter stack are up after patching
+ */
+func checkPatchedHost(host Host) error {
+	_, err := runHostCommands(host, []string{
+		"export KUBECONFIG=/etc/rancher/k3s/k3s.yaml",
+		"kubectl wait --for=condition=Ready nodes --all --timeout=300s",
+		"kubectl wait --for=condition=Ready pods --all -n filter --timeout=300s",
+	}, false)
+	if err != nil {
+		return err
+	}
+	status := probeHostWithTimeout(host)
+	if status.Err != nil {
+		return status.Err
+	}
+	if status.K3s != "active" {
+		return fmt.Errorf("k3s is %s", status.K3s)
+	}
+	if status.Release != "deployed" && status.Release != "not deployed" {
+		return fmt.Errorf("filter release is %s", status.Release)
+	}
+	return nil
+}
+
+/*
+ * Update OS packages and k3s on a target, then check the filter came back
+ */
+func PatchHost(name string, rebootIfNeeded bool) int {
+
+	config, err := loadConfig()
+	if err != nil {
+		log.Fatal("Failed to load config: ", err)
+		return -1
+	}
+
+	_, host := FindHost(config, name)
+	if host.Name != name {
+		log.Fatalf("Host %s doesn't exist, create it first", name)
+		return -1
+	}
+
+	password, err := sudoPassword(host)
+	if err != nil {
+		log.Fatal("Failed to get password: ", err)
+		return -1
+	}
+
+	// Pre-check
+	out, err := runSudoCommands(host, []string{pendingUpdatesCommand}, password)
+	if err != nil {
+		log.Fatal("Failed to check for pending updates: ", err)
+		return -1
+	}
+	lines := strings.Split(strings.TrimSpace(out), "\n")
+	pending := strings.TrimSpace(lines[len(lines)-1])
+	if pending == "unsupported" {
+		log.Fatalln("Target has no supported package manager (apt or dnf)")
+		return -1
+	}
+	if count, err := strconv.Atoi(pending); err == nil {
+		log.Printf("%d package update(s) pending on '%s'\n", count, name)
+	}
+
+	log.Printf("Updating packages on '%s'...\n", name)
+	_, err = runSudoCommands(host, []string{upgradePackagesCommand}, password)
+	if err != nil {
+		log.Fatal("Failed to update packages: ", err)
+		return -1
+	}
+
+	// The setup playbook installs the k3s version it pins, upgrading it in place
+	log.Printf("Updating k3s on '%s'...\n", name)
+	err = runSetupPlaybook(host, password)
+	if err != nil {
+		log.Fatal("Failed to update k3s: ", err)
+		return -1
+	}
+
+	out, err = runHostCommands(host, []string{rebootRequiredCommand}, false)
+	if err == nil && strings.TrimSpace(out) == "yes" {
+		if rebootIfNeeded {
+			log.Printf("Rebooting '%s'...\n", name)
+			// The connection drops as the host goes down, so ignore the result
+			runSudoCommands(host, []string{"sudo systemctl reboot"}, password)
+			err = waitForHost(host)
+			if err != nil {
+				log.Fatal("Failed waiting for reboot: ", err)
+				return -1
+			}
+		} else {
+			log.Printf("A reboot is needed to finish patching '%s'; rerun with --reboot-if-needed\n", name)
+		}
+	}
+
+	// Post-check
+	err = checkPatchedHost(host)
+	if err != nil {
+		log.Fatal("Host patched, but the filter stack is not healthy: ", err)
+		return -1
+	}
+
+	log.Printf("Patched '%s', filter stack is healthy\n", name)
+	return 0
+}
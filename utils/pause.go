@@ -0,0 +1,97 @@
+package utils
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+)
+
+/*
+ * Re-run helm against the deployed release, overriding only the given values
+ */
+func setReleaseValues(host Host, values map[string]string) error {
+	var sets []string
+	for k, v := range values {
+		sets = append(sets, fmt.Sprintf("--set %s=%s", k, v))
+	}
+	sort.Strings(sets)
+	_, err := runHostCommands(host, []string{
+		fmt.Sprintf("cd %s", getRemoteHelmPath(host)),
+		"export KUBECONFIG=/etc/rancher/k3s/k3s.yaml",
+		fmt.Sprintf("helm upgrade --wait --reuse-values %s -n filter guardian-angel guardian-angel", strings.Join(sets, " ")),
+	}, true)
+	return err
+}
+
+/*
+ * Put the filter in pass-through mode, where the proxy stays up but allows
+ * everything without sending it through e2guardian. Scaling the filter to zero
+ * instead would leave clients pointed at the proxy without a network.
+ */
+func StopFilter(targetName string, dnsPassthrough bool) int {
+
+	config, err := loadConfig()
+	if err != nil {
+		log.Fatal("Failed to load config: ", err)
+		return -1
+	}
+
+	_, host := FindHost(config, targetName)
+	if host.Name != targetName {
+		log.Fatalf("Host %s doesn't exist, create it first", targetName)
+		return -1
+	}
+
+	values := map[string]string{"filterPassthrough": "true"}
+	if dnsPassthrough {
+		values["safeSearchEnforced"] = "false"
+	}
+
+	err = setReleaseValues(host, values)
+	if err != nil {
+		log.Fatal("Failed to stop filter: ", err)
+		return -1
+	}
+
+	fmt.Printf("Filtering stopped on '%s', traffic passes unfiltered. Use 'filter start' to resume.\n", targetName)
+	return 0
+}
+
+/*
+ * Leave pass-through mode. The replicas are restored too, for a release that was
+ * stopped by scaling it to zero.
+ */
+func StartFilter(targetName string) int {
+
+	config, err := loadConfig()
+	if err != nil {
+		log.Fatal("Failed to load config: ", err)
+		return -1
+	}
+
+	_, host := FindHost(config, targetName)
+	if host.Name != targetName {
+		log.Fatalf("Host %s doesn't exist, create it first", targetName)
+		return -1
+	}
+
+	filterConfig, err := getHostFilterConfig(targetName)
+	if err != nil {
+		log.Fatal("Failed to get host config: ", err)
+		return -1
+	}
+
+	err = setReleaseValues(host, map[string]string{
+		"filterPassthrough":  "false",
+		"filterReplicas":     fmt.Sprintf("%d", filterConfig.FilterReplicas),
+		"safeSearchEnforced": fmt.Sprintf("%t", filterConfig.SafeSearchEnforced),
+	})
+	if err != nil {
+		log.Fatal("Failed to start filter: ", err)
+		return -1
+	}
+
+	fmt.Printf("Filtering resumed on '%s'.\n", targetName)
+	return 0
+}
@@ -0,0 +1,122 @@
+package utils
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+/*
+ * One line of a text-only PDF
+ */
+type pdfLine struct {
+	Text string
+	Bold bool
+}
+
+// A4 in points, with Courier's fixed advance of 0.6em
+const (
+	pdfPageWidth  = 595
+	pdfPageHeight = 842
+	pdfMargin     = 50
+	pdfFontSize   = 8.5
+	pdfLeading    = 12
+	pdfLineChars  = 97 // (pdfPageWidth - 2*pdfMargin) / (pdfFontSize * 0.6)
+	pdfPageLines  = (pdfPageHeight - 2*pdfMargin) / pdfLeading
+)
+
+/*
+ * Escape text for a PDF string literal. The standard fonts are WinAnsi encoded, which
+ * matches Latin-1 from 160 up, so anything else outside ASCII is replaced.
+ */
+func pdfEscape(text string) string {
+	var b strings.Builder
+	for _, r := range text {
+		switch {
+		case r == '\\' || r == '(' || r == ')':
+			b.WriteRune('\\')
+			b.WriteRune(r)
+		case r >= 160 && r <= 255:
+			b.WriteByte(byte(r))
+		case r < 32 || r > 126:
+			b.WriteRune('?')
+		default:
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+/*
+ * Break lines longer than the page is wide, indenting the continuations
+ */
+func wrapPdfLines(lines []pdfLine) []pdfLine {
+	var wrapped []pdfLine
+	for _, line := range lines {
+		text := []rune(line.Text)
+		for len(text) > pdfLineChars {
+			wrapped = append(wrapped, pdfLine{Text: string(text[:pdfLineChars]), Bold: line.Bold})
+			text = append([]rune("    "), text[pdfLineChars:]...)
+		}
+		wrapped = append(wrapped, pdfLine{Text: string(text), Bold: line.Bold})
+	}
+	return wrapped
+}
+
+/*
+ * Render lines of text as a PDF document of as many A4 pages as they need
+ */
+func renderPdf(lines []pdfLine) []byte {
+	lines = wrapPdfLines(lines)
+	var pages [][]pdfLine
+	for len(lines) > pdfPageLines {
+		pages = append(pages, lines[:pdfPageLines])
+		lines = lines[pdfPageLines:]
+	}
+	pages = append(pages, lines)
+
+	// Objects 1-4 are the catalog, page tree and fonts, then a page and its content per page
+	var objects []string
+	var kids []string
+	for i := range pages {
+		kids = append(kids, fmt.Sprintf("%d 0 R", 5+2*i))
+	}
+	objects = append(objects,
+		"<< /Type /Catalog /Pages 2 0 R >>",
+		fmt.Sprintf("<< /Type /Pages /Kids [%s] /Count %d >>", strings.Join(kids, " "), len(pages)),
+		"<< /Type /Font /Subtype /Type1 /BaseFont /Courier /Encoding /WinAnsiEncoding >>",
+		"<< /Type /Font /Subtype /Type1 /BaseFont /Courier-Bold /Encoding /WinAnsiEncoding >>",
+	)
+	for i, page := range pages {
+		var content bytes.Buffer
+		fmt.Fprintf(&content, "BT\n%d TL\n%d %d Td\n", pdfLeading, pdfMargin, pdfPageHeight-pdfMargin)
+		for _, line := range page {
+			font := "F1"
+			if line.Bold {
+				font = "F2"
+			}
+			fmt.Fprintf(&content, "/%s %g Tf\n(%s) Tj T*\n", font, pdfFontSize, pdfEscape(line.Text))
+		}
+		fmt.Fprintf(&content, "/F1 %g Tf\n(Page %d of %d) Tj\nET\n", pdfFontSize, i+1, len(pages))
+		objects = append(objects,
+			fmt.Sprintf("<< /Type /Page /Parent 2 0 R /MediaBox [0 0 %d %d] /Resources << /Font << /F1 3 0 R /F2 4 0 R >> >> /Contents %d 0 R >>",
+				pdfPageWidth, pdfPageHeight, 6+2*i),
+			fmt.Sprintf("<< /Length %d >>\nstream\n%sendstream", content.Len(), content.String()),
+		)
+	}
+
+	var out bytes.Buffer
+	out.WriteString("%PDF-1.4\n")
+	offsets := make([]int, len(objects))
+	for i, object := range objects {
+		offsets[i] = out.Len()
+		fmt.Fprintf(&out, "%d 0 obj\n%s\nendobj\n", i+1, object)
+	}
+	xref := out.Len()
+	fmt.Fprintf(&out, "xref\n0 %d\n0000000000 65535 f \n", len(objects)+1)
+	for _, offset := range offsets {
+		fmt.Fprintf(&out, "%010d 00000 n \n", offset)
+	}
+	fmt.Fprintf(&out, "trailer\n<< /Size %d /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(objects)+1, xref)
+	return out.Bytes()
+}
@@ -0,0 +1,64 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+/*
+ * Target platforms setup can provision. The playbooks need bash, sudo,
+ * systemd and a Linux home path layout, so only Linux targets are supported:
+ *
+ *   Linux          supported
+ *   Windows Server unsupported, run k3s in a Linux VM or WSL2 distro and target that instead
+ *   macOS          unsupported, run k3s in a Linux VM and target that instead
+ */
+var setupPlatforms = map[string]bool{
+	"linux":   true,
+	"windows": false,
+	"darwin":  false,
+}
+
+var errUnknownPlatform = errors.New("could not determine the target's operating system")
+
+/*
+ * Determine the operating system of a target host
+ */
+func detectPlatform(host Host) (string, error) {
+	out, err := runHostCommands(host, []string{"uname -s"}, false)
+	if err == nil {
+		switch strings.ToLower(strings.TrimSpace(out)) {
+		case "linux":
+			return "linux", nil
+		case "darwin":
+			return "darwin", nil
+		}
+		// uname under cygwin/msys reports i.e. MINGW64_NT-10.0
+		if strings.Contains(strings.ToUpper(out), "_NT-") {
+			return "windows", nil
+		}
+	}
+
+	// Windows OpenSSH defaults to cmd.exe or PowerShell, neither has uname
+	out, err = runHostCommands(host, []string{"ver"}, false)
+	if err == nil && strings.Contains(out, "Windows") {
+		return "windows", nil
+	}
+	return "", errUnknownPlatform
+}
+
+/*
+ * Fail early if setup can't provision the target's platform
+ */
+func checkSetupPlatform(host Host) error {
+	platform, err := detectPlatform(host)
+	if err != nil {
+		return err
+	}
+	if !setupPlatforms[platform] {
+		return fmt.Errorf("%s targets are not supported by setup, which needs bash, sudo and systemd; "+
+			"install k3s in a Linux VM or WSL2 distro and add that as the target", platform)
+	}
+	return nil
+}
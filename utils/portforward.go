@@ -0,0 +1,179 @@
+package utils
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"regexp"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Short names for the services admins usually need to reach
+var portForwardServices = map[string]string{
+	"web":      "guardian-nginx",
+	"grafana":  "grafana",
+	"postgres": "guardian-db",
+}
+
+var forwardingPattern = regexp.MustCompile(`Forwarding from 127\.0\.0\.1:(\d+) ->`)
+
+/*
+ * Look up the first port a service in the filter namespace listens on
+ */
+func getServicePort(host Host, service string) (int, error) {
+	out, err := runHostCommands(host, []string{
+		"export KUBECONFIG=/etc/rancher/k3s/k3s.yaml",
+		fmt.Sprintf("kubectl get svc -n filter %s -o jsonpath='{.spec.ports[0].port}'", service),
+	}, false)
+	if err != nil {
+		return 0, fmt.Errorf("service '%s' not found: %s", service, err)
+	}
+	return strconv.Atoi(strings.TrimSpace(out))
+}
+
+/*
+ * Start kubectl port-forward on the target, bound to its loopback only,
+ * and return the port it picked once it is ready
+ */
+func startRemotePortForward(conn *ssh.Client, service string, servicePort int) (*ssh.Session, int, error) {
+	session, err := conn.NewSession()
+	if err != nil {
+		return nil, 0, err
+	}
+	// A pty makes kubectl exit with the session
+	err = session.RequestPty("xterm", 80, 40, ssh.TerminalModes{})
+	if err != nil {
+		session.Close()
+		return nil, 0, err
+	}
+	stdout, err := session.StdoutPipe()
+	if err != nil {
+		session.Close()
+		return nil, 0, err
+	}
+	err = session.Start(fmt.Sprintf("export KUBECONFIG=/etc/rancher/k3s/k3s.yaml; kubectl port-forward -n filter --address 127.0.0.1 svc/%s :%d",
+		service, servicePort))
+	if err != nil {
+		session.Close()
+		return nil, 0, err
+	}
+
+	scanner := bufio.NewScanner(stdout)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if match := forwardingPattern.FindStringSubmatch(line); match != nil {
+			port, _ := strconv.Atoi(match[1])
+			// Keep draining output so kubectl never blocks on a full pipe
+			go io.Copy(io.Discard, stdout)
+			return session, port, nil
+		}
+		if line != "" && !strings.HasPrefix(line, "Forwarding from") {
+			session.Close()
+			return nil, 0, fmt.Errorf("kubectl port-forward failed: %s", line)
+		}
+	}
+	session.Close()
+	return nil, 0, fmt.Errorf("kubectl port-forward exited before it was ready")
+}
+
+/*
+ * Pipe one local connection through the SSH connection to the forwarded port
+ */
+func tunnelConnection(conn *ssh.Client, local net.Conn, remotePort int) {
+	defer local.Close()
+	remote, err := conn.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", remotePort))
+	if err != nil {
+		log.Printf("Failed to open tunnel: %s\n", err)
+		return
+	}
+	defer remote.Close()
+
+	done := make(chan struct{}, 2)
+	go func() {
+		io.Copy(remote, local)
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(local, remote)
+		done <- struct{}{}
+	}()
+	<-done
+}
+
+/*
+ * Reach a service of the filter from this machine through an SSH tunnel,
+ * without exposing it on the LAN. Runs until interrupted.
+ */
+func PortForward(name string, service string, localPort uint16, remotePort int) int {
+
+	config, err := loadConfig()
+	if err != nil {
+		log.Fatal("Failed to load config: ", err)
+		return -1
+	}
+
+	_, host := FindHost(config, name)
+	if host.Name != name {
+		log.Fatalf("Host %s doesn't exist, create it first", name)
+		return -1
+	}
+
+	if alias, ok := portForwardServices[service]; ok {
+		service = alias
+	}
+	if remotePort == 0 {
+		remotePort, err = getServicePort(host, service)
+		if err != nil {
+			log.Fatal("Failed to get service port: ", err)
+			return -1
+		}
+	}
+
+	conn, err := dialHost(interruptContext, host)
+	if err != nil {
+		log.Fatal("Failed to connect to target: ", err)
+		return -1
+	}
+	defer conn.Close()
+
+	session, forwardedPort, err := startRemotePortForward(conn, service, remotePort)
+	if err != nil {
+		log.Fatal("Failed to forward service: ", err)
+		return -1
+	}
+	defer session.Close()
+
+	listener, err := net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", localPort))
+	if err != nil {
+		session.Close()
+		log.Fatal("Failed to listen locally: ", err)
+		return -1
+	}
+
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-interrupt
+		listener.Close()
+	}()
+
+	log.Printf("Forwarding 127.0.0.1:%d to %s:%d on '%s', press Ctrl-C to stop\n", localPort, service, remotePort, name)
+	for {
+		local, err := listener.Accept()
+		if err != nil {
+			break
+		}
+		go tunnelConnection(conn, local, forwardedPort)
+	}
+
+	log.Println("Stopped port forwarding")
+	return 0
+}
@@ -0,0 +1,216 @@
+package utils
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Below this much free space on the home path, the images and volumes of the stack may not fit
+const preflightMinFreeDisk = 10 << 30
+
+// Ports k3s listens on: the API server, the kubelet and flannel's VXLAN
+var k3sPorts = []struct {
+	Proto string
+	Port  int
+}{{"tcp", 6443}, {"tcp", 10250}, {"udp", 8472}}
+
+// Machine names k3s publishes binaries for
+var k3sArchitectures = []string{"x86_64", "amd64", "aarch64", "arm64", "armv7l"}
+
+/*
+ * Connect to the host's SSH port and read the server's banner
+ */
+func preflightSsh(host Host) []doctorFinding {
+	reachable := doctorFinding{Check: "Reachable"}
+	banner := doctorFinding{Check: "SSH banner"}
+
+	ctx, cancel := context.WithTimeout(interruptContext, targetProbeTimeout)
+	defer cancel()
+	start := time.Now()
+	conn, err := dialSshPort(ctx, host, nil)
+	if err != nil {
+		reachable.Status = "fail"
+		reachable.Detail = err.Error()
+		reachable.Hint = "Check the address and port, and that no firewall drops the connection"
+		banner.Status = "skipped"
+		banner.Detail = "not connected"
+		return []doctorFinding{reachable, banner}
+	}
+	defer conn.Close()
+	reachable.Status = "ok"
+	reachable.Detail = fmt.Sprintf("%s:%d in %dms", host.Address, host.Port, time.Since(start).Milliseconds())
+
+	conn.SetReadDeadline(time.Now().Add(targetProbeTimeout))
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	line = strings.TrimSpace(line)
+	switch {
+	case err != nil && line == "":
+		banner.Status = "fail"
+		banner.Detail = fmt.Sprintf("no banner: %s", err)
+		banner.Hint = "Something other than an SSH server may be listening on the port"
+	case !strings.HasPrefix(line, "SSH-2.0-") && !strings.HasPrefix(line, "SSH-1.99-"):
+		banner.Status = "fail"
+		banner.Detail = fmt.Sprintf("unexpected banner '%s'", line)
+		banner.Hint = "Something other than an SSH server may be listening on the port"
+	default:
+		banner.Status = "ok"
+		banner.Detail = line
+	}
+	return []doctorFinding{reachable, banner}
+}
+
+func preflightCheckPlatform(out string) doctorFinding {
+	finding := doctorFinding{Check: "OS/arch"}
+	lines := strings.Split(strings.TrimSpace(out), "\n")
+	if len(lines) < 2 {
+		finding.Status = "fail"
+		finding.Detail = "uname failed"
+		finding.Hint = "Setup needs a Linux target with a POSIX shell"
+		return finding
+	}
+	platform := strings.ToLower(strings.TrimSpace(lines[0]))
+	arch := strings.TrimSpace(lines[1])
+	finding.Detail = fmt.Sprintf("%s %s", strings.TrimSpace(lines[0]), arch)
+	if len(lines) > 2 && strings.TrimSpace(lines[2]) != "" {
+		finding.Detail += ", " + strings.TrimSpace(lines[2])
+	}
+	if !setupPlatforms[platform] {
+		finding.Status = "fail"
+		finding.Hint = "Setup only provisions Linux, install k3s in a Linux VM or WSL2 distro and add that as the target"
+		return finding
+	}
+	if !contains(k3sArchitectures, arch) {
+		finding.Status = "warn"
+		finding.Hint = fmt.Sprintf("k3s publishes no binaries for %s", arch)
+		return finding
+	}
+	finding.Status = "ok"
+	return finding
+}
+
+func preflightCheckSudo(out string) doctorFinding {
+	finding := doctorFinding{Check: "Sudo"}
+	lines := strings.Split(strings.TrimSpace(out), "\n")
+	if len(lines) > 0 && strings.TrimSpace(lines[0]) == "0" {
+		finding.Status = "ok"
+		finding.Detail = "logged in as root"
+		return finding
+	}
+	// The uid, then the markers echoed, then the groups
+	present, nopasswd := false, false
+	for _, line := range lines {
+		present = present || strings.TrimSpace(line) == "present"
+		nopasswd = nopasswd || strings.TrimSpace(line) == "nopasswd"
+	}
+	groups := lines[len(lines)-1]
+	admin := false
+	for _, group := range strings.Fields(groups) {
+		admin = admin || group == "sudo" || group == "wheel" || group == "admin"
+	}
+	switch {
+	case !present:
+		finding.Status = "fail"
+		finding.Detail = "sudo is not installed"
+		finding.Hint = "Install sudo and give the user administrator rights, setup runs as root through it"
+	case nopasswd:
+		finding.Status = "ok"
+		finding.Detail = "available without a password"
+	case admin:
+		finding.Status = "ok"
+		finding.Detail = "available with a password, setup asks for it"
+	default:
+		finding.Status = "warn"
+		finding.Detail = fmt.Sprintf("user is not in the sudo, wheel or admin group (%s)", strings.TrimSpace(groups))
+		finding.Hint = "Setup fails unless sudoers allows the user otherwise"
+	}
+	return finding
+}
+
+func preflightCheckDisk(out string, homePath string) doctorFinding {
+	finding := doctorFinding{Check: "Free disk"}
+	free, err := strconv.ParseInt(strings.TrimSpace(out), 10, 64)
+	if err != nil {
+		finding.Status = "warn"
+		finding.Detail = fmt.Sprintf("could not read the free space of %s", homePath)
+		finding.Hint = "Check the home path exists, or give the right one with --home-path"
+		return finding
+	}
+	finding.Detail = fmt.Sprintf("%s free on %s", humanBytes(free), homePath)
+	if free < preflightMinFreeDisk {
+		finding.Status = "warn"
+		finding.Hint = fmt.Sprintf("The stack's images and volumes need about %s", humanBytes(preflightMinFreeDisk))
+		return finding
+	}
+	finding.Status = "ok"
+	return finding
+}
+
+func preflightCheckPorts(out string) doctorFinding {
+	finding := doctorFinding{Check: "k3s ports"}
+	installed := strings.HasPrefix(strings.TrimSpace(out), "installed")
+	var used []string
+	for _, k3sPort := range k3sPorts {
+		suffix := fmt.Sprintf(":%d", k3sPort.Port)
+		for _, line := range strings.Split(out, "\n") {
+			fields := strings.Fields(line)
+			if len(fields) < 4 || !strings.HasPrefix(fields[0], k3sPort.Proto) {
+				continue
+			}
+			// ss has the local address fifth, netstat fourth
+			if strings.HasSuffix(fields[3], suffix) || (len(fields) > 4 && strings.HasSuffix(fields[4], suffix)) {
+				used = append(used, fmt.Sprintf("%d/%s", k3sPort.Port, k3sPort.Proto))
+				break
+			}
+		}
+	}
+	switch {
+	case len(used) == 0:
+		finding.Status = "ok"
+		finding.Detail = "free"
+	case installed:
+		finding.Status = "ok"
+		finding.Detail = fmt.Sprintf("%s in use by the k3s already installed", strings.Join(used, ", "))
+	default:
+		finding.Status = "warn"
+		finding.Detail = fmt.Sprintf("%s already in use", strings.Join(used, ", "))
+		finding.Hint = "Another service holds ports k3s needs, setup's k3s install will fail until it is stopped"
+	}
+	return finding
+}
+
+/*
+ * Check a host that passed preflightSsh is fit to become a target: a Linux k3s
+ * supports, sudo for setup, room on the home path and the k3s ports free. Needs a
+ * working login.
+ */
+func preflightRemote(host Host) []doctorFinding {
+	var findings []doctorFinding
+	out, err := runHostCommands(host, []string{
+		"uname -s; uname -m; (. /etc/os-release 2>/dev/null && echo \"$PRETTY_NAME\"); true",
+		"echo ---",
+		"id -u; command -v sudo >/dev/null && echo present; sudo -n true 2>/dev/null && echo nopasswd; id -nG",
+		"echo ---",
+		fmt.Sprintf("df -B1 --output=avail %s 2>/dev/null | tail -1", shellQuote(host.HomePath)),
+		"echo ---",
+		"command -v k3s >/dev/null && echo installed; ss -Hltun 2>/dev/null || netstat -ltun 2>/dev/null; true",
+	}, false)
+	if err != nil {
+		return append(findings, doctorFinding{Check: "Remote checks", Status: "fail", Detail: err.Error(),
+			Hint: "Logging in worked, but the checks could not run; the target may not have a POSIX shell"})
+	}
+	sections := strings.SplitN(strings.ReplaceAll(out, "\r", ""), "---\n", 4)
+	if len(sections) != 4 {
+		return append(findings, doctorFinding{Check: "Remote checks", Status: "fail", Detail: "unexpected output from target",
+			Hint: "The target may not have a POSIX shell"})
+	}
+	return append(findings,
+		preflightCheckPlatform(sections[0]),
+		preflightCheckSudo(sections[1]),
+		preflightCheckDisk(sections[2], host.HomePath),
+		preflightCheckPorts(sections[3]),
+	)
+}
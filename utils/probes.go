@@ -0,0 +1,254 @@
+package utils
+
+import (
+	"fmt"
+	"log"
+	"net/url"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// Label of the jobs of the probes CronJob installed by the chart
+const probesJobLabel = "app=guardian-probes"
+
+const defaultProbesInterval = 5 * time.Minute
+
+/*
+ * Canary requests the chart makes through the filter on Schedule, to catch
+ * filtering that silently stopped working. Allowed URLs must load and Blocked
+ * URLs must be denied; each run logs one '<ok|fail> <allowed|blocked> <url> <detail>'
+ * line per URL, and failures raise probe-failed alerts.
+ */
+type ProbesConfig struct {
+	Enabled  bool     `yaml:"enabled"`
+	Schedule string   `yaml:"schedule,omitempty"`
+	Allowed  []string `yaml:"allowed,omitempty"`
+	Blocked  []string `yaml:"blocked,omitempty"`
+}
+
+/*
+ * Result of one URL in the latest probe run
+ */
+type probeResult struct {
+	Ok     bool
+	Expect string
+	Url    string
+	Detail string
+}
+
+/*
+ * The cron schedule for probing every interval, which must divide an hour or a day
+ */
+func probesSchedule(interval time.Duration) (string, error) {
+	switch {
+	case interval >= time.Minute && interval < time.Hour && interval%time.Minute == 0 && 60%int(interval.Minutes()) == 0:
+		return fmt.Sprintf("*/%d * * * *", int(interval.Minutes())), nil
+	case interval >= time.Hour && interval <= 24*time.Hour && interval%time.Hour == 0 && 24%int(interval.Hours()) == 0:
+		return fmt.Sprintf("0 */%d * * *", int(interval.Hours())), nil
+	}
+	return "", fmt.Errorf("invalid interval %s, use whole minutes that divide an hour or whole hours that divide a day", interval)
+}
+
+func validateProbeUrl(rawUrl string) error {
+	u, err := url.Parse(rawUrl)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("invalid probe url '%s', expected an http or https url", rawUrl)
+	}
+	return nil
+}
+
+/*
+ * Commands printing when the latest probe run started, then its log
+ */
+func probeResultsCommand() string {
+	return fmt.Sprintf("job=$(kubectl -n filter get jobs -l %s --sort-by=.metadata.creationTimestamp -o name 2>/dev/null | tail -1); if [ -n \"$job\" ]; then kubectl -n filter get $job -o jsonpath='{.status.startTime}{\"\\n\"}'; kubectl -n filter logs $job 2>/dev/null; fi; true", probesJobLabel)
+}
+
+/*
+ * Parse the output of probeResultsCommand, a zero time if the probes never ran
+ */
+func parseProbeResults(out string) (time.Time, []probeResult) {
+	lines := strings.Split(strings.TrimSpace(strings.ReplaceAll(out, "\r", "")), "\n")
+	started, err := time.Parse(time.RFC3339, strings.TrimSpace(lines[0]))
+	if err != nil {
+		return time.Time{}, nil
+	}
+	var results []probeResult
+	for _, line := range lines[1:] {
+		fields := strings.SplitN(strings.TrimSpace(line), " ", 4)
+		if len(fields) < 3 || (fields[0] != "ok" && fields[0] != "fail") {
+			continue
+		}
+		result := probeResult{Ok: fields[0] == "ok", Expect: fields[1], Url: fields[2]}
+		if len(fields) == 4 {
+			result.Detail = fields[3]
+		}
+		results = append(results, result)
+	}
+	return started, results
+}
+
+/*
+ * Status finding of the latest probe run
+ */
+func statusCheckProbes(out string) doctorFinding {
+	finding := doctorFinding{Check: "Canary probes"}
+	started, results := parseProbeResults(out)
+	if started.IsZero() {
+		finding.Status = "warn"
+		finding.Detail = "no probe run yet"
+		finding.Hint = "Probes run once deployed, check again after the first interval"
+		return finding
+	}
+	var failed []string
+	for _, result := range results {
+		if !result.Ok {
+			failed = append(failed, fmt.Sprintf("%s should be %s", result.Url, result.Expect))
+		}
+	}
+	if len(failed) > 0 {
+		finding.Status = "fail"
+		finding.Detail = strings.Join(failed, "; ")
+		finding.Hint = "See 'filter probes status' for details"
+		return finding
+	}
+	finding.Status = "ok"
+	finding.Detail = fmt.Sprintf("%d url(s) passed at %s", len(results), started.Local().Format("15:04"))
+	return finding
+}
+
+/*
+ * Set the URLs probed from the cluster, replacing the current ones
+ */
+func SetProbes(targetName string, allowed []string, blocked []string, every string) int {
+
+	config, err := getHostFilterConfig(targetName)
+	if err != nil {
+		log.Fatal("Failed to get host config: ", err)
+		return -1
+	}
+
+	if len(allowed) == 0 && len(blocked) == 0 {
+		log.Fatalln("Give at least one --allowed or --blocked url")
+		return -1
+	}
+	for _, rawUrl := range append(append([]string{}, allowed...), blocked...) {
+		if err := validateProbeUrl(rawUrl); err != nil {
+			log.Fatal(err)
+			return -1
+		}
+	}
+
+	interval := defaultProbesInterval
+	if every != "" {
+		interval, err = time.ParseDuration(every)
+		if err != nil {
+			log.Fatalf("Invalid interval '%s'\n", every)
+			return -1
+		}
+	}
+	schedule, err := probesSchedule(interval)
+	if err != nil {
+		log.Fatal(err)
+		return -1
+	}
+
+	config.Probes = ProbesConfig{Enabled: true, Schedule: schedule, Allowed: allowed, Blocked: blocked}
+	err = writeHostFilterConfig(targetName, config)
+	if err != nil {
+		log.Fatal("Failed to write host config: ", err)
+		return -1
+	}
+
+	log.Printf("Probing %d allowed and %d blocked url(s) every %s; deploy to apply\n", len(allowed), len(blocked), interval)
+	return 0
+}
+
+/*
+ * Stop probing
+ */
+func ClearProbes(targetName string) int {
+
+	config, err := getHostFilterConfig(targetName)
+	if err != nil {
+		log.Fatal("Failed to get host config: ", err)
+		return -1
+	}
+
+	config.Probes = ProbesConfig{}
+	err = writeHostFilterConfig(targetName, config)
+	if err != nil {
+		log.Fatal("Failed to write host config: ", err)
+		return -1
+	}
+
+	log.Println("Removed canary probes; deploy to apply")
+	return 0
+}
+
+/*
+ * Show the probed URLs and how each did in the latest run
+ */
+func ShowProbes(targetName string) int {
+
+	config, err := loadConfig()
+	if err != nil {
+		log.Fatal("Failed to load config: ", err)
+		return -1
+	}
+
+	_, host := FindHost(config, targetName)
+	if host.Name != targetName {
+		log.Fatalf("Host %s doesn't exist, create it first", targetName)
+		return -1
+	}
+
+	filterConfig, err := getHostFilterConfig(targetName)
+	if err != nil {
+		log.Fatal("Failed to get host config: ", err)
+		return -1
+	}
+	if !filterConfig.Probes.Enabled {
+		log.Fatalln("No canary probes are set, add them with 'filter probes set'")
+		return -1
+	}
+
+	out, err := runHostCommands(host, []string{
+		"export KUBECONFIG=/etc/rancher/k3s/k3s.yaml",
+		probeResultsCommand(),
+	}, false)
+	if err != nil {
+		log.Fatal("Failed to get probe results: ", err)
+		return -1
+	}
+	started, results := parseProbeResults(out)
+	latest := map[string]probeResult{}
+	for _, result := range results {
+		latest[result.Expect+" "+result.Url] = result
+	}
+
+	if started.IsZero() {
+		fmt.Fprintf(showOutput(), "Schedule %s, no run yet\n", filterConfig.Probes.Schedule)
+	} else {
+		fmt.Fprintf(showOutput(), "Schedule %s, last run %s\n", filterConfig.Probes.Schedule, started.Local().Format("2006-01-02 15:04:05"))
+	}
+	w := tabwriter.NewWriter(showOutput(), 1, 1, 3, ' ', 0)
+	fmt.Fprintln(w, "Expect\tUrl\tResult\tDetail")
+	show := func(expect string, urls []string) {
+		for _, rawUrl := range urls {
+			result, ok := latest[expect+" "+rawUrl]
+			status := "-"
+			if ok && result.Ok {
+				status = "ok"
+			} else if ok {
+				status = "FAIL"
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", expect, rawUrl, status, result.Detail)
+		}
+	}
+	show("allowed", filterConfig.Probes.Allowed)
+	show("blocked", filterConfig.Probes.Blocked)
+	w.Flush()
+	return 0
+}
@@ -0,0 +1,191 @@
+package utils
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"text/tabwriter"
+)
+
+/*
+ * Memory and CPU limits of a service's pods, in Kubernetes quantities
+ */
+type ResourceLimits struct {
+	Memory string `yaml:"memory,omitempty"`
+	Cpu    string `yaml:"cpu,omitempty"`
+}
+
+type ComponentResources struct {
+	Filter ResourceLimits `yaml:"filter,omitempty"`
+	Lookup ResourceLimits `yaml:"lookup,omitempty"`
+	Nginx  ResourceLimits `yaml:"nginx,omitempty"`
+}
+
+/*
+ * Sizing of a whole deployment for a class of hardware
+ */
+type deploymentProfile struct {
+	Description string
+	// By the setting holding them, i.e. filterReplicas
+	Replicas  map[string]int
+	Resources ComponentResources
+	Db        DbTuning
+	Redis     RedisTuning
+	// Domains the lookup service caches
+	MaxKeys int
+	// Off for boards where every pod counts, i.e. e2guardian statistics and search terms
+	Heavyweight bool
+}
+
+var deploymentProfiles = map[string]deploymentProfile{
+	"low-memory": {
+		Description: "single-board computers such as a Raspberry Pi with 1-2GB of RAM",
+		Replicas: map[string]int{"guardianReplicas": 1, "filterReplicas": 1, "reverseDnsReplicas": 1,
+			"nginxReplicas": 1, "redisReplicas": 1, "guardianDbReplicas": 1},
+		Resources: ComponentResources{
+			Filter: ResourceLimits{Memory: "384Mi", Cpu: "1"},
+			Lookup: ResourceLimits{Memory: "128Mi", Cpu: "500m"},
+			Nginx:  ResourceLimits{Memory: "64Mi", Cpu: "250m"},
+		},
+		Db:      DbTuning{MaxConnections: 20, PoolSize: 5, SharedBuffers: "64Mi", MemoryLimit: "256Mi"},
+		Redis:   RedisTuning{MaxMemory: "64Mi", EvictionPolicy: "allkeys-lru", Persistence: "none", MemoryLimit: "128Mi"},
+		MaxKeys: 5000,
+	},
+	"high-throughput": {
+		Description: "servers with 8GB of RAM or more filtering a large network",
+		Replicas: map[string]int{"guardianReplicas": 2, "filterReplicas": 3, "reverseDnsReplicas": 2,
+			"nginxReplicas": 2, "redisReplicas": 1, "guardianDbReplicas": 1},
+		Resources: ComponentResources{
+			Filter: ResourceLimits{Memory: "2Gi", Cpu: "2"},
+			Lookup: ResourceLimits{Memory: "512Mi", Cpu: "1"},
+			Nginx:  ResourceLimits{Memory: "256Mi", Cpu: "500m"},
+		},
+		Db:          DbTuning{MaxConnections: 200, PoolSize: 40, SharedBuffers: "1Gi", MemoryLimit: "3Gi"},
+		Redis:       RedisTuning{MaxMemory: "1Gi", EvictionPolicy: "allkeys-lfu", Persistence: "rdb", MemoryLimit: "1536Mi"},
+		MaxKeys:     200000,
+		Heavyweight: true,
+	},
+}
+
+var DeploymentProfiles = []string{"low-memory", "high-throughput"}
+
+// Replica settings in the order they are shown
+var replicaSettings = []string{"guardianReplicas", "filterReplicas", "reverseDnsReplicas", "nginxReplicas", "redisReplicas", "guardianDbReplicas"}
+
+// Replicas 'filter ha enable' sizes to the nodes it spreads them over
+var haReplicaSettings = []string{"filterReplicas", "reverseDnsReplicas", "nginxReplicas"}
+
+/*
+ * Settings a profile changes, as (setting, before, after) rows
+ */
+type profileChanges [][3]string
+
+func (changes *profileChanges) add(setting string, before interface{}, after interface{}) {
+	b, a := fmt.Sprint(before), fmt.Sprint(after)
+	if b != a {
+		*changes = append(*changes, [3]string{setting, b, a})
+	}
+}
+
+/*
+ * Size a target's deployment for its hardware: replicas, resource limits, cache
+ * sizes, and for low-memory boards, switching off components they can't spare
+ */
+func ApplyProfile(targetName string, name string, dryRun bool) int {
+
+	profile, ok := deploymentProfiles[name]
+	if !ok {
+		log.Fatalf("Invalid profile '%s', valid options are %s\n", name, strings.Join(DeploymentProfiles, ", "))
+		return -1
+	}
+
+	config, err := getHostFilterConfig(targetName)
+	if err != nil {
+		log.Fatal("Failed to get host config: ", err)
+		return -1
+	}
+
+	// Checks the limits fit in the target's memory, refusing high-throughput on small boxes
+	err = validateTuning(targetName, profile.Db, profile.Redis)
+	if err != nil {
+		log.Fatalf("The %s profile doesn't fit %s: %s\n", name, targetName, err)
+		return -1
+	}
+
+	var changes profileChanges
+	replicas := map[string]*int{
+		"guardianReplicas":   &config.GuardianReplicas,
+		"filterReplicas":     &config.FilterReplicas,
+		"reverseDnsReplicas": &config.ReverseDnsReplicas,
+		"nginxReplicas":      &config.NginxReplicas,
+		"redisReplicas":      &config.RedisReplicas,
+		"guardianDbReplicas": &config.GuardianDbReplicas,
+	}
+	keepHa := profile.Heavyweight && config.HighAvailability.Enabled
+	for _, setting := range replicaSettings {
+		if keepHa && contains(haReplicaSettings, setting) {
+			continue
+		}
+		changes.add(setting, *replicas[setting], profile.Replicas[setting])
+		*replicas[setting] = profile.Replicas[setting]
+	}
+	for _, component := range []struct {
+		Name    string
+		Current *ResourceLimits
+		Profile ResourceLimits
+	}{
+		{"filter", &config.Resources.Filter, profile.Resources.Filter},
+		{"lookup", &config.Resources.Lookup, profile.Resources.Lookup},
+		{"nginx", &config.Resources.Nginx, profile.Resources.Nginx},
+	} {
+		changes.add(fmt.Sprintf("resources.%s.memory", component.Name), component.Current.Memory, component.Profile.Memory)
+		changes.add(fmt.Sprintf("resources.%s.cpu", component.Name), component.Current.Cpu, component.Profile.Cpu)
+		*component.Current = component.Profile
+	}
+	changes.add("dbTuning.maxConnections", config.DbTuning.MaxConnections, profile.Db.MaxConnections)
+	changes.add("dbTuning.poolSize", config.DbTuning.PoolSize, profile.Db.PoolSize)
+	changes.add("dbTuning.sharedBuffers", config.DbTuning.SharedBuffers, profile.Db.SharedBuffers)
+	changes.add("dbTuning.memoryLimit", config.DbTuning.MemoryLimit, profile.Db.MemoryLimit)
+	config.DbTuning = profile.Db
+	changes.add("redisTuning.maxMemory", config.RedisTuning.MaxMemory, profile.Redis.MaxMemory)
+	changes.add("redisTuning.evictionPolicy", config.RedisTuning.EvictionPolicy, profile.Redis.EvictionPolicy)
+	changes.add("redisTuning.persistence", config.RedisTuning.Persistence, profile.Redis.Persistence)
+	changes.add("redisTuning.memoryLimit", config.RedisTuning.MemoryLimit, profile.Redis.MemoryLimit)
+	config.RedisTuning = profile.Redis
+	changes.add("maxKeys", config.MaxKeys, profile.MaxKeys)
+	config.MaxKeys = profile.MaxKeys
+
+	if !profile.Heavyweight {
+		// Replicas are down to one, spreading them is moot
+		changes.add("highAvailability.enabled", config.HighAvailability.Enabled, false)
+		config.HighAvailability = HighAvailabilityConfig{}
+		changes.add("e2gStats.enabled", config.E2gStats.Enabled, false)
+		config.E2gStats.Enabled = false
+		changes.add("searchTerms.enabled", config.SearchTerms.Enabled, false)
+		config.SearchTerms.Enabled = false
+	} else if keepHa {
+		log.Println("High availability stays enabled with the filter, DNS and nginx replicas it was given")
+	}
+	changes.add("profile", config.Profile, name)
+	config.Profile = name
+
+	w := tabwriter.NewWriter(showOutput(), 1, 1, 3, ' ', 0)
+	fmt.Fprintln(w, "Setting\tBefore\tAfter")
+	for _, change := range changes {
+		fmt.Fprintf(w, "%s\t%s\t%s\n", change[0], change[1], change[2])
+	}
+	w.Flush()
+
+	if dryRun {
+		log.Printf("Dry run, the %s profile was not applied\n", name)
+		return 0
+	}
+	err = writeHostFilterConfig(targetName, config)
+	if err != nil {
+		log.Fatal("Failed to write host config: ", err)
+		return -1
+	}
+
+	log.Printf("Sized %s for %s; deploy to apply\n", targetName, profile.Description)
+	return 0
+}
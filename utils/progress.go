@@ -0,0 +1,135 @@
+package utils
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+var ProgressFormats = []string{"text", "json"}
+
+// Set from --progress; json replaces human-oriented output with events
+var ProgressFormat = "text"
+
+type ProgressEvent struct {
+	Time time.Time `json:"time"`
+	// step-started, step-finished, step-failed, transfer, estimate, output or log
+	Event    string  `json:"event"`
+	Target   string  `json:"target,omitempty"`
+	Step     string  `json:"step,omitempty"`
+	Line     string  `json:"line,omitempty"`
+	Bytes    int64   `json:"bytes,omitempty"`
+	Duration float64 `json:"duration,omitempty"`
+	Error    string  `json:"error,omitempty"`
+}
+
+var progressOutput io.Writer = os.Stdout
+var progressMutex sync.Mutex
+
+func jsonProgress() bool {
+	return ProgressFormat == "json"
+}
+
+func emitProgress(event ProgressEvent) {
+	if !jsonProgress() {
+		return
+	}
+	event.Time = time.Now().UTC()
+	data, err := json.Marshal(event)
+	if err != nil {
+		return
+	}
+	progressMutex.Lock()
+	defer progressMutex.Unlock()
+	progressOutput.Write(append(data, '\n'))
+}
+
+/*
+ * Report a step starting; the returned function reports it finishing or failing
+ */
+func progressStep(target string, step string) func(error) {
+	start := time.Now()
+	emitProgress(ProgressEvent{Event: "step-started", Target: target, Step: step})
+	return func(err error) {
+		event := ProgressEvent{Event: "step-finished", Target: target, Step: step, Duration: time.Since(start).Seconds()}
+		if err != nil {
+			event.Event = "step-failed"
+			event.Error = err.Error()
+		}
+		emitProgress(event)
+	}
+}
+
+/*
+ * Report the size of a file or directory copied to a target
+ */
+func progressTransfer(target string, step string, src string) {
+	if !jsonProgress() {
+		return
+	}
+	emitProgress(ProgressEvent{Event: "transfer", Target: target, Step: step, Line: src, Bytes: pathSize(src)})
+}
+
+// Turns log lines into log events, taking the target from the "[name] " prefix
+type progressLogWriter struct{}
+
+func (progressLogWriter) Write(p []byte) (int, error) {
+	line := strings.TrimRight(string(p), "\n")
+	event := ProgressEvent{Event: "log", Line: line}
+	if strings.HasPrefix(line, "[") {
+		if end := strings.Index(line, "] "); end > 0 {
+			event.Target = line[1:end]
+			event.Line = line[end+2:]
+		}
+	}
+	emitProgress(event)
+	return len(p), nil
+}
+
+/*
+ * Switch to newline-delimited JSON events on stdout. Log lines and anything
+ * printed to stdout, like helm output, are wrapped in events. Call the
+ * returned function before exiting to flush the remaining output; it doesn't
+ * log, so it can run from a log.Fatal through OnFatal.
+ */
+func StartJsonProgress() func() {
+	ProgressFormat = "json"
+	progressOutput = os.Stdout
+
+	log.SetFlags(0)
+	log.SetOutput(progressLogWriter{})
+
+	reader, writer, err := os.Pipe()
+	if err != nil {
+		log.Printf("Failed to capture output: %s\n", err)
+		return func() {}
+	}
+	stdout := os.Stdout
+	os.Stdout = writer
+
+	done := make(chan struct{})
+	go func() {
+		scanner := bufio.NewScanner(reader)
+		scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+		for scanner.Scan() {
+			// Keep only the last update of lines redrawn with carriage returns
+			line := strings.TrimRight(scanner.Text(), "\r")
+			line = line[strings.LastIndex(line, "\r")+1:]
+			if strings.TrimSpace(line) != "" {
+				emitProgress(ProgressEvent{Event: "output", Line: line})
+			}
+		}
+		close(done)
+	}()
+
+	return func() {
+		os.Stdout = stdout
+		writer.Close()
+		<-done
+	}
+}
@@ -0,0 +1,43 @@
+package utils
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/manifoldco/promptui"
+)
+
+// Set by '--yes' to agree to confirmations, i.e. new host keys and 'target reset'
+var AssumeYes bool
+
+// Set by '--non-interactive' to fail instead of waiting for input nobody will type
+var NonInteractive bool
+
+/*
+ * Ask a yes/no question, answered by --yes or refused by --non-interactive
+ */
+func confirm(label string) (bool, error) {
+	if AssumeYes {
+		log.Printf("%s yes (--yes)\n", label)
+		return true, nil
+	}
+	if err := checkInteractive("a confirmation"); err != nil {
+		return false, fmt.Errorf("%s; pass --yes to agree", err)
+	}
+	prompt := promptui.Select{
+		Label: label + " (yes/no)",
+		Items: []string{"yes", "no"},
+	}
+	_, result, err := prompt.Run()
+	return result == "yes", err
+}
+
+/*
+ * Fail a prompt for what in --non-interactive mode
+ */
+func checkInteractive(what string) error {
+	if NonInteractive {
+		return fmt.Errorf("%s is needed but --non-interactive is set", what)
+	}
+	return nil
+}
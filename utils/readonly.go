@@ -0,0 +1,51 @@
+package utils
+
+import (
+	"fmt"
+	"log"
+	"os"
+)
+
+/*
+ * Whether this workstation config is shared read-only, through GUARDIAN_READ_ONLY
+ * or the config file
+ */
+func ReadOnly() bool {
+	if value := os.Getenv("GUARDIAN_READ_ONLY"); value != "" && value != "0" && value != "false" {
+		return true
+	}
+	config, err := loadConfig()
+	return err == nil && config.ReadOnly
+}
+
+/*
+ * Mark the config read-only so only viewing commands are allowed
+ */
+func SetReadOnly(readOnly bool) int {
+
+	err := initLocal()
+	if err != nil {
+		log.Fatal("Failed to initialize: ", err)
+		return -1
+	}
+
+	config, err := loadConfig()
+	if err != nil {
+		log.Fatal("Failed to load config: ", err)
+		return -1
+	}
+
+	config.ReadOnly = readOnly
+	err = writeConfig(config)
+	if err != nil {
+		log.Fatal("Failed to write config: ", err)
+		return -1
+	}
+
+	if readOnly {
+		fmt.Println("Configuration is now read-only; commands that change policy or targets are refused.")
+	} else {
+		fmt.Println("Configuration is writable again.")
+	}
+	return 0
+}
@@ -0,0 +1,249 @@
+package utils
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Lines of output quoted in a failed command's error
+const errorTailLines = 3
+
+/*
+ * The outcome of one command in a remote run
+ */
+type CommandResult struct {
+	Command  string        `json:"command"`
+	Stdout   string        `json:"stdout,omitempty"`
+	Stderr   string        `json:"stderr,omitempty"`
+	ExitCode int           `json:"exitCode"`
+	Duration time.Duration `json:"duration"`
+}
+
+type RemoteResult []CommandResult
+
+/*
+ * Standard output of all commands, as the remote shell printed it
+ */
+func (results RemoteResult) Stdout() string {
+	var b strings.Builder
+	for _, result := range results {
+		b.WriteString(result.Stdout)
+	}
+	return b.String()
+}
+
+/*
+ * Result of the first command matching prefix
+ */
+func (results RemoteResult) Find(prefix string) (CommandResult, bool) {
+	for _, result := range results {
+		if strings.HasPrefix(result.Command, prefix) {
+			return result, true
+		}
+	}
+	return CommandResult{}, false
+}
+
+/*
+ * A command that exited non-zero
+ */
+type RemoteCommandError struct {
+	Result CommandResult
+}
+
+/*
+ * The program and subcommand a command runs, i.e. 'helm upgrade'
+ */
+func commandName(command string) string {
+	fields := strings.Fields(command)
+	if len(fields) == 0 {
+		return "command"
+	}
+	name := fields[0]
+	if contains([]string{"for", "if", "while", "until", "case", "exit", "{", "("}, name) {
+		return "command"
+	}
+	if len(fields) > 1 && !strings.HasPrefix(fields[1], "-") && strings.IndexFunc(fields[1], func(r rune) bool {
+		return !(r >= 'a' && r <= 'z' || r == '-')
+	}) < 0 {
+		name += " " + fields[1]
+	}
+	return name
+}
+
+/*
+ * Last few non-empty lines of output
+ */
+func outputTail(output string) string {
+	var lines []string
+	for _, line := range strings.Split(output, "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	if len(lines) > errorTailLines {
+		lines = lines[len(lines)-errorTailLines:]
+	}
+	return strings.Join(lines, "; ")
+}
+
+func (e *RemoteCommandError) Error() string {
+	message := fmt.Sprintf("%s failed with exit %d", commandName(e.Result.Command), e.Result.ExitCode)
+	tail := outputTail(e.Result.Stderr)
+	if tail == "" {
+		tail = outputTail(e.Result.Stdout)
+	}
+	if tail != "" {
+		message += ": " + tail
+	}
+	return message
+}
+
+/*
+ * Error for a command's result, nil if it succeeded
+ */
+func (result CommandResult) Err() error {
+	if result.ExitCode == 0 {
+		return nil
+	}
+	return &RemoteCommandError{Result: result}
+}
+
+/*
+ * The error of a run: like a shell running the commands in a row, it fails if the last
+ * command failed. Errors from the connection itself are passed through.
+ */
+func resultsError(commands []string, results RemoteResult, runErr error) error {
+	if len(commands) > 0 && len(results) == len(commands) {
+		return results[len(results)-1].Err()
+	}
+	if runErr == nil && len(commands) > 0 {
+		return fmt.Errorf("remote shell exited after %d of %d commands", len(results), len(commands))
+	}
+	return runErr
+}
+
+/*
+ * Wrap commands in one sh script that reports each command's stderr line by line as it
+ * is written, and its exit code after its output, on marker lines carrying nonce.
+ * Commands still share one shell, so cd and export carry over, and the script exits with
+ * the last command's code as before. A command that exits the shell is reported by the
+ * exit trap. Targets without a POSIX sh run their commands with runHostCommandUnwrapped.
+ */
+func wrapCommands(commands []string, nonce string) string {
+	report := fmt.Sprintf(`printf '\036%s end %%d %%d\n' $__i $__rc`, nonce)
+	// Stderr goes through a fifo so it is marked as such without waiting for the command to end
+	reader := fmt.Sprintf(`while IFS= read -r __l || [ -n "$__l" ]; do printf '\036%s e %%s\n' "$__l"; done <"$__d/err" & __p=$!`, nonce)
+
+	var b strings.Builder
+	b.WriteString("__d=$(mktemp -d 2>/dev/null || { mkdir -m 700 /tmp/.guardian-$$ && echo /tmp/.guardian-$$; }); __rc=0; __i=-1; __done=-1; __p=\n")
+	b.WriteString("mkfifo \"$__d/err\" || exit 1\n")
+	fmt.Fprintf(&b, "trap %s EXIT\n", shellQuote(fmt.Sprintf(`__rc=$?; [ -n "$__p" ] && wait $__p; if [ "$__done" != "$__i" ]; then %s; fi; rm -rf "$__d"`, report)))
+	for i, command := range commands {
+		fmt.Fprintf(&b, "__i=%d; %s\n{ %s\n} 2>\"$__d/err\"; __rc=$?; wait $__p; __p=; __done=%d; %s\n", i, reader, command, i, report)
+	}
+	b.WriteString("exit $__rc")
+	return fmt.Sprintf("sh -c %s", shellQuote(b.String()))
+}
+
+/*
+ * Splits the output of wrapped commands into per-command results, passing the
+ * output without markers on to next as it arrives
+ */
+type resultWriter struct {
+	nonce    string
+	commands []string
+	next     io.Writer
+	results  RemoteResult
+	stdout   bytes.Buffer
+	stderr   bytes.Buffer
+	pending  []byte
+	started  time.Time
+}
+
+func newResultWriter(commands []string, nonce string, next io.Writer) *resultWriter {
+	return &resultWriter{nonce: nonce, commands: commands, next: next, started: time.Now()}
+}
+
+func (w *resultWriter) emit(text []byte) {
+	if len(text) == 0 {
+		return
+	}
+	w.stdout.Write(text)
+	if w.next != nil {
+		w.next.Write(text)
+	}
+}
+
+func (w *resultWriter) marker(line string) {
+	if strings.HasPrefix(line, "e ") {
+		text := line[2:] + "\n"
+		w.stderr.WriteString(text)
+		if w.next != nil {
+			io.WriteString(w.next, text)
+		}
+		return
+	}
+	fields := strings.Fields(line)
+	if len(fields) < 3 || fields[0] != "end" {
+		return
+	}
+	i, _ := strconv.Atoi(fields[1])
+	code, _ := strconv.Atoi(fields[2])
+	result := CommandResult{ExitCode: code, Duration: time.Since(w.started)}
+	if i >= 0 && i < len(w.commands) {
+		result.Command = w.commands[i]
+	}
+	// The pty turns newlines into CRLF
+	result.Stdout = strings.ReplaceAll(w.stdout.String(), "\r\n", "\n")
+	result.Stderr = strings.ReplaceAll(w.stderr.String(), "\r\n", "\n")
+	w.results = append(w.results, result)
+	w.stdout.Reset()
+	w.stderr.Reset()
+	w.started = time.Now()
+}
+
+func (w *resultWriter) Write(p []byte) (int, error) {
+	data := append(w.pending, p...)
+	w.pending = nil
+	prefix := []byte("\036" + w.nonce + " ")
+	for len(data) > 0 {
+		start := bytes.IndexByte(data, '\036')
+		if start < 0 {
+			w.emit(data)
+			return len(p), nil
+		}
+		w.emit(data[:start])
+		data = data[start:]
+		end := bytes.IndexByte(data, '\n')
+		if end < 0 {
+			// Wait for the rest of a possible marker
+			w.pending = append([]byte{}, data...)
+			return len(p), nil
+		}
+		if !bytes.HasPrefix(data, prefix) {
+			w.emit(data[:1])
+			data = data[1:]
+			continue
+		}
+		w.marker(strings.TrimRight(string(data[len(prefix):end]), "\r"))
+		data = data[end+1:]
+	}
+	return len(p), nil
+}
+
+/*
+ * Results of the commands that finished, with any output after the last one
+ */
+func (w *resultWriter) finish() RemoteResult {
+	if len(w.pending) > 0 {
+		pending := w.pending
+		w.pending = nil
+		w.emit(pending)
+	}
+	return w.results
+}
@@ -0,0 +1,212 @@
+package utils
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"reflect"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Top-level keys of overrides.yaml that make up a target's filtering policy. Everything
+// else is the replica's own: its address, volumes, certificates, clients, sizing and
+// the passwords and keys its services were set up with.
+var replicatedKeys = []string{
+	"decryptHTTPS", "allowRules", "decryptRules", "e2guardianConf", "cacheTTL",
+	"safeSearchEnforced", "threatFeeds", "newDomains", "homographProtection", "blockPage",
+	"searchTerms", "alerts", "squidSnippet", "scanners", "downloads", "decryptExclusions",
+	"geo", "probes",
+}
+
+const minReplicateInterval = time.Minute
+
+/*
+ * The top-level keys of overrides.yaml
+ */
+func filterConfigKeys() []string {
+	var keys []string
+	t := reflect.TypeOf(FilterConfig{})
+	for i := 0; i < t.NumField(); i++ {
+		if tag, ok := t.Field(i).Tag.Lookup("yaml"); ok {
+			keys = append(keys, strings.Split(tag, ",")[0])
+		}
+	}
+	return keys
+}
+
+func filterConfigMap(config FilterConfig) (map[string]interface{}, error) {
+	data, err := yaml.Marshal(config)
+	if err != nil {
+		return nil, err
+	}
+	values := map[string]interface{}{}
+	err = yaml.Unmarshal(data, &values)
+	return values, err
+}
+
+/*
+ * The replica's config with the primary's policy, less the excluded keys
+ */
+func replicaConfig(primary FilterConfig, replica FilterConfig, exclude []string) (FilterConfig, error) {
+	policy, err := filterConfigMap(primary)
+	if err != nil {
+		return FilterConfig{}, err
+	}
+	merged, err := filterConfigMap(replica)
+	if err != nil {
+		return FilterConfig{}, err
+	}
+	for _, key := range replicatedKeys {
+		if contains(exclude, key) {
+			continue
+		}
+		if value, ok := policy[key]; ok {
+			merged[key] = value
+		} else {
+			delete(merged, key)
+		}
+	}
+
+	data, err := yaml.Marshal(merged)
+	if err != nil {
+		return FilterConfig{}, err
+	}
+	var config FilterConfig
+	err = yaml.Unmarshal(data, &config)
+	return config, err
+}
+
+/*
+ * Copy the primary's overrides to one replica and deploy it if anything changed
+ */
+func replicateTo(primary FilterConfig, host Host, exclude []string, message string) error {
+	current, err := getHostFilterConfig(host.Name)
+	if err != nil {
+		return fmt.Errorf("failed to get host config: %s", err)
+	}
+	config, err := replicaConfig(primary, current, exclude)
+	if err != nil {
+		return fmt.Errorf("failed to merge config: %s", err)
+	}
+
+	before, _ := yaml.Marshal(current)
+	after, _ := yaml.Marshal(config)
+	if bytes.Equal(before, after) {
+		log.Println("Already in sync with the primary")
+		return nil
+	}
+
+	err = writeHostFilterConfig(host.Name, config)
+	if err != nil {
+		return fmt.Errorf("failed to write host config: %s", err)
+	}
+	err = deployHost(host, message, false, false)
+	if err != nil {
+		// Put the old overrides back so the next run sees the difference and tries again
+		if written, loadErr := loadHostFilterConfig(host.Name); loadErr == nil {
+			current.Revision = written.Revision
+			writeHostFilterConfig(host.Name, current)
+		}
+	}
+	return err
+}
+
+/*
+ * Push the primary's policy to every replica once, returning the number that failed
+ */
+func replicateOnce(primaryName string, replicas []Host, exclude []string) int {
+	log.SetPrefix(fmt.Sprintf("[%s] ", primaryName))
+	primary, err := getHostFilterConfig(primaryName)
+	if err != nil {
+		log.Printf("Failed to get primary config: %s\n", err)
+		return len(replicas)
+	}
+
+	message := fmt.Sprintf("replicated from %s", primaryName)
+	failed := 0
+	for _, host := range replicas {
+		stopOutput := PrefixTargetOutput(host.Name)
+		if err := replicateTo(primary, host, exclude, message); err != nil {
+			log.Printf("Failed to replicate: %s\n", err)
+			failed++
+		}
+		stopOutput()
+	}
+	log.SetPrefix("")
+	return failed
+}
+
+/*
+ * Keep replica targets' policy in lockstep with a primary, once or on a schedule
+ */
+func Replicate(primaryName string, replicaNames []string, exclude []string, schedule string) int {
+
+	var interval time.Duration
+	if schedule != "" {
+		var err error
+		interval, err = parseLongDuration(schedule)
+		if err != nil {
+			log.Fatalf("Invalid schedule '%s': %s\n", schedule, err)
+			return -1
+		}
+		if interval < minReplicateInterval {
+			log.Fatalf("Schedule must be at least %s\n", minReplicateInterval)
+			return -1
+		}
+	}
+
+	for _, key := range exclude {
+		if !contains(replicatedKeys, key) {
+			log.Fatalf("Invalid override '%s' in --exclude, valid options are %s\n", key, strings.Join(replicatedKeys, ", "))
+			return -1
+		}
+	}
+
+	config, err := loadConfig()
+	if err != nil {
+		log.Fatal("Failed to load config: ", err)
+		return -1
+	}
+
+	if _, host := FindHost(config, primaryName); host.Name != primaryName {
+		log.Fatalf("Host %s doesn't exist, create it first", primaryName)
+		return -1
+	}
+	if len(replicaNames) == 0 {
+		log.Fatalln("No replicas given, pass --to")
+		return -1
+	}
+	var replicas []Host
+	for _, name := range replicaNames {
+		_, host := FindHost(config, name)
+		if host.Name != name {
+			log.Fatalf("Host %s doesn't exist, create it first", name)
+			return -1
+		}
+		if name == primaryName {
+			log.Fatalf("Target '%s' can't be a replica of itself\n", name)
+			return -1
+		}
+		replicas = append(replicas, host)
+	}
+
+	if interval == 0 {
+		if failed := replicateOnce(primaryName, replicas, exclude); failed > 0 {
+			log.Printf("%d of %d replicas failed\n", failed, len(replicas))
+			return -1
+		}
+		log.Printf("All %d replicas are in sync with %s\n", len(replicas), primaryName)
+		return 0
+	}
+
+	log.Printf("Replicating %s to %s every %s, interrupt to stop\n", primaryName, strings.Join(replicaNames, ", "), interval)
+	for {
+		if failed := replicateOnce(primaryName, replicas, exclude); failed > 0 {
+			log.Printf("%d of %d replicas failed, retrying in %s\n", failed, len(replicas), interval)
+		}
+		time.Sleep(interval)
+	}
+}
@@ -0,0 +1,192 @@
+package utils
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/mail"
+	"os"
+	"strings"
+	"text/tabwriter"
+)
+
+var ReportFrequencies = []string{"daily", "weekly", "monthly"}
+
+// summary: totals only, detailed: per-client activity, blocked: blocked requests only
+var ReportTemplates = []string{"summary", "detailed", "blocked"}
+
+type ReportSchedule struct {
+	Name       string   `yaml:"name"`
+	Frequency  string   `yaml:"frequency"`
+	Recipients []string `yaml:"recipients"`
+	Template   string   `yaml:"template"`
+}
+
+type SmtpConfig struct {
+	Server   string `yaml:"server"`
+	From     string `yaml:"from"`
+	Username string `yaml:"username,omitempty"`
+	Password string `yaml:"password,omitempty"`
+}
+
+func contains(options []string, value string) bool {
+	for _, option := range options {
+		if option == value {
+			return true
+		}
+	}
+	return false
+}
+
+func (config *FilterConfig) findReportSchedule(name string) *ReportSchedule {
+	for i := range config.ReportSchedules {
+		schedule := &config.ReportSchedules[i]
+		if schedule.Name == name {
+			return schedule
+		}
+	}
+	return nil
+}
+
+/*
+ * Add or replace a report schedule
+ */
+func ScheduleReport(targetName string, name string, frequency string, recipients []string, template string) int {
+
+	if !contains(ReportFrequencies, frequency) {
+		log.Fatalf("Invalid frequency '%s', valid options are %s\n", frequency, strings.Join(ReportFrequencies, ", "))
+		return -1
+	}
+	if !contains(ReportTemplates, template) {
+		log.Fatalf("Invalid template '%s', valid options are %s\n", template, strings.Join(ReportTemplates, ", "))
+		return -1
+	}
+	if len(recipients) == 0 {
+		log.Fatalln("At least one recipient is required")
+		return -1
+	}
+	for _, recipient := range recipients {
+		if _, err := mail.ParseAddress(recipient); err != nil {
+			log.Fatalf("Invalid email address '%s'\n", recipient)
+			return -1
+		}
+	}
+
+	config, err := getHostFilterConfig(targetName)
+	if err != nil {
+		log.Fatal("Failed to get host config: ", err)
+		return -1
+	}
+
+	if config.Smtp.Server == "" {
+		log.Println("Warning: no SMTP server configured; use 'filter report smtp' before deploying")
+	}
+
+	schedule := ReportSchedule{Name: name, Frequency: frequency, Recipients: recipients, Template: template}
+	if existing := config.findReportSchedule(name); existing != nil {
+		*existing = schedule
+	} else {
+		config.ReportSchedules = append(config.ReportSchedules, schedule)
+	}
+
+	err = writeHostFilterConfig(targetName, config)
+	if err != nil {
+		log.Fatal("Failed to write host config: ", err)
+		return -1
+	}
+
+	log.Printf("Scheduled %s %s report '%s' to %s\n", frequency, template, name, strings.Join(recipients, ", "))
+	return 0
+}
+
+func UnscheduleReport(targetName string, name string) int {
+
+	config, err := getHostFilterConfig(targetName)
+	if err != nil {
+		log.Fatal("Failed to get host config: ", err)
+		return -1
+	}
+
+	for i := range config.ReportSchedules {
+		if config.ReportSchedules[i].Name == name {
+			config.ReportSchedules = append(config.ReportSchedules[:i], config.ReportSchedules[i+1:]...)
+			err = writeHostFilterConfig(targetName, config)
+			if err != nil {
+				log.Fatal("Failed to write host config: ", err)
+				return -1
+			}
+			log.Printf("Removed report schedule '%s'\n", name)
+			return 0
+		}
+	}
+
+	log.Fatalf("Report schedule '%s' does not exist\n", name)
+	return -1
+}
+
+func ListReportSchedules(targetName string) int {
+
+	config, err := getHostFilterConfig(targetName)
+	if err != nil {
+		log.Fatal("Failed to get host config: ", err)
+		return -1
+	}
+
+	if config.Smtp.Server != "" {
+		fmt.Fprintf(showOutput(), "SMTP server: %s (from %s)\n", config.Smtp.Server, config.Smtp.From)
+	}
+	fmt.Fprintf(showOutput(), "Schedules run in time zone %s\n", targetLocation(targetName))
+	w := tabwriter.NewWriter(showOutput(), 1, 1, 3, ' ', 0)
+	fmt.Fprintln(w, "Name\tFrequency\tTemplate\tRecipients")
+	for _, schedule := range config.ReportSchedules {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", schedule.Name, schedule.Frequency, schedule.Template, strings.Join(schedule.Recipients, ", "))
+	}
+	w.Flush()
+
+	return 0
+}
+
+/*
+ * Configure the mail server the stack sends reports through
+ */
+func ConfigureSmtp(targetName string, server string, from string, username string) int {
+
+	if _, _, err := net.SplitHostPort(server); err != nil {
+		log.Fatalf("Invalid SMTP server '%s', expected host:port\n", server)
+		return -1
+	}
+	if _, err := mail.ParseAddress(from); err != nil {
+		log.Fatalf("Invalid from address '%s'\n", from)
+		return -1
+	}
+
+	config, err := getHostFilterConfig(targetName)
+	if err != nil {
+		log.Fatal("Failed to get host config: ", err)
+		return -1
+	}
+
+	password := ""
+	if username != "" {
+		password = os.Getenv("SMTP_PASSWORD")
+		if password == "" {
+			fmt.Println("Need SMTP password for authentication.")
+			password, err = getUserCredentials()
+			if err != nil {
+				log.Fatal("Failed to retrieve SMTP password: ", err)
+				return -1
+			}
+		}
+	}
+
+	config.Smtp = SmtpConfig{Server: server, From: from, Username: username, Password: password}
+
+	err = writeHostFilterConfig(targetName, config)
+	if err != nil {
+		log.Fatal("Failed to write host config: ", err)
+		return -1
+	}
+
+	log.Printf("Configured SMTP server '%s'\n", server)
+	return 0
+}
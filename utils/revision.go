@@ -0,0 +1,97 @@
+package utils
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// How long to wait for another writer of the same overrides to finish
+const overridesLockTimeout = 10 * time.Second
+
+// A write lock older than this is left over from a crashed process
+const staleOverridesLockAge = time.Minute
+
+// Revision of each target's overrides this process last read or wrote
+var overridesRevisions = struct {
+	sync.Mutex
+	seen map[string]int
+}{seen: map[string]int{}}
+
+func rememberRevision(host string, revision int) {
+	overridesRevisions.Lock()
+	defer overridesRevisions.Unlock()
+	overridesRevisions.seen[host] = revision
+}
+
+func seenRevision(host string) (int, bool) {
+	overridesRevisions.Lock()
+	defer overridesRevisions.Unlock()
+	revision, ok := overridesRevisions.seen[host]
+	return revision, ok
+}
+
+/*
+ * Revision of the overrides on disk, 0 if there are none yet
+ */
+func readRevision(fileName string) (int, error) {
+	data, err := ioutil.ReadFile(fileName)
+	if os.IsNotExist(err) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	var stored struct {
+		Revision int `yaml:"revision"`
+	}
+	err = yaml.Unmarshal(data, &stored)
+	return stored.Revision, err
+}
+
+/*
+ * Take the write lock on a target's overrides so checking the revision and
+ * writing are one step. mkdir is atomic, so only one process can create the
+ * lock directory. Returns a function that releases it.
+ */
+func lockOverrides(fileName string) (func(), error) {
+	lockPath := fileName + ".lock"
+	deadline := time.Now().Add(overridesLockTimeout)
+	for {
+		err := os.Mkdir(lockPath, privateDirMode)
+		if err == nil {
+			return func() { os.Remove(lockPath) }, nil
+		}
+		if !os.IsExist(err) {
+			return nil, err
+		}
+		if info, statErr := os.Stat(lockPath); statErr == nil && time.Since(info.ModTime()) > staleOverridesLockAge {
+			os.Remove(lockPath)
+			continue
+		}
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("overrides are locked by another command, remove %s if none is running", lockPath)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+/*
+ * Reject a write based on overrides changed since they were read, by another
+ * process or by another write in this one, then bump the revision the write will carry
+ */
+func checkAndBumpRevision(host string, fileName string, config *FilterConfig) error {
+	current, err := readRevision(fileName)
+	if err != nil {
+		return err
+	}
+	// Writes of overrides this process never read, i.e. imports, replace them outright
+	if _, ok := seenRevision(host); ok && config.Revision != current {
+		return fmt.Errorf("config of '%s' changed underneath you (now revision %d, this command read %d), re-run the command", host, current, config.Revision)
+	}
+	config.Revision = current + 1
+	return nil
+}
@@ -0,0 +1,112 @@
+package utils
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Verify each deploy and roll it back if that fails, set by 'filter deploy --auto-rollback'
+var AutoRollback bool
+
+// Snapshot of the overrides of the last successful deploy, restored by a rollback
+const deployedSnapshot = "deployed"
+
+// How long the release and pods of a deploy get to settle before verification fails
+const deployVerifyTimeout = 2 * time.Minute
+
+/*
+ * Revision of the deployed release, 0 if there is none to roll back to
+ */
+func deployedRevision(host Host) (int, error) {
+	out, err := runHostCommands(host, []string{
+		"export KUBECONFIG=/etc/rancher/k3s/k3s.yaml",
+		"helm list -n filter --filter '^guardian-angel$' -o json 2>/dev/null || echo '[]'",
+	}, false)
+	if err != nil {
+		return 0, err
+	}
+	var releases []helmRelease
+	if err := json.Unmarshal([]byte(strings.TrimSpace(out)), &releases); err != nil {
+		return 0, fmt.Errorf("failed to parse helm output: %s", err)
+	}
+	if len(releases) == 0 || releases[0].Status != "deployed" {
+		return 0, nil
+	}
+	return strconv.Atoi(releases[0].Revision)
+}
+
+/*
+ * Smoke test a deploy: the release must be deployed with all pods ready, then the
+ * post-deploy hooks must pass
+ */
+func verifyDeploy(host Host, env map[string]string) error {
+	deadline := time.Now().Add(deployVerifyTimeout)
+	for {
+		out, err := runHostCommands(host, []string{
+			"export KUBECONFIG=/etc/rancher/k3s/k3s.yaml",
+			"helm list -n filter --filter '^guardian-angel$' -o json 2>/dev/null || echo '[]'",
+			"echo ---",
+			"kubectl get pods -n filter -o json 2>/dev/null || echo '{}'",
+		}, false)
+		if err != nil {
+			return err
+		}
+		sections := strings.SplitN(strings.ReplaceAll(out, "\r", ""), "---\n", 2)
+		if len(sections) != 2 {
+			return fmt.Errorf("unexpected output from target")
+		}
+		var failed []string
+		for _, finding := range []doctorFinding{statusCheckRelease(strings.TrimSpace(sections[0])), statusCheckPods(sections[1])} {
+			if finding.Status != "ok" {
+				failed = append(failed, fmt.Sprintf("%s: %s", finding.Check, finding.Detail))
+			}
+		}
+		if len(failed) == 0 {
+			break
+		}
+		// Pods of the replaced release may still be going away
+		if time.Now().After(deadline) {
+			return fmt.Errorf("%s", strings.Join(failed, "; "))
+		}
+		select {
+		case <-interruptContext.Done():
+			return interruptContext.Err()
+		case <-time.After(5 * time.Second):
+		}
+	}
+	return runHooks(host, "post-deploy", env)
+}
+
+/*
+ * Roll the release back to revision and the overrides back to those deployed with it
+ */
+func rollbackDeploy(host Host, revision int) error {
+	if revision == 0 {
+		return fmt.Errorf("there is no earlier release to roll back to")
+	}
+
+	ctx, cancel := stepContext(helmUpgradeTimeout)
+	defer cancel()
+	_, err := runHostCommandsContext(ctx, host, []string{
+		"export KUBECONFIG=/etc/rancher/k3s/k3s.yaml",
+		fmt.Sprintf("helm rollback --wait -n filter guardian-angel %d", revision),
+	}, true)
+	if err != nil {
+		return fmt.Errorf("failed to roll back the release: %s", err)
+	}
+
+	if _, err := os.Stat(getSnapshotPath(host.Name, deployedSnapshot)); os.IsNotExist(err) {
+		return fmt.Errorf("rolled back the release to revision %d, but no overrides were saved with it, so they were left as they are", revision)
+	}
+	err = restoreSnapshot(host.Name, deployedSnapshot)
+	if err != nil {
+		return fmt.Errorf("rolled back the release to revision %d, but failed to restore its overrides: %s", revision, err)
+	}
+	log.Printf("Rolled back to revision %d and its overrides, the ones that failed are saved as snapshot '%s'\n", revision, previousSnapshot)
+	return nil
+}
@@ -0,0 +1,255 @@
+package utils
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"strings"
+	"text/tabwriter"
+)
+
+var ScannerTypes = []string{"clamav", "icap"}
+
+// Filter groups a scanner can be toggled for
+var scannerGroups = []string{"default", guestGroup}
+
+// URL scheme and port each scanner type is reached with
+var scannerSchemes = map[string]string{"clamav": "tcp", "icap": "icap"}
+var scannerDefaultPorts = map[string]string{"clamav": "3310", "icap": "1344"}
+
+type ContentScanner struct {
+	Name string `yaml:"name"`
+	Type string `yaml:"type"`
+	Url  string `yaml:"url"`
+	// Filter groups whose downloads are scanned
+	Groups []string `yaml:"groups"`
+}
+
+func (config *FilterConfig) findScanner(name string) *ContentScanner {
+	for i := range config.Scanners {
+		scanner := &config.Scanners[i]
+		if scanner.Name == name {
+			return scanner
+		}
+	}
+	return nil
+}
+
+func scannerAddress(scanner ContentScanner) (string, error) {
+	u, err := url.Parse(scanner.Url)
+	if err != nil {
+		return "", err
+	}
+	if u.Scheme != scannerSchemes[scanner.Type] || u.Hostname() == "" {
+		return "", fmt.Errorf("expected a URL like %s://host:%s", scannerSchemes[scanner.Type], scannerDefaultPorts[scanner.Type])
+	}
+	port := u.Port()
+	if port == "" {
+		port = scannerDefaultPorts[scanner.Type]
+	}
+	return net.JoinHostPort(u.Hostname(), port), nil
+}
+
+/*
+ * Ask the scanner whether it is up, from the target since that is where the
+ * filter reaches it: PING for clamd, OPTIONS for ICAP
+ */
+func checkScanner(host Host, scanner ContentScanner) error {
+	address, err := scannerAddress(scanner)
+	if err != nil {
+		return err
+	}
+	hostname, port, _ := net.SplitHostPort(address)
+
+	request, reply := "zPING\\0", "head -c 4"
+	if scanner.Type == "icap" {
+		request = fmt.Sprintf("OPTIONS %s ICAP/1.0\\r\\nHost: %s\\r\\nEncapsulated: null-body=0\\r\\n\\r\\n", scanner.Url, address)
+		reply = "head -n 1"
+	}
+	script := fmt.Sprintf("exec 3<>/dev/tcp/%s/%s && printf '%%b' %s >&3 && %s <&3",
+		shellQuote(hostname), shellQuote(port), shellQuote(request), reply)
+	out, err := runHostCommands(host, []string{fmt.Sprintf("timeout 5 bash -c %s", shellQuote(script))}, false)
+	if err != nil {
+		return fmt.Errorf("no answer from the target: %s", err)
+	}
+
+	out = strings.TrimSpace(out)
+	if scanner.Type == "clamav" {
+		if out != "PONG" {
+			return fmt.Errorf("unexpected reply '%s'", out)
+		}
+		return nil
+	}
+	if !strings.HasPrefix(out, "ICAP/1.0 200") {
+		return fmt.Errorf("unexpected status '%s'", out)
+	}
+	return nil
+}
+
+/*
+ * Scan downloads with an external antivirus or ICAP service
+ */
+func AddScanner(targetName string, scannerType string, name string, scannerUrl string) int {
+
+	if !contains(ScannerTypes, scannerType) {
+		log.Fatalf("Invalid scanner type '%s', valid options are %s\n", scannerType, strings.Join(ScannerTypes, ", "))
+		return -1
+	}
+	if name == "" {
+		name = scannerType
+	}
+
+	scanner := ContentScanner{Name: name, Type: scannerType, Url: scannerUrl, Groups: []string{"default"}}
+	_, err := scannerAddress(scanner)
+	if err != nil {
+		log.Fatalf("Invalid URL '%s': %s\n", scannerUrl, err)
+		return -1
+	}
+
+	guardianConf, err := loadConfig()
+	if err != nil {
+		log.Fatal("Failed to load config: ", err)
+		return -1
+	}
+	_, host := FindHost(guardianConf, targetName)
+	if host.Name != targetName {
+		log.Fatalf("Host %s doesn't exist, create it first", targetName)
+		return -1
+	}
+
+	config, err := getHostFilterConfig(targetName)
+	if err != nil {
+		log.Fatal("Failed to get host config: ", err)
+		return -1
+	}
+
+	if config.findScanner(name) != nil {
+		log.Fatalf("Scanner '%s' already exists\n", name)
+		return -1
+	}
+
+	err = checkScanner(host, scanner)
+	if err != nil {
+		log.Printf("Warning: scanner '%s' is not answering: %s\n", name, err)
+	}
+
+	config.Scanners = append(config.Scanners, scanner)
+
+	err = writeHostFilterConfig(targetName, config)
+	if err != nil {
+		log.Fatal("Failed to write host config: ", err)
+		return -1
+	}
+
+	log.Printf("Added %s scanner '%s' for the default group; deploy to apply\n", scannerType, name)
+	return 0
+}
+
+func RemoveScanner(targetName string, name string) int {
+
+	config, err := getHostFilterConfig(targetName)
+	if err != nil {
+		log.Fatal("Failed to get host config: ", err)
+		return -1
+	}
+
+	for i := range config.Scanners {
+		if config.Scanners[i].Name == name {
+			config.Scanners = append(config.Scanners[:i], config.Scanners[i+1:]...)
+			err = writeHostFilterConfig(targetName, config)
+			if err != nil {
+				log.Fatal("Failed to write host config: ", err)
+				return -1
+			}
+			log.Printf("Removed scanner '%s'; deploy to apply\n", name)
+			return 0
+		}
+	}
+
+	log.Fatalf("Scanner '%s' does not exist\n", name)
+	return -1
+}
+
+/*
+ * Turn scanning by a scanner on or off for a filter group
+ */
+func ToggleScanner(targetName string, name string, group string, enabled bool) int {
+
+	if !contains(scannerGroups, group) {
+		log.Fatalf("Invalid group '%s', valid options are %s\n", group, strings.Join(scannerGroups, ", "))
+		return -1
+	}
+
+	config, err := getHostFilterConfig(targetName)
+	if err != nil {
+		log.Fatal("Failed to get host config: ", err)
+		return -1
+	}
+
+	scanner := config.findScanner(name)
+	if scanner == nil {
+		log.Fatalf("Scanner '%s' does not exist\n", name)
+		return -1
+	}
+
+	var groups []string
+	for _, g := range scanner.Groups {
+		if g != group {
+			groups = append(groups, g)
+		}
+	}
+	if enabled {
+		groups = append(groups, group)
+	}
+	scanner.Groups = groups
+
+	err = writeHostFilterConfig(targetName, config)
+	if err != nil {
+		log.Fatal("Failed to write host config: ", err)
+		return -1
+	}
+
+	if enabled {
+		log.Printf("Scanner '%s' enabled for group '%s'; deploy to apply\n", name, group)
+	} else {
+		log.Printf("Scanner '%s' disabled for group '%s'; deploy to apply\n", name, group)
+	}
+	return 0
+}
+
+/*
+ * List scanners with the groups they apply to and whether they answer
+ */
+func ListScanners(targetName string) int {
+
+	guardianConf, err := loadConfig()
+	if err != nil {
+		log.Fatal("Failed to load config: ", err)
+		return -1
+	}
+	_, host := FindHost(guardianConf, targetName)
+	if host.Name != targetName {
+		log.Fatalf("Host %s doesn't exist, create it first", targetName)
+		return -1
+	}
+
+	config, err := getHostFilterConfig(targetName)
+	if err != nil {
+		log.Fatal("Failed to get host config: ", err)
+		return -1
+	}
+
+	w := tabwriter.NewWriter(showOutput(), 1, 1, 3, ' ', 0)
+	fmt.Fprintln(w, "Name\tType\tURL\tGroups\tHealth")
+	for _, scanner := range config.Scanners {
+		health := "ok"
+		if err := checkScanner(host, scanner); err != nil {
+			health = err.Error()
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", scanner.Name, scanner.Type, scanner.Url, strings.Join(scanner.Groups, ","), health)
+	}
+	w.Flush()
+
+	return 0
+}
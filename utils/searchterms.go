@@ -0,0 +1,235 @@
+package utils
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/mail"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"text/tabwriter"
+)
+
+var loggedUrlPattern = regexp.MustCompile(`https?://[^\s"]+`)
+var logClientPattern = regexp.MustCompile(`\b(?:\d{1,3}\.){3}\d{1,3}\b`)
+
+type searchEngine struct {
+	Host  *regexp.Regexp
+	Param string
+}
+
+// Search engines and the query parameter holding the search terms
+var searchEngines = []searchEngine{
+	{Host: regexp.MustCompile(`(^|\.)google\.[a-z.]+$`), Param: "q"},
+	{Host: regexp.MustCompile(`(^|\.)bing\.com$`), Param: "q"},
+	{Host: regexp.MustCompile(`(^|\.)duckduckgo\.com$`), Param: "q"},
+	{Host: regexp.MustCompile(`(^|\.)search\.yahoo\.com$`), Param: "p"},
+	{Host: regexp.MustCompile(`(^|\.)youtube\.com$`), Param: "search_query"},
+}
+
+type SearchTermsConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// Terms that trigger an alert when searched for
+	WatchWords []string `yaml:"watchWords,omitempty"`
+	// Where watch-word alerts are sent, through the report SMTP server
+	AlertEmail []string `yaml:"alertEmail,omitempty"`
+}
+
+type SearchTerm struct {
+	Term   string `json:"term"`
+	Client string `json:"client"`
+	Hits   int    `json:"hits"`
+	// Watch word the term matched, if any
+	Watch string `json:"watch,omitempty"`
+}
+
+/*
+ * Extract the search terms from a logged URL, if it is a search engine query
+ */
+func extractSearchTerm(rawUrl string) string {
+	u, err := url.Parse(rawUrl)
+	if err != nil {
+		return ""
+	}
+	host := strings.ToLower(u.Hostname())
+	for _, engine := range searchEngines {
+		if engine.Host.MatchString(host) {
+			return strings.TrimSpace(strings.ToLower(u.Query().Get(engine.Param)))
+		}
+	}
+	return ""
+}
+
+func matchWatchWord(term string, watchWords []string) string {
+	for _, word := range watchWords {
+		if strings.Contains(term, strings.ToLower(word)) {
+			return word
+		}
+	}
+	return ""
+}
+
+/*
+ * Collect search terms per client from access log output, most searched first
+ */
+func collectSearchTerms(logs string, client string, watchWords []string) []SearchTerm {
+	counts := map[[2]string]int{}
+	for _, line := range strings.Split(logs, "\n") {
+		address := logClientPattern.FindString(line)
+		if client != "" && address != client {
+			continue
+		}
+		for _, rawUrl := range loggedUrlPattern.FindAllString(line, -1) {
+			if term := extractSearchTerm(rawUrl); term != "" {
+				counts[[2]string{term, address}]++
+			}
+		}
+	}
+
+	var terms []SearchTerm
+	for key, hits := range counts {
+		terms = append(terms, SearchTerm{
+			Term:   key[0],
+			Client: key[1],
+			Hits:   hits,
+			Watch:  matchWatchWord(key[0], watchWords),
+		})
+	}
+	sort.Slice(terms, func(i, j int) bool {
+		if terms[i].Hits != terms[j].Hits {
+			return terms[i].Hits > terms[j].Hits
+		}
+		return terms[i].Term < terms[j].Term
+	})
+	return terms
+}
+
+/*
+ * Turn on search term logging, optionally alerting on watch words
+ */
+func EnableSearchTerms(targetName string, watchWords []string, alertEmail []string) int {
+
+	for _, recipient := range alertEmail {
+		if _, err := mail.ParseAddress(recipient); err != nil {
+			log.Fatalf("Invalid email address '%s'\n", recipient)
+			return -1
+		}
+	}
+
+	config, err := getHostFilterConfig(targetName)
+	if err != nil {
+		log.Fatal("Failed to get host config: ", err)
+		return -1
+	}
+
+	if len(alertEmail) > 0 && config.Smtp.Server == "" {
+		log.Println("Warning: no SMTP server configured; use 'filter report smtp' before deploying")
+	}
+	if !config.DecryptHTTPS {
+		log.Println("Warning: HTTPS decryption is disabled; search terms are only visible in decrypted traffic")
+	}
+
+	config.SearchTerms = SearchTermsConfig{Enabled: true, WatchWords: watchWords, AlertEmail: alertEmail}
+
+	err = writeHostFilterConfig(targetName, config)
+	if err != nil {
+		log.Fatal("Failed to write host config: ", err)
+		return -1
+	}
+
+	log.Printf("Enabled search term logging\n")
+	return 0
+}
+
+func DisableSearchTerms(targetName string) int {
+
+	config, err := getHostFilterConfig(targetName)
+	if err != nil {
+		log.Fatal("Failed to get host config: ", err)
+		return -1
+	}
+
+	config.SearchTerms = SearchTermsConfig{}
+
+	err = writeHostFilterConfig(targetName, config)
+	if err != nil {
+		log.Fatal("Failed to write host config: ", err)
+		return -1
+	}
+
+	log.Printf("Disabled search term logging\n")
+	return 0
+}
+
+/*
+ * Report the search terms seen in the filter's logs, flagging watch words
+ */
+func ReportSearchTerms(targetName string, client string, since string, jsonOutput bool) int {
+
+	sinceDuration, err := parseLongDuration(since)
+	if err != nil {
+		log.Fatal(err)
+		return -1
+	}
+
+	filterConfig, err := getHostFilterConfig(targetName)
+	if err != nil {
+		log.Fatal("Failed to get host config: ", err)
+		return -1
+	}
+	if !filterConfig.SearchTerms.Enabled {
+		log.Println("Warning: search term logging is not enabled; use 'filter search-terms enable'")
+	}
+
+	config, err := loadConfig()
+	if err != nil {
+		log.Fatal("Failed to load config: ", err)
+		return -1
+	}
+
+	_, host := FindHost(config, targetName)
+	if host.Name != targetName {
+		log.Fatalf("Host %s doesn't exist, create it first", targetName)
+		return -1
+	}
+
+	address := ""
+	if client != "" {
+		address = filterConfig.resolveClient(client)
+	}
+
+	logs, err := fetchAccessLogs(host, sinceDuration)
+	if err != nil {
+		log.Fatal("Failed to fetch filter logs: ", err)
+		return -1
+	}
+
+	terms := collectSearchTerms(logs, address, filterConfig.SearchTerms.WatchWords)
+
+	if jsonOutput {
+		encoder := json.NewEncoder(showOutput())
+		encoder.SetIndent("", "  ")
+		encoder.Encode(terms)
+		return 0
+	}
+
+	if len(terms) == 0 {
+		fmt.Fprintln(showOutput(), "No search terms found")
+		return 0
+	}
+
+	w := tabwriter.NewWriter(showOutput(), 1, 1, 3, ' ', 0)
+	fmt.Fprintln(w, "Term\tClient\tHits\tWatch")
+	for _, term := range terms {
+		name := term.Client
+		if known := filterConfig.findClientByAddress(term.Client); known != nil {
+			name = known.Name
+		}
+		fmt.Fprintf(w, "%s\t%s\t%d\t%s\n", term.Term, name, term.Hits, term.Watch)
+	}
+	w.Flush()
+
+	return 0
+}
@@ -0,0 +1,147 @@
+package utils
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/pem"
+	"fmt"
+	"html/template"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+)
+
+var caInstallPage = template.Must(template.New("ca").Parse(`<!DOCTYPE html>
+<html>
+<head><meta name="viewport" content="width=device-width, initial-scale=1"><title>Install the filter certificate</title></head>
+<body style="font-family: sans-serif; max-width: 40em; margin: auto; padding: 1em">
+<h1>Install the filter certificate</h1>
+<p>Download: <a href="/guardian-ca.crt">guardian-ca.crt</a> (PEM) or <a href="/guardian-ca.der">guardian-ca.der</a> (DER)</p>
+<p>SHA-256 fingerprint: <code>{{.Fingerprint}}</code></p>
+<h2>iPhone / iPad</h2>
+<p>Open this page in Safari and download guardian-ca.crt, then go to Settings &gt; Profile Downloaded &gt; Install.
+Afterwards enable it under Settings &gt; General &gt; About &gt; Certificate Trust Settings.</p>
+<h2>Android</h2>
+<p>Download guardian-ca.crt, then go to Settings &gt; Security &gt; Encryption &amp; credentials &gt; Install a certificate &gt; CA certificate.</p>
+<h2>Windows</h2>
+<p>Open guardian-ca.crt, choose Install Certificate &gt; Local Machine &gt; Place all certificates in the following store &gt; Trusted Root Certification Authorities.</p>
+<h2>macOS</h2>
+<p>Open guardian-ca.crt to add it to Keychain Access, then double-click it under System and set Trust to Always Trust.</p>
+<h2>ChromeOS</h2>
+<p>Go to Settings &gt; Privacy and security &gt; Security &gt; Manage certificates &gt; Authorities &gt; Import, and select guardian-ca.crt.</p>
+<h2>Linux</h2>
+<p>Copy guardian-ca.crt to /usr/local/share/ca-certificates/ and run <code>sudo update-ca-certificates</code>.
+Firefox keeps its own store: Settings &gt; Privacy &amp; Security &gt; Certificates &gt; View Certificates &gt; Authorities &gt; Import.</p>
+</body>
+</html>
+`))
+
+/*
+ * Addresses of this machine other devices on the LAN can reach
+ */
+func lanAddresses() []string {
+	var addresses []string
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return addresses
+	}
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && !ipNet.IP.IsLoopback() && ipNet.IP.To4() != nil {
+			addresses = append(addresses, ipNet.IP.String())
+		}
+	}
+	return addresses
+}
+
+func certificateFingerprint(der []byte) string {
+	sum := sha256.Sum256(der)
+	var parts []string
+	for _, b := range sum {
+		parts = append(parts, fmt.Sprintf("%02X", b))
+	}
+	return strings.Join(parts, ":")
+}
+
+/*
+ * Temporarily serve the root CA and install instructions over HTTP on the LAN
+ */
+func ServeRootCa(targetName string, port uint16, duration string) int {
+
+	timeout, err := time.ParseDuration(duration)
+	if err != nil || timeout <= 0 {
+		log.Fatalf("Invalid duration '%s'\n", duration)
+		return -1
+	}
+
+	certPem, err := ioutil.ReadFile(getCaPathDir(targetName))
+	if err != nil {
+		log.Fatal("Failed to open root CA, have you already deployed?")
+		return -1
+	}
+	block, _ := pem.Decode(certPem)
+	if block == nil {
+		log.Fatalln("Root CA file is not a PEM certificate")
+		return -1
+	}
+	fingerprint := certificateFingerprint(block.Bytes)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		caInstallPage.Execute(w, struct{ Fingerprint string }{fingerprint})
+	})
+	mux.HandleFunc("/guardian-ca.crt", func(w http.ResponseWriter, r *http.Request) {
+		log.Printf("%s downloaded the root CA\n", r.RemoteAddr)
+		w.Header().Set("Content-Type", "application/x-x509-ca-cert")
+		w.Write(certPem)
+	})
+	mux.HandleFunc("/guardian-ca.der", func(w http.ResponseWriter, r *http.Request) {
+		log.Printf("%s downloaded the root CA\n", r.RemoteAddr)
+		w.Header().Set("Content-Type", "application/x-x509-ca-cert")
+		w.Write(block.Bytes)
+	})
+
+	server := &http.Server{Addr: fmt.Sprintf(":%d", port), Handler: mux}
+	listener, err := net.Listen("tcp", server.Addr)
+	if err != nil {
+		log.Fatal("Failed to listen: ", err)
+		return -1
+	}
+
+	log.Printf("Serving the root CA for %s, press Ctrl-C to stop. Open on the device:\n", timeout)
+	for _, address := range lanAddresses() {
+		fmt.Printf("  http://%s:%d/\n", address, port)
+	}
+	fmt.Printf("SHA-256 fingerprint: %s\n", fingerprint)
+
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		select {
+		case <-interrupt:
+		case <-time.After(timeout):
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		server.Shutdown(ctx)
+	}()
+
+	err = server.Serve(listener)
+	if err != nil && err != http.ErrServerClosed {
+		log.Fatal("Failed to serve root CA: ", err)
+		return -1
+	}
+
+	log.Println("Stopped serving the root CA")
+	return 0
+}
@@ -5,6 +5,7 @@ import (
 	"log"
 	"os"
 	"path"
+	"path/filepath"
 
 	"github.com/go-git/go-git/v5"
 )
@@ -15,11 +16,13 @@ func Setup(name string) int {
 
 	err := initLocal()
 	if err != nil {
+		log.Fatal("Failed to initialize: ", err)
 		return -1
 	}
 
 	config, err := loadConfig()
 	if err != nil {
+		log.Fatal("Failed to load config: ", err)
 		return -1
 	}
 
@@ -29,97 +32,114 @@ func Setup(name string) int {
 		return -1
 	}
 
-	playbookDir := path.Join(GuardianConfigHome(), "playbooks")
-
-	/*
-	 * TODO: instead of wiping the directory and re-cloning, just do a git pull
-	 */
-	os.RemoveAll(playbookDir)
-	os.MkdirAll(playbookDir, 0o755)
+	// Check the platform before doing any work
+	done := progressStep(name, "check-platform")
+	err = checkSetupPlatform(target)
+	done(err)
+	if err != nil {
+		log.Fatal("Cannot set up host: ", err)
+		return -1
+	}
 
-	log.Printf("Cloning playbooks into \"%s\"...\n", playbookDir)
-	_, err = git.PlainClone(playbookDir, false, &git.CloneOptions{
-		URL:      playbookGit,
-		Progress: os.Stdout,
-	})
+	password, err := sudoPassword(target)
+	if err != nil {
+		log.Fatal("Failed to get password: ", err)
+		return -1
+	}
 
+	err = runSetupPlaybook(target, password)
 	if err != nil {
-		log.Fatal("Failed to clone playbooks: ", err)
+		log.Fatal(err)
 		return -1
 	}
 
+	return 0
+
+}
+
+/*
+ * Clone the setup playbook and run it on a target. It installs k3s at the version it
+ * pins, so it also upgrades k3s on a host set up before.
+ */
+func runSetupPlaybook(target Host, password string) error {
+	name := target.Name
+	playbookDir := filepath.Join(GuardianConfigHome(), "playbooks")
+
+	// Replays run offline, use the playbooks already cloned
+	if _, err := os.Stat(playbookDir); err != nil || !replaying() {
+		/*
+		 * TODO: instead of wiping the directory and re-cloning, just do a git pull
+		 */
+		os.RemoveAll(playbookDir)
+		os.MkdirAll(playbookDir, 0o755)
+
+		log.Printf("Cloning playbooks into \"%s\"...\n", playbookDir)
+		done := progressStep(name, "clone-playbooks")
+		_, err = git.PlainClone(playbookDir, false, &git.CloneOptions{
+			URL:      playbookGit,
+			Progress: os.Stdout,
+		})
+		done(err)
+
+		if err != nil {
+			return fmt.Errorf("failed to clone playbooks: %s", err)
+		}
+	}
+
 	// Create hosts file
-	inventoryFile, err := os.Create(path.Join(playbookDir, "hosts.yml"))
+	inventoryFile, err := os.Create(filepath.Join(playbookDir, "hosts.yml"))
 	if err != nil {
-		log.Fatal("Failed to create config file: ", err)
-		return -1
+		return fmt.Errorf("failed to create config file: %s", err)
 	}
 	defer inventoryFile.Close()
 	inventoryFile.WriteString("[local]\n")
 	inventoryFile.WriteString("127.0.0.1\n")
 
 	// Create vars file
-	varsFile, err := os.Create(path.Join(playbookDir, "extra.yml"))
+	varsFile, err := os.Create(filepath.Join(playbookDir, "extra.yml"))
 	if err != nil {
-		log.Fatal("Failed to create config file: ", err)
-		return -1
+		return fmt.Errorf("failed to create config file: %s", err)
 	}
 	defer varsFile.Close()
 	varsFile.WriteString(fmt.Sprintf("home_dir: \"%s\"\n", target.HomePath))
 
-	log.Printf("Copying playbook to remote host...")
-	dstPath := path.Join(target.HomePath, ".guardian", "playbooks")
-
-	client, err := getHostSshClient(target)
+	// Only informs, setup runs even if the target can't be sized
+	err = estimateSetupTransfer(target, playbookDir)
 	if err != nil {
-		log.Fatal("Failed to create SSH client: ", err)
-		return -1
-	}
-	err = client.NewCryptoContext()
-	if err != nil {
-		log.Fatal("Failed to create SSH client: ", err)
-		return -1
+		log.Printf("Failed to estimate the transfer: %s\n", err)
 	}
 
-	if err != nil {
-		log.Fatal("Failed to generate SSH config: ", err)
-		return -1
-	}
+	log.Printf("Copying playbook to remote host...")
+	dstPath := path.Join(target.HomePath, ".guardian", "playbooks")
 
-	_, err = client.RunCommands([]string{fmt.Sprintf("rm -rf %s", dstPath)}, false)
+	done := progressStep(name, "copy-playbooks")
+	_, err = runHostCommands(target, []string{fmt.Sprintf("rm -rf %s", dstPath)}, false)
 	if err != nil {
-		log.Fatal("Failed to delete remote playbooks: ", err)
-		return -1
+		done(err)
+		return fmt.Errorf("failed to delete remote playbooks: %s", err)
 	}
 
-	err = client.Put(playbookDir, dstPath)
+	err = putHostFile(target, playbookDir, dstPath)
+	done(err)
 	if err != nil {
-		log.Fatal("Failed to copy playbooks to target host: ", err)
-		return -1
+		return fmt.Errorf("failed to copy playbooks to target host: %s", err)
 	}
+	progressTransfer(name, "copy-playbooks", playbookDir)
 
 	log.Printf("Executing playbook on target host \"%s\"...\n", target.Name)
 
-	password := os.Getenv("SUDO_PASSWORD")
-	if password == "" {
-		log.Printf("You will need to enter your password for sudo access.")
-		password, err = getUserCredentials()
-		if err != nil {
-			log.Fatal("Failed to get password: ", err)
-		}
-	}
-
-	_, err = client.RunCommandsWithPrompts([]string{
+	done = progressStep(name, "run-playbook")
+	ctx, cancel := stepContext(playbookTimeout)
+	defer cancel()
+	_, err = runHostCommandsWithPromptsContext(ctx, target, []string{
 		fmt.Sprintf("cd %s", dstPath),
 		"sudo bash setup.sh",
 	}, map[string]string{
 		"[sudo] password for ": password,
 	}, true)
+	done(err)
 	if err != nil {
-		log.Fatal("Failed to run playbook: ", err)
-		return -1
+		return fmt.Errorf("failed to run playbook: %s", err)
 	}
-
-	return 0
-
+	return nil
 }
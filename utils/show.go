@@ -0,0 +1,184 @@
+package utils
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"regexp"
+	"sync"
+)
+
+// Where show commands write their data, set by the '--output-file' flag
+var outputFile *os.File
+
+/*
+ * Stdout, or the output file if one was given. Looked up on every call since
+ * json progress replaces os.Stdout.
+ */
+func showOutput() io.Writer {
+	if outputFile != nil {
+		return outputFile
+	}
+	return os.Stdout
+}
+
+/*
+ * Write the data of show commands to a file instead of stdout, log lines stay on
+ * stderr. Call the returned function before exiting to close the file.
+ */
+func OpenOutputFile(path string) (func() error, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	outputFile = f
+	return func() error {
+		outputFile = nil
+		return f.Close()
+	}, nil
+}
+
+// Flushes the prefixed output of the current target, if any, without logging
+var stopTargetOutput func()
+var targetOutputHook sync.Once
+
+/*
+ * Prefix log lines and everything printed to stdout with the target's name, for
+ * commands that run against several targets in turn. Call the returned function
+ * before moving on to the next target to flush its output.
+ */
+func PrefixTargetOutput(name string) func() {
+	prefix := fmt.Sprintf("[%s] ", name)
+	log.SetPrefix(prefix)
+	// Json progress events already carry the target taken from the log prefix
+	if jsonProgress() {
+		return func() { log.SetPrefix("") }
+	}
+
+	reader, writer, err := os.Pipe()
+	if err != nil {
+		log.Printf("Failed to capture output: %s\n", err)
+		return func() { log.SetPrefix("") }
+	}
+	stdout := os.Stdout
+	os.Stdout = writer
+
+	done := make(chan struct{})
+	go func() {
+		scanner := bufio.NewScanner(reader)
+		scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+		for scanner.Scan() {
+			fmt.Fprintf(stdout, "%s%s\n", prefix, scanner.Text())
+		}
+		close(done)
+	}()
+
+	stopTargetOutput = func() {
+		os.Stdout = stdout
+		writer.Close()
+		<-done
+	}
+	stop := func() {
+		stopTargetOutput()
+		stopTargetOutput = nil
+		log.SetPrefix("")
+	}
+	// A log.Fatal would otherwise drop what is still in the pipe. The hook runs
+	// with the logger held, so it leaves the prefix alone.
+	targetOutputHook.Do(func() {
+		OnFatal(func() {
+			if stopTargetOutput != nil {
+				stopTargetOutput()
+			}
+		})
+	})
+	return stop
+}
+
+/*
+ * Options for narrowing down the output of show commands
+ */
+type ShowOptions struct {
+	Limit   int
+	Offset  int
+	Pattern string
+}
+
+/*
+ * Streams entries to the show output, applying pattern, offset and limit as it goes
+ */
+type entryWriter struct {
+	out     *bufio.Writer
+	pattern *regexp.Regexp
+	offset  int
+	limit   int
+	matched int
+	written int
+	pending []string
+}
+
+func newEntryWriter(opts ShowOptions) (*entryWriter, error) {
+	w := &entryWriter{offset: opts.Offset, limit: opts.Limit}
+
+	if opts.Pattern != "" {
+		pattern, err := regexp.Compile(opts.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid pattern '%s': %s", opts.Pattern, err)
+		}
+		w.pattern = pattern
+	}
+
+	w.out = bufio.NewWriter(showOutput())
+
+	return w, nil
+}
+
+/*
+ * Write a line unconditionally
+ */
+func (w *entryWriter) line(line string) {
+	fmt.Fprintln(w.out, line)
+}
+
+/*
+ * Queue a heading; it is only written if an entry below it is
+ */
+func (w *entryWriter) section(line string) {
+	w.pending = append(w.pending, line)
+}
+
+/*
+ * Write an entry if it matches and falls within the page, returns false once the limit is reached
+ */
+func (w *entryWriter) entry(line string) bool {
+	if w.limit > 0 && w.written >= w.limit {
+		return false
+	}
+	if w.pattern != nil && !w.pattern.MatchString(line) {
+		return true
+	}
+	w.matched++
+	if w.matched <= w.offset {
+		return true
+	}
+	for _, heading := range w.pending {
+		fmt.Fprintln(w.out, heading)
+	}
+	w.pending = nil
+	fmt.Fprintln(w.out, line)
+	w.written++
+	return true
+}
+
+/*
+ * Drop headings queued for a section that had no entries written
+ */
+func (w *entryWriter) endSection() {
+	w.pending = nil
+}
+
+func (w *entryWriter) Close() error {
+	return w.out.Flush()
+}
@@ -0,0 +1,190 @@
+package utils
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Restoring a snapshot saves the overrides it replaces under this name
+const previousSnapshot = "previous"
+
+func getSnapshotDir(name string) string {
+	return filepath.Join(getHostDataDir(name), "snapshots")
+}
+
+func validSnapshotName(snapshot string) bool {
+	if !targetNamePattern.MatchString(snapshot) {
+		log.Fatalf("Invalid snapshot name '%s', use letters, digits, '.', '_' and '-'\n", snapshot)
+		return false
+	}
+	return true
+}
+
+func getSnapshotPath(name string, snapshot string) string {
+	return filepath.Join(getSnapshotDir(name), fmt.Sprintf("%s.yaml", snapshot))
+}
+
+/*
+ * Copy the host's overrides file to a snapshot
+ */
+func saveSnapshot(name string, snapshot string) error {
+	data, err := ioutil.ReadFile(getHostFilterConfigPath(name))
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(getSnapshotDir(name), privateDirMode)
+	if err != nil {
+		return err
+	}
+	// Overrides hold the database and API passwords
+	f, err := createPrivateFile(getSnapshotPath(name, snapshot))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = f.Write(data)
+	return err
+}
+
+/*
+ * Save a named copy of the target's current overrides
+ */
+func CreateSnapshot(targetName string, snapshot string, force bool) int {
+
+	if !validSnapshotName(snapshot) {
+		return -1
+	}
+
+	// Make sure the target has an overrides file to copy
+	_, err := getHostFilterConfig(targetName)
+	if err != nil {
+		log.Fatal("Failed to get host config: ", err)
+		return -1
+	}
+
+	if _, err := os.Stat(getSnapshotPath(targetName, snapshot)); err == nil && !force {
+		log.Fatalf("Snapshot '%s' already exists, use --force to replace it\n", snapshot)
+		return -1
+	}
+
+	err = saveSnapshot(targetName, snapshot)
+	if err != nil {
+		log.Fatal("Failed to save snapshot: ", err)
+		return -1
+	}
+
+	log.Printf("Saved snapshot '%s'\n", snapshot)
+	return 0
+}
+
+func ListSnapshots(targetName string) int {
+
+	entries, err := ioutil.ReadDir(getSnapshotDir(targetName))
+	if err != nil && !os.IsNotExist(err) {
+		log.Fatal("Failed to read snapshots: ", err)
+		return -1
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].ModTime().Before(entries[j].ModTime())
+	})
+
+	current, _ := ioutil.ReadFile(getHostFilterConfigPath(targetName))
+
+	w := tabwriter.NewWriter(showOutput(), 1, 1, 3, ' ', 0)
+	fmt.Fprintln(w, "Name\tCreated\tCurrent")
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".yaml") {
+			continue
+		}
+		snapshot := strings.TrimSuffix(entry.Name(), ".yaml")
+		data, _ := ioutil.ReadFile(getSnapshotPath(targetName, snapshot))
+		matches := ""
+		if current != nil && bytes.Equal(data, current) {
+			matches = "*"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\n", snapshot, entry.ModTime().Format("2006-01-02 15:04:05"), matches)
+	}
+	w.Flush()
+
+	return 0
+}
+
+/*
+ * Replace the target's overrides with a snapshot, keeping the replaced ones as the 'previous' snapshot
+ */
+func restoreSnapshot(targetName string, snapshot string) error {
+
+	data, err := ioutil.ReadFile(getSnapshotPath(targetName, snapshot))
+	if os.IsNotExist(err) {
+		return fmt.Errorf("snapshot '%s' does not exist", snapshot)
+	} else if err != nil {
+		return fmt.Errorf("failed to read snapshot: %s", err)
+	}
+
+	var config FilterConfig
+	err = yaml.Unmarshal(data, &config)
+	if err != nil {
+		return fmt.Errorf("snapshot is not a valid filter config: %s", err)
+	}
+
+	// Restoring 'previous' swaps back and forth between the two
+	err = saveSnapshot(targetName, previousSnapshot)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to save current overrides: %s", err)
+	}
+
+	// A restore replaces the overrides whatever revision they are at
+	config.Revision, err = readRevision(getHostFilterConfigPath(targetName))
+	if err != nil {
+		return fmt.Errorf("failed to read host config: %s", err)
+	}
+	err = writeHostFilterConfig(targetName, config)
+	if err != nil {
+		return fmt.Errorf("failed to write host config: %s", err)
+	}
+	return nil
+}
+
+func RestoreSnapshot(targetName string, snapshot string) int {
+
+	if !validSnapshotName(snapshot) {
+		return -1
+	}
+
+	err := restoreSnapshot(targetName, snapshot)
+	if err != nil {
+		log.Fatal(err)
+		return -1
+	}
+
+	log.Printf("Restored snapshot '%s', the replaced overrides are saved as '%s'; deploy to apply\n", snapshot, previousSnapshot)
+	return 0
+}
+
+func DeleteSnapshot(targetName string, snapshot string) int {
+
+	if !validSnapshotName(snapshot) {
+		return -1
+	}
+
+	err := os.Remove(getSnapshotPath(targetName, snapshot))
+	if os.IsNotExist(err) {
+		log.Fatalf("Snapshot '%s' does not exist\n", snapshot)
+		return -1
+	} else if err != nil {
+		log.Fatal("Failed to delete snapshot: ", err)
+		return -1
+	}
+
+	log.Printf("Deleted snapshot '%s'\n", snapshot)
+	return 0
+}
@@ -0,0 +1,51 @@
+package utils
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// Registered by the embedded driver in sqlite_driver.go
+const sqliteDriver = "sqlite"
+
+/*
+ * Open an SQLite database file through the embedded driver. One connection is
+ * kept, so the busy timeout applies to every statement and writers of this
+ * process queue instead of failing.
+ */
+func openSqlite(path string) (*sql.DB, error) {
+	if !contains(sql.Drivers(), sqliteDriver) {
+		return nil, fmt.Errorf("this build has no SQLite driver, build with '-tags sqlite' to use SQLite storage")
+	}
+	db, err := sql.Open(sqliteDriver, path)
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(1)
+	// Other processes, i.e. the daemon, write to the same file
+	if _, err := db.Exec("PRAGMA busy_timeout = 5000"); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+/*
+ * The first column of the rows a query selects
+ */
+func queryStrings(db *sql.DB, query string, args ...interface{}) ([]string, error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var values []string
+	for rows.Next() {
+		var value string
+		if err := rows.Scan(&value); err != nil {
+			return nil, err
+		}
+		values = append(values, value)
+	}
+	return values, rows.Err()
+}
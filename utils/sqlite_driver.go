@@ -0,0 +1,6 @@
+//go:build sqlite
+
+package utils
+
+// Pure Go, so the CLI stays a static build without cgo
+import _ "modernc.org/sqlite"
@@ -0,0 +1,130 @@
+package utils
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"strings"
+)
+
+// Directives the chart sets itself; overriding them breaks the stack
+var squidManagedDirectives = []string{
+	"http_port", "https_port", "cache_dir", "pid_filename", "include",
+	"cache_effective_user", "coredump_dir", "sslcrtd_program", "workers",
+}
+
+// Directives commonly needed in snippets, anything else only gets a warning
+var squidKnownDirectives = []string{
+	"acl", "http_access", "cache_peer", "cache_peer_access", "never_direct", "always_direct",
+	"prefer_direct", "request_header_access", "reply_header_access", "request_header_add",
+	"header_replace", "forwarded_for", "via", "visible_hostname", "dns_nameservers",
+	"cache", "cache_mem", "maximum_object_size", "maximum_object_size_in_memory",
+	"refresh_pattern", "logformat", "access_log", "delay_pools", "delay_class",
+	"delay_parameters", "delay_access", "tcp_outgoing_address", "ssl_bump",
+	"connect_timeout", "read_timeout", "request_timeout", "client_lifetime",
+}
+
+/*
+ * Check every line of a squid.conf fragment is a directive the chart leaves alone
+ */
+func validateSquidSnippet(snippet string) ([]string, error) {
+	var warnings []string
+	directives := 0
+	for i, line := range strings.Split(snippet, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		directive := fields[0]
+		if contains(squidManagedDirectives, directive) {
+			return nil, fmt.Errorf("line %d: '%s' is managed by guardian-angel and can't be set in a snippet", i+1, directive)
+		}
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("line %d: '%s' has no value", i+1, directive)
+		}
+		if !contains(squidKnownDirectives, directive) {
+			warnings = append(warnings, fmt.Sprintf("line %d: unknown directive '%s', check it against squid.conf.documented", i+1, directive))
+		}
+		directives++
+	}
+	if directives == 0 {
+		return nil, fmt.Errorf("snippet has no directives")
+	}
+	return warnings, nil
+}
+
+/*
+ * Add a raw squid.conf fragment to the filter's squid configuration
+ */
+func SetSquidSnippet(targetName string, fileName string) int {
+
+	data, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		log.Fatal("Failed to read snippet: ", err)
+		return -1
+	}
+	snippet := strings.ReplaceAll(string(data), "\r", "")
+
+	warnings, err := validateSquidSnippet(snippet)
+	if err != nil {
+		log.Fatal("Invalid snippet: ", err)
+		return -1
+	}
+	for _, warning := range warnings {
+		log.Printf("Warning: %s\n", warning)
+	}
+
+	config, err := getHostFilterConfig(targetName)
+	if err != nil {
+		log.Fatal("Failed to get host config: ", err)
+		return -1
+	}
+
+	config.SquidSnippet = snippet
+
+	err = writeHostFilterConfig(targetName, config)
+	if err != nil {
+		log.Fatal("Failed to write host config: ", err)
+		return -1
+	}
+
+	log.Println("Set squid config snippet; deploy to apply")
+	return 0
+}
+
+func ShowSquidSnippet(targetName string) int {
+
+	config, err := getHostFilterConfig(targetName)
+	if err != nil {
+		log.Fatal("Failed to get host config: ", err)
+		return -1
+	}
+
+	if config.SquidSnippet == "" {
+		log.Println("No squid config snippet set")
+		return 0
+	}
+	fmt.Fprint(showOutput(), config.SquidSnippet)
+	return 0
+}
+
+func RemoveSquidSnippet(targetName string) int {
+
+	config, err := getHostFilterConfig(targetName)
+	if err != nil {
+		log.Fatal("Failed to get host config: ", err)
+		return -1
+	}
+
+	config.SquidSnippet = ""
+
+	err = writeHostFilterConfig(targetName, config)
+	if err != nil {
+		log.Fatal("Failed to write host config: ", err)
+		return -1
+	}
+
+	log.Println("Removed squid config snippet; deploy to apply")
+	return 0
+}
@@ -1,20 +1,27 @@
 package utils
 
 import (
+	"bufio"
+	"bytes"
+	"context"
 	"crypto/md5"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"net"
 	"os"
 	"path"
+	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/justinschw/gofigure/crypto"
-	"github.com/manifoldco/promptui"
+	"github.com/pkg/sftp"
 	"golang.org/x/crypto/ssh"
 	"golang.org/x/crypto/ssh/knownhosts"
+	"golang.org/x/term"
 )
 
 /*
@@ -27,7 +34,7 @@ import (
  */
 func getSshKeysDir() string {
 	guardianHome := GuardianConfigHome()
-	sshKeysDir := path.Join(guardianHome, "ssh-keys")
+	sshKeysDir := filepath.Join(guardianHome, "ssh-keys")
 	return sshKeysDir
 }
 
@@ -35,21 +42,21 @@ func getSshKeysDir() string {
  * Get the path to the private key file
  */
 func getPrivateKeyFilename() string {
-	return path.Join(getSshKeysDir(), "id_rsa")
+	return filepath.Join(getSshKeysDir(), "id_rsa")
 }
 
 /*
  * Get the path to the public key file
  */
 func getPublicKeyFilename() string {
-	return path.Join(getSshKeysDir(), "id_rsa.pub")
+	return filepath.Join(getSshKeysDir(), "id_rsa.pub")
 }
 
 /*
  * Get known_hosts file
  */
 func getKnownHostsFile() string {
-	return path.Join(getSshKeysDir(), "known_hosts")
+	return filepath.Join(getSshKeysDir(), "known_hosts")
 }
 
 /*
@@ -65,7 +72,7 @@ func initSsh(bitSize int) error {
 	sshKeysDir := getSshKeysDir()
 	_, err = os.Stat(sshKeysDir)
 	if os.IsNotExist(err) {
-		os.MkdirAll(sshKeysDir, 0o755)
+		os.MkdirAll(sshKeysDir, privateDirMode)
 	}
 
 	keyPair := crypto.SshKeyPair{
@@ -95,7 +102,7 @@ func initSsh(bitSize int) error {
 	_, knownHostsError := os.Stat(knownHostsFile)
 	if os.IsNotExist(knownHostsError) {
 		// Create config file
-		f, err := os.Create(knownHostsFile)
+		f, err := createPrivateFile(knownHostsFile)
 		if err != nil {
 			log.Fatal("Failed to create config file: ", err)
 			return err
@@ -120,7 +127,7 @@ func knownHostContains(line string) (error, bool) {
 
 func appendToKnownHosts(line string) error {
 	knownHostsFile := getKnownHostsFile()
-	f, err := os.OpenFile(knownHostsFile, os.O_APPEND|os.O_WRONLY, 0666)
+	f, err := os.OpenFile(knownHostsFile, os.O_APPEND|os.O_WRONLY, privateFileMode)
 	if err != nil {
 		log.Fatal("Failed to open known_hosts file: ", err)
 		return err
@@ -134,6 +141,129 @@ func appendToKnownHosts(line string) error {
 	return nil
 }
 
+/*
+ * Answer keyboard-interactive challenges, i.e. PAM one-time passwords, by asking
+ * the user. A password question is answered with password when there is one.
+ */
+func keyboardInteractive(password string) ssh.AuthMethod {
+	return ssh.KeyboardInteractive(func(name string, instruction string, questions []string, echos []bool) ([]string, error) {
+		if len(questions) == 0 {
+			return nil, nil
+		}
+		for _, text := range []string{name, instruction} {
+			if text = strings.TrimSpace(text); text != "" {
+				fmt.Println(text)
+			}
+		}
+		answers := make([]string, len(questions))
+		for i, question := range questions {
+			if password != "" && strings.Contains(strings.ToLower(question), "password") {
+				answers[i] = password
+				continue
+			}
+			if err := checkInteractive("an SSH login challenge"); err != nil {
+				return nil, err
+			}
+			fmt.Print(question)
+			var answer []byte
+			var err error
+			if echos[i] {
+				answer, err = bufio.NewReader(os.Stdin).ReadBytes('\n')
+			} else {
+				answer, err = term.ReadPassword(int(os.Stdin.Fd()))
+				fmt.Println("")
+			}
+			if err != nil {
+				return nil, err
+			}
+			answers[i] = strings.TrimRight(string(answer), "\r\n")
+		}
+		return answers, nil
+	})
+}
+
+/*
+ * Private key to log in to a host with: its own identity file, or the CLI's key
+ */
+func hostPrivateKeyFilename(host Host) string {
+	if host.IdentityFile != "" {
+		return host.IdentityFile
+	}
+	return getPrivateKeyFilename()
+}
+
+/*
+ * Absolute path of an existing private key given with --identity-file
+ */
+func resolveIdentityFile(file string) (string, error) {
+	if file == "~" || strings.HasPrefix(file, "~/") {
+		file = filepath.Join(UserHomeDir(), file[1:])
+	}
+	file, err := filepath.Abs(file)
+	if err != nil {
+		return "", err
+	}
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return "", err
+	}
+	// Keys protected by a passphrase are decrypted when they are used
+	_, err = ssh.ParsePrivateKey(data)
+	if _, ok := err.(*ssh.PassphraseMissingError); !ok && err != nil {
+		return "", fmt.Errorf("%s is not a private key: %s", file, err)
+	}
+	return file, nil
+}
+
+/*
+ * Log in to a target with its identity file, accepting its host key, where
+ * targets without one get the CLI's key installed
+ */
+func checkIdentityLogin(host Host) error {
+	sshClient := crypto.SshClient{
+		Address:         host.Address,
+		Port:            host.Port,
+		Username:        host.Username,
+		HostKeyCallback: PromptAtKey,
+		KnownHostsFile:  getKnownHostsFile(),
+	}
+	err := newKeyCryptoContext(&sshClient, host.IdentityFile)
+	if err != nil {
+		return err
+	}
+	client, err := dialHostConfig(interruptContext, host, sshClient.SshConfig, nil)
+	if err != nil {
+		return fmt.Errorf("failed to log in with %s: %s", host.IdentityFile, err)
+	}
+	return client.Close()
+}
+
+/*
+ * Log in to a known target with a password instead of a key
+ */
+func checkPasswordLogin(host Host, password string) error {
+	hostKeyCallback, err := knownhosts.New(getKnownHostsFile())
+	if err != nil {
+		return err
+	}
+	var jumpConfig *ssh.ClientConfig
+	if host.ProxyJump != nil {
+		jumpConfig, err = getJumpSshConfig(host)
+		if err != nil {
+			return err
+		}
+	}
+	client, err := dialHostConfig(interruptContext, host, &ssh.ClientConfig{
+		User:            host.Username,
+		Auth:            []ssh.AuthMethod{ssh.Password(password), keyboardInteractive(password)},
+		HostKeyCallback: hostKeyCallback,
+	}, jumpConfig)
+	if err != nil {
+		return err
+	}
+	return client.Close()
+}
+
 func getHostSshClient(host Host) (crypto.SshClient, error) {
 
 	client := crypto.SshClient{
@@ -142,13 +272,544 @@ func getHostSshClient(host Host) (crypto.SshClient, error) {
 		Username:       host.Username,
 		KnownHostsFile: getKnownHostsFile(),
 	}
-	client.SetPrivateKeyAuth(getPrivateKeyFilename(), "")
 
-	err := client.NewCryptoContext()
+	err := newKeyCryptoContext(&client, hostPrivateKeyFilename(host))
 	return client, err
 
 }
 
+/*
+ * Client config for logging in to a host's jump host with the CLI's key
+ */
+func getJumpSshConfig(host Host) (*ssh.ClientConfig, error) {
+	client := crypto.SshClient{
+		Address:        host.ProxyJump.Address,
+		Port:           host.ProxyJump.Port,
+		Username:       host.ProxyJump.Username,
+		KnownHostsFile: getKnownHostsFile(),
+	}
+
+	err := newKeyCryptoContext(&client, getPrivateKeyFilename())
+	return client.SshConfig, err
+}
+
+/*
+ * A connection tunnelled through a jump host, closing it closes the tunnel too
+ */
+type jumpConn struct {
+	net.Conn
+	jump *ssh.Client
+}
+
+func (conn *jumpConn) Close() error {
+	err := conn.Conn.Close()
+	conn.jump.Close()
+	return err
+}
+
+/*
+ * Connect to a host's SSH port, through its jump host if it has one. jumpConfig
+ * logs in to the jump host, nil for the CLI's key. The first hop goes through the
+ * host's SSH proxy when one is set.
+ */
+func dialSshPort(ctx context.Context, host Host, jumpConfig *ssh.ClientConfig) (net.Conn, error) {
+	server := net.JoinHostPort(host.Address, fmt.Sprintf("%d", host.Port))
+	if host.ProxyJump == nil {
+		netConn, err := dialSshTcp(ctx, host, server)
+		if err != nil {
+			return nil, fmt.Errorf("dial to %v failed %v", server, err)
+		}
+		return netConn, nil
+	}
+
+	if jumpConfig == nil {
+		var err error
+		jumpConfig, err = getJumpSshConfig(host)
+		if err != nil {
+			return nil, err
+		}
+	}
+	jumpServer := net.JoinHostPort(host.ProxyJump.Address, fmt.Sprintf("%d", host.ProxyJump.Port))
+	jumpNetConn, err := dialSshTcp(ctx, host, jumpServer)
+	if err != nil {
+		return nil, fmt.Errorf("dial to jump host %v failed %v", jumpServer, err)
+	}
+	c, chans, reqs, err := ssh.NewClientConn(jumpNetConn, jumpServer, jumpConfig)
+	if err != nil {
+		jumpNetConn.Close()
+		return nil, fmt.Errorf("dial to jump host %v failed %v", jumpServer, err)
+	}
+	jump := ssh.NewClient(c, chans, reqs)
+
+	// The jump host's dial doesn't take a context, closing the client stops it
+	dialed := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			jump.Close()
+		case <-dialed:
+		}
+	}()
+	netConn, err := jump.Dial("tcp", server)
+	close(dialed)
+	if err != nil {
+		jump.Close()
+		return nil, fmt.Errorf("dial to %v through jump host %v failed %v", server, jumpServer, err)
+	}
+	return &jumpConn{Conn: netConn, jump: jump}, nil
+}
+
+/*
+ * Log in to a host over SSH, giving up when ctx is cancelled
+ */
+func dialHostConfig(ctx context.Context, host Host, config *ssh.ClientConfig, jumpConfig *ssh.ClientConfig) (*ssh.Client, error) {
+	netConn, err := dialSshPort(ctx, host, jumpConfig)
+	if err != nil {
+		return nil, err
+	}
+	server := net.JoinHostPort(host.Address, fmt.Sprintf("%d", host.Port))
+	// The handshake doesn't take a context either, a target that accepts the connection
+	// but never answers must not outlast it
+	if deadline, ok := ctx.Deadline(); ok {
+		netConn.SetDeadline(deadline)
+	}
+	handshaken := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			netConn.Close()
+		case <-handshaken:
+		}
+	}()
+	c, chans, reqs, err := ssh.NewClientConn(netConn, server, config)
+	close(handshaken)
+	if err != nil {
+		netConn.Close()
+		return nil, contextError(ctx, fmt.Errorf("dial to %v failed %v", server, err))
+	}
+	netConn.SetDeadline(time.Time{})
+	return ssh.NewClient(c, chans, reqs), nil
+}
+
+/*
+ * Dial a host over SSH with its key, giving up when ctx is cancelled
+ */
+func dialHost(ctx context.Context, host Host) (*ssh.Client, error) {
+	sshClient, err := getHostSshClient(host)
+	if err != nil {
+		return nil, err
+	}
+	return dialHostConfig(ctx, host, sshClient.SshConfig, nil)
+}
+
+/*
+ * Add the CLI's public key to the authorized keys of the user client is logged in as
+ */
+func authorizeKey(client *ssh.Client) error {
+	keyData, err := ioutil.ReadFile(getPublicKeyFilename())
+	if err != nil {
+		return err
+	}
+	key := shellQuote(strings.TrimSpace(string(keyData)))
+	session, err := client.NewSession()
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+	out, err := session.CombinedOutput(fmt.Sprintf(
+		"mkdir -p $HOME/.ssh && chmod 700 $HOME/.ssh && (grep -qxF %s $HOME/.ssh/authorized_keys 2>/dev/null || echo %s >> $HOME/.ssh/authorized_keys)",
+		key, key))
+	if err != nil {
+		return fmt.Errorf("%s: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+/*
+ * Remove the CLI's public key from the authorized keys of a host's user again
+ */
+func unauthorizeKey(host Host) error {
+	keyData, err := ioutil.ReadFile(getPublicKeyFilename())
+	if err != nil {
+		return err
+	}
+	key := shellQuote(strings.TrimSpace(string(keyData)))
+	// Rewritten in place, so the file keeps its owner and mode
+	_, err = runHostCommands(host, []string{
+		"keys=$HOME/.ssh/authorized_keys",
+		fmt.Sprintf("grep -vxF %s \"$keys\" > \"$keys.guardian\"; cat \"$keys.guardian\" > \"$keys\" && rm -f \"$keys.guardian\"", key),
+	}, false)
+	return err
+}
+
+/*
+ * Log in to a new target with its password and install the CLI's key on it. A jump
+ * host is logged in to with the CLI's key, or its own password if the key isn't
+ * authorized there yet, in which case the key is installed on it as well.
+ */
+func copyKeyToHost(host Host, password string) error {
+	if host.ProxyJump == nil {
+		sshClient := crypto.SshClient{
+			Address:         host.Address,
+			Port:            host.Port,
+			Username:        host.Username,
+			HostKeyCallback: PromptAtKey,
+			KnownHostsFile:  getKnownHostsFile(),
+		}
+		sshClient.SetPasswordAuth(password)
+		err := sshClient.NewCryptoContext()
+		if err != nil {
+			return err
+		}
+		// Targets that only take keyboard-interactive logins get the password there
+		sshClient.SshConfig.Auth = append(sshClient.SshConfig.Auth, keyboardInteractive(password))
+		pair := crypto.SshKeyPair{
+			PrivateKeyFile: getPrivateKeyFilename(),
+			PublicKeyFile:  getPublicKeyFilename(),
+			BitSize:        4096,
+		}
+		return sshClient.CopyKeyToRemote(pair)
+	}
+
+	jumpConfig, err := getJumpSshConfig(host)
+	if err != nil {
+		return err
+	}
+	jumpConfig.HostKeyCallback = PromptAtKey
+	jumpPassword := ""
+	jumpConfig.Auth = append(jumpConfig.Auth, ssh.PasswordCallback(func() (string, error) {
+		jumpPassword = os.Getenv("JUMPHOST_PASSWORD")
+		if jumpPassword != "" {
+			return jumpPassword, nil
+		}
+		fmt.Printf("Need password for %s on jump host %s.\n", host.ProxyJump.Username, host.ProxyJump.Address)
+		var promptErr error
+		jumpPassword, promptErr = getUserCredentials()
+		return jumpPassword, promptErr
+	}))
+
+	config := &ssh.ClientConfig{
+		User:            host.Username,
+		Auth:            []ssh.AuthMethod{ssh.Password(password), keyboardInteractive(password)},
+		HostKeyCallback: PromptAtKey,
+	}
+	client, err := dialHostConfig(interruptContext, host, config, jumpConfig)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	err = authorizeKey(client)
+	if err != nil || jumpPassword == "" {
+		return err
+	}
+
+	// The jump host's key was accepted above, so known_hosts checks it now
+	log.Printf("Installing the SSH key on jump host %s\n", host.ProxyJump.Address)
+	hostKeyCallback, err := knownhosts.New(getKnownHostsFile())
+	if err != nil {
+		return err
+	}
+	jumpClient, err := dialHostConfig(interruptContext, Host{Address: host.ProxyJump.Address, Port: host.ProxyJump.Port, SshProxy: host.SshProxy}, &ssh.ClientConfig{
+		User:            host.ProxyJump.Username,
+		Auth:            []ssh.AuthMethod{ssh.Password(jumpPassword), keyboardInteractive(jumpPassword)},
+		HostKeyCallback: hostKeyCallback,
+	}, nil)
+	if err != nil {
+		return err
+	}
+	defer jumpClient.Close()
+	return authorizeKey(jumpClient)
+}
+
+/*
+ * Check that a host's SSH port answers, through its jump host or proxy if it has one
+ */
+func probeHostPort(host Host) error {
+	if host.ProxyJump == nil && hostSshProxy(host) == "" {
+		return probeTargetAddress(host.Address, host.Port)
+	}
+	ctx, cancel := context.WithTimeout(interruptContext, targetProbeTimeout)
+	defer cancel()
+	conn, err := dialSshPort(ctx, host, nil)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+/*
+ * Answers any prompt that appears at the start of a line of remote output
+ */
+type promptWriter struct {
+	stdin   io.Writer
+	prompts map[string]string
+	line    string
+}
+
+func (w *promptWriter) Write(p []byte) (int, error) {
+	for _, b := range p {
+		if b == '\n' {
+			w.line = ""
+			continue
+		}
+		w.line += string(b)
+		for prompt, answer := range w.prompts {
+			if strings.HasPrefix(w.line, prompt) {
+				w.stdin.Write([]byte(answer + "\n"))
+				w.line = ""
+			}
+		}
+	}
+	return len(p), nil
+}
+
+/*
+ * Run a script over SSH, in a session on the command's connection to the host.
+ * When ctx is cancelled the remote command is sent Ctrl-C, then the connection is
+ * dropped, which hangs up on anything still running.
+ */
+func runSshCommands(ctx context.Context, host Host, script string, prompts map[string]string, out io.Writer) error {
+	conn := sharedHostConn(host)
+	session, err := conn.newSession(ctx)
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+
+	modes := ssh.TerminalModes{
+		ssh.TTY_OP_ISPEED: 14400, // input speed = 14.4kbaud
+		ssh.TTY_OP_OSPEED: 14400, // output speed = 14.4kbaud
+	}
+	err = session.RequestPty("xterm", 80, 40, modes)
+	if err != nil {
+		return err
+	}
+
+	stdin, err := session.StdinPipe()
+	if err != nil {
+		return err
+	}
+	session.Stdout = out
+	if len(prompts) > 0 {
+		session.Stdout = io.MultiWriter(out, &promptWriter{stdin: stdin, prompts: prompts})
+	}
+
+	result := make(chan error, 1)
+	go func() {
+		result <- session.Run(script)
+	}()
+
+	select {
+	case err = <-result:
+		return err
+	case <-ctx.Done():
+		stdin.Write([]byte{3})
+		select {
+		case err = <-result:
+		case <-time.After(interruptGracePeriod):
+			conn.drop()
+			err = <-result
+		}
+		if err == nil {
+			err = ctx.Err()
+		}
+		return contextError(ctx, err)
+	}
+}
+
+/*
+ * Run commands on a host, through the daemon's warm connection if one is available
+ */
+func runHostCommands(host Host, commands []string, print bool) (string, error) {
+	return runHostCommandsContext(interruptContext, host, commands, print)
+}
+
+/*
+ * Run commands on a host, stopping them when ctx is cancelled
+ */
+func runHostCommandsContext(ctx context.Context, host Host, commands []string, print bool) (string, error) {
+	results, err := runHostCommandResults(ctx, host, commands, nil, print)
+	if err != nil || print {
+		return "", err
+	}
+	return results.Stdout(), nil
+}
+
+/*
+ * Run commands on a host, answering prompts like sudo's password prompt
+ */
+func runHostCommandsWithPrompts(host Host, commands []string, prompts map[string]string, print bool) (string, error) {
+	return runHostCommandsWithPromptsContext(interruptContext, host, commands, prompts, print)
+}
+
+func runHostCommandsWithPromptsContext(ctx context.Context, host Host, commands []string, prompts map[string]string, print bool) (string, error) {
+	results, err := runHostCommandResults(ctx, host, commands, prompts, print)
+	if err != nil || print {
+		return "", err
+	}
+	return results.Stdout(), nil
+}
+
+/*
+ * Run commands on a host and collect each one's output, exit code and duration
+ */
+func runHostCommandResults(ctx context.Context, host Host, commands []string, prompts map[string]string, print bool) (RemoteResult, error) {
+	kind := transcriptRun
+	if prompts != nil {
+		kind = transcriptPrompts
+	}
+	if replaying() {
+		return replayTranscript(host, kind, commands, print)
+	}
+	defer trackRemoteOperation()()
+
+	var live io.Writer
+	if print {
+		live = os.Stdout
+	}
+	nonce := randomString(16)
+	out := newResultWriter(commands, nonce, live)
+
+	var err error
+	if host.Local {
+		err = runLocalCommands(ctx, host, wrapCommands(localCommands(host, commands), nonce), out)
+	} else if prompts != nil {
+		err = runSshCommands(ctx, host, wrapCommands(commands, nonce), prompts, out)
+	} else {
+		script := wrapCommands(commands, nonce)
+		err = daemonRunCommands(ctx, host, script, out)
+		if err == errDaemonUnavailable || err == errDaemonNoTarget {
+			err = runSshCommands(ctx, host, script, nil, out)
+		}
+	}
+	results := out.finish()
+	if ctx.Err() == nil {
+		err = resultsError(commands, results, err)
+	}
+	recordTranscript(host, kind, commands, results, err)
+	return results, err
+}
+
+/*
+ * Run one command on a host as it is, without the sh wrapper, for targets like Windows
+ * OpenSSH that have no POSIX shell. Stdout and stderr come back together.
+ */
+func runHostCommandUnwrapped(ctx context.Context, host Host, command string, print bool) (RemoteResult, error) {
+	commands := []string{command}
+	if host.Local {
+		return runHostCommandResults(ctx, host, commands, nil, print)
+	} else if replaying() {
+		return replayTranscript(host, transcriptRun, commands, print)
+	}
+	defer trackRemoteOperation()()
+
+	var out bytes.Buffer
+	var writer io.Writer = &out
+	if print {
+		writer = io.MultiWriter(&out, os.Stdout)
+	}
+	started := time.Now()
+	err := runSshCommands(ctx, host, command, nil, writer)
+	var results RemoteResult
+	var exitErr *ssh.ExitError
+	if err == nil || errors.As(err, &exitErr) {
+		result := CommandResult{Command: command, Stdout: strings.ReplaceAll(out.String(), "\r\n", "\n"), Duration: time.Since(started)}
+		if exitErr != nil {
+			result.ExitCode = exitErr.ExitStatus()
+		}
+		results = append(results, result)
+		err = resultsError(commands, results, nil)
+	}
+	recordTranscript(host, transcriptRun, commands, results, err)
+	return results, err
+}
+
+/*
+ * Copy a local file or directory to dst on an SFTP connection
+ */
+func putSftp(sftpClient *sftp.Client, src string, dst string) error {
+	return filepath.Walk(src, func(srcPath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(src, srcPath)
+		dstPath := path.Join(dst, filepath.ToSlash(rel))
+		if info.IsDir() {
+			return sftpClient.MkdirAll(dstPath)
+		}
+		if err := sftpClient.MkdirAll(path.Dir(dstPath)); err != nil {
+			return err
+		}
+
+		srcFile, err := os.Open(srcPath)
+		if err != nil {
+			return err
+		}
+		defer srcFile.Close()
+		dstFile, err := sftpClient.Create(dstPath)
+		if err != nil {
+			return err
+		}
+		defer dstFile.Close()
+		_, err = io.Copy(dstFile, srcFile)
+		return err
+	})
+}
+
+/*
+ * Copy a local file or directory to a host. A copy that fails or is interrupted is removed
+ * so no half-uploaded chart or overrides are left behind.
+ */
+func putHostFile(host Host, src string, dst string) error {
+	paths := []string{src, dst}
+	if replaying() {
+		_, err := replayTranscript(host, transcriptPut, paths, false)
+		return err
+	}
+	defer trackRemoteOperation()()
+
+	ctx := interruptContext
+	var err error
+	if host.Local {
+		err = runLocalCommands(ctx, host, fmt.Sprintf("mkdir -p %s && cp -r %s %s",
+			shellQuote(path.Dir(dst)), shellQuote(src), shellQuote(dst)), ioutil.Discard)
+	} else {
+		var sftpClient *sftp.Client
+		sftpClient, err = sharedHostConn(host).newSftp(ctx)
+		if err == nil {
+			// Closing the sftp session stops the copy
+			copied := make(chan struct{})
+			go func() {
+				select {
+				case <-ctx.Done():
+					sftpClient.Close()
+				case <-copied:
+				}
+			}()
+			err = putSftp(sftpClient, src, dst)
+			close(copied)
+			sftpClient.Close()
+			if err != nil {
+				err = contextError(ctx, err)
+			}
+		}
+	}
+	if err != nil && ctx.Err() != nil {
+		removePartialUpload(host, dst)
+	}
+	recordTranscript(host, transcriptPut, paths, nil, err)
+	return err
+}
+
+func removePartialUpload(host Host, dst string) {
+	ctx, cancel := cleanupContext()
+	defer cancel()
+	_, err := runHostCommandsContext(ctx, host, []string{fmt.Sprintf("rm -rf %s", shellQuote(dst))}, false)
+	if err != nil {
+		log.Printf("Failed to remove partial upload '%s': %s\n", dst, err)
+	}
+}
+
 // hexadecimal md5 hash grouped by 2 characters separated by colons
 // Copy/pasted from: https://github.com/golang/go/issues/12292#issuecomment-255588529
 func FingerprintMD5(key ssh.PublicKey) string {
@@ -174,15 +835,10 @@ func PromptAtKey(hostname string, remote net.Addr, key ssh.PublicKey) error {
 	// For automation, allow auto acceptance of new public key
 	autoAccept := os.Getenv("AUTOACCEPT_PUBKEY")
 	if autoAccept == "" {
-		// prompt for user input
-		prompt := promptui.Select{
-			Label: "Do you wish to accept this key and continue? (yes/no)",
-			Items: []string{"yes", "no"},
-		}
-		_, result, err := prompt.Run()
+		accepted, err := confirm("Do you wish to accept this key and continue?")
 		if err != nil {
 			return err
-		} else if result == "no" {
+		} else if !accepted {
 			return errors.New("user rejected public key")
 		}
 	}
@@ -202,18 +858,13 @@ func PromptAtKey(hostname string, remote net.Addr, key ssh.PublicKey) error {
  */
 func ResetSsh() int {
 	fmt.Println("!!! WARNING !!! This will reset your SSH keys and delete all of your target hosts.")
-	prompt := promptui.Select{
-		Label: "Are you sure you want to proceed? (yes/no)",
-		Items: []string{"yes", "no"},
-	}
-
-	_, result, err := prompt.Run()
+	proceed, err := confirm("Are you sure you want to proceed?")
 	if err != nil {
 
 		log.Fatal("Error receiving prompt: ", err)
 		return -1
 
-	} else if result == "no" {
+	} else if !proceed {
 
 		return 0
 
@@ -226,6 +877,7 @@ func ResetSsh() int {
 
 		config, err := loadConfig()
 		if err != nil {
+			log.Fatal("Failed to load config: ", err)
 			return -1
 		}
 
@@ -233,6 +885,7 @@ func ResetSsh() int {
 		config.Hosts = nil
 		err = writeConfig(config)
 		if err != nil {
+			log.Fatal("Failed to write config: ", err)
 			return -1
 		}
 
@@ -244,6 +897,7 @@ func TestSshCommand(name string) int {
 
 	config, err := loadConfig()
 	if err != nil {
+		log.Fatal("Failed to load config: ", err)
 		return -1
 	}
 
@@ -253,18 +907,7 @@ func TestSshCommand(name string) int {
 		return -1
 	}
 
-	client, err := getHostSshClient(host)
-	if err != nil {
-		log.Fatal("Failed to create SSH connection: ", err)
-		return -1
-	}
-	err = client.NewCryptoContext()
-	if err != nil {
-		log.Fatal("Failed to create SSH connection: ", err)
-		return -1
-	}
-
-	_, err = client.RunCommands([]string{
+	_, err = runHostCommands(host, []string{
 		"echo test",
 	}, true)
 	if err != nil {
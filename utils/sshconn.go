@@ -0,0 +1,166 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+/*
+ * An SSH connection to a target kept open between uses, redialed when it drops.
+ * Sessions are multiplexed over it, so remote operations after the first skip
+ * the handshake and login.
+ */
+type hostConn struct {
+	host   Host
+	mutex  sync.Mutex
+	client *ssh.Client
+}
+
+/*
+ * Get the open connection, dialing if there is none
+ */
+func (conn *hostConn) get(ctx context.Context) (*ssh.Client, error) {
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+	if conn.client == nil {
+		client, err := dialHost(ctx, conn.host)
+		if err != nil {
+			return nil, err
+		}
+		conn.client = client
+	}
+	return conn.client, nil
+}
+
+/*
+ * Close the connection so the next use redials
+ */
+func (conn *hostConn) drop() {
+	conn.dropClient(nil)
+}
+
+/*
+ * Close the connection if it is still client, or whichever it is when client is nil
+ */
+func (conn *hostConn) dropClient(client *ssh.Client) {
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+	if conn.client != nil && (client == nil || conn.client == client) {
+		conn.client.Close()
+		conn.client = nil
+	}
+}
+
+/*
+ * Ping the connection, dropping it if the target stopped answering
+ */
+func (conn *hostConn) keepAlive() {
+	conn.mutex.Lock()
+	client := conn.client
+	conn.mutex.Unlock()
+	if client == nil {
+		return
+	}
+	_, _, err := client.SendRequest("keepalive@openssh.com", true, nil)
+	if err != nil {
+		log.Printf("Connection to '%s' dropped: %s\n", conn.host.Name, err)
+		conn.dropClient(client)
+	}
+}
+
+/*
+ * Whether the connection still answers. A channel the target refused, i.e. past
+ * its MaxSessions, fails on a connection that is fine.
+ */
+func connectionAlive(client *ssh.Client, err error) bool {
+	var channelErr *ssh.OpenChannelError
+	if errors.As(err, &channelErr) {
+		return true
+	}
+	_, _, err = client.SendRequest("keepalive@openssh.com", true, nil)
+	return err == nil
+}
+
+/*
+ * Open a channel on the connection with open, redialing once if the connection
+ * went stale since its last use. Other commands share the connection, so it is
+ * only dropped when the connection itself failed.
+ */
+func (conn *hostConn) open(ctx context.Context, open func(*ssh.Client) error) error {
+	client, err := conn.get(ctx)
+	if err != nil {
+		return err
+	}
+	if err = open(client); err == nil || ctx.Err() != nil || connectionAlive(client, err) {
+		return err
+	}
+	conn.dropClient(client)
+	if client, err = conn.get(ctx); err != nil {
+		return err
+	}
+	return open(client)
+}
+
+func (conn *hostConn) newSession(ctx context.Context) (*ssh.Session, error) {
+	var session *ssh.Session
+	err := conn.open(ctx, func(client *ssh.Client) (err error) {
+		session, err = client.NewSession()
+		return err
+	})
+	return session, err
+}
+
+func (conn *hostConn) newSftp(ctx context.Context) (*sftp.Client, error) {
+	var sftpClient *sftp.Client
+	err := conn.open(ctx, func(client *ssh.Client) (err error) {
+		sftpClient, err = sftp.NewClient(client)
+		return err
+	})
+	return sftpClient, err
+}
+
+// Connections this command opened, shared by all its remote operations on a target
+var hostConns = struct {
+	sync.Mutex
+	conns map[string]*hostConn
+}{conns: map[string]*hostConn{}}
+
+/*
+ * The command's connection to a host. A host changed during the command, i.e. by
+ * 'target update', gets a connection of its own.
+ */
+func sharedHostConn(host Host) *hostConn {
+	key := fmt.Sprintf("%s/%s@%s:%d/%s", host.Name, host.Username, host.Address, host.Port, host.IdentityFile)
+	if host.ProxyJump != nil {
+		key += fmt.Sprintf("/%s@%s:%d", host.ProxyJump.Username, host.ProxyJump.Address, host.ProxyJump.Port)
+	}
+	if host.SshProxy != "" {
+		key += "/" + host.SshProxy
+	}
+	hostConns.Lock()
+	defer hostConns.Unlock()
+	conn, ok := hostConns.conns[key]
+	if !ok {
+		conn = &hostConn{host: host}
+		hostConns.conns[key] = conn
+	}
+	return conn
+}
+
+/*
+ * Close the connections this command opened
+ */
+func CloseHostConnections() {
+	hostConns.Lock()
+	defer hostConns.Unlock()
+	for key, conn := range hostConns.conns {
+		conn.drop()
+		delete(hostConns.conns, key)
+	}
+}
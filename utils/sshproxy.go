@@ -0,0 +1,229 @@
+package utils
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"golang.org/x/net/proxy"
+)
+
+// Proxy schemes SSH connections can go through; socks5h leaves name resolution to the proxy, like curl
+var sshProxySchemes = []string{"socks5", "socks5h", "http"}
+
+// Per-host proxy setting that bypasses the global one
+const sshProxyDirect = "direct"
+
+/*
+ * Parse a proxy given as scheme://[user:password@]host:port
+ */
+func parseSshProxy(raw string) (*url.URL, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, errors.New("invalid SSH proxy, expected scheme://[user:password@]host:port")
+	}
+	// Errors show the proxy without its password
+	if !contains(sshProxySchemes, u.Scheme) {
+		return nil, fmt.Errorf("invalid SSH proxy '%s', expected one of %s", u.Redacted(), strings.Join(sshProxySchemes, ", "))
+	}
+	if u.Hostname() == "" || u.Port() == "" {
+		return nil, fmt.Errorf("invalid SSH proxy '%s', expected %s://host:port", u.Redacted(), u.Scheme)
+	}
+	return u, nil
+}
+
+/*
+ * Check a host's proxy, which may also be 'direct'
+ */
+func validateHostSshProxy(raw string) error {
+	if raw == "" || raw == sshProxyDirect {
+		return nil
+	}
+	_, err := parseSshProxy(raw)
+	return err
+}
+
+/*
+ * The proxy a host's SSH connections go through: its own, else the global one
+ */
+func hostSshProxy(host Host) string {
+	if host.SshProxy == sshProxyDirect {
+		return ""
+	}
+	if host.SshProxy != "" {
+		return host.SshProxy
+	}
+	config, err := loadConfig()
+	if err != nil {
+		return ""
+	}
+	return config.SshProxy
+}
+
+/*
+ * A connection whose first bytes were already read into a buffer
+ */
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (conn *bufferedConn) Read(p []byte) (int, error) {
+	return conn.reader.Read(p)
+}
+
+/*
+ * Open a tunnel to address with an HTTP CONNECT request
+ */
+func dialHttpProxy(ctx context.Context, proxyUrl *url.URL, address string) (net.Conn, error) {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", proxyUrl.Host)
+	if err != nil {
+		return nil, err
+	}
+
+	// The exchange below doesn't take a context, closing the connection stops it
+	connected := make(chan struct{})
+	defer close(connected)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-connected:
+		}
+	}()
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: address},
+		Host:   address,
+		Header: http.Header{},
+	}
+	if proxyUrl.User != nil {
+		password, _ := proxyUrl.User.Password()
+		credentials := base64.StdEncoding.EncodeToString([]byte(proxyUrl.User.Username() + ":" + password))
+		req.Header.Set("Proxy-Authorization", "Basic "+credentials)
+	}
+	err = req.Write(conn)
+	if err != nil {
+		conn.Close()
+		return nil, contextError(ctx, err)
+	}
+
+	// The SSH banner may arrive right behind the response, keep what was buffered
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, req)
+	if err != nil {
+		conn.Close()
+		return nil, contextError(ctx, err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("proxy refused CONNECT: %s", resp.Status)
+	}
+	return &bufferedConn{Conn: conn, reader: reader}, nil
+}
+
+/*
+ * Connect to address through an SSH proxy
+ */
+func dialSshProxy(ctx context.Context, proxyUrl *url.URL, address string) (net.Conn, error) {
+	if proxyUrl.Scheme == "http" {
+		return dialHttpProxy(ctx, proxyUrl, address)
+	}
+
+	if proxyUrl.Scheme == "socks5" {
+		host, port, err := net.SplitHostPort(address)
+		if err != nil {
+			return nil, err
+		}
+		if net.ParseIP(host) == nil {
+			addresses, err := net.DefaultResolver.LookupHost(ctx, host)
+			if err != nil {
+				return nil, err
+			}
+			address = net.JoinHostPort(addresses[0], port)
+		}
+	}
+	var auth *proxy.Auth
+	if proxyUrl.User != nil {
+		password, _ := proxyUrl.User.Password()
+		auth = &proxy.Auth{User: proxyUrl.User.Username(), Password: password}
+	}
+	dialer, err := proxy.SOCKS5("tcp", proxyUrl.Host, auth, proxy.Direct)
+	if err != nil {
+		return nil, err
+	}
+	return dialer.(proxy.ContextDialer).DialContext(ctx, "tcp", address)
+}
+
+/*
+ * Open a TCP connection for SSH to address, through the host's proxy if it has one
+ */
+func dialSshTcp(ctx context.Context, host Host, address string) (net.Conn, error) {
+	raw := hostSshProxy(host)
+	if raw == "" {
+		var dialer net.Dialer
+		return dialer.DialContext(ctx, "tcp", address)
+	}
+	proxyUrl, err := parseSshProxy(raw)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := dialSshProxy(ctx, proxyUrl, address)
+	if err != nil {
+		return nil, fmt.Errorf("through proxy %s: %s", proxyUrl.Redacted(), err)
+	}
+	return conn, nil
+}
+
+/*
+ * Set the proxy SSH connections to every target go through, unless a target has
+ * its own. An empty proxy connects directly.
+ */
+func SetSshProxy(proxyUrl string) int {
+
+	err := initLocal()
+	if err != nil {
+		log.Fatal("Failed to initialize: ", err)
+		return -1
+	}
+
+	config, err := loadConfig()
+	if err != nil {
+		log.Fatal("Failed to load config: ", err)
+		return -1
+	}
+
+	redacted := ""
+	if proxyUrl != "" {
+		u, err := parseSshProxy(proxyUrl)
+		if err != nil {
+			log.Fatal("Invalid SSH proxy: ", err)
+			return -1
+		}
+		redacted = u.Redacted()
+	}
+
+	config.SshProxy = proxyUrl
+	err = writeConfig(config)
+	if err != nil {
+		log.Fatal("Failed to write config: ", err)
+		return -1
+	}
+
+	if proxyUrl == "" {
+		log.Println("SSH connections now go directly to targets")
+	} else {
+		log.Printf("SSH connections now go through %s\n", redacted)
+	}
+	return 0
+}
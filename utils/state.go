@@ -0,0 +1,391 @@
+package utils
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	gitconfig "github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+)
+
+// Branch the git backend keeps state on
+const stateBranch = "master"
+
+// Keep everything but the state out of the state repository, the SSH keys above all
+const stateGitignore = "/*\n!/.gitignore\n!/config.json\n!/local.db\n!/host_data/\n*.lock\n*.tmp\n"
+
+/*
+ * Where config.json and host_data are kept between commands. GUARDIAN_HOME is
+ * always the working copy commands read and write; a backend fills it before
+ * a command and stores what the command changed afterwards.
+ */
+type StateBackend interface {
+	Load() error
+	Save(message string) error
+}
+
+/*
+ * Pick the backend from a spec: 'file' (the default), 'git:<remote url>' or
+ * 'sqlite[:<database path>]'
+ */
+func OpenStateBackend(spec string) (StateBackend, error) {
+	home := GuardianConfigHome()
+	kind, location := spec, ""
+	if i := strings.Index(spec, ":"); i >= 0 {
+		kind, location = spec[:i], spec[i+1:]
+	}
+	switch kind {
+	case "", "file":
+		return fileState{}, nil
+	case "git":
+		if location == "" {
+			return nil, fmt.Errorf("git state needs a remote, i.e. 'git:git@example.com:me/guardian-state.git'")
+		}
+		return gitState{Home: home, Remote: location}, nil
+	case "sqlite":
+		if location == "" {
+			location = filepath.Join(home, "state.db")
+		}
+		return &sqliteState{Home: home, Path: location}, nil
+	}
+	return nil, fmt.Errorf("unknown state backend '%s', use file, git:<remote> or sqlite[:<path>]", kind)
+}
+
+/*
+ * Files under home that make up the state, relative to it
+ */
+func statePaths(home string) ([]string, error) {
+	var paths []string
+	for _, name := range []string{"config.json", "local.db"} {
+		if _, err := os.Stat(filepath.Join(home, name)); err == nil {
+			paths = append(paths, name)
+		}
+	}
+	err := filepath.Walk(filepath.Join(home, "host_data"), func(path string, info os.FileInfo, err error) error {
+		if os.IsNotExist(err) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		// Write locks and half-written files only matter to the command holding them
+		if strings.HasSuffix(path, ".lock") || strings.HasSuffix(path, ".tmp") {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if info.Mode().IsRegular() {
+			rel, _ := filepath.Rel(home, path)
+			paths = append(paths, filepath.ToSlash(rel))
+		}
+		return nil
+	})
+	return paths, err
+}
+
+func isStatePath(path string) bool {
+	return (path == "config.json" || path == "local.db" || strings.HasPrefix(path, "host_data/")) &&
+		!strings.Contains(path, ".lock") && !strings.HasSuffix(path, ".tmp")
+}
+
+/*
+ * State kept in GUARDIAN_HOME itself
+ */
+type fileState struct{}
+
+func (fileState) Load() error {
+	return nil
+}
+
+func (fileState) Save(message string) error {
+	return nil
+}
+
+/*
+ * State kept in a git repository, so several admins or machines share it.
+ * The remote always wins on load; a save that lost a race is rejected by the push.
+ */
+type gitState struct {
+	Home   string
+	Remote string
+}
+
+func (s gitState) open() (*git.Repository, error) {
+	repo, err := git.PlainOpen(s.Home)
+	if err != git.ErrRepositoryNotExists {
+		return repo, err
+	}
+	os.MkdirAll(s.Home, privateDirMode)
+	repo, err = git.PlainInit(s.Home, false)
+	if err != nil {
+		return nil, err
+	}
+	_, err = repo.CreateRemote(&gitconfig.RemoteConfig{Name: "origin", URLs: []string{s.Remote}})
+	if err != nil {
+		return nil, err
+	}
+	return repo, ioutil.WriteFile(filepath.Join(s.Home, ".gitignore"), []byte(stateGitignore), 0o644)
+}
+
+func (s gitState) Load() error {
+	repo, err := s.open()
+	if err != nil {
+		return err
+	}
+	err = repo.Fetch(&git.FetchOptions{RemoteName: "origin"})
+	if errors.Is(err, transport.ErrEmptyRemoteRepository) {
+		// Nothing saved yet, the first save fills the remote
+		return nil
+	} else if err != nil && err != git.NoErrAlreadyUpToDate {
+		return fmt.Errorf("failed to fetch state from %s: %s", s.Remote, err)
+	}
+	ref, err := repo.Reference(plumbing.NewRemoteReferenceName("origin", stateBranch), true)
+	if err == plumbing.ErrReferenceNotFound {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	// A new working copy has no branch yet for the reset to move
+	branch := plumbing.NewBranchReferenceName(stateBranch)
+	if _, err := repo.Reference(branch, false); err == plumbing.ErrReferenceNotFound {
+		if err := repo.Storer.SetReference(plumbing.NewHashReference(branch, ref.Hash())); err != nil {
+			return err
+		}
+	}
+	worktree, err := repo.Worktree()
+	if err != nil {
+		return err
+	}
+	return worktree.Reset(&git.ResetOptions{Commit: ref.Hash(), Mode: git.HardReset})
+}
+
+func (s gitState) Save(message string) error {
+	repo, err := s.open()
+	if err != nil {
+		return err
+	}
+	worktree, err := repo.Worktree()
+	if err != nil {
+		return err
+	}
+	status, err := worktree.Status()
+	if err != nil {
+		return err
+	}
+	changed := 0
+	for path, fileStatus := range status {
+		if !isStatePath(path) && path != ".gitignore" {
+			continue
+		}
+		if fileStatus.Worktree == git.Deleted {
+			_, err = worktree.Remove(path)
+		} else {
+			_, err = worktree.Add(path)
+		}
+		if err != nil {
+			return err
+		}
+		changed++
+	}
+	if changed == 0 {
+		return nil
+	}
+	_, err = worktree.Commit(message, &git.CommitOptions{
+		Author: &object.Signature{Name: getOperator(), Email: getOperator() + "@guardian-cli", When: time.Now()},
+	})
+	if err != nil {
+		return err
+	}
+	err = repo.Push(&git.PushOptions{RemoteName: "origin"})
+	if err == git.ErrNonFastForwardUpdate || (err != nil && strings.Contains(err.Error(), "non-fast-forward")) {
+		return fmt.Errorf("state on %s changed while this command ran, re-run it", s.Remote)
+	} else if err != nil && err != git.NoErrAlreadyUpToDate {
+		return fmt.Errorf("failed to push state to %s: %s", s.Remote, err)
+	}
+	return nil
+}
+
+/*
+ * State kept in an SQLite database, one row per file. Every save bumps the revision
+ * row, and only if it still has the revision loaded, so a save that lost a race is
+ * rejected like a git push that isn't a fast-forward.
+ */
+type sqliteState struct {
+	Home string
+	Path string
+	// Revision of the state loaded, which a save must still find
+	revision int
+}
+
+const stateSchema = `CREATE TABLE IF NOT EXISTS state (path TEXT PRIMARY KEY, mode INTEGER NOT NULL, data BLOB NOT NULL, updated TEXT NOT NULL);
+CREATE TABLE IF NOT EXISTS state_revision (id INTEGER PRIMARY KEY CHECK (id = 1), revision INTEGER NOT NULL);
+INSERT OR IGNORE INTO state_revision (id, revision) VALUES (1, 0);
+`
+
+func (s *sqliteState) open() (*sql.DB, error) {
+	db, err := openSqlite(s.Path)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := db.Exec(stateSchema); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+func (s *sqliteState) Load() error {
+	db, err := s.open()
+	if err != nil {
+		return fmt.Errorf("failed to read state from %s: %s", s.Path, err)
+	}
+	defer db.Close()
+
+	// One statement, so the revision is the one of the files read
+	rows, err := db.Query("SELECT r.revision, s.path, s.mode, s.data FROM state_revision r LEFT JOIN state s")
+	if err != nil {
+		return fmt.Errorf("failed to read state from %s: %s", s.Path, err)
+	}
+	defer rows.Close()
+
+	stored := map[string]bool{}
+	for rows.Next() {
+		var path sql.NullString
+		var mode sql.NullInt64
+		var data []byte
+		if err := rows.Scan(&s.revision, &path, &mode, &data); err != nil {
+			return err
+		}
+		if !path.Valid {
+			// Only the revision, nothing saved yet
+			continue
+		}
+		if !isStatePath(path.String) || strings.Contains(path.String, "..") {
+			return fmt.Errorf("state database has an invalid path '%s'", path.String)
+		}
+		full := filepath.Join(s.Home, filepath.FromSlash(path.String))
+		os.MkdirAll(filepath.Dir(full), privateDirMode)
+		if err := ioutil.WriteFile(full, data, os.FileMode(mode.Int64)); err != nil {
+			return err
+		}
+		stored[path.String] = true
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if len(stored) == 0 {
+		// Nothing saved yet, the first save fills the database
+		return nil
+	}
+	// Files another machine deleted, i.e. of a removed target
+	local, err := statePaths(s.Home)
+	if err != nil {
+		return err
+	}
+	for _, path := range local {
+		if !stored[path] {
+			os.Remove(filepath.Join(s.Home, filepath.FromSlash(path)))
+		}
+	}
+	return nil
+}
+
+func (s *sqliteState) Save(message string) error {
+	paths, err := statePaths(s.Home)
+	if err != nil {
+		return err
+	}
+	type stateFile struct {
+		path string
+		mode int
+		data []byte
+	}
+	var files []stateFile
+	for _, path := range paths {
+		full := filepath.Join(s.Home, filepath.FromSlash(path))
+		data, err := ioutil.ReadFile(full)
+		if err != nil {
+			return err
+		}
+		info, err := os.Stat(full)
+		if err != nil {
+			return err
+		}
+		files = append(files, stateFile{path, int(info.Mode().Perm()), data})
+	}
+
+	db, err := s.open()
+	if err != nil {
+		return fmt.Errorf("failed to write state to %s: %s", s.Path, err)
+	}
+	defer db.Close()
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to write state to %s: %s", s.Path, err)
+	}
+	defer tx.Rollback()
+
+	// Only bumps the revision if it is still the one loaded
+	result, err := tx.Exec("UPDATE state_revision SET revision = revision + 1 WHERE id = 1 AND revision = ?", s.revision)
+	if err != nil {
+		return fmt.Errorf("failed to write state to %s: %s", s.Path, err)
+	}
+	if swapped, err := result.RowsAffected(); err != nil {
+		return err
+	} else if swapped != 1 {
+		return fmt.Errorf("state in %s changed while this command ran, re-run it", s.Path)
+	}
+
+	if _, err := tx.Exec("DELETE FROM state"); err != nil {
+		return fmt.Errorf("failed to write state to %s: %s", s.Path, err)
+	}
+	now := time.Now().UTC().Format(time.RFC3339)
+	for _, file := range files {
+		_, err := tx.Exec("INSERT INTO state (path, mode, data, updated) VALUES (?, ?, ?, ?)", file.path, file.mode, file.data, now)
+		if err != nil {
+			return fmt.Errorf("failed to write state to %s: %s", s.Path, err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to write state to %s: %s", s.Path, err)
+	}
+	s.revision++
+	return nil
+}
+
+/*
+ * Upload the state in GUARDIAN_HOME to a backend, to start using a new one
+ */
+func PushState(spec string) int {
+	backend, err := OpenStateBackend(spec)
+	if err != nil {
+		log.Fatal("Invalid state backend: ", err)
+		return -1
+	}
+	if _, ok := backend.(fileState); ok {
+		log.Fatal("Pick the backend to push to with --state-backend or GUARDIAN_STATE")
+		return -1
+	}
+	paths, err := statePaths(GuardianConfigHome())
+	if err != nil {
+		log.Fatal("Failed to read state: ", err)
+		return -1
+	}
+	err = backend.Save("Import existing state")
+	if err != nil {
+		log.Fatal("Failed to push state: ", err)
+		return -1
+	}
+	log.Printf("Pushed %d state files\n", len(paths))
+	return 0
+}
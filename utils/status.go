@@ -0,0 +1,370 @@
+package utils
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Upper bound on how long a single host probe may take
+const hostProbeTimeout = 10 * time.Second
+
+type HostStatus struct {
+	Host      Host
+	Reachable bool
+	K3s       string
+	Release   string
+	Chart     string
+	Revision  string
+	Err       error
+}
+
+type helmRelease struct {
+	Name     string `json:"name"`
+	Revision string `json:"revision"`
+	Status   string `json:"status"`
+	Chart    string `json:"chart"`
+}
+
+/*
+ * Probe a single host over SSH for k3s and release state, giving up when ctx is done
+ */
+func probeHost(ctx context.Context, host Host) HostStatus {
+	status := HostStatus{Host: host}
+
+	out, err := runHostCommandsContext(ctx, host, []string{
+		"export KUBECONFIG=/etc/rancher/k3s/k3s.yaml",
+		"echo \"k3s=$(systemctl is-active k3s)\"",
+		"helm list -n filter --filter '^guardian-angel$' -o json 2>/dev/null || echo '[]'",
+	}, false)
+	if err != nil {
+		status.Err = err
+		return status
+	}
+	status.Reachable = true
+
+	lines := strings.SplitN(strings.ReplaceAll(out, "\r", ""), "\n", 2)
+	status.K3s = strings.TrimPrefix(strings.TrimSpace(lines[0]), "k3s=")
+	if len(lines) < 2 {
+		status.Err = errors.New("unexpected probe output")
+		return status
+	}
+
+	var releases []helmRelease
+	err = json.Unmarshal([]byte(strings.TrimSpace(lines[1])), &releases)
+	if err != nil {
+		status.Err = fmt.Errorf("failed to parse helm output: %s", err)
+		return status
+	}
+	if len(releases) == 0 {
+		status.Release = "not deployed"
+	} else {
+		status.Release = releases[0].Status
+		status.Chart = releases[0].Chart
+		status.Revision = releases[0].Revision
+	}
+
+	return status
+}
+
+/*
+ * Probe a host, giving up once the probe timeout has passed. The dial and the
+ * commands are stopped with it, so nothing is left running after the table is printed.
+ */
+func probeHostWithTimeout(host Host) HostStatus {
+	ctx, cancel := context.WithTimeout(interruptContext, hostProbeTimeout)
+	defer cancel()
+	status := probeHost(ctx, host)
+	if status.Err != nil && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		status.Err = errors.New("probe timed out")
+	}
+	return status
+}
+
+/*
+ * Probe all hosts concurrently, results are in the same order as the hosts
+ */
+func probeHosts(hosts []Host) []HostStatus {
+	statuses := make([]HostStatus, len(hosts))
+	var wg sync.WaitGroup
+	for i, host := range hosts {
+		wg.Add(1)
+		go func(i int, host Host) {
+			defer wg.Done()
+			statuses[i] = probeHostWithTimeout(host)
+		}(i, host)
+	}
+	wg.Wait()
+	return statuses
+}
+
+// Certificates expiring sooner than this are reported before they break clients
+const certExpiryWarning = 30 * 24 * time.Hour
+
+type nodeList struct {
+	Items []struct {
+		Metadata struct {
+			Name   string            `json:"name"`
+			Labels map[string]string `json:"labels"`
+		} `json:"metadata"`
+		Status struct {
+			Conditions []struct {
+				Type   string `json:"type"`
+				Status string `json:"status"`
+			} `json:"conditions"`
+			Addresses []struct {
+				Type    string `json:"type"`
+				Address string `json:"address"`
+			} `json:"addresses"`
+		} `json:"status"`
+	} `json:"items"`
+}
+
+type podList struct {
+	Items []struct {
+		Metadata struct {
+			Name string `json:"name"`
+		} `json:"metadata"`
+		Status struct {
+			Phase             string `json:"phase"`
+			ContainerStatuses []struct {
+				Ready        bool `json:"ready"`
+				RestartCount int  `json:"restartCount"`
+			} `json:"containerStatuses"`
+		} `json:"status"`
+	} `json:"items"`
+}
+
+func statusCheckNodes(out string) doctorFinding {
+	finding := doctorFinding{Check: "k3s nodes"}
+	var nodes nodeList
+	if err := json.Unmarshal([]byte(out), &nodes); err != nil || len(nodes.Items) == 0 {
+		finding.Status = "fail"
+		finding.Detail = "k3s is not answering"
+		finding.Hint = "Check the k3s service with 'target exec <name> -- systemctl status k3s'"
+		return finding
+	}
+	var notReady []string
+	for _, node := range nodes.Items {
+		ready := false
+		for _, condition := range node.Status.Conditions {
+			if condition.Type == "Ready" && condition.Status == "True" {
+				ready = true
+			}
+		}
+		if !ready {
+			notReady = append(notReady, node.Metadata.Name)
+		}
+	}
+	if len(notReady) > 0 {
+		finding.Status = "fail"
+		finding.Detail = fmt.Sprintf("%d of %d nodes not ready: %s", len(notReady), len(nodes.Items), strings.Join(notReady, ", "))
+		finding.Hint = "Describe the nodes with 'target exec <name> -- kubectl describe nodes'"
+		return finding
+	}
+	finding.Status = "ok"
+	finding.Detail = fmt.Sprintf("%d nodes ready", len(nodes.Items))
+	return finding
+}
+
+func statusCheckRelease(out string) doctorFinding {
+	finding := doctorFinding{Check: "Helm release"}
+	var releases []helmRelease
+	if err := json.Unmarshal([]byte(out), &releases); err != nil {
+		finding.Status = "skipped"
+		finding.Detail = fmt.Sprintf("failed to parse helm output: %s", err)
+		return finding
+	}
+	if len(releases) == 0 {
+		finding.Status = "fail"
+		finding.Detail = "not deployed"
+		finding.Hint = "Deploy the filter with 'filter deploy'"
+		return finding
+	}
+	release := releases[0]
+	finding.Detail = fmt.Sprintf("%s, %s revision %s", release.Status, release.Chart, release.Revision)
+	if release.Status != "deployed" {
+		finding.Status = "fail"
+		finding.Hint = "Redeploy with 'filter deploy', or roll back with 'filter snapshot restore'"
+		return finding
+	}
+	finding.Status = "ok"
+	return finding
+}
+
+func statusCheckPods(out string) doctorFinding {
+	finding := doctorFinding{Check: "Pods"}
+	var pods podList
+	if err := json.Unmarshal([]byte(out), &pods); err != nil {
+		finding.Status = "skipped"
+		finding.Detail = fmt.Sprintf("failed to parse pods: %s", err)
+		return finding
+	}
+	if len(pods.Items) == 0 {
+		finding.Status = "fail"
+		finding.Detail = "no pods in the filter namespace"
+		finding.Hint = "Deploy the filter with 'filter deploy'"
+		return finding
+	}
+	var unhealthy []string
+	restarts := 0
+	for _, pod := range pods.Items {
+		ready := pod.Status.Phase == "Succeeded"
+		if pod.Status.Phase == "Running" {
+			ready = true
+			for _, container := range pod.Status.ContainerStatuses {
+				ready = ready && container.Ready
+			}
+		}
+		for _, container := range pod.Status.ContainerStatuses {
+			restarts += container.RestartCount
+		}
+		if !ready {
+			unhealthy = append(unhealthy, fmt.Sprintf("%s (%s)", pod.Metadata.Name, pod.Status.Phase))
+		}
+	}
+	if len(unhealthy) > 0 {
+		finding.Status = "fail"
+		finding.Detail = fmt.Sprintf("%d of %d pods not ready: %s", len(unhealthy), len(pods.Items), strings.Join(unhealthy, ", "))
+		finding.Hint = "Inspect them with 'target exec <name> -- kubectl -n filter describe pods'"
+		return finding
+	}
+	finding.Status = "ok"
+	finding.Detail = fmt.Sprintf("%d pods ready, %d restarts", len(pods.Items), restarts)
+	return finding
+}
+
+func statusCheckDisk(out string, volumePath string, threshold int) doctorFinding {
+	finding := doctorFinding{Check: "Disk"}
+	fs := strings.Fields(out)
+	if len(fs) != 3 {
+		finding.Status = "skipped"
+		finding.Detail = fmt.Sprintf("cannot read usage of %s", volumePath)
+		return finding
+	}
+	size, _ := strconv.ParseInt(fs[0], 10, 64)
+	used, _ := strconv.ParseInt(fs[1], 10, 64)
+	avail, _ := strconv.ParseInt(fs[2], 10, 64)
+	percent := percentOf(used, size)
+	finding.Detail = fmt.Sprintf("%s free of %s on %s (%d%% used)", humanBytes(avail), humanBytes(size), volumePath, percent)
+	if percent >= threshold {
+		finding.Status = "warn"
+		finding.Hint = "See what uses the space with 'filter storage status'"
+		return finding
+	}
+	finding.Status = "ok"
+	return finding
+}
+
+func statusCheckCert(out string) doctorFinding {
+	finding := doctorFinding{Check: "Root CA"}
+	block, _ := pem.Decode([]byte(out))
+	if block == nil {
+		finding.Status = "skipped"
+		finding.Detail = "no CA certificate in the filter namespace"
+		return finding
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		finding.Status = "skipped"
+		finding.Detail = fmt.Sprintf("failed to parse the CA certificate: %s", err)
+		return finding
+	}
+	left := time.Until(cert.NotAfter)
+	finding.Detail = fmt.Sprintf("expires %s (in %d days)", cert.NotAfter.Format("2006-01-02"), int(left.Hours()/24))
+	switch {
+	case left <= 0:
+		finding.Status = "fail"
+		finding.Detail = fmt.Sprintf("expired %s", cert.NotAfter.Format("2006-01-02"))
+		finding.Hint = "Regenerate the CA by redeploying, then reinstall it on clients with 'filter certificate serve-ca'"
+	case left < certExpiryWarning:
+		finding.Status = "warn"
+		finding.Hint = "Regenerate the CA by redeploying soon, then reinstall it on clients with 'filter certificate serve-ca'"
+	default:
+		finding.Status = "ok"
+	}
+	return finding
+}
+
+/*
+ * Check over SSH that a target's cluster, release, pods, disk and CA are healthy
+ */
+func TargetStatus(name string, threshold int) int {
+
+	config, err := loadConfig()
+	if err != nil {
+		log.Fatal("Failed to load config: ", err)
+		return -1
+	}
+
+	_, host := FindHost(config, name)
+	if host.Name != name {
+		log.Fatalf("Host %s doesn't exist, create it first", name)
+		return -1
+	}
+
+	volumePath := getHostVolumePath(host)
+	filterConfig, err := loadHostFilterConfig(name)
+	if err == nil && filterConfig.VolumePath != "" {
+		volumePath = filterConfig.VolumePath
+	}
+
+	var findings []doctorFinding
+	out, err := runHostCommands(host, []string{
+		"export KUBECONFIG=/etc/rancher/k3s/k3s.yaml",
+		"kubectl get nodes -o json 2>/dev/null || echo '{}'",
+		"echo ---",
+		"helm list -n filter --filter '^guardian-angel$' -o json 2>/dev/null || echo '[]'",
+		"echo ---",
+		"kubectl get pods -n filter -o json 2>/dev/null || echo '{}'",
+		"echo ---",
+		fmt.Sprintf("df -B1 --output=size,used,avail %s 2>/dev/null | tail -1", shellQuote(volumePath)),
+		"echo ---",
+		probeResultsCommand(),
+		"echo ---",
+		"kubectl -n filter get secret guardian-ca-tls -o jsonpath='{.data.ca\\.crt}' 2>/dev/null | base64 -d 2>/dev/null; true",
+	}, false)
+	if err != nil {
+		findings = append(findings, doctorFinding{Check: "SSH", Status: "fail", Detail: err.Error(),
+			Hint: fmt.Sprintf("Check the host is up and reachable with 'target test %s'", name)})
+		return reportFindings(findings)
+	}
+	findings = append(findings, doctorFinding{Check: "SSH", Status: "ok", Detail: fmt.Sprintf("%s:%d", host.Address, host.Port)})
+
+	// The certificate comes last, its PEM armour ends in dashes too
+	sections := strings.SplitN(strings.ReplaceAll(out, "\r", ""), "---\n", 6)
+	if len(sections) != 6 {
+		log.Fatalln("Unexpected output from target")
+		return -1
+	}
+	findings = append(findings,
+		statusCheckNodes(sections[0]),
+		statusCheckRelease(strings.TrimSpace(sections[1])),
+		statusCheckPods(sections[2]),
+		statusCheckDisk(sections[3], volumePath, threshold),
+		statusCheckCert(sections[5]),
+	)
+	if filterConfig.Probes.Enabled {
+		findings = append(findings, statusCheckProbes(sections[4]))
+	}
+	if components := debugComponentsOn(name); len(components) > 0 {
+		component := "<component>"
+		if len(components) == 1 {
+			component = components[0]
+		}
+		findings = append(findings, doctorFinding{Check: "Debug logging", Status: "warn", Detail: "on for " + strings.Join(components, ", "),
+			Hint: fmt.Sprintf("Turn it off with 'filter debug off --component %s'", component)})
+	}
+	for i := range findings {
+		findings[i].Hint = strings.ReplaceAll(findings[i].Hint, "<name>", name)
+	}
+	return reportFindings(findings)
+}
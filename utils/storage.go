@@ -0,0 +1,218 @@
+package utils
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+)
+
+type pvcList struct {
+	Items []struct {
+		Metadata struct {
+			Name string `json:"name"`
+		} `json:"metadata"`
+		Spec struct {
+			VolumeName string `json:"volumeName"`
+		} `json:"spec"`
+		Status struct {
+			Capacity struct {
+				Storage string `json:"storage"`
+			} `json:"capacity"`
+		} `json:"status"`
+	} `json:"items"`
+}
+
+type volumeUsage struct {
+	Name     string
+	Capacity int64
+	Used     int64
+}
+
+var quantitySuffixes = map[string]int64{
+	"Ki": 1 << 10, "Mi": 1 << 20, "Gi": 1 << 30, "Ti": 1 << 40,
+	"K": 1e3, "M": 1e6, "G": 1e9, "T": 1e12,
+}
+
+/*
+ * Parse a kubernetes storage quantity, i.e. 10Gi
+ */
+func parseQuantity(quantity string) (int64, error) {
+	for suffix, multiplier := range quantitySuffixes {
+		if strings.HasSuffix(quantity, suffix) {
+			value, err := strconv.ParseFloat(strings.TrimSuffix(quantity, suffix), 64)
+			return int64(value * float64(multiplier)), err
+		}
+	}
+	return strconv.ParseInt(quantity, 10, 64)
+}
+
+func humanBytes(bytes int64) string {
+	const unit = 1024
+	if bytes < unit {
+		return fmt.Sprintf("%dB", bytes)
+	}
+	div, exp := int64(unit), 0
+	for n := bytes / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f%ciB", float64(bytes)/float64(div), "KMGTPE"[exp])
+}
+
+// Where the chart's squid keeps its disk cache
+const squidCacheDir = "/var/spool/squid"
+
+/*
+ * Bytes reported by 'du -sb' lines, summed, and whether there were any
+ */
+func sumDuBytes(out string) (int64, bool) {
+	var total int64
+	found := false
+	for _, line := range strings.Split(strings.TrimSpace(out), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 1 {
+			continue
+		}
+		if used, err := strconv.ParseInt(fields[0], 10, 64); err == nil {
+			total += used
+			found = true
+		}
+	}
+	return total, found
+}
+
+func percentOf(used int64, total int64) int {
+	if total == 0 {
+		return 0
+	}
+	return int(used * 100 / total)
+}
+
+/*
+ * Report PVC and filesystem usage on a target, warning past the threshold percent,
+ * and what the category DB, postgres and squid's cache take of it
+ */
+func ShowStorageStatus(targetName string, threshold int) int {
+
+	config, err := loadConfig()
+	if err != nil {
+		log.Fatal("Failed to load config: ", err)
+		return -1
+	}
+
+	_, host := FindHost(config, targetName)
+	if host.Name != targetName {
+		log.Fatalf("Host %s doesn't exist, create it first", targetName)
+		return -1
+	}
+
+	filterConfig, err := getHostFilterConfig(targetName)
+	if err != nil {
+		log.Fatal("Failed to get host config: ", err)
+		return -1
+	}
+	volumePath := filterConfig.VolumePath
+
+	out, err := runHostCommands(host, []string{
+		"export KUBECONFIG=/etc/rancher/k3s/k3s.yaml",
+		"kubectl get pvc -n filter -o json",
+		"echo ---",
+		fmt.Sprintf("du -sb %s/* 2>/dev/null; true", volumePath),
+		"echo ---",
+		fmt.Sprintf("df -B1 --output=size,used,avail %s | tail -1", volumePath),
+		"echo ---",
+		fmt.Sprintf("kubectl -n filter exec %s -- sh -c 'du -sb \"$PGDATA\"' 2>/dev/null; true", guardianDbDeployment),
+		"echo ---",
+		fmt.Sprintf("for pod in $(kubectl -n filter get pods -l app=squid -o name); do kubectl -n filter exec $pod -- du -sb %s 2>/dev/null; done; true", squidCacheDir),
+	}, false)
+	if err != nil {
+		log.Fatal("Failed to get storage usage: ", err)
+		return -1
+	}
+	sections := strings.Split(strings.ReplaceAll(out, "\r", ""), "---\n")
+	if len(sections) != 5 {
+		log.Fatalln("Unexpected output from target")
+		return -1
+	}
+
+	var pvcs pvcList
+	err = json.Unmarshal([]byte(sections[0]), &pvcs)
+	if err != nil {
+		log.Fatal("Failed to parse PVCs: ", err)
+		return -1
+	}
+
+	// Volume directories are named after the persistent volume, i.e. pvc-<uid>_filter_<claim>
+	dirUsage := map[string]int64{}
+	for _, line := range strings.Split(strings.TrimSpace(sections[1]), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			continue
+		}
+		if used, err := strconv.ParseInt(fields[0], 10, 64); err == nil {
+			dirUsage[filepath.Base(fields[1])] = used
+		}
+	}
+
+	var volumes []volumeUsage
+	for _, pvc := range pvcs.Items {
+		volume := volumeUsage{Name: pvc.Metadata.Name}
+		volume.Capacity, _ = parseQuantity(pvc.Status.Capacity.Storage)
+		for dir, used := range dirUsage {
+			if pvc.Spec.VolumeName != "" && strings.HasPrefix(dir, pvc.Spec.VolumeName) {
+				volume.Used += used
+			}
+		}
+		volumes = append(volumes, volume)
+	}
+
+	var warnings []string
+	w := tabwriter.NewWriter(showOutput(), 1, 1, 3, ' ', 0)
+	fmt.Fprintln(w, "Volume\tCapacity\tUsed\tUse%")
+	for _, volume := range volumes {
+		percent := percentOf(volume.Used, volume.Capacity)
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d%%\n", volume.Name, humanBytes(volume.Capacity), humanBytes(volume.Used), percent)
+		if percent >= threshold {
+			warnings = append(warnings, fmt.Sprintf("volume '%s' is %d%% full", volume.Name, percent))
+		}
+	}
+	w.Flush()
+
+	fs := strings.Fields(sections[2])
+	if len(fs) == 3 {
+		size, _ := strconv.ParseInt(fs[0], 10, 64)
+		used, _ := strconv.ParseInt(fs[1], 10, 64)
+		avail, _ := strconv.ParseInt(fs[2], 10, 64)
+		percent := percentOf(used, size)
+		fmt.Fprintf(showOutput(), "\nFilesystem of %s: %s free of %s (%d%% used)\n", volumePath, humanBytes(avail), humanBytes(size), percent)
+		if percent >= threshold {
+			warnings = append(warnings, fmt.Sprintf("filesystem of %s is %d%% full", volumePath, percent))
+		}
+	}
+
+	// Not running pods leave these out rather than failing the report
+	dbSize, err := getDbSize(host)
+	if err != nil || dbSize == "" {
+		dbSize = "unavailable"
+	}
+	fmt.Fprintf(showOutput(), "Category DB: %s\n", dbSize)
+	if used, ok := sumDuBytes(sections[3]); ok {
+		fmt.Fprintf(showOutput(), "Postgres data: %s\n", humanBytes(used))
+	} else {
+		fmt.Fprintln(showOutput(), "Postgres data: unavailable")
+	}
+	if used, ok := sumDuBytes(sections[4]); ok {
+		fmt.Fprintf(showOutput(), "Squid cache: %s\n", humanBytes(used))
+	} else {
+		fmt.Fprintln(showOutput(), "Squid cache: unavailable")
+	}
+
+	for _, warning := range warnings {
+		log.Printf("Warning: %s\n", warning)
+	}
+	return 0
+}
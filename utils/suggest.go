@@ -0,0 +1,198 @@
+package utils
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/manifoldco/promptui"
+)
+
+var urlHostPattern = regexp.MustCompile(`(?i)(?:https?://([a-z0-9.-]+\.[a-z]{2,}))|(?:\b([a-z0-9.-]+\.[a-z]{2,}):443\b)`)
+
+type DomainSuggestion struct {
+	Domain string `json:"domain"`
+	Hits   int    `json:"hits"`
+	// Categories proposed by the external categorizer, if one is configured
+	Suggested []string `json:"suggested,omitempty"`
+}
+
+/*
+ * Parse a duration that may also be given in days, i.e. 7d
+ */
+func parseLongDuration(s string) (time.Duration, error) {
+	if strings.HasSuffix(s, "d") {
+		days, err := strconv.Atoi(strings.TrimSuffix(s, "d"))
+		if err != nil {
+			return 0, fmt.Errorf("invalid duration '%s'", s)
+		}
+		return time.Duration(days) * 24 * time.Hour, nil
+	}
+	return time.ParseDuration(s)
+}
+
+/*
+ * Fetch the filter's access logs for the given period
+ */
+func fetchAccessLogs(host Host, since time.Duration) (string, error) {
+	return runHostCommands(host, []string{
+		"export KUBECONFIG=/etc/rancher/k3s/k3s.yaml",
+		fmt.Sprintf("kubectl -n filter logs -l app=e2guardian --tail=-1 --since=%ds", int(since.Seconds())),
+	}, false)
+}
+
+/*
+ * Count requests per domain in the filter's access logs
+ */
+func countLoggedDomains(host Host, since time.Duration) (map[string]int, error) {
+	out, err := fetchAccessLogs(host, since)
+	if err != nil {
+		return nil, err
+	}
+
+	counts := map[string]int{}
+	for _, match := range urlHostPattern.FindAllStringSubmatch(out, -1) {
+		domain := match[1]
+		if domain == "" {
+			domain = match[2]
+		}
+		counts[strings.ToLower(domain)]++
+	}
+	return counts, nil
+}
+
+/*
+ * Categories the lookup service has for a domain
+ */
+func lookupCategories(targetName string, domain string) ([]string, error) {
+	resp, err := ApiPost(targetName, "/api/listCategories", fmt.Sprintf("{\"hostname\": \"%s\"}", domain))
+	if err != nil {
+		return nil, err
+	}
+	defer closeResponse(resp)
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	var categories CatList
+	err = json.Unmarshal(body, &categories)
+	return categories, err
+}
+
+/*
+ * Find frequently visited domains that have no category, most visited first
+ */
+func findUncategorized(targetName string, host Host, since time.Duration, limit int) ([]DomainSuggestion, error) {
+	counts, err := countLoggedDomains(host, since)
+	if err != nil {
+		return nil, err
+	}
+
+	var ranked []DomainSuggestion
+	for domain, hits := range counts {
+		ranked = append(ranked, DomainSuggestion{Domain: domain, Hits: hits})
+	}
+	sort.Slice(ranked, func(i, j int) bool {
+		if ranked[i].Hits != ranked[j].Hits {
+			return ranked[i].Hits > ranked[j].Hits
+		}
+		return ranked[i].Domain < ranked[j].Domain
+	})
+
+	var suggestions []DomainSuggestion
+	for _, candidate := range ranked {
+		if len(suggestions) >= limit {
+			break
+		}
+		categories, source, err := categorizeDomain(targetName, candidate.Domain)
+		if err != nil {
+			return nil, err
+		}
+		if source != "local" {
+			candidate.Suggested = categories
+			suggestions = append(suggestions, candidate)
+		}
+	}
+	return suggestions, nil
+}
+
+/*
+ * Suggest uncategorized domains from recent traffic and optionally categorize them
+ */
+func SuggestCategories(targetName string, since string, limit int, jsonOutput bool) int {
+
+	sinceDuration, err := parseLongDuration(since)
+	if err != nil {
+		log.Fatal(err)
+		return -1
+	}
+
+	config, err := loadConfig()
+	if err != nil {
+		log.Fatal("Failed to load config: ", err)
+		return -1
+	}
+
+	_, host := FindHost(config, targetName)
+	if host.Name != targetName {
+		log.Fatalf("Host %s doesn't exist, create it first", targetName)
+		return -1
+	}
+
+	suggestions, err := findUncategorized(targetName, host, sinceDuration, limit)
+	if err != nil {
+		log.Fatal("Failed to gather suggestions: ", err)
+		return -1
+	}
+
+	if jsonOutput {
+		encoder := json.NewEncoder(showOutput())
+		encoder.SetIndent("", "  ")
+		encoder.Encode(suggestions)
+		return 0
+	}
+
+	if len(suggestions) == 0 {
+		fmt.Fprintln(showOutput(), "No uncategorized domains found")
+		return 0
+	}
+
+	if err := checkInteractive("a category for each domain"); err != nil {
+		log.Fatalf("%s; use --json to only list the suggestions\n", err)
+		return -1
+	}
+
+	// Ask for a category for each domain, then apply them grouped by category
+	assignments := map[string][]string{}
+	for _, suggestion := range suggestions {
+		prompt := promptui.Prompt{
+			Label: fmt.Sprintf("%s (%d hits) category, empty to skip", suggestion.Domain, suggestion.Hits),
+		}
+		if len(suggestion.Suggested) > 0 {
+			prompt.Default = suggestion.Suggested[0]
+		}
+		category, err := prompt.Run()
+		if err != nil {
+			// Interrupted; apply what we have so far
+			break
+		}
+		category = strings.TrimSpace(category)
+		if category != "" {
+			assignments[category] = append(assignments[category], suggestion.Domain)
+		}
+	}
+
+	code := 0
+	for category, domains := range assignments {
+		if Categorize(targetName, domains, category) != 0 {
+			code = -1
+		}
+	}
+	return code
+}
@@ -0,0 +1,304 @@
+package utils
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Categories known to a target's lookup service, cached to validate acl rules offline
+type CategoryTaxonomy struct {
+	Categories []string
+	FetchedAt  time.Time
+}
+
+func getCategoryTaxonomyPath(name string) string {
+	return filepath.Join(getHostDataDir(name), "categories.json")
+}
+
+func loadCategoryTaxonomyFile(name string) (CategoryTaxonomy, error) {
+	data, err := ioutil.ReadFile(getCategoryTaxonomyPath(name))
+	if err != nil {
+		return CategoryTaxonomy{}, err
+	}
+	var taxonomy CategoryTaxonomy
+	err = json.Unmarshal(data, &taxonomy)
+	return taxonomy, err
+}
+
+func loadCategoryTaxonomy(name string) (CategoryTaxonomy, error) {
+	if !useLocalDb() {
+		return loadCategoryTaxonomyFile(name)
+	}
+	importLegacyCaches(name)
+
+	db, err := localDb()
+	if err != nil {
+		return CategoryTaxonomy{}, err
+	}
+	var fetchedAt string
+	err = db.QueryRow("SELECT fetched_at FROM category_syncs WHERE target = ?", name).Scan(&fetchedAt)
+	if err == sql.ErrNoRows {
+		return CategoryTaxonomy{}, fmt.Errorf("no categories cached for '%s'", name)
+	} else if err != nil {
+		return CategoryTaxonomy{}, err
+	}
+	taxonomy := CategoryTaxonomy{}
+	taxonomy.FetchedAt, err = time.Parse(time.RFC3339, fetchedAt)
+	if err != nil {
+		return CategoryTaxonomy{}, err
+	}
+	taxonomy.Categories, err = queryStrings(db, "SELECT category FROM categories WHERE target = ? ORDER BY category", name)
+	return taxonomy, err
+}
+
+func writeCategoryTaxonomy(name string, taxonomy CategoryTaxonomy) error {
+	if !useLocalDb() {
+		jsonString, err := json.Marshal(taxonomy)
+		if err != nil {
+			return err
+		}
+		os.MkdirAll(getHostDataDir(name), privateDirMode)
+		return ioutil.WriteFile(getCategoryTaxonomyPath(name), jsonString, 0o644)
+	}
+
+	err := updateLocalDb(func(tx *sql.Tx) error {
+		if _, err := tx.Exec("DELETE FROM categories WHERE target = ?", name); err != nil {
+			return err
+		}
+		for _, category := range taxonomy.Categories {
+			if _, err := tx.Exec("INSERT OR IGNORE INTO categories (target, category) VALUES (?, ?)", name, category); err != nil {
+				return err
+			}
+		}
+		_, err := tx.Exec("INSERT OR REPLACE INTO category_syncs (target, fetched_at) VALUES (?, ?)",
+			name, taxonomy.FetchedAt.UTC().Format(time.RFC3339))
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	// Superseded by the database, it would be imported over newer data
+	os.Remove(getCategoryTaxonomyPath(name))
+	return nil
+}
+
+/*
+ * Those of categories the cached taxonomy doesn't have, looked up by index
+ * rather than by loading the whole taxonomy
+ */
+func uncachedCategories(name string, categories []string) ([]string, error) {
+	if !useLocalDb() {
+		taxonomy, err := loadCategoryTaxonomyFile(name)
+		if err != nil {
+			return nil, err
+		}
+		var unknown []string
+		for _, category := range categories {
+			if !contains(taxonomy.Categories, category) && !contains(unknown, category) {
+				unknown = append(unknown, category)
+			}
+		}
+		return unknown, nil
+	}
+	importLegacyCaches(name)
+
+	db, err := localDb()
+	if err != nil {
+		return nil, err
+	}
+	var target string
+	err = db.QueryRow("SELECT target FROM category_syncs WHERE target = ?", name).Scan(&target)
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("no categories cached for '%s'", name)
+	} else if err != nil {
+		return nil, err
+	}
+	if len(categories) == 0 {
+		return nil, nil
+	}
+	args := []interface{}{name}
+	for _, category := range categories {
+		args = append(args, category)
+	}
+	placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(categories)), ", ")
+	rows, err := queryStrings(db, "SELECT category FROM categories WHERE target = ? AND category IN ("+placeholders+")", args...)
+	if err != nil {
+		return nil, err
+	}
+	known := map[string]bool{}
+	for _, category := range rows {
+		known[category] = true
+	}
+	var unknown []string
+	for _, category := range categories {
+		if !known[category] && !contains(unknown, category) {
+			unknown = append(unknown, category)
+		}
+	}
+	return unknown, nil
+}
+
+/*
+ * Number of single character edits between two strings
+ */
+func editDistance(a string, b string) int {
+	previous := make([]int, len(b)+1)
+	current := make([]int, len(b)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		current[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			current[j] = previous[j-1] + cost
+			if previous[j]+1 < current[j] {
+				current[j] = previous[j] + 1
+			}
+			if current[j-1]+1 < current[j] {
+				current[j] = current[j-1] + 1
+			}
+		}
+		previous, current = current, previous
+	}
+	return previous[len(b)]
+}
+
+/*
+ * Known categories that look like a mistyped one, closest first
+ */
+func similarCategories(category string, known []string) []string {
+	var similar []string
+	for _, candidate := range known {
+		if editDistance(category, candidate) <= 2 || strings.Contains(candidate, category) || strings.Contains(category, candidate) {
+			similar = append(similar, candidate)
+		}
+	}
+	sort.SliceStable(similar, func(i, j int) bool {
+		return editDistance(category, similar[i]) < editDistance(category, similar[j])
+	})
+	return similar
+}
+
+/*
+ * All categories in the target's lookup service database
+ */
+func fetchCategories(targetName string) ([]string, error) {
+	resp, err := ApiPost(targetName, "/api/listCategories", "")
+	if err != nil {
+		return nil, err
+	}
+	defer closeResponse(resp)
+
+	var categories CatList
+	err = json.NewDecoder(resp.Body).Decode(&categories)
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(categories)
+	return categories, nil
+}
+
+/*
+ * Categories the lookup service knows, from the service itself or the cache when it can't be reached
+ */
+func knownCategories(targetName string) ([]string, error) {
+	categories, err := fetchCategories(targetName)
+	if err == nil {
+		// Keep the cache current while we have the list anyway
+		writeCategoryTaxonomy(targetName, CategoryTaxonomy{Categories: categories, FetchedAt: time.Now()})
+		return categories, nil
+	}
+	taxonomy, cacheErr := loadCategoryTaxonomy(targetName)
+	if cacheErr != nil {
+		return nil, err
+	}
+	return taxonomy.Categories, nil
+}
+
+/*
+ * Check that a category exists in the database, the cached taxonomy or an acl rule, so rules
+ * and domains don't end up in a mistyped category that never matches
+ */
+func checkCategory(targetName string, config FilterConfig, category string) error {
+	for _, rule := range config.AllowRules {
+		if rule.Category == category {
+			return nil
+		}
+	}
+	for _, rule := range config.DecryptRules {
+		if rule.Category == category {
+			return nil
+		}
+	}
+
+	known, err := knownCategories(targetName)
+	if err != nil {
+		log.Printf("Warning: cannot check category '%s', the lookup service is unreachable and no categories are cached: %s\n", category, err)
+		return nil
+	}
+	if contains(known, category) {
+		return nil
+	}
+
+	message := fmt.Sprintf("unknown category '%s'", category)
+	if similar := similarCategories(category, known); len(similar) > 0 {
+		if len(similar) > 3 {
+			similar = similar[:3]
+		}
+		message += fmt.Sprintf(" (did you mean %s?)", strings.Join(similar, ", "))
+	}
+	return fmt.Errorf("%s", message)
+}
+
+/*
+ * Categorize domains, refusing a category that doesn't exist yet unless create is set
+ */
+func CategorizeDomains(targetName string, domains []string, category string, create bool) int {
+
+	if !create {
+		config, err := getHostFilterConfig(targetName)
+		if err != nil {
+			log.Fatal("Failed to get host config: ", err)
+			return -1
+		}
+		if err := checkCategory(targetName, config, category); err != nil {
+			log.Fatalf("Not categorizing: %s; use --create to make a new category\n", err)
+			return -1
+		}
+	}
+
+	return Categorize(targetName, domains, category)
+}
+
+/*
+ * Cache the categories the target's lookup service knows so acl rules can be checked for typos
+ */
+func SyncBuiltinCategories(targetName string) int {
+
+	categories, err := fetchCategories(targetName)
+	if err != nil {
+		log.Fatal("Failed to list categories in database: ", err)
+		return -1
+	}
+
+	err = writeCategoryTaxonomy(targetName, CategoryTaxonomy{Categories: categories, FetchedAt: time.Now()})
+	if err != nil {
+		log.Fatal("Failed to cache categories: ", err)
+		return -1
+	}
+
+	log.Printf("Cached %d categories from the lookup service; 'filter acl add' now checks category names\n", len(categories))
+	return 0
+}
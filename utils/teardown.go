@@ -0,0 +1,190 @@
+package utils
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"strings"
+)
+
+// Directories a volume path outside ~/.guardian may be a dedicated directory under
+var volumeRoots = []string{"/srv", "/data", "/mnt", "/media", "/opt", "/var/lib"}
+
+/*
+ * Check a user-set volume path is a dedicated directory teardown may delete as
+ * root: strictly under ~/.guardian or one of the volume roots, and never the home
+ * directory or one of its parents
+ */
+func checkVolumePath(host Host, volumePath string) error {
+	guardianDir := path.Join(host.HomePath, ".guardian")
+	if !path.IsAbs(volumePath) {
+		return fmt.Errorf("volume path %s is not absolute", volumePath)
+	}
+	volumePath = path.Clean(volumePath)
+	home := path.Clean(host.HomePath)
+	if volumePath == "/" || volumePath == guardianDir || volumePath == home || strings.HasPrefix(home+"/", volumePath+"/") {
+		return fmt.Errorf("volume path %s holds more than the filter's data", volumePath)
+	}
+	for _, root := range append([]string{guardianDir}, volumeRoots...) {
+		if strings.HasPrefix(volumePath, root+"/") {
+			return nil
+		}
+	}
+	return fmt.Errorf("volume path %s is not a directory under %s", volumePath, strings.Join(append([]string{guardianDir}, volumeRoots...), ", "))
+}
+
+/*
+ * Remove everything setup and deploys put on a target: the filter release, the
+ * k3s agents of its workers, k3s itself and ~/.guardian, with the volumes unless
+ * keepData is set. The target stays configured, so 'target setup' can start over.
+ */
+func TeardownHost(name string, keepData bool, forceUnlock bool) int {
+
+	config, err := loadConfig()
+	if err != nil {
+		log.Fatal("Failed to load config: ", err)
+		return -1
+	}
+
+	index, host := FindHost(config, name)
+	if host.Name != name {
+		log.Fatalf("Host %s doesn't exist, create it first", name)
+		return -1
+	}
+	if host.Local {
+		log.Fatalf("%s is a local cluster, remove it with 'devtest down'\n", name)
+		return -1
+	}
+
+	guardianDir := path.Join(host.HomePath, ".guardian")
+	volumePath := getHostVolumePath(host)
+	if filterConfig, err := loadHostFilterConfig(name); err == nil && filterConfig.VolumePath != "" {
+		volumePath = path.Clean(filterConfig.VolumePath)
+	}
+	// Deleted as root, or kept while everything around it in ~/.guardian goes
+	if keepData && (volumePath == guardianDir || strings.HasPrefix(guardianDir+"/", volumePath+"/")) {
+		log.Fatalf("Refusing to tear down %s: volume path %s contains all of %s, so nothing can be removed around it\n", name, volumePath, guardianDir)
+		return -1
+	} else if !keepData {
+		if err := checkVolumePath(host, volumePath); err != nil {
+			log.Fatalf("Refusing to tear down %s: %s; use --keep-data and remove the data by hand\n", name, err)
+			return -1
+		}
+	}
+
+	removed := []string{"the filter release", "k3s", guardianDir}
+	if len(host.Nodes) > 0 {
+		removed = append(removed, fmt.Sprintf("k3s on %d worker node(s)", len(host.Nodes)))
+	}
+	if keepData {
+		removed[2] += fmt.Sprintf(" except %s", volumePath)
+	} else if !strings.HasPrefix(volumePath, guardianDir+"/") {
+		removed = append(removed, volumePath)
+	}
+	fmt.Printf("This removes %s from %s.\n", strings.Join(removed, ", "), name)
+	if !keepData {
+		fmt.Println("The filter's data (category database, logs, certificates) is deleted with it, use --keep-data to keep it.")
+	}
+	proceed, err := confirm("Are you sure you want to proceed?")
+	if err != nil {
+		log.Fatal("Error receiving prompt: ", err)
+		return -1
+	} else if !proceed {
+		return 0
+	}
+
+	sudo, err := sudoPassword(host)
+	if err != nil {
+		log.Fatal("Failed to get password: ", err)
+		return -1
+	}
+	prompts := map[string]string{"[sudo] password for ": sudo}
+
+	// Held until ~/.guardian, where it lives, is deleted
+	done := progressStep(name, "lock")
+	release, err := acquireTargetLock(host, "teardown", forceUnlock)
+	done(err)
+	if err != nil {
+		log.Fatal("Failed to lock target: ", err)
+		return -1
+	}
+
+	log.Println("Uninstalling the filter release...")
+	done = progressStep(name, "helm-uninstall")
+	_, err = runHostCommands(host, []string{
+		"export KUBECONFIG=/etc/rancher/k3s/k3s.yaml",
+		"if command -v helm >/dev/null && helm status -n filter guardian-angel >/dev/null 2>&1; then helm uninstall --wait -n filter guardian-angel; fi",
+	}, true)
+	done(err)
+	if err != nil {
+		release()
+		log.Fatal("Failed to uninstall filter stack: ", err)
+		return -1
+	}
+
+	// Their agents would keep trying to reach the server removed next
+	for _, node := range host.Nodes {
+		log.Printf("Removing k3s from worker %s...\n", node.Name)
+		_, err = runHostCommandsWithPrompts(nodeHost(host, node), []string{
+			"if [ -x /usr/local/bin/k3s-agent-uninstall.sh ]; then sudo /usr/local/bin/k3s-agent-uninstall.sh; fi",
+		}, prompts, false)
+		if err != nil {
+			log.Printf("Warning: failed to uninstall k3s from %s, remove it by hand: %s\n", node.Address, err)
+		}
+	}
+
+	log.Println("Removing k3s...")
+	done = progressStep(name, "remove-k3s")
+	ctx, cancel := stepContext(playbookTimeout)
+	defer cancel()
+	_, err = runHostCommandsWithPromptsContext(ctx, host, []string{
+		"if [ -x /usr/local/bin/k3s-uninstall.sh ]; then sudo /usr/local/bin/k3s-uninstall.sh; fi",
+	}, prompts, true)
+	done(err)
+	if err != nil {
+		release()
+		log.Fatal("Failed to remove k3s: ", err)
+		return -1
+	}
+
+	// Volumes are written by the pods as root, so deleting them needs sudo
+	commands := []string{fmt.Sprintf("sudo rm -rf %s", shellQuote(guardianDir))}
+	if keepData {
+		// Keeps the entry of ~/.guardian the volumes are in, the lock goes with the rest
+		kept := volumePath
+		if strings.HasPrefix(volumePath, guardianDir+"/") {
+			kept = path.Join(guardianDir, strings.SplitN(strings.TrimPrefix(volumePath, guardianDir+"/"), "/", 2)[0])
+		}
+		commands = []string{fmt.Sprintf("find %s -mindepth 1 -maxdepth 1 ! -path %s -exec sudo rm -rf {} +",
+			shellQuote(guardianDir), shellQuote(kept))}
+	} else if !strings.HasPrefix(volumePath, guardianDir+"/") {
+		commands = append(commands, fmt.Sprintf("sudo rm -rf %s", shellQuote(volumePath)))
+	}
+	log.Printf("Removing %s...\n", guardianDir)
+	done = progressStep(name, "remove-files")
+	_, err = runHostCommandsWithPrompts(host, commands, prompts, false)
+	done(err)
+	if err != nil {
+		release()
+		log.Fatalf("Failed to remove %s: %s\n", guardianDir, err)
+		return -1
+	}
+
+	// The cluster they described is gone
+	os.Remove(getClusterFactsPath(name))
+	config.Hosts[index].Nodes = nil
+	err = writeConfig(config)
+	if err != nil {
+		log.Fatal("Failed to write config: ", err)
+		return -1
+	}
+
+	if keepData {
+		log.Printf("Tore down %s, its data is kept in %s\n", name, volumePath)
+	} else {
+		log.Printf("Tore down %s\n", name)
+	}
+	log.Printf("Run 'target setup %s' to install it again, or 'target delete %s' to forget it\n", name, name)
+	return 0
+}
@@ -0,0 +1,266 @@
+package utils
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+	"time"
+)
+
+type threatFeed struct {
+	Url      string
+	Category string
+}
+
+// Known feeds; each lists one URL per line
+var threatFeeds = map[string]threatFeed{
+	"openphish": {Url: "https://openphish.com/feed.txt", Category: "phishing"},
+	"urlhaus":   {Url: "https://urlhaus.abuse.ch/downloads/text_online/", Category: "malware"},
+}
+
+type ThreatFeedConfig struct {
+	Feeds []string `yaml:"feeds"`
+	// How often the daemon updates the feeds, i.e. 6h
+	Refresh string `yaml:"refresh"`
+}
+
+// How often the daemon checks whether a target's feeds are due
+const threatFeedCheckInterval = time.Minute
+
+// Hosts serving many unrelated sites, where a phishing URL says nothing about the rest of the host
+var sharedHostingDomains = []string{
+	"sites.google.com", "docs.google.com", "drive.google.com", "forms.gle", "storage.googleapis.com",
+	"firebaseapp.com", "web.app", "github.io", "githubusercontent.com", "gitlab.io", "blogspot.com",
+	"wixsite.com", "weebly.com", "godaddysites.com", "webflow.io", "netlify.app", "vercel.app",
+	"pages.dev", "workers.dev", "herokuapp.com", "azurewebsites.net", "web.core.windows.net",
+	"blob.core.windows.net", "s3.amazonaws.com", "dropbox.com", "onedrive.live.com",
+	"sharepoint.com", "000webhostapp.com", "ipfs.io", "glitch.me", "repl.co",
+}
+
+/*
+ * Whether a feed entry names a page on a shared host rather than the whole site
+ */
+func sharedHostingPage(u *url.URL, domain string) bool {
+	if u.Path == "" || u.Path == "/" {
+		return false
+	}
+	for _, shared := range sharedHostingDomains {
+		if domain == shared || strings.HasSuffix(domain, "."+shared) {
+			return true
+		}
+	}
+	return false
+}
+
+func threatFeedNames() []string {
+	var names []string
+	for name := range threatFeeds {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+/*
+ * Download a feed and return the distinct domains in it. The category DB matches
+ * domains only, so pages on shared hosts are dropped instead of blocking the host.
+ */
+func fetchThreatFeed(feed threatFeed) ([]string, error) {
+	client := &http.Client{Timeout: 60 * time.Second}
+	resp, err := client.Get(feed.Url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("received code %d from %s", resp.StatusCode, feed.Url)
+	}
+
+	seen := map[string]bool{}
+	var domains []string
+	skipped := 0
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		u, err := url.Parse(line)
+		if err != nil || u.Hostname() == "" {
+			continue
+		}
+		domain := strings.ToLower(u.Hostname())
+		if sharedHostingPage(u, domain) {
+			skipped++
+			continue
+		}
+		if !seen[domain] {
+			seen[domain] = true
+			domains = append(domains, domain)
+		}
+	}
+	if skipped > 0 {
+		log.Printf("Skipped %d entries on shared hosting from %s\n", skipped, feed.Url)
+	}
+	return domains, scanner.Err()
+}
+
+/*
+ * Fetch every enabled feed and load its domains into the category DB
+ */
+func UpdateThreatFeeds(targetName string) int {
+
+	config, err := getHostFilterConfig(targetName)
+	if err != nil {
+		log.Fatal("Failed to get host config: ", err)
+		return -1
+	}
+
+	if len(config.ThreatFeeds.Feeds) == 0 && config.NewDomains.Age == "" {
+		log.Fatalln("No threat feeds are enabled")
+		return -1
+	}
+
+	code := 0
+	for _, name := range config.ThreatFeeds.Feeds {
+		feed := threatFeeds[name]
+		log.Printf("Fetching threat feed '%s'...\n", name)
+		domains, err := fetchThreatFeed(feed)
+		if err != nil {
+			log.Printf("Failed to fetch threat feed '%s': %s\n", name, err)
+			code = -1
+			continue
+		}
+		log.Printf("Adding %d domains from '%s' to category '%s'\n", len(domains), name, feed.Category)
+		if Categorize(targetName, domains, feed.Category) != 0 {
+			code = -1
+		}
+	}
+
+	if config.NewDomains.Age != "" {
+		log.Println("Syncing newly registered domains...")
+		if err := syncNewDomains(targetName, config.NewDomains); err != nil {
+			log.Printf("Failed to sync new domains: %s\n", err)
+			code = -1
+		}
+	}
+	return code
+}
+
+/*
+ * Enable threat feeds, deny their categories, and load them once
+ */
+func EnableThreatFeeds(targetName string, feeds []string, refresh string) int {
+
+	for _, name := range feeds {
+		if _, ok := threatFeeds[name]; !ok {
+			log.Fatalf("Unknown threat feed '%s', valid options are %s\n", name, strings.Join(threatFeedNames(), ", "))
+			return -1
+		}
+	}
+	if d, err := time.ParseDuration(refresh); err != nil || d < threatFeedCheckInterval {
+		log.Fatalf("Invalid refresh interval '%s', it must be at least %s\n", refresh, threatFeedCheckInterval)
+		return -1
+	}
+
+	config, err := getHostFilterConfig(targetName)
+	if err != nil {
+		log.Fatal("Failed to get host config: ", err)
+		return -1
+	}
+
+	config.ThreatFeeds = ThreatFeedConfig{Feeds: feeds, Refresh: refresh}
+
+	// Deny rules go first so they win over any allow rule
+	for _, name := range feeds {
+		category := threatFeeds[name].Category
+		if !config.AclRuleExists(category, "deny") {
+			config.AddAclRule(category, "deny", 0)
+			log.Printf("Added acl rule '%s=deny'\n", category)
+		}
+	}
+
+	err = writeHostFilterConfig(targetName, config)
+	if err != nil {
+		log.Fatal("Failed to write host config: ", err)
+		return -1
+	}
+
+	log.Printf("Enabled threat feeds: %s; 'daemon' updates them every %s\n", strings.Join(feeds, ", "), refresh)
+	return UpdateThreatFeeds(targetName)
+}
+
+/*
+ * Stop updating threat feeds; categories and rules already added are left in place
+ */
+func DisableThreatFeeds(targetName string) int {
+
+	config, err := getHostFilterConfig(targetName)
+	if err != nil {
+		log.Fatal("Failed to get host config: ", err)
+		return -1
+	}
+
+	config.ThreatFeeds = ThreatFeedConfig{}
+
+	err = writeHostFilterConfig(targetName, config)
+	if err != nil {
+		log.Fatal("Failed to write host config: ", err)
+		return -1
+	}
+
+	log.Println("Disabled threat feeds. Use 'filter acl delete-category' to drop their domains.")
+	return 0
+}
+
+/*
+ * Run 'filter threat-feed update' for the targets whose feeds are due, on the
+ * interval each target's config sets. The settings are read again on every check,
+ * so enabling, disabling or changing the interval applies without a restart.
+ */
+func refreshThreatFeeds(targets []string) {
+	lastUpdate := map[string]time.Time{}
+	for {
+		for _, name := range targets {
+			config, err := loadHostFilterConfig(name)
+			if err != nil || len(config.ThreatFeeds.Feeds) == 0 {
+				continue
+			}
+			refresh, err := time.ParseDuration(config.ThreatFeeds.Refresh)
+			if err != nil || time.Since(lastUpdate[name]) < refresh {
+				continue
+			}
+			lastUpdate[name] = time.Now()
+			if err := runThreatFeedUpdate(name); err != nil {
+				log.Printf("Failed to update threat feeds of '%s': %s\n", name, err)
+			}
+		}
+		time.Sleep(threatFeedCheckInterval)
+	}
+}
+
+/*
+ * Update a target's feeds as a command of its own, one failing ends only that process
+ */
+func runThreatFeedUpdate(name string) error {
+	executable, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	cmd := exec.Command(executable, "--non-interactive", "filter", "threat-feed", "update", "--target", name)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	err = cmd.Run()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return fmt.Errorf("exited with code %d", exitErr.ExitCode())
+	}
+	return err
+}
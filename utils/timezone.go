@@ -0,0 +1,122 @@
+package utils
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	// Validate zone names on admin machines without a zoneinfo database
+	_ "time/tzdata"
+)
+
+/*
+ * Ask the target for its IANA time zone, from systemd or the zoneinfo link
+ */
+func detectTimeZone(host Host) (string, error) {
+	out, err := runHostCommands(host, []string{
+		"timedatectl show -p Timezone --value 2>/dev/null || cat /etc/timezone 2>/dev/null || readlink /etc/localtime | sed 's|.*/zoneinfo/||'",
+	}, false)
+	if err != nil {
+		return "", err
+	}
+	zone := strings.TrimSpace(out)
+	if _, err := time.LoadLocation(zone); err != nil || zone == "" {
+		return "", fmt.Errorf("target reported unknown time zone '%s'", zone)
+	}
+	return zone, nil
+}
+
+/*
+ * Set the target's time zone from an override, or detect it unless an earlier
+ * override should be kept; 'auto' drops the override
+ */
+func setHostTimeZone(host *Host, override string) {
+	if override == "auto" {
+		host.TimeZoneOverride = false
+	} else if override != "" {
+		host.TimeZone = override
+		host.TimeZoneOverride = true
+		return
+	}
+	if host.TimeZoneOverride && host.TimeZone != "" {
+		return
+	}
+	zone, err := detectTimeZone(*host)
+	if err != nil {
+		log.Printf("Warning: failed to detect the time zone of '%s', schedules will run in UTC: %s\n", host.Name, err)
+		return
+	}
+	host.TimeZone = zone
+	host.TimeZoneOverride = false
+}
+
+func validateTimeZone(zone string) error {
+	if zone == "" || zone == "auto" {
+		return nil
+	}
+	if _, err := time.LoadLocation(zone); err != nil {
+		return fmt.Errorf("invalid time zone '%s', use an IANA name like 'Europe/Berlin'", zone)
+	}
+	return nil
+}
+
+/*
+ * Location schedules of a target are evaluated in, UTC when it is unknown
+ */
+func hostLocation(host Host) *time.Location {
+	if host.TimeZone == "" {
+		return time.UTC
+	}
+	location, err := time.LoadLocation(host.TimeZone)
+	if err != nil {
+		return time.UTC
+	}
+	return location
+}
+
+/*
+ * Location of a target by name, for commands that only have its filter config
+ */
+func targetLocation(targetName string) *time.Location {
+	config, err := loadConfig()
+	if err != nil {
+		return time.UTC
+	}
+	_, host := FindHost(config, targetName)
+	return hostLocation(host)
+}
+
+/*
+ * Detect a target's time zone on deploy if it has none yet, and pass it to the
+ * chart so report and maintenance CronJobs run in target-local time
+ */
+func syncHostTimeZone(host *Host, filterConfig *FilterConfig) error {
+	if host.TimeZone == "" {
+		setHostTimeZone(host, "")
+		if host.TimeZone != "" {
+			config, err := loadConfig()
+			if err != nil {
+				return err
+			}
+			index, _ := FindHost(config, host.Name)
+			if index >= 0 {
+				config.Hosts[index].TimeZone = host.TimeZone
+				if err := writeConfig(config); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	if filterConfig.TimeZone == host.TimeZone {
+		return nil
+	}
+	filterConfig.TimeZone = host.TimeZone
+	err := writeHostFilterConfig(host.Name, *filterConfig)
+	if err != nil {
+		return err
+	}
+	// Later writes of the deploy carry on from the revision this one made
+	*filterConfig, err = loadHostFilterConfig(host.Name)
+	return err
+}
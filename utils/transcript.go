@@ -0,0 +1,160 @@
+package utils
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+)
+
+// Set from --record and --replay; remote operations are written to or served from these files
+var RecordFile string
+var ReplayFile string
+
+// Kinds of remote operation in a transcript
+const (
+	transcriptRun     = "run"
+	transcriptPrompts = "prompts"
+	transcriptPut     = "put"
+	transcriptExec    = "exec"
+)
+
+type transcriptEntry struct {
+	Target string `json:"target"`
+	Kind   string `json:"kind"`
+	// Commands run, or the source and destination of a copy
+	Commands []string     `json:"commands"`
+	Results  RemoteResult `json:"results,omitempty"`
+	Error    string       `json:"error,omitempty"`
+	used     bool
+}
+
+// Commands whose output is a secret, recorded without it
+var secretOutputCommands = map[string]bool{
+	readK3sTokenCommand: true,
+}
+
+var transcriptMutex sync.Mutex
+var replayEntries []*transcriptEntry
+var replayLoaded bool
+
+func replaying() bool {
+	return ReplayFile != ""
+}
+
+/*
+ * Append a remote operation and its result to the record file
+ */
+func recordTranscript(host Host, kind string, commands []string, results RemoteResult, err error) {
+	if RecordFile == "" {
+		return
+	}
+	var recorded RemoteResult
+	for _, result := range results {
+		if secretOutputCommands[result.Command] {
+			result.Stdout = redactedValue
+		}
+		recorded = append(recorded, result)
+	}
+	entry := transcriptEntry{Target: host.Name, Kind: kind, Commands: commands, Results: recorded}
+	if err != nil {
+		entry.Error = err.Error()
+	}
+	data, jsonErr := json.Marshal(entry)
+	if jsonErr != nil {
+		return
+	}
+
+	transcriptMutex.Lock()
+	defer transcriptMutex.Unlock()
+	f, fileErr := os.OpenFile(RecordFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, privateFileMode)
+	if fileErr != nil {
+		log.Printf("Failed to record transcript: %s\n", fileErr)
+		return
+	}
+	defer f.Close()
+	f.Write(append(data, '\n'))
+}
+
+func loadReplayEntries() error {
+	if replayLoaded {
+		return nil
+	}
+	f, err := os.Open(ReplayFile)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		if strings.TrimSpace(scanner.Text()) == "" {
+			continue
+		}
+		var entry transcriptEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return fmt.Errorf("line %d: %s", line, err)
+		}
+		replayEntries = append(replayEntries, &entry)
+	}
+	replayLoaded = true
+	return scanner.Err()
+}
+
+/*
+ * The deploy lock owner records the time and pid, so it never matches a recording
+ */
+func volatileCommand(command string) bool {
+	return strings.Contains(command, "echo ") && strings.HasSuffix(command, "/owner")
+}
+
+func sameCommands(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] && !(volatileCommand(a[i]) && volatileCommand(b[i])) {
+			return false
+		}
+	}
+	return true
+}
+
+/*
+ * Answer a remote operation from the replay file instead of the host, using
+ * each recorded entry once and in order
+ */
+func replayTranscript(host Host, kind string, commands []string, print bool) (RemoteResult, error) {
+	transcriptMutex.Lock()
+	defer transcriptMutex.Unlock()
+
+	if err := loadReplayEntries(); err != nil {
+		return nil, fmt.Errorf("failed to load replay file: %s", err)
+	}
+
+	for _, entry := range replayEntries {
+		if entry.used || entry.Target != host.Name || entry.Kind != kind || !sameCommands(entry.Commands, commands) {
+			continue
+		}
+		entry.used = true
+		if print {
+			for _, result := range entry.Results {
+				fmt.Print(result.Stdout + result.Stderr)
+			}
+		}
+		var err error
+		if entry.Error != "" {
+			err = errors.New(entry.Error)
+		}
+		if kind == transcriptPut {
+			return nil, err
+		}
+		return entry.Results, resultsError(commands, entry.Results, err)
+	}
+	return nil, fmt.Errorf("no recorded %s of '%s' on %s in the replay file", kind, strings.Join(commands, "; "), host.Name)
+}
@@ -0,0 +1,322 @@
+package utils
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Skip looking up which of the chart's images the target must pull, set by --skip-image-precheck
+var SkipImagePrecheck bool
+
+// Guess for an image the target has no version of, most of the stack's are around this size
+const defaultImagePullSize = 150 << 20
+
+// What setup downloads on a host without k3s: the k3s binary and its system images
+const k3sInstallSize = 250 << 20
+
+// Below this, copying over SSH is slow enough to mention
+const slowLinkBytesPerSecond = 1 << 20
+
+// Uploaded to measure the SSH link
+const linkSampleSize = 256 << 10
+
+// Literal image references in the chart's templates, templated ones come from values.yaml
+var templateImagePattern = regexp.MustCompile(`(?m)^\s*-?\s*image:\s*["']?([a-z0-9][^\s"'{}]*)["']?\s*$`)
+
+type nodeImagesJson struct {
+	Items []struct {
+		Metadata struct {
+			Name string
+		}
+		Status struct {
+			Images []struct {
+				Names     []string
+				SizeBytes int64
+			}
+		}
+	}
+}
+
+/*
+ * Size of the files under a path
+ */
+func pathSize(src string) int64 {
+	var size int64
+	filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size
+}
+
+/*
+ * Image reference as containerd names it, i.e. redis:7 is docker.io/library/redis:7
+ */
+func normalizeImage(image string) string {
+	if !strings.Contains(image, "@") && !strings.Contains(image[strings.LastIndex(image, "/")+1:], ":") {
+		image += ":latest"
+	}
+	first := strings.SplitN(image, "/", 2)[0]
+	if !strings.Contains(image, "/") {
+		return "docker.io/library/" + image
+	}
+	if !strings.ContainsAny(first, ".:") && first != "localhost" {
+		return "docker.io/" + image
+	}
+	return image
+}
+
+/*
+ * Repository of an image without its tag or digest
+ */
+func imageRepository(image string) string {
+	image = strings.SplitN(image, "@", 2)[0]
+	if i := strings.LastIndex(image, ":"); i > strings.LastIndex(image, "/") {
+		return image[:i]
+	}
+	return image
+}
+
+/*
+ * Images in chart values: 'image' strings and maps with a 'repository' and 'tag'
+ */
+func valuesImages(node interface{}, images map[string]bool) {
+	switch value := node.(type) {
+	case map[interface{}]interface{}:
+		if repository, ok := value["repository"].(string); ok && repository != "" {
+			image := repository
+			if registry, ok := value["registry"].(string); ok && registry != "" {
+				image = registry + "/" + image
+			}
+			if tag := fmt.Sprint(value["tag"]); value["tag"] != nil && tag != "" {
+				image += ":" + tag
+			}
+			images[normalizeImage(image)] = true
+		}
+		for key, child := range value {
+			if image, ok := child.(string); ok && key == "image" && image != "" && !strings.Contains(image, "{{") {
+				images[normalizeImage(image)] = true
+			}
+			valuesImages(child, images)
+		}
+	case []interface{}:
+		for _, child := range value {
+			valuesImages(child, images)
+		}
+	}
+}
+
+/*
+ * Images the checked out chart runs, from its values and templates
+ */
+func chartImages() ([]string, error) {
+	images := map[string]bool{}
+	chartDir := filepath.Join(getHelmPath(), "guardian-angel")
+	err := filepath.Walk(chartDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			if info.Name() == ".git" {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if ext := filepath.Ext(path); ext != ".yaml" && ext != ".yml" && ext != ".tpl" {
+			return nil
+		}
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		if info.Name() == "values.yaml" {
+			var values interface{}
+			if err := yaml.Unmarshal(data, &values); err != nil {
+				return fmt.Errorf("failed to parse %s: %s", path, err)
+			}
+			valuesImages(values, images)
+			return nil
+		}
+		for _, match := range templateImagePattern.FindAllStringSubmatch(string(data), -1) {
+			images[normalizeImage(match[1])] = true
+		}
+		return nil
+	})
+	var list []string
+	for image := range images {
+		list = append(list, image)
+	}
+	sort.Strings(list)
+	return list, err
+}
+
+/*
+ * Time a small upload over the host's SSH connection, in bytes per second
+ */
+func measureLinkSpeed(host Host) (float64, error) {
+	ctx, cancel := context.WithTimeout(interruptContext, 30*time.Second)
+	defer cancel()
+	session, err := sharedHostConn(host).newSession(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer session.Close()
+	// Random, so compression along the way can't flatter the link
+	session.Stdin = io.LimitReader(rand.Reader, linkSampleSize)
+	start := time.Now()
+	err = session.Run("cat > /dev/null")
+	if err != nil {
+		return 0, err
+	}
+	return float64(linkSampleSize) / time.Since(start).Seconds(), nil
+}
+
+/*
+ * Warn when the target's connection is metered, and when measure is set, when the
+ * SSH link to it is slow for copying bytes
+ */
+func warnLink(host Host, metered string, bytes int64, measure bool) {
+	for _, line := range strings.Split(metered, "\n") {
+		// nmcli reports 'yes' or 'yes (guessed)' per device
+		if strings.HasPrefix(strings.TrimSpace(line), "yes") {
+			log.Println("Warning: the target's connection is metered, image pulls count against its data plan")
+			break
+		}
+	}
+	// The sample is uploaded outside the transcript, a replay must not reach the target
+	if host.Local || !measure || replaying() {
+		return
+	}
+	speed, err := measureLinkSpeed(host)
+	if err != nil {
+		log.Printf("Could not measure the SSH link: %s\n", err)
+		return
+	}
+	if speed < slowLinkBytesPerSecond {
+		log.Printf("Warning: the SSH link runs at %s/s, copying %s takes about %s\n",
+			humanBytes(int64(speed)), humanBytes(bytes), (time.Duration(float64(bytes)/speed) * time.Second).Round(time.Second))
+	}
+}
+
+/*
+ * Report what a deploy transfers: the chart copied over SSH, and the chart's images
+ * the target doesn't have yet, sized by an older version it has or else a guess
+ */
+func estimateDeployTransfer(host Host, masterNode string) error {
+	chartSize := pathSize(getHelmPath()) + pathSize(getHostFilterConfigPath(host.Name))
+	emitProgress(ProgressEvent{Event: "estimate", Target: host.Name, Step: "copy-chart", Bytes: chartSize})
+
+	commands := []string{"(nmcli -t -g GENERAL.METERED device show 2>/dev/null; true)"}
+	if !SkipImagePrecheck {
+		commands = append(commands, "echo ---", k3sKubeconfigExport, "kubectl get nodes -o json 2>/dev/null || echo '{}'")
+	}
+	out, err := runHostCommands(host, commands, false)
+	if err != nil {
+		return err
+	}
+	sections := strings.SplitN(strings.ReplaceAll(out, "\r", ""), "---\n", 2)
+
+	if SkipImagePrecheck {
+		log.Printf("Transfer: %s of chart, image pulls not checked (--skip-image-precheck)\n", humanBytes(chartSize))
+		warnLink(host, sections[0], chartSize, false)
+		return nil
+	}
+	if len(sections) != 2 {
+		return fmt.Errorf("unexpected output from target")
+	}
+
+	images, err := chartImages()
+	if err != nil {
+		return fmt.Errorf("failed to list the chart's images: %s", err)
+	}
+	var nodes nodeImagesJson
+	if err := json.Unmarshal([]byte(sections[1]), &nodes); err != nil {
+		return fmt.Errorf("failed to parse kubectl output: %s", err)
+	}
+	// Pods run on the master node, so its images are what count
+	present := map[string]int64{}
+	repositories := map[string]int64{}
+	for i, node := range nodes.Items {
+		if node.Metadata.Name != masterNode && !(masterNode == "" && i == 0) {
+			continue
+		}
+		for _, image := range node.Status.Images {
+			for _, imageName := range image.Names {
+				present[imageName] = image.SizeBytes
+				repositories[imageRepository(imageName)] = image.SizeBytes
+			}
+		}
+	}
+
+	var pullSize int64
+	var missing []string
+	for _, image := range images {
+		if _, ok := present[image]; ok {
+			continue
+		}
+		size, known := repositories[imageRepository(image)]
+		detail := "size of the version on the target"
+		if !known {
+			size = defaultImagePullSize
+			detail = "guessed"
+		}
+		pullSize += size
+		missing = append(missing, fmt.Sprintf("%s ~%s (%s)", image, humanBytes(size), detail))
+	}
+	emitProgress(ProgressEvent{Event: "estimate", Target: host.Name, Step: "pull-images", Bytes: pullSize})
+
+	log.Printf("Transfer: %s of chart, %d of %d images to pull, ~%s\n", humanBytes(chartSize), len(missing), len(images), humanBytes(pullSize))
+	for _, line := range missing {
+		log.Printf("  pull %s\n", line)
+	}
+	warnLink(host, sections[0], chartSize, false)
+	return nil
+}
+
+/*
+ * Report what setup transfers: the playbooks copied over SSH, and k3s unless the host has it
+ */
+func estimateSetupTransfer(host Host, playbookDir string) error {
+	playbookSize := pathSize(playbookDir)
+	emitProgress(ProgressEvent{Event: "estimate", Target: host.Name, Step: "copy-playbooks", Bytes: playbookSize})
+
+	out, err := runHostCommands(host, []string{
+		"(nmcli -t -g GENERAL.METERED device show 2>/dev/null; true)",
+		"echo ---",
+		"command -v k3s >/dev/null && echo installed; true",
+	}, false)
+	if err != nil {
+		return err
+	}
+	sections := strings.SplitN(strings.ReplaceAll(out, "\r", ""), "---\n", 2)
+	if len(sections) != 2 {
+		return fmt.Errorf("unexpected output from target")
+	}
+
+	if SkipImagePrecheck {
+		log.Printf("Transfer: %s of playbooks, downloads not checked (--skip-image-precheck)\n", humanBytes(playbookSize))
+	} else if strings.HasPrefix(strings.TrimSpace(sections[1]), "installed") {
+		log.Printf("Transfer: %s of playbooks, k3s is installed already\n", humanBytes(playbookSize))
+	} else {
+		emitProgress(ProgressEvent{Event: "estimate", Target: host.Name, Step: "install-k3s", Bytes: k3sInstallSize})
+		log.Printf("Transfer: %s of playbooks, ~%s downloaded by the target for k3s and its system images\n",
+			humanBytes(playbookSize), humanBytes(k3sInstallSize))
+	}
+	warnLink(host, sections[0], playbookSize, !SkipImagePrecheck)
+	return nil
+}
@@ -0,0 +1,189 @@
+package utils
+
+import (
+	"fmt"
+	"log"
+	"strings"
+)
+
+// Share of the host's memory the bundled Postgres and Redis may use together
+const dbMemoryShare = 0.75
+
+var RedisEvictionPolicies = []string{"noeviction", "allkeys-lru", "allkeys-lfu", "volatile-lru", "volatile-lfu", "allkeys-random", "volatile-random", "volatile-ttl"}
+
+var RedisPersistenceModes = []string{"none", "rdb", "aof"}
+
+type DbTuning struct {
+	MaxConnections int    `yaml:"maxConnections,omitempty"`
+	PoolSize       int    `yaml:"poolSize,omitempty"`
+	SharedBuffers  string `yaml:"sharedBuffers,omitempty"`
+	MemoryLimit    string `yaml:"memoryLimit,omitempty"`
+}
+
+type RedisTuning struct {
+	MaxMemory      string `yaml:"maxMemory,omitempty"`
+	EvictionPolicy string `yaml:"evictionPolicy,omitempty"`
+	Persistence    string `yaml:"persistence,omitempty"`
+	MemoryLimit    string `yaml:"memoryLimit,omitempty"`
+}
+
+func parseMemory(name string, quantity string) (int64, error) {
+	if quantity == "" {
+		return 0, nil
+	}
+	bytes, err := parseQuantity(quantity)
+	if err != nil || bytes <= 0 {
+		return 0, fmt.Errorf("invalid %s '%s', expected a size like 512Mi or 2Gi", name, quantity)
+	}
+	return bytes, nil
+}
+
+/*
+ * Check the tuning is consistent and fits in the target's memory
+ */
+func validateTuning(targetName string, db DbTuning, redis RedisTuning) error {
+	dbLimit, err := parseMemory("memory limit", db.MemoryLimit)
+	if err != nil {
+		return err
+	}
+	sharedBuffers, err := parseMemory("shared buffers", db.SharedBuffers)
+	if err != nil {
+		return err
+	}
+	redisLimit, err := parseMemory("memory limit", redis.MemoryLimit)
+	if err != nil {
+		return err
+	}
+	maxMemory, err := parseMemory("max memory", redis.MaxMemory)
+	if err != nil {
+		return err
+	}
+	if db.PoolSize > 0 && db.MaxConnections > 0 && db.PoolSize > db.MaxConnections {
+		return fmt.Errorf("pool size %d exceeds max connections %d", db.PoolSize, db.MaxConnections)
+	}
+	if dbLimit > 0 && sharedBuffers > dbLimit {
+		return fmt.Errorf("shared buffers %s exceed the Postgres memory limit %s", db.SharedBuffers, db.MemoryLimit)
+	}
+	if redisLimit > 0 && maxMemory > redisLimit {
+		return fmt.Errorf("max memory %s exceeds the Redis memory limit %s", redis.MaxMemory, redis.MemoryLimit)
+	}
+
+	config, err := loadConfig()
+	if err != nil {
+		return err
+	}
+	_, host := FindHost(config, targetName)
+	facts, err := getClusterFacts(host)
+	if err != nil || facts.MemoryBytes == 0 {
+		log.Println("Warning: could not detect the target's memory, limits are not checked against it")
+		return nil
+	}
+	budget := int64(float64(facts.MemoryBytes) * dbMemoryShare)
+	if dbLimit+redisLimit > budget {
+		return fmt.Errorf("Postgres and Redis limits total %s, more than %d%% of the target's %s",
+			humanBytes(dbLimit+redisLimit), int(dbMemoryShare*100), humanBytes(facts.MemoryBytes))
+	}
+	return nil
+}
+
+/*
+ * Set connection and memory options of the bundled Postgres
+ */
+func TuneDb(targetName string, maxConnections int, poolSize int, sharedBuffers string, memoryLimit string) int {
+
+	if maxConnections < 0 || maxConnections > 1000 {
+		log.Fatalf("Invalid max connections %d, expected 1-1000\n", maxConnections)
+		return -1
+	}
+	if poolSize < 0 {
+		log.Fatalf("Invalid pool size %d\n", poolSize)
+		return -1
+	}
+
+	config, err := getHostFilterConfig(targetName)
+	if err != nil {
+		log.Fatal("Failed to get host config: ", err)
+		return -1
+	}
+
+	tuning := config.DbTuning
+	if maxConnections > 0 {
+		tuning.MaxConnections = maxConnections
+	}
+	if poolSize > 0 {
+		tuning.PoolSize = poolSize
+	}
+	if sharedBuffers != "" {
+		tuning.SharedBuffers = sharedBuffers
+	}
+	if memoryLimit != "" {
+		tuning.MemoryLimit = memoryLimit
+	}
+
+	err = validateTuning(targetName, tuning, config.RedisTuning)
+	if err != nil {
+		log.Fatal("Invalid tuning: ", err)
+		return -1
+	}
+	config.DbTuning = tuning
+
+	err = writeHostFilterConfig(targetName, config)
+	if err != nil {
+		log.Fatal("Failed to write host config: ", err)
+		return -1
+	}
+
+	log.Println("Updated Postgres tuning; deploy to apply")
+	return 0
+}
+
+/*
+ * Set memory and persistence options of the bundled Redis
+ */
+func TuneRedis(targetName string, maxMemory string, evictionPolicy string, persistence string, memoryLimit string) int {
+
+	if evictionPolicy != "" && !contains(RedisEvictionPolicies, evictionPolicy) {
+		log.Fatalf("Invalid eviction policy '%s', valid options are %s\n", evictionPolicy, strings.Join(RedisEvictionPolicies, ", "))
+		return -1
+	}
+	if persistence != "" && !contains(RedisPersistenceModes, persistence) {
+		log.Fatalf("Invalid persistence '%s', valid options are %s\n", persistence, strings.Join(RedisPersistenceModes, ", "))
+		return -1
+	}
+
+	config, err := getHostFilterConfig(targetName)
+	if err != nil {
+		log.Fatal("Failed to get host config: ", err)
+		return -1
+	}
+
+	tuning := config.RedisTuning
+	if maxMemory != "" {
+		tuning.MaxMemory = maxMemory
+	}
+	if evictionPolicy != "" {
+		tuning.EvictionPolicy = evictionPolicy
+	}
+	if persistence != "" {
+		tuning.Persistence = persistence
+	}
+	if memoryLimit != "" {
+		tuning.MemoryLimit = memoryLimit
+	}
+
+	err = validateTuning(targetName, config.DbTuning, tuning)
+	if err != nil {
+		log.Fatal("Invalid tuning: ", err)
+		return -1
+	}
+	config.RedisTuning = tuning
+
+	err = writeHostFilterConfig(targetName, config)
+	if err != nil {
+		log.Fatal("Failed to write host config: ", err)
+		return -1
+	}
+
+	log.Println("Updated Redis tuning; deploy to apply")
+	return 0
+}
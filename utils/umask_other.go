@@ -0,0 +1,12 @@
+//go:build !windows
+
+package utils
+
+import "syscall"
+
+/*
+ * Set the file mode creation mask, returning the previous one
+ */
+func setUmask(mask int) int {
+	return syscall.Umask(mask)
+}
@@ -0,0 +1,10 @@
+//go:build windows
+
+package utils
+
+/*
+ * Windows has no creation mask, files take the ACLs of their directory
+ */
+func setUmask(mask int) int {
+	return 0
+}
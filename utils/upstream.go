@@ -0,0 +1,152 @@
+package utils
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+type UpstreamConfig struct {
+	// Parent proxy every request is forwarded through, i.e. http://corp-proxy:3128
+	Proxy    string `yaml:"proxy,omitempty"`
+	Username string `yaml:"username,omitempty"`
+	Password string `yaml:"password,omitempty"`
+	// squid.conf lines chaining to the parent
+	SquidLines []string `yaml:"squidLines,omitempty"`
+}
+
+/*
+ * Host and port of the upstream proxy URL
+ */
+func upstreamAddress(proxy string) (string, string, error) {
+	u, err := url.Parse(proxy)
+	if err != nil {
+		return "", "", err
+	}
+	if u.Scheme != "http" || u.Hostname() == "" {
+		return "", "", fmt.Errorf("expected a URL like http://proxy:3128")
+	}
+	if u.User != nil {
+		return "", "", fmt.Errorf("pass credentials with --auth instead of in the URL")
+	}
+	port := u.Port()
+	if port == "" {
+		port = "3128"
+	}
+	return u.Hostname(), port, nil
+}
+
+/*
+ * Render the squid cache_peer lines sending all traffic through the upstream proxy
+ */
+func (upstream UpstreamConfig) squidLines() []string {
+	host, port, err := upstreamAddress(upstream.Proxy)
+	if err != nil {
+		return nil
+	}
+	peer := fmt.Sprintf("cache_peer %s parent %s 0 no-query no-digest default name=upstream", host, port)
+	if upstream.Username != "" {
+		peer += fmt.Sprintf(" login=%s:%s", upstream.Username, upstream.Password)
+	}
+	return []string{
+		peer,
+		"cache_peer_access upstream allow all",
+		// Direct egress is blocked in networks that need this
+		"never_direct allow all",
+	}
+}
+
+/*
+ * Chain squid through an upstream or corporate proxy
+ */
+func SetUpstreamProxy(targetName string, proxy string, auth string) int {
+
+	host, port, err := upstreamAddress(proxy)
+	if err != nil {
+		log.Fatalf("Invalid proxy '%s': %s\n", proxy, err)
+		return -1
+	}
+
+	upstream := UpstreamConfig{Proxy: proxy}
+	if auth != "" {
+		parts := strings.SplitN(auth, ":", 2)
+		if len(parts) != 2 || parts[0] == "" || strings.ContainsAny(auth, " \t") {
+			log.Fatalln("Invalid auth, expected user:pass without whitespace")
+			return -1
+		}
+		upstream.Username, upstream.Password = parts[0], parts[1]
+	}
+	upstream.SquidLines = upstream.squidLines()
+
+	config, err := getHostFilterConfig(targetName)
+	if err != nil {
+		log.Fatal("Failed to get host config: ", err)
+		return -1
+	}
+
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(host, port), 5*time.Second)
+	if err != nil {
+		log.Printf("Warning: upstream proxy is not reachable from here: %s\n", err)
+	} else {
+		conn.Close()
+	}
+
+	config.Upstream = upstream
+
+	err = writeHostFilterConfig(targetName, config)
+	if err != nil {
+		log.Fatal("Failed to write host config: ", err)
+		return -1
+	}
+
+	log.Printf("Chaining through upstream proxy %s; deploy to apply\n", proxy)
+	return 0
+}
+
+func ShowUpstreamProxy(targetName string) int {
+
+	config, err := getHostFilterConfig(targetName)
+	if err != nil {
+		log.Fatal("Failed to get host config: ", err)
+		return -1
+	}
+
+	if config.Upstream.Proxy == "" {
+		log.Println("No upstream proxy set, squid connects directly")
+		return 0
+	}
+
+	auth := "none"
+	if config.Upstream.Username != "" {
+		auth = fmt.Sprintf("%s:********", config.Upstream.Username)
+	}
+	w := tabwriter.NewWriter(showOutput(), 1, 1, 3, ' ', 0)
+	fmt.Fprintf(w, "Proxy\t%s\n", config.Upstream.Proxy)
+	fmt.Fprintf(w, "Auth\t%s\n", auth)
+	w.Flush()
+	return 0
+}
+
+func RemoveUpstreamProxy(targetName string) int {
+
+	config, err := getHostFilterConfig(targetName)
+	if err != nil {
+		log.Fatal("Failed to get host config: ", err)
+		return -1
+	}
+
+	config.Upstream = UpstreamConfig{}
+
+	err = writeHostFilterConfig(targetName, config)
+	if err != nil {
+		log.Fatal("Failed to write host config: ", err)
+		return -1
+	}
+
+	log.Println("Removed upstream proxy; deploy to apply")
+	return 0
+}
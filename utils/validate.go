@@ -0,0 +1,152 @@
+package utils
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var hostnamePattern = regexp.MustCompile(`^(?i)[a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?(\.[a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?)*\.?$`)
+
+// Portable POSIX user names
+var usernamePattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_.-]{0,31}$`)
+
+// Target names are used as directory names under host_data
+var targetNamePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.-]{0,62}$`)
+
+const targetProbeTimeout = 5 * time.Second
+
+func validateTargetName(name string) error {
+	if !targetNamePattern.MatchString(name) {
+		return fmt.Errorf("invalid target name '%s', use letters, digits, '.', '_' and '-'", name)
+	}
+	return nil
+}
+
+func validateHostAddress(host string) error {
+	if net.ParseIP(host) != nil {
+		return nil
+	}
+	if len(host) > 253 || !hostnamePattern.MatchString(host) {
+		return fmt.Errorf("invalid address '%s', expected an IP address or hostname", host)
+	}
+	return nil
+}
+
+func validatePort(port uint16) error {
+	if port == 0 {
+		return fmt.Errorf("invalid SSH port %d, expected 1-65535", port)
+	}
+	return nil
+}
+
+func validateUsername(username string) error {
+	if !usernamePattern.MatchString(username) {
+		return fmt.Errorf("invalid username '%s'", username)
+	}
+	return nil
+}
+
+/*
+ * Check that a target's address resolves and its SSH port accepts connections
+ */
+func probeTargetAddress(host string, port uint16) error {
+	if net.ParseIP(host) == nil {
+		if _, err := net.LookupHost(host); err != nil {
+			return fmt.Errorf("cannot resolve '%s': %s", host, err)
+		}
+	}
+	address := net.JoinHostPort(host, strconv.Itoa(int(port)))
+	conn, err := net.DialTimeout("tcp", address, targetProbeTimeout)
+	if err != nil {
+		return fmt.Errorf("cannot connect to %s: %s", address, err)
+	}
+	conn.Close()
+	return nil
+}
+
+/*
+ * Parse a jump host given as [user@]host[:port], defaulting to the target's user and port 22
+ */
+func parseProxyJump(jumpHost string, defaultUsername string) (*ProxyJump, error) {
+	jump := &ProxyJump{Username: defaultUsername, Port: 22}
+	address := jumpHost
+	if i := strings.LastIndex(address, "@"); i >= 0 {
+		jump.Username = address[:i]
+		address = address[i+1:]
+	}
+	if host, port, err := net.SplitHostPort(address); err == nil {
+		portNumber, err := strconv.ParseUint(port, 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("invalid jump host port '%s'", port)
+		}
+		address = host
+		jump.Port = uint16(portNumber)
+	} else {
+		address = strings.TrimSuffix(strings.TrimPrefix(address, "["), "]")
+	}
+	jump.Address = address
+
+	if err := validateHostAddress(jump.Address); err != nil {
+		return nil, err
+	}
+	if err := validatePort(jump.Port); err != nil {
+		return nil, err
+	}
+	if err := validateUsername(jump.Username); err != nil {
+		return nil, err
+	}
+	return jump, nil
+}
+
+/*
+ * Check that a target's SSH port accepts connections through its SSH proxy, which
+ * may be the only one able to resolve it
+ */
+func probeProxiedAddress(host Host) error {
+	ctx, cancel := context.WithTimeout(interruptContext, targetProbeTimeout)
+	defer cancel()
+	address := net.JoinHostPort(host.Address, strconv.Itoa(int(host.Port)))
+	conn, err := dialSshTcp(ctx, host, address)
+	if err != nil {
+		return fmt.Errorf("cannot connect to %s: %s", address, err)
+	}
+	return conn.Close()
+}
+
+/*
+ * Validate target inputs, and unless skipped, that the target is reachable
+ */
+func validateTarget(name string, host string, port uint16, username string, jump *ProxyJump, sshProxy string, skipProbe bool) error {
+	if err := validateTargetName(name); err != nil {
+		return err
+	}
+	if err := validateHostAddress(host); err != nil {
+		return err
+	}
+	if err := validatePort(port); err != nil {
+		return err
+	}
+	if err := validateUsername(username); err != nil {
+		return err
+	}
+	if err := validateHostSshProxy(sshProxy); err != nil {
+		return err
+	}
+	if skipProbe {
+		return nil
+	}
+	// Behind a bastion only the bastion can be reached from here
+	first := Host{Address: host, Port: port, SshProxy: sshProxy}
+	if jump != nil {
+		first.Address, first.Port = jump.Address, jump.Port
+	}
+	if hostSshProxy(first) != "" {
+		return probeProxiedAddress(first)
+	}
+	return probeTargetAddress(first.Address, first.Port)
+}
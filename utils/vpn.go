@@ -0,0 +1,331 @@
+package utils
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+
+	"golang.org/x/crypto/curve25519"
+)
+
+type VpnPeer struct {
+	Name      string `yaml:"name"`
+	Address   string `yaml:"address"`
+	PublicKey string `yaml:"publicKey"`
+}
+
+type VpnConfig struct {
+	Enabled bool   `yaml:"enabled"`
+	Port    int    `yaml:"port"`
+	Network string `yaml:"network"`
+	// Public hostname or address roaming devices connect to
+	Endpoint   string    `yaml:"endpoint"`
+	PrivateKey string    `yaml:"privateKey"`
+	PublicKey  string    `yaml:"publicKey"`
+	Peers      []VpnPeer `yaml:"peers,omitempty"`
+}
+
+/*
+ * Generate a WireGuard key pair, base64 encoded
+ */
+func wireguardKeyPair() (string, string, error) {
+	private := make([]byte, curve25519.ScalarSize)
+	_, err := rand.Read(private)
+	if err != nil {
+		return "", "", err
+	}
+	// Clamp as WireGuard does
+	private[0] &= 248
+	private[31] = (private[31] & 127) | 64
+
+	public, err := curve25519.X25519(private, curve25519.Basepoint)
+	if err != nil {
+		return "", "", err
+	}
+	return base64.StdEncoding.EncodeToString(private), base64.StdEncoding.EncodeToString(public), nil
+}
+
+func (vpn *VpnConfig) findPeer(name string) *VpnPeer {
+	for i := range vpn.Peers {
+		if vpn.Peers[i].Name == name {
+			return &vpn.Peers[i]
+		}
+	}
+	return nil
+}
+
+/*
+ * First address of the tunnel network not taken by the gateway or a peer
+ */
+func (vpn *VpnConfig) nextPeerAddress() (string, error) {
+	ip, network, err := net.ParseCIDR(vpn.Network)
+	if err != nil {
+		return "", err
+	}
+	ip = ip.Mask(network.Mask).To4()
+	base := uint32(ip[0])<<24 | uint32(ip[1])<<16 | uint32(ip[2])<<8 | uint32(ip[3])
+	taken := map[string]bool{}
+	for _, peer := range vpn.Peers {
+		taken[peer.Address] = true
+	}
+	// .0 is the network and .1 the gateway
+	for n := base + 2; ; n++ {
+		candidate := net.IPv4(byte(n>>24), byte(n>>16), byte(n>>8), byte(n))
+		if !network.Contains(candidate) {
+			return "", fmt.Errorf("no free addresses left in %s", vpn.Network)
+		}
+		if !taken[candidate.String()] {
+			return candidate.String(), nil
+		}
+	}
+}
+
+func (vpn *VpnConfig) gatewayAddress() string {
+	ip, network, _ := net.ParseCIDR(vpn.Network)
+	ip = ip.Mask(network.Mask).To4()
+	ip[3]++
+	return ip.String()
+}
+
+/*
+ * Run a WireGuard gateway so roaming devices stay filtered off the home network
+ */
+func EnableVpn(targetName string, wireguard bool, port uint16, network string, endpoint string) int {
+
+	if !wireguard {
+		log.Fatalln("Only WireGuard is supported, pass --wireguard")
+		return -1
+	}
+	if port == 0 {
+		log.Fatalln("Invalid port 0")
+		return -1
+	}
+	ip, tunnel, err := net.ParseCIDR(network)
+	if err != nil || ip.To4() == nil {
+		log.Fatalf("Invalid tunnel network '%s', expected IPv4 CIDR notation\n", network)
+		return -1
+	}
+
+	guardianConf, err := loadConfig()
+	if err != nil {
+		log.Fatal("Failed to load config: ", err)
+		return -1
+	}
+
+	_, host := FindHost(guardianConf, targetName)
+	if host.Name != targetName {
+		log.Fatalf("Host %s doesn't exist, create it first", targetName)
+		return -1
+	}
+	if endpoint == "" {
+		endpoint = host.Address
+	}
+	if err := validateHostAddress(endpoint); err != nil {
+		log.Fatalf("Invalid endpoint '%s'\n", endpoint)
+		return -1
+	}
+
+	config, err := getHostFilterConfig(targetName)
+	if err != nil {
+		log.Fatal("Failed to get host config: ", err)
+		return -1
+	}
+
+	if _, localNet, err := net.ParseCIDR(config.LocalNetwork); err == nil && networksOverlap(tunnel, localNet) {
+		log.Fatalf("Tunnel network %s overlaps the local network %s\n", tunnel, localNet)
+		return -1
+	}
+	if len(config.Vpn.Peers) > 0 && config.Vpn.Network != tunnel.String() {
+		log.Fatalf("Peers already have addresses in %s; remove them before changing the tunnel network\n", config.Vpn.Network)
+		return -1
+	}
+
+	vpn := config.Vpn
+	// Keep the gateway keys so existing peer configs keep working
+	if vpn.PrivateKey == "" {
+		vpn.PrivateKey, vpn.PublicKey, err = wireguardKeyPair()
+		if err != nil {
+			log.Fatal("Failed to generate keys: ", err)
+			return -1
+		}
+	}
+	vpn.Enabled = true
+	vpn.Port = int(port)
+	vpn.Network = tunnel.String()
+	vpn.Endpoint = endpoint
+	config.Vpn = vpn
+
+	err = writeHostFilterConfig(targetName, config)
+	if err != nil {
+		log.Fatal("Failed to write host config: ", err)
+		return -1
+	}
+
+	log.Printf("Enabled WireGuard gateway on %s:%d; forward UDP port %d on the router to the target, then deploy\n", endpoint, port, port)
+	return 0
+}
+
+func DisableVpn(targetName string) int {
+
+	config, err := getHostFilterConfig(targetName)
+	if err != nil {
+		log.Fatal("Failed to get host config: ", err)
+		return -1
+	}
+
+	// Keys and peers are kept so re-enabling doesn't invalidate device configs
+	config.Vpn.Enabled = false
+
+	err = writeHostFilterConfig(targetName, config)
+	if err != nil {
+		log.Fatal("Failed to write host config: ", err)
+		return -1
+	}
+
+	log.Println("Disabled WireGuard gateway; deploy to apply")
+	return 0
+}
+
+/*
+ * Render the wg-quick config for a device, sending all its traffic through the filter
+ */
+func (vpn *VpnConfig) peerConfig(peer VpnPeer, privateKey string) string {
+	return fmt.Sprintf(`[Interface]
+PrivateKey = %s
+Address = %s/32
+DNS = %s
+
+[Peer]
+PublicKey = %s
+Endpoint = %s
+AllowedIPs = 0.0.0.0/0, ::/0
+PersistentKeepalive = 25
+`, privateKey, peer.Address, vpn.gatewayAddress(), vpn.PublicKey, net.JoinHostPort(vpn.Endpoint, fmt.Sprint(vpn.Port)))
+}
+
+/*
+ * Add a device to the VPN and write its config, shown as a QR code if qrencode is installed
+ */
+func AddVpnPeer(targetName string, name string, output string) int {
+
+	// Device names end up in config file names
+	if !targetNamePattern.MatchString(name) {
+		log.Fatalf("Invalid device name '%s', use letters, digits, '.', '_' and '-'\n", name)
+		return -1
+	}
+
+	config, err := getHostFilterConfig(targetName)
+	if err != nil {
+		log.Fatal("Failed to get host config: ", err)
+		return -1
+	}
+
+	if config.Vpn.PrivateKey == "" {
+		log.Fatalln("The VPN is not set up; run 'filter vpn enable --wireguard' first")
+		return -1
+	}
+	if config.Vpn.findPeer(name) != nil {
+		log.Fatalf("Peer '%s' already exists\n", name)
+		return -1
+	}
+
+	address, err := config.Vpn.nextPeerAddress()
+	if err != nil {
+		log.Fatal("Failed to assign an address: ", err)
+		return -1
+	}
+	privateKey, publicKey, err := wireguardKeyPair()
+	if err != nil {
+		log.Fatal("Failed to generate keys: ", err)
+		return -1
+	}
+	peer := VpnPeer{Name: name, Address: address, PublicKey: publicKey}
+	config.Vpn.Peers = append(config.Vpn.Peers, peer)
+
+	if output == "" {
+		output = filepath.Join(getHostDataDir(targetName), fmt.Sprintf("wg-%s.conf", name))
+	}
+	// The device's private key is only ever in this file
+	f, err := createPrivateFile(output)
+	if err != nil {
+		log.Fatal("Failed to create peer config: ", err)
+		return -1
+	}
+	peerConfig := config.Vpn.peerConfig(peer, privateKey)
+	_, err = f.WriteString(peerConfig)
+	f.Close()
+	if err != nil {
+		log.Fatal("Failed to write peer config: ", err)
+		return -1
+	}
+
+	err = writeHostFilterConfig(targetName, config)
+	if err != nil {
+		log.Fatal("Failed to write host config: ", err)
+		return -1
+	}
+
+	log.Printf("Added peer '%s' at %s; config written to %s\n", name, address, output)
+	if _, err := exec.LookPath("qrencode"); err == nil {
+		cmd := exec.Command("qrencode", "-t", "ansiutf8")
+		cmd.Stdin = strings.NewReader(peerConfig)
+		cmd.Stdout = os.Stdout
+		if cmd.Run() == nil {
+			fmt.Println("Scan the code with the WireGuard app on the device.")
+		}
+	} else {
+		log.Println("Install qrencode to show the config as a QR code for phones")
+	}
+	log.Println("Deploy to let the device connect")
+	return 0
+}
+
+func RemoveVpnPeer(targetName string, name string) int {
+
+	config, err := getHostFilterConfig(targetName)
+	if err != nil {
+		log.Fatal("Failed to get host config: ", err)
+		return -1
+	}
+
+	for i := range config.Vpn.Peers {
+		if config.Vpn.Peers[i].Name == name {
+			config.Vpn.Peers = append(config.Vpn.Peers[:i], config.Vpn.Peers[i+1:]...)
+			err = writeHostFilterConfig(targetName, config)
+			if err != nil {
+				log.Fatal("Failed to write host config: ", err)
+				return -1
+			}
+			log.Printf("Removed peer '%s'; deploy to apply\n", name)
+			return 0
+		}
+	}
+
+	log.Fatalf("Peer '%s' does not exist\n", name)
+	return -1
+}
+
+func ListVpnPeers(targetName string) int {
+
+	config, err := getHostFilterConfig(targetName)
+	if err != nil {
+		log.Fatal("Failed to get host config: ", err)
+		return -1
+	}
+
+	w := tabwriter.NewWriter(showOutput(), 1, 1, 3, ' ', 0)
+	fmt.Fprintln(w, "Name\tAddress\tPublic key")
+	for _, peer := range config.Vpn.Peers {
+		fmt.Fprintf(w, "%s\t%s\t%s\n", peer.Name, peer.Address, peer.PublicKey)
+	}
+	w.Flush()
+
+	return 0
+}
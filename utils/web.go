@@ -0,0 +1,296 @@
+package utils
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/term"
+)
+
+// Account created when the web UI is first enabled
+const webAdminUser = "admin"
+
+// admin can change settings from the web UI, viewer can only read reports
+var WebRoles = []string{"admin", "viewer"}
+
+type WebUser struct {
+	Name string `yaml:"name"`
+	Role string `yaml:"role"`
+	// bcrypt hash, the chart renders it into the htpasswd secret
+	PasswordHash string `yaml:"passwordHash"`
+}
+
+type WebConfig struct {
+	Enabled  bool   `yaml:"enabled"`
+	Hostname string `yaml:"hostname,omitempty"`
+	// Credentials for the web UI and report pages, kept in a chart secret
+	AdminUser     string    `yaml:"adminUser,omitempty"`
+	AdminPassword string    `yaml:"adminPassword,omitempty"`
+	Users         []WebUser `yaml:"users,omitempty"`
+}
+
+func webUrl(hostname string, port int) string {
+	if port == 443 {
+		return fmt.Sprintf("https://%s/", hostname)
+	}
+	return fmt.Sprintf("https://%s:%d/", hostname, port)
+}
+
+/*
+ * Serve the web UI under a hostname, covered by the filter certificate
+ */
+func EnableWeb(targetName string, hostname string, port uint16) int {
+
+	config, err := getHostFilterConfig(targetName)
+	if err != nil {
+		log.Fatal("Failed to get host config: ", err)
+		return -1
+	}
+
+	if hostname != "" {
+		err = validateHostAddress(hostname)
+		if err != nil {
+			log.Fatal("Invalid hostname: ", err)
+			return -1
+		}
+		config.Web.Hostname = hostname
+	}
+	if config.Web.Hostname == "" {
+		log.Fatalln("No hostname for the web UI, pass --hostname")
+		return -1
+	}
+	config.WebCn = config.Web.Hostname
+	if !contains(config.DnsNames, config.Web.Hostname) {
+		config.DnsNames = append(config.DnsNames, config.Web.Hostname)
+	}
+	if port != 0 {
+		config.WebHttpsPublicPort = int(port)
+	} else if config.WebHttpsPublicPort == 0 {
+		config.WebHttpsPublicPort = 443
+	}
+	if config.NginxReplicas < 1 {
+		config.NginxReplicas = 1
+	}
+
+	config.Web.Enabled = true
+	if config.Web.AdminUser == "" {
+		config.Web.AdminUser = webAdminUser
+	}
+	newPassword := config.Web.AdminPassword == ""
+	if newPassword {
+		config.Web.AdminPassword = randomString(20)
+	}
+
+	err = writeHostFilterConfig(targetName, config)
+	if err != nil {
+		log.Fatal("Failed to write host config: ", err)
+		return -1
+	}
+
+	log.Printf("Enabled the web UI at %s; deploy to apply\n", webUrl(config.Web.Hostname, config.WebHttpsPublicPort))
+	if newPassword {
+		// Kept out of the log, which can end up in audit records or CI output
+		if term.IsTerminal(int(os.Stdout.Fd())) {
+			fmt.Printf("Log in as '%s' with password '%s'\n", config.Web.AdminUser, config.Web.AdminPassword)
+		} else {
+			log.Printf("Log in as '%s' with the password under web.adminPassword in %s\n", config.Web.AdminUser, getHostFilterConfigPath(targetName))
+		}
+	}
+	return 0
+}
+
+/*
+ * Stop serving the web UI. Nginx keeps running since the CLI reaches the API through it.
+ */
+func DisableWeb(targetName string) int {
+
+	config, err := getHostFilterConfig(targetName)
+	if err != nil {
+		log.Fatal("Failed to get host config: ", err)
+		return -1
+	}
+
+	config.Web.Enabled = false
+
+	err = writeHostFilterConfig(targetName, config)
+	if err != nil {
+		log.Fatal("Failed to write host config: ", err)
+		return -1
+	}
+
+	log.Println("Disabled the web UI; deploy to apply")
+	return 0
+}
+
+/*
+ * Show the web UI settings and whether it answers
+ */
+func ShowWebStatus(targetName string) int {
+
+	config, err := loadConfig()
+	if err != nil {
+		log.Fatal("Failed to load config: ", err)
+		return -1
+	}
+
+	_, host := FindHost(config, targetName)
+	if host.Name != targetName {
+		log.Fatalf("Host %s doesn't exist, create it first", targetName)
+		return -1
+	}
+
+	filterConfig, err := getHostFilterConfig(targetName)
+	if err != nil {
+		log.Fatal("Failed to get host config: ", err)
+		return -1
+	}
+
+	state := "disabled"
+	if filterConfig.Web.Enabled {
+		state = "enabled"
+	}
+	reachable := "-"
+	if filterConfig.Web.Enabled {
+		reachable = "no"
+		tr, err := AddRootCa(targetName)
+		if err == nil {
+			client := &http.Client{Transport: tr, Timeout: 10 * time.Second}
+			resp, err := client.Get(webUrl(host.Address, filterConfig.WebHttpsPublicPort))
+			if err == nil {
+				resp.Body.Close()
+				reachable = fmt.Sprintf("yes (HTTP %d)", resp.StatusCode)
+			}
+		}
+	}
+
+	url := "-"
+	if filterConfig.Web.Hostname != "" {
+		url = webUrl(filterConfig.Web.Hostname, filterConfig.WebHttpsPublicPort)
+	}
+
+	w := tabwriter.NewWriter(showOutput(), 1, 1, 3, ' ', 0)
+	fmt.Fprintf(w, "State\t%s\n", state)
+	fmt.Fprintf(w, "URL\t%s\n", url)
+	fmt.Fprintf(w, "Address\t%s\n", webUrl(host.Address, filterConfig.WebHttpsPublicPort))
+	fmt.Fprintf(w, "Admin user\t%s\n", filterConfig.Web.AdminUser)
+	fmt.Fprintf(w, "Reachable\t%s\n", reachable)
+	w.Flush()
+	return 0
+}
+
+/*
+ * Create an account for the web UI and report pages
+ */
+func AddWebUser(targetName string, name string, role string) int {
+
+	if !contains(WebRoles, role) {
+		log.Fatalf("Invalid role '%s', valid options are %s\n", role, strings.Join(WebRoles, ", "))
+		return -1
+	}
+	err := validateUsername(name)
+	if err != nil {
+		log.Fatal("Invalid user name: ", err)
+		return -1
+	}
+
+	config, err := getHostFilterConfig(targetName)
+	if err != nil {
+		log.Fatal("Failed to get host config: ", err)
+		return -1
+	}
+
+	if name == config.Web.AdminUser {
+		log.Fatalf("User '%s' is the built-in admin account\n", name)
+		return -1
+	}
+	for _, user := range config.Web.Users {
+		if user.Name == name {
+			log.Fatalf("User '%s' already exists\n", name)
+			return -1
+		}
+	}
+
+	password := os.Getenv("WEB_PASSWORD")
+	if password == "" {
+		log.Printf("Choose a password for '%s'.", name)
+		password, err = getUserCredentials()
+		if err != nil {
+			log.Fatal("Failed to get password: ", err)
+			return -1
+		}
+	}
+	if len(password) < 8 {
+		log.Fatalln("Password must be at least 8 characters")
+		return -1
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		log.Fatal("Failed to hash password: ", err)
+		return -1
+	}
+
+	config.Web.Users = append(config.Web.Users, WebUser{Name: name, Role: role, PasswordHash: string(hash)})
+	err = writeHostFilterConfig(targetName, config)
+	if err != nil {
+		log.Fatal("Failed to write host config: ", err)
+		return -1
+	}
+
+	log.Printf("Added %s user '%s'; deploy to apply\n", role, name)
+	if !config.Web.Enabled {
+		log.Println("The web UI is disabled, enable it with 'filter web enable'")
+	}
+	return 0
+}
+
+func RemoveWebUser(targetName string, name string) int {
+
+	config, err := getHostFilterConfig(targetName)
+	if err != nil {
+		log.Fatal("Failed to get host config: ", err)
+		return -1
+	}
+
+	for i := range config.Web.Users {
+		if config.Web.Users[i].Name == name {
+			config.Web.Users = append(config.Web.Users[:i], config.Web.Users[i+1:]...)
+			err = writeHostFilterConfig(targetName, config)
+			if err != nil {
+				log.Fatal("Failed to write host config: ", err)
+				return -1
+			}
+			log.Printf("Removed user '%s'; deploy to apply\n", name)
+			return 0
+		}
+	}
+
+	log.Fatalf("User '%s' does not exist\n", name)
+	return -1
+}
+
+func ListWebUsers(targetName string) int {
+
+	config, err := getHostFilterConfig(targetName)
+	if err != nil {
+		log.Fatal("Failed to get host config: ", err)
+		return -1
+	}
+
+	w := tabwriter.NewWriter(showOutput(), 1, 1, 3, ' ', 0)
+	fmt.Fprintln(w, "Name\tRole")
+	if config.Web.AdminUser != "" {
+		fmt.Fprintf(w, "%s\t%s\n", config.Web.AdminUser, "admin")
+	}
+	for _, user := range config.Web.Users {
+		fmt.Fprintf(w, "%s\t%s\n", user.Name, user.Role)
+	}
+	w.Flush()
+
+	return 0
+}